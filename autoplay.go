@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/room"
+)
+
+// skipThreshold is the fraction of a track that must have played for a track
+// change to count as a play rather than a skip.
+const skipThreshold = 0.3
+
+// endSlack is how close to the end of a track the room position must be for
+// the track to count as played to the end, absorbing tick and network delay.
+const endSlack = 2.0
+
+// recordOutgoingTrack updates the play metrics of the track the room is about
+// to leave. Whether it ended or was skipped is judged from the room's own
+// position, never from what the client claims. Tracks that were loaded but
+// never started are not counted.
+func recordOutgoingTrack(rm *room.Room) {
+	pos := rm.CurrentPosition()
+	rm.Mu.RLock()
+	ta := rm.TrackAudio
+	started := rm.State != room.StateStopped || rm.Position > 0
+	end := rm.EffectiveDuration()
+	rm.Mu.RUnlock()
+	if ta == nil || !started {
+		return
+	}
+	ended := end > 0 && pos >= end-endSlack
+	skipped := !ended && ta.Duration > 0 && pos < skipThreshold*ta.Duration
+	globalDB.RecordTrackPlay(ta.AudioID, skipped)
+}
+
+// listenThreshold is how long a track must play before it counts as a listen
+// for scrobbling: half its length or four minutes, whichever is shorter.
+func listenThreshold(duration float64) float64 {
+	if duration <= 0 {
+		return 240
+	}
+	return math.Min(duration/2, 240)
+}
+
+// countListen adds one sync tick of playback to the room's current track and,
+// once it passes listenThreshold, records a listen for everyone in the room.
+func countListen(rm *room.Room, tick time.Duration) {
+	rm.Mu.Lock()
+	ta := rm.TrackAudio
+	if ta == nil || rm.ListenSent {
+		rm.Mu.Unlock()
+		return
+	}
+	rm.ListenedFor += tick.Seconds()
+	if rm.ListenedFor < listenThreshold(ta.Duration) {
+		rm.Mu.Unlock()
+		return
+	}
+	rm.ListenSent = true
+	started := time.Now().Add(-time.Duration(rm.ListenedFor * float64(time.Second)))
+	seen := make(map[int64]bool)
+	var users []int64
+	for _, c := range rm.Clients {
+		if !seen[c.UID] {
+			seen[c.UID] = true
+			users = append(users, c.UID)
+		}
+	}
+	rm.Mu.Unlock()
+	go scrobbler.Record(users, ta.AudioID, started)
+}
+
+// pickNextTrack chooses the playlist index that follows current when a track
+// ends on its own. Sequential and repeat_one are deterministic; shuffle is a
+// weighted draw that favours tracks the people in the room rated highly or
+// loved, and never repeats the current track when there is a choice.
+func pickNextTrack(rm *room.Room, mode string, items []*db.PlaylistItem, current int) int {
+	n := len(items)
+	if n == 0 {
+		return -1
+	}
+	switch mode {
+	case "repeat_one":
+		if current >= 0 && current < n {
+			return current
+		}
+		return 0
+	case "shuffle":
+	default:
+		return (current + 1) % n
+	}
+	if n == 1 {
+		return 0
+	}
+
+	ids := make([]int64, n)
+	for i, it := range items {
+		ids[i] = it.AudioID
+	}
+	var listeners []int64
+	for _, c := range rm.GetClients() {
+		listeners = append(listeners, c.UID)
+	}
+	// Scores from everyone give a baseline; the listeners' own taste counts double.
+	all, _ := globalDB.GetTrackScores(ids, nil)
+	here, _ := globalDB.GetTrackScores(ids, listeners)
+
+	weights := make([]float64, n)
+	total := 0.0
+	for i, id := range ids {
+		if i == current {
+			continue
+		}
+		w := 1.0
+		if sc := all[id]; sc != nil {
+			w += trackWeight(sc)
+		}
+		if sc := here[id]; sc != nil {
+			w += 2 * trackWeight(sc)
+		}
+		if w < 0.1 {
+			w = 0.1
+		}
+		weights[i] = w
+		total += w
+	}
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		if x < w {
+			return i
+		}
+		x -= w
+	}
+	return (current + 1) % n
+}
+
+// trackWeight turns a score into an additive shuffle weight. Ratings are
+// centred on 3 stars so that disliked tracks come up less often than unrated
+// ones; pickNextTrack keeps every track drawable.
+func trackWeight(sc *db.TrackScore) float64 {
+	w := 0.5 * float64(sc.FavoriteCount)
+	if sc.RatingCount > 0 {
+		w += (sc.AvgRating - 3) / 2
+	}
+	return w
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/library"
+	"github.com/xingzihai/listen-together/internal/speaker"
+	"github.com/xingzihai/listen-together/internal/storage"
+	"github.com/xingzihai/listen-together/pkg/client"
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// runCommand dispatches `listen-together <command> [args]`. It exits the process
+// when the command is done; an unknown command prints usage.
+func runCommand(args []string) {
+	switch args[0] {
+	case "retranscode":
+		cmdRetranscode(args[1:])
+	case "export":
+		cmdExport(args[1:])
+	case "import":
+		cmdImport(args[1:])
+	case "schema":
+		cmdSchema()
+	case "listen":
+		cmdListen(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nUsage:\n  listen-together                      start the server\n  listen-together retranscode [-all] [id...]\n  listen-together export -user NAME [-tier original] -o FILE.zip\n  listen-together import -user NAME FILE.zip\n  listen-together schema                print the WebSocket protocol JSON Schema\n  listen-together listen [-server URL] [-out alsa] ROOM   play a room on this machine\n", args[0])
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// cmdSchema prints the JSON Schema of the WebSocket protocol.
+func cmdSchema() {
+	out, _ := json.MarshalIndent(protocol.Schema(), "", "  ")
+	fmt.Println(string(out))
+}
+
+func openDatabase() *db.DB {
+	database, err := db.Open("./data/listen-together.db")
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	return database
+}
+
+func openLibrary(database *db.DB) *library.LibraryHandlers {
+	store, err := storage.FromEnv("./data")
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+	return &library.LibraryHandlers{DB: database, DataDir: "./data", Store: store}
+}
+
+func lookupUser(database *db.DB, name string) *db.User {
+	if name == "" {
+		log.Fatal("-user is required")
+	}
+	u, err := database.GetUserByUsername(name)
+	if err != nil {
+		log.Fatalf("user %q not found", name)
+	}
+	return u
+}
+
+// cmdRetranscode re-runs segmentation for the given track IDs (or all tracks)
+// from their stored originals, printing progress as it goes.
+func cmdRetranscode(args []string) {
+	fs := flag.NewFlagSet("retranscode", flag.ExitOnError)
+	all := fs.Bool("all", false, "re-transcode every track in the library")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: listen-together retranscode [-all] [id...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if !*all && fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	database := openDatabase()
+	defer database.Close()
+	store, err := storage.FromEnv("./data")
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+
+	var files []*db.AudioFile
+	if *all {
+		if files, err = database.GetAllAudioFiles(); err != nil {
+			log.Fatalf("list tracks: %v", err)
+		}
+	} else {
+		for _, arg := range fs.Args() {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				log.Fatalf("invalid track id %q", arg)
+			}
+			af, err := database.GetAudioFileByID(id)
+			if err != nil {
+				log.Fatalf("track %d not found", id)
+			}
+			files = append(files, af)
+		}
+	}
+
+	fmt.Printf("Re-transcoding %d track(s), original retention: %s\n", len(files), library.OriginalRetention())
+	failed := 0
+	for i, af := range files {
+		fmt.Printf("[%d/%d] #%d %s ... ", i+1, len(files), af.ID, af.Title)
+		if err := library.Retranscode(database, store, "./data", af); err != nil {
+			failed++
+			fmt.Printf("FAILED: %v\n", err)
+			continue
+		}
+		fmt.Println("ok")
+	}
+	fmt.Printf("Done: %d ok, %d failed\n", len(files)-failed, failed)
+	if failed > 0 {
+		database.Close()
+		os.Exit(1)
+	}
+}
+
+// cmdExport writes a user's library to a portable zip archive.
+func cmdExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	user := fs.String("user", "", "username whose library to export")
+	tier := fs.String("tier", library.TierOriginal, "original, lossless, high, medium or low")
+	out := fs.String("o", "", "output file")
+	fs.Parse(args)
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "Usage: listen-together export -user NAME [-tier original] -o FILE.zip")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	database := openDatabase()
+	defer database.Close()
+	u := lookupUser(database, *user)
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("create %s: %v", *out, err)
+	}
+	if err := openLibrary(database).ExportArchive(u.ID, *tier, f); err != nil {
+		f.Close()
+		os.Remove(*out)
+		log.Fatalf("export: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("write %s: %v", *out, err)
+	}
+	fmt.Printf("Exported library of %s to %s\n", u.Username, *out)
+}
+
+// cmdImport loads a library archive into a user's library.
+func cmdImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	user := fs.String("user", "", "username that will own the imported tracks")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: listen-together import -user NAME FILE.zip")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	database := openDatabase()
+	defer database.Close()
+	u := lookupUser(database, *user)
+
+	lib := openLibrary(database)
+	report, err := lib.ImportArchive(u.ID, fs.Arg(0))
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	for _, t := range report.Imported {
+		fmt.Printf("imported #%d -> #%d %s\n", t.SourceID, t.ID, t.Title)
+	}
+	for _, f := range report.Failed {
+		fmt.Printf("FAILED   #%d %s: %s\n", f.SourceID, f.Title, f.Error)
+	}
+	for _, code := range report.SkippedPlaylists {
+		fmt.Printf("skipped playlist %s: room code already in use\n", code)
+	}
+	fmt.Println("Waiting for background transcodes...")
+	lib.Wait()
+	fmt.Printf("Done: %d imported, %d failed, %d playlist(s)\n", len(report.Imported), len(report.Failed), len(report.Playlists))
+	if len(report.Failed) > 0 {
+		database.Close()
+		os.Exit(1)
+	}
+}
+
+// cmdListen joins a room as a headless listener and plays it through a local
+// sink, reconnecting until interrupted. Losing the sink ends the command.
+func cmdListen(args []string) {
+	fs := flag.NewFlagSet("listen", flag.ExitOnError)
+	server := fs.String("server", envOr("LT_SERVER", "http://localhost:8080"), "server URL")
+	token := fs.String("token", os.Getenv("LT_TOKEN"), "API token with room:control and library:read")
+	user := fs.String("user", "", "log in as this user instead of a token (password from LT_PASSWORD)")
+	quality := fs.String("quality", "medium", "preferred quality: lossless, high, medium or low")
+	out := fs.String("out", "alsa", "output: alsa[:DEVICE], pulse[:SINK], - for stdout, or a file/pipe path")
+	latency := fs.Duration("latency", 0, "output buffer for alsa/pulse, or how far behind a pipe reader plays")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*token == "" && *user == "") {
+		fmt.Fprintln(os.Stderr, "Usage: listen-together listen [-server URL] (-token TOKEN | -user NAME) [-out alsa] ROOM")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+	opts := client.Options{BaseURL: *server, Token: *token, ClientName: "listen-together-cli"}
+	if *token == "" {
+		opts.Username, opts.Password = *user, os.Getenv("LT_PASSWORD")
+		if opts.Password == "" {
+			log.Fatal("set LT_PASSWORD to log in with -user")
+		}
+	}
+	roomCode := strings.ToUpper(fs.Arg(0))
+
+	sink, err := speaker.OpenSink(*out, *latency)
+	if err != nil {
+		log.Fatalf("open output: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := listenOnce(ctx, opts, roomCode, sink, *quality)
+		if ctx.Err() != nil {
+			break
+		}
+		if errors.Is(err, speaker.ErrKicked) || errors.Is(err, speaker.ErrOutput) {
+			sink.Close()
+			log.Fatalf("listen: %v", err)
+		}
+		// Only a session that lasted a while resets the backoff, so one that
+		// drops right after joining doesn't reconnect in a tight loop.
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("listen: %v; retrying in %v", err, backoff)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+	if err := sink.Close(); err != nil {
+		log.Printf("close output: %v", err)
+	}
+}
+
+// listenOnce connects, joins roomCode and plays until the connection ends.
+func listenOnce(ctx context.Context, opts client.Options, roomCode string, sink speaker.Sink, quality string) error {
+	c, err := client.Dial(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	j, err := c.Join(ctx, roomCode)
+	if err != nil {
+		return err
+	}
+	log.Printf("Joined room %s (%d listening)", j.RoomCode, j.ClientCount)
+	return speaker.NewPlayer(c, sink, speaker.Options{Quality: quality, Logf: log.Printf}).Run(ctx)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/room"
+	syncpkg "github.com/xingzihai/listen-together/internal/sync"
+	"github.com/xingzihai/listen-together/internal/webhook"
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// Server-sent events: GET /api/room/{code}/events streams a room's broadcasts
+// to listen-only clients behind proxies that break WebSockets. Each event's
+// data is the same JSON message /ws would send; GET /api/time stands in for
+// the WebSocket ping/pong clock sync.
+
+// sseKeepalive is how often a comment is written on an idle stream so
+// proxies don't time it out.
+const sseKeepalive = 15 * time.Second
+
+// sseEvents are the broadcasts forwarded to SSE listeners. roomClosed is
+// sent by the room itself when the stream ends.
+var sseEvents = map[string]bool{
+	protocol.TypeTrackChange:    true,
+	protocol.TypePlay:           true,
+	protocol.TypePause:          true,
+	protocol.TypeSeek:           true,
+	protocol.TypeSyncTick:       true,
+	protocol.TypePlaylistUpdate: true,
+	protocol.TypeUserJoined:     true,
+	protocol.TypeUserLeft:       true,
+}
+
+func registerEventRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/room/{code}/events", func(w http.ResponseWriter, r *http.Request) {
+		auth.AuthMiddleware(http.HandlerFunc(serveRoomEvents)).ServeHTTP(w, r)
+	})
+	mux.HandleFunc("GET /api/time", serveTime)
+}
+
+// publishEvent forwards msg to the room's SSE listeners if it is one of the
+// streamed events.
+func publishEvent(rm *room.Room, msg interface{}) {
+	if !rm.HasSubscribers() {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil || !sseEvents[protocol.PeekType(data)] {
+		return
+	}
+	rm.Publish(data)
+}
+
+// serveRoomEvents handles GET /api/room/{code}/events. The stream opens with
+// the room's current playlist, track and play position, like a WebSocket
+// join, and ends when the room closes or the owner kicks the listener. The
+// listener is announced to the room with userJoined and userLeft.
+func serveRoomEvents(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	code := r.PathValue("code")
+	rm := manager.GetRoom(code)
+	if rm == nil {
+		// Misses count against the join limit so room codes can't be guessed here
+		if !joinLimiter.Allow(auth.GetClientIP(r), 5, time.Minute) {
+			jsonError(w, "操作太频繁，请稍后再试", 429)
+			return
+		}
+		jsonError(w, "房间不存在", 404)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, "streaming unsupported", 500)
+		return
+	}
+	sub, err := rm.Subscribe(generateClientID(), user.UserID, user.Username)
+	if err == room.ErrRoomClosed {
+		jsonError(w, "房间不存在", 404)
+		return
+	} else if err != nil {
+		jsonError(w, err.Error(), 503)
+		return
+	}
+	broadcast(rm, protocol.UserJoinedEvent{Type: protocol.TypeUserJoined, ClientCount: rm.ClientCount(), Username: user.Username, Users: rm.GetClientList()}, "")
+	emitUserEvent(webhook.EventUserJoined, rm, user.UserID, user.Username)
+	defer func() {
+		rm.Unsubscribe(sub)
+		emitUserEvent(webhook.EventUserLeft, rm, user.UserID, user.Username)
+		if manager.GetRoom(code) == rm {
+			broadcast(rm, userLeftEvent(rm), "")
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx: don't buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	send := func(data []byte) bool {
+		if _, err := w.Write([]byte("data: ")); err != nil {
+			return false
+		}
+		w.Write(data)
+		if _, err := w.Write([]byte("\n\n")); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	sendJSON := func(v interface{}) bool {
+		data, _ := json.Marshal(v)
+		return send(data)
+	}
+
+	if pl, err := globalDB.GetPlaylistByRoom(code); err == nil && pl != nil {
+		items, _ := globalDB.GetPlaylistItems(pl.ID)
+		if !sendJSON(playlistUpdateEvent(pl, items)) {
+			return
+		}
+	}
+	rm.Mu.RLock()
+	trackAudio := rm.TrackAudio
+	trackIdx := rm.CurrentTrack
+	state, pos, startT := rm.State, rm.Position, rm.StartTime
+	rm.Mu.RUnlock()
+	if trackAudio != nil {
+		if !sendJSON(protocol.TrackChangeEvent{
+			Type:       protocol.TypeTrackChange,
+			TrackIndex: trackIdx,
+			TrackAudio: signTrackAudio(trackAudio),
+			ServerTime: syncpkg.GetServerTime(),
+		}) {
+			return
+		}
+		if state == room.StatePlaying {
+			currentPos := pos + time.Since(startT).Seconds()
+			if !sendJSON(protocol.PlayEvent{Type: protocol.TypePlay, Position: currentPos, ServerTime: syncpkg.GetServerTime(), TrackIndex: trackIdx}) {
+				return
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-sub.C:
+			if !ok || !send(data) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// serveTime handles GET /api/time?t={clientTime}: the HTTP version of the
+// WebSocket ping, answered with the same pong message.
+func serveTime(w http.ResponseWriter, r *http.Request) {
+	clientTime, _ := strconv.ParseInt(r.URL.Query().Get("t"), 10, 64)
+	w.Header().Set("Cache-Control", "no-store")
+	jsonOK(w, protocol.PongEvent{Type: protocol.TypePong, ClientTime: clientTime, ServerTime: syncpkg.GetServerTime()})
+}
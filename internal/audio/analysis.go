@@ -0,0 +1,363 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+	"strconv"
+	"strings"
+)
+
+const (
+	// silenceThreshold is the RMS level (about -50 dBFS) below which a window counts as silent.
+	silenceThreshold = 0.00316
+	silenceWindow    = analysisSampleRate / 20 // 50ms
+
+	onsetFFTSize  = 1024
+	onsetHop      = 256
+	chromaFFTSize = 4096
+	chromaHop     = 2048
+
+	// maxAnalysisSeconds caps how much audio BPM/key detection looks at.
+	maxAnalysisSeconds = 180
+
+	minBPM = 60
+	maxBPM = 200
+)
+
+// Analysis holds tempo, key and silence detected at ingest.
+type Analysis struct {
+	BPM            float64 `json:"bpm"`
+	Key            string  `json:"key"`             // e.g. "C", "F#m"
+	LeadingSilence float64 `json:"leading_silence"` // seconds of silence before the first audible sound
+	EffectiveEnd   float64 `json:"effective_end"`   // seconds at which trailing silence begins
+}
+
+var pitchNames = []string{"C", "C#", "D", "D#", "E", "F", "F#", "G", "G#", "A", "A#", "B"}
+
+// Krumhansl-Kessler key profiles, tonic first.
+var (
+	majorProfile = []float64{6.35, 2.23, 3.48, 2.33, 4.38, 4.09, 2.52, 5.19, 2.39, 3.66, 2.29, 2.88}
+	minorProfile = []float64{6.33, 2.68, 3.52, 5.38, 2.60, 3.53, 2.54, 4.75, 3.98, 2.69, 3.34, 3.17}
+)
+
+// AnalyzeAudio decodes inputPath once, writes waveform.json into outputDir and
+// returns the tempo/key/silence analysis computed from the same samples.
+// Samples are processed as they are decoded; only the capped window used for
+// tempo/key detection is held in memory.
+func AnalyzeAudio(inputPath, outputDir string, duration float64) (*Analysis, error) {
+	wb := newWaveformBuilder()
+	sa := newSampleAnalyzer()
+	if _, err := decodePCM(inputPath, func(samples []float32) {
+		wb.add(samples)
+		sa.add(samples)
+	}); err != nil {
+		return nil, err
+	}
+	if err := writeWaveform(outputDir, wb.finish(duration)); err != nil {
+		return nil, err
+	}
+	return sa.finish(), nil
+}
+
+// sampleAnalyzer runs silence, tempo and key detection on streamed mono
+// samples at analysisSampleRate.
+type sampleAnalyzer struct {
+	n int // samples seen
+
+	// The silence window in progress, starting at sample winStart.
+	win      []float32
+	winStart int
+	winSum   float64
+
+	// first/last bound the audible windows, -1 until one is found.
+	first, last int
+
+	// body holds up to maxAnalysisSeconds of audio from the first audible window.
+	body []float32
+}
+
+func newSampleAnalyzer() *sampleAnalyzer {
+	return &sampleAnalyzer{win: make([]float32, 0, silenceWindow), first: -1, last: -1}
+}
+
+func (a *sampleAnalyzer) add(samples []float32) {
+	for _, s := range samples {
+		a.win = append(a.win, s)
+		a.winSum += float64(s) * float64(s)
+		a.n++
+		if len(a.win) == silenceWindow {
+			a.flushWindow()
+		}
+	}
+}
+
+// flushWindow judges the window in progress and feeds it to the tempo/key body.
+func (a *sampleAnalyzer) flushWindow() {
+	if math.Sqrt(a.winSum/float64(len(a.win))) >= silenceThreshold {
+		if a.first < 0 {
+			a.first = a.winStart
+		}
+		a.last = a.winStart + len(a.win)
+	}
+	// Tempo and key only look at the audible part, capped for speed.
+	if a.first >= 0 {
+		if room := maxAnalysisSeconds*analysisSampleRate - len(a.body); room > 0 {
+			a.body = append(a.body, a.win[:min(room, len(a.win))]...)
+		}
+	}
+	a.winStart += len(a.win)
+	a.win = a.win[:0]
+	a.winSum = 0
+}
+
+// finish returns the analysis of everything added.
+// A fully silent track reports 0 for the silence bounds and no tempo or key.
+func (a *sampleAnalyzer) finish() *Analysis {
+	if len(a.win) > 0 {
+		a.flushWindow()
+	}
+	res := &Analysis{}
+	if a.first < 0 {
+		return res
+	}
+	res.LeadingSilence = round2(float64(a.first) / analysisSampleRate)
+	res.EffectiveEnd = round2(float64(a.last) / analysisSampleRate)
+
+	// Drop trailing silence when it falls inside the captured window.
+	body := a.body
+	if n := a.last - a.first; n < len(body) {
+		body = body[:n]
+	}
+	res.BPM = detectTempo(body)
+	res.Key = detectKey(body)
+	return res
+}
+
+// detectTempo estimates BPM by autocorrelating a spectral-flux onset envelope.
+func detectTempo(samples []float32) float64 {
+	if len(samples) < onsetFFTSize*8 {
+		return 0
+	}
+	window := hann(onsetFFTSize)
+	buf := make([]complex128, onsetFFTSize)
+	prev := make([]float64, onsetFFTSize/2)
+	var envelope []float64
+	for start := 0; start+onsetFFTSize <= len(samples); start += onsetHop {
+		for i := range buf {
+			buf[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft(buf)
+		var flux float64
+		for k := 0; k < onsetFFTSize/2; k++ {
+			mag := math.Log1p(cmplx.Abs(buf[k]))
+			if d := mag - prev[k]; d > 0 {
+				flux += d
+			}
+			prev[k] = mag
+		}
+		envelope = append(envelope, flux)
+	}
+
+	// Remove the mean so autocorrelation reflects periodicity rather than loudness.
+	var mean float64
+	for _, v := range envelope {
+		mean += v
+	}
+	mean /= float64(len(envelope))
+	for i := range envelope {
+		envelope[i] -= mean
+	}
+
+	framesPerSec := float64(analysisSampleRate) / onsetHop
+	minLag := int(framesPerSec * 60 / maxBPM)
+	maxLag := int(framesPerSec * 60 / minBPM)
+	if maxLag >= len(envelope) {
+		return 0
+	}
+
+	scores := make([]float64, maxLag+2)
+	bestLag, bestScore := 0, 0.0
+	for lag := minLag; lag <= maxLag+1 && lag < len(envelope); lag++ {
+		var sum float64
+		for i := lag; i < len(envelope); i++ {
+			sum += envelope[i] * envelope[i-lag]
+		}
+		sum /= float64(len(envelope) - lag)
+		// Log-Gaussian prior centred on 120 BPM to resolve half/double tempo ambiguity.
+		bpm := framesPerSec * 60 / float64(lag)
+		weight := math.Exp(-0.5 * math.Pow(math.Log2(bpm/120), 2) / 0.5)
+		scores[lag] = sum * weight
+		if lag <= maxLag && scores[lag] > bestScore {
+			bestLag, bestScore = lag, scores[lag]
+		}
+	}
+	if bestLag == 0 {
+		return 0
+	}
+
+	// Parabolic interpolation around the peak for sub-frame precision.
+	lag := float64(bestLag)
+	if bestLag > minLag && bestLag < maxLag {
+		y0, y1, y2 := scores[bestLag-1], scores[bestLag], scores[bestLag+1]
+		if denom := y0 - 2*y1 + y2; denom != 0 {
+			lag += 0.5 * (y0 - y2) / denom
+		}
+	}
+	return math.Round(framesPerSec*60/lag*10) / 10
+}
+
+// detectKey builds a chromagram and matches it against major/minor key profiles.
+func detectKey(samples []float32) string {
+	if len(samples) < chromaFFTSize {
+		return ""
+	}
+	window := hann(chromaFFTSize)
+	buf := make([]complex128, chromaFFTSize)
+	var chroma [12]float64
+
+	// Precompute the pitch class of each FFT bin in the 65Hz-2kHz range (C2-B6).
+	binClass := make([]int, chromaFFTSize/2)
+	for k := range binClass {
+		freq := float64(k) * analysisSampleRate / chromaFFTSize
+		if freq < 65 || freq > 2000 {
+			binClass[k] = -1
+			continue
+		}
+		midi := 69 + 12*math.Log2(freq/440)
+		binClass[k] = (int(math.Round(midi))%12 + 12) % 12
+	}
+
+	for start := 0; start+chromaFFTSize <= len(samples); start += chromaHop {
+		for i := range buf {
+			buf[i] = complex(float64(samples[start+i])*window[i], 0)
+		}
+		fft(buf)
+		for k, pc := range binClass {
+			if pc >= 0 {
+				chroma[pc] += cmplx.Abs(buf[k])
+			}
+		}
+	}
+
+	var total float64
+	for _, v := range chroma {
+		total += v
+	}
+	if total == 0 {
+		return ""
+	}
+
+	bestKey, bestCorr := "", math.Inf(-1)
+	for tonic := 0; tonic < 12; tonic++ {
+		if c := profileCorrelation(chroma[:], majorProfile, tonic); c > bestCorr {
+			bestKey, bestCorr = pitchNames[tonic], c
+		}
+		if c := profileCorrelation(chroma[:], minorProfile, tonic); c > bestCorr {
+			bestKey, bestCorr = pitchNames[tonic]+"m", c
+		}
+	}
+	return bestKey
+}
+
+// profileCorrelation is the Pearson correlation between chroma and profile rotated to tonic.
+func profileCorrelation(chroma, profile []float64, tonic int) float64 {
+	var meanC, meanP float64
+	for i := 0; i < 12; i++ {
+		meanC += chroma[i]
+		meanP += profile[i]
+	}
+	meanC /= 12
+	meanP /= 12
+	var num, denC, denP float64
+	for i := 0; i < 12; i++ {
+		dc := chroma[(i+tonic)%12] - meanC
+		dp := profile[i] - meanP
+		num += dc * dp
+		denC += dc * dc
+		denP += dp * dp
+	}
+	if denC == 0 || denP == 0 {
+		return 0
+	}
+	return num / math.Sqrt(denC*denP)
+}
+
+// camelotMajor/camelotMinor map pitch class to Camelot wheel number.
+var (
+	camelotMajor = []int{8, 3, 10, 5, 12, 7, 2, 9, 4, 11, 6, 1}
+	camelotMinor = []int{5, 12, 7, 2, 9, 4, 11, 6, 1, 8, 3, 10}
+)
+
+// CamelotCode converts a key such as "F#m" to its Camelot notation ("11A").
+// Returns "" for unknown keys.
+func CamelotCode(key string) string {
+	minor := strings.HasSuffix(key, "m")
+	name := strings.TrimSuffix(key, "m")
+	for pc, p := range pitchNames {
+		if p != name {
+			continue
+		}
+		if minor {
+			return strconv.Itoa(camelotMinor[pc]) + "A"
+		}
+		return strconv.Itoa(camelotMajor[pc]) + "B"
+	}
+	return ""
+}
+
+// CamelotSortKey orders keys around the Camelot wheel (1A, 1B, 2A, ...).
+// Unknown keys sort last.
+func CamelotSortKey(key string) int {
+	code := CamelotCode(key)
+	if code == "" {
+		return 1 << 30
+	}
+	n := 0
+	for _, c := range code[:len(code)-1] {
+		n = n*10 + int(c-'0')
+	}
+	if code[len(code)-1] == 'B' {
+		return n*2 + 1
+	}
+	return n * 2
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+func hann(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	return w
+}
+
+// fft is an in-place iterative radix-2 FFT. len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u := x[start+k]
+				v := x[start+k+size/2] * w
+				x[start+k] = u + v
+				x[start+k+size/2] = u - v
+				w *= step
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -43,9 +44,16 @@ type QualityInfo struct {
 // MultiQualityManifest is written as manifest.json inside the audio directory.
 type MultiQualityManifest struct {
 	mu          sync.Mutex              `json:"-"`
+	wg          sync.WaitGroup
 	Duration    float64                 `json:"duration"`
 	SegmentTime int                     `json:"segment_time"`
 	Qualities   map[string]*QualityInfo `json:"qualities"`
+	Analysis    *Analysis               `json:"analysis,omitempty"`
+}
+
+// Wait blocks until all background tiers have finished (successfully or not).
+func (m *MultiQualityManifest) Wait() {
+	m.wg.Wait()
 }
 
 // qualityDef defines how to encode one quality tier.
@@ -205,6 +213,13 @@ func ProcessAudioMultiQuality(inputPath, outputDir, filename string) (*MultiQual
 		Qualities:   make(map[string]*QualityInfo),
 	}
 
+	// Waveform and tempo/key/silence analysis are extras: a decode failure must not fail the upload.
+	if analysis, err := AnalyzeAudio(inputPath, outputDir, duration); err != nil {
+		log.Printf("analysis failed for %s: %v", filename, err)
+	} else {
+		manifest.Analysis = analysis
+	}
+
 	// Find the "medium" tier (or the first available) to process synchronously.
 	syncIdx := 0
 	for i, d := range defs {
@@ -228,33 +243,12 @@ func ProcessAudioMultiQuality(inputPath, outputDir, filename string) (*MultiQual
 	// Write initial manifest
 	writeManifest(outputDir, manifest)
 
-	// Process remaining tiers in background
-	remaining := make([]qualityDef, 0, len(defs)-1)
+	// Process remaining tiers in background on the shared worker pool
 	for i, d := range defs {
 		if i != syncIdx {
-			remaining = append(remaining, d)
+			enqueueTier(inputPath, outputDir, d, manifest)
 		}
 	}
-	if len(remaining) > 0 {
-		go func() {
-			for _, q := range remaining {
-				s, err := segmentOneQuality(inputPath, outputDir, q)
-				if err != nil {
-					log.Printf("background segment %s failed: %v", q.Name, err)
-					continue
-				}
-				manifest.mu.Lock()
-				manifest.Qualities[q.Name] = &QualityInfo{
-					Format:   q.Codec,
-					Bitrate:  parseBitrateInt(q.Bitrate),
-					Segments: s,
-				}
-				manifest.mu.Unlock()
-				writeManifest(outputDir, manifest)
-				log.Printf("background segment %s done: %d segments", q.Name, len(s))
-			}
-		}()
-	}
 
 	return manifest, probe, nil
 }
@@ -272,6 +266,40 @@ func writeManifest(outputDir string, m *MultiQualityManifest) {
 	os.WriteFile(filepath.Join(outputDir, "manifest.json"), data, 0644)
 }
 
+// VerifyManifest checks that every expected tier is present in the manifest and
+// that its segments exist on disk, are non-empty and cover the track duration.
+func VerifyManifest(outputDir string, m *MultiQualityManifest, expected []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	want := int(math.Ceil(m.Duration / float64(SegmentDuration)))
+	for _, name := range expected {
+		q, ok := m.Qualities[name]
+		if !ok || len(q.Segments) == 0 {
+			return fmt.Errorf("tier %s missing", name)
+		}
+		// ffmpeg may merge a very short trailing segment into the previous one
+		if len(q.Segments) < want-1 {
+			return fmt.Errorf("tier %s has %d segments, expected %d", name, len(q.Segments), want)
+		}
+		dir := ""
+		for _, d := range allQualities {
+			if d.Name == name {
+				dir = d.DirSuffix
+			}
+		}
+		for _, seg := range q.Segments {
+			fi, err := os.Stat(filepath.Join(outputDir, dir, seg))
+			if err != nil {
+				return fmt.Errorf("tier %s: %w", name, err)
+			}
+			if fi.Size() == 0 {
+				return fmt.Errorf("tier %s: empty segment %s", name, seg)
+			}
+		}
+	}
+	return nil
+}
+
 // ProcessAudio converts and segments an audio file using ffmpeg (legacy, still used for room upload)
 func ProcessAudio(inputPath, outputDir, filename string) (*Manifest, error) {
 	if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -549,3 +577,33 @@ func LoadManifest(roomDir string) (*Manifest, error) {
 func CleanupRoom(roomDir string) error {
 	return os.RemoveAll(roomDir)
 }
+
+// ConcatSegments joins segment files (in order) into a single FLAC file at outPath.
+func ConcatSegments(segPaths []string, outPath string) error {
+	if len(segPaths) == 0 {
+		return fmt.Errorf("no segments to concatenate")
+	}
+	var list strings.Builder
+	for _, p := range segPaths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		list.WriteString("file '" + strings.ReplaceAll(abs, "'", `'\''`) + "'\n")
+	}
+	listPath := outPath + ".txt"
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(listPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-v", "error",
+		"-f", "concat", "-safe", "0", "-i", sanitizeInputPath(listPath),
+		"-vn", "-c:a", "flac", "-y", sanitizeInputPath(outPath))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg concat failed: %w, output: %s", err, string(out))
+	}
+	return nil
+}
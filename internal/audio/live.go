@@ -0,0 +1,106 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+)
+
+// Live streams (room radio) decode tracks to raw PCM and feed one long-running
+// encoder, so track changes, seeks and pauses never interrupt the output.
+
+// PCM format shared by DecodePCM and StartEncoder: signed 16-bit little-endian
+// stereo at 44.1kHz.
+const (
+	PCMSampleRate     = 44100
+	PCMChannels       = 2
+	PCMBytesPerSecond = PCMSampleRate * PCMChannels * 2
+)
+
+// Live stream formats accepted by StartEncoder.
+const (
+	LiveMP3 = "mp3"
+	LiveOgg = "ogg"
+)
+
+// LiveContentType returns the Content-Type of a live stream format.
+func LiveContentType(format string) string {
+	if format == LiveOgg {
+		return "audio/ogg"
+	}
+	return "audio/mpeg"
+}
+
+// DecodePCM starts decoding inputPath from pos seconds and returns its PCM
+// output. The process is killed when ctx is cancelled; Close reaps it and must
+// be called once reading is done.
+func DecodePCM(ctx context.Context, inputPath string, pos float64) (io.ReadCloser, error) {
+	args := []string{"-v", "error"}
+	if pos > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(pos, 'f', 3, 64))
+	}
+	args = append(args, "-i", sanitizeInputPath(inputPath), "-vn",
+		"-f", "s16le", "-ac", strconv.Itoa(PCMChannels), "-ar", strconv.Itoa(PCMSampleRate), "pipe:1")
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ffmpeg decode: %w", err)
+	}
+	return &pcmReader{ReadCloser: out, cmd: cmd}, nil
+}
+
+type pcmReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *pcmReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
+}
+
+// LiveEncoder turns PCM written to In into a continuous stream read from Out.
+type LiveEncoder struct {
+	In  io.WriteCloser
+	Out io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// StartEncoder starts an encoder for format (LiveMP3 or LiveOgg). It runs
+// until In is closed or ctx is cancelled.
+func StartEncoder(ctx context.Context, format string) (*LiveEncoder, error) {
+	args := []string{"-v", "error",
+		"-f", "s16le", "-ac", strconv.Itoa(PCMChannels), "-ar", strconv.Itoa(PCMSampleRate), "-i", "pipe:0"}
+	switch format {
+	case LiveMP3:
+		args = append(args, "-c:a", "libmp3lame", "-b:a", "128k", "-f", "mp3", "-write_xing", "0", "-id3v2_version", "0")
+	case LiveOgg:
+		args = append(args, "-c:a", "libvorbis", "-q:a", "4", "-f", "ogg")
+	default:
+		return nil, fmt.Errorf("unsupported live format %q", format)
+	}
+	args = append(args, "-flush_packets", "1", "pipe:1")
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ffmpeg encode: %w", err)
+	}
+	return &LiveEncoder{In: in, Out: out, cmd: cmd}, nil
+}
+
+// Wait waits for the encoder process to exit.
+func (e *LiveEncoder) Wait() error {
+	return e.cmd.Wait()
+}
@@ -0,0 +1,163 @@
+package audio
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Tier processing states reported by TierStatuses. Ready tiers are not tracked:
+// a tier missing from the status map is either ready or absent from the manifest.
+const (
+	TierPending    = "pending"
+	TierProcessing = "processing"
+	TierFailed     = "failed"
+)
+
+// tierSem bounds how many background tiers are encoded at once across all tracks.
+// Configure with TRANSCODE_WORKERS (default 2).
+var tierSem = make(chan struct{}, transcodeWorkers())
+
+func transcodeWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("TRANSCODE_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return 2
+}
+
+var tierStatus = struct {
+	sync.RWMutex
+	m map[string]map[string]string // track dir -> quality -> state
+}{m: make(map[string]map[string]string)}
+
+func setTierStatus(outputDir, quality, state string) {
+	key := filepath.Clean(outputDir)
+	tierStatus.Lock()
+	defer tierStatus.Unlock()
+	if state == "" {
+		delete(tierStatus.m[key], quality)
+		if len(tierStatus.m[key]) == 0 {
+			delete(tierStatus.m, key)
+		}
+		return
+	}
+	if tierStatus.m[key] == nil {
+		tierStatus.m[key] = make(map[string]string)
+	}
+	tierStatus.m[key][quality] = state
+}
+
+// TierStatuses returns the in-flight or failed tiers of a track directory,
+// or nil when nothing is pending.
+func TierStatuses(outputDir string) map[string]string {
+	tierStatus.RLock()
+	defer tierStatus.RUnlock()
+	cur := tierStatus.m[filepath.Clean(outputDir)]
+	if len(cur) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(cur))
+	for q, s := range cur {
+		out[q] = s
+	}
+	return out
+}
+
+// ClearTierStatus forgets any tracked state for a track directory (e.g. after deletion).
+func ClearTierStatus(outputDir string) {
+	tierStatus.Lock()
+	delete(tierStatus.m, filepath.Clean(outputDir))
+	tierStatus.Unlock()
+}
+
+// enqueueTier schedules one quality tier on the worker pool and records it in m when done.
+func enqueueTier(inputPath, outputDir string, q qualityDef, m *MultiQualityManifest) {
+	setTierStatus(outputDir, q.Name, TierPending)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		tierSem <- struct{}{}
+		defer func() { <-tierSem }()
+
+		setTierStatus(outputDir, q.Name, TierProcessing)
+		s, err := segmentOneQuality(inputPath, outputDir, q)
+		if err != nil {
+			setTierStatus(outputDir, q.Name, TierFailed)
+			log.Printf("background segment %s failed: %v", q.Name, err)
+			return
+		}
+		m.mu.Lock()
+		m.Qualities[q.Name] = &QualityInfo{
+			Format:   q.Codec,
+			Bitrate:  parseBitrateInt(q.Bitrate),
+			Segments: s,
+		}
+		m.mu.Unlock()
+		writeManifest(outputDir, m)
+		setTierStatus(outputDir, q.Name, "")
+		log.Printf("background segment %s done: %d segments", q.Name, len(s))
+	}()
+}
+
+// LoadMultiQualityManifest reads manifest.json from a library track directory.
+func LoadMultiQualityManifest(outputDir string) (*MultiQualityManifest, error) {
+	data, err := os.ReadFile(filepath.Join(outputDir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var m MultiQualityManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Qualities == nil {
+		m.Qualities = make(map[string]*QualityInfo)
+	}
+	return &m, nil
+}
+
+// ResumeTiers re-enqueues tiers listed in expected that are missing or incomplete
+// in outputDir's manifest, e.g. after the server restarted mid-transcode.
+// It returns the loaded manifest (Wait on it for the queued tiers) and the
+// number of tiers queued. With no source file to encode from, the missing tiers
+// are marked failed.
+func ResumeTiers(inputPath, outputDir string, expected []string) (*MultiQualityManifest, int, error) {
+	m, err := LoadMultiQualityManifest(outputDir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("load manifest: %w", err)
+	}
+
+	var missing []qualityDef
+	for _, name := range expected {
+		if VerifyManifest(outputDir, m, []string{name}) == nil {
+			continue
+		}
+		for _, d := range allQualities {
+			if d.Name == name {
+				missing = append(missing, d)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return m, 0, nil
+	}
+	if inputPath == "" {
+		for _, d := range missing {
+			setTierStatus(outputDir, d.Name, TierFailed)
+		}
+		return m, 0, fmt.Errorf("original missing, cannot rebuild %d tier(s)", len(missing))
+	}
+
+	for _, d := range missing {
+		// Drop partial output so stale segments past the new end don't linger.
+		os.RemoveAll(filepath.Join(outputDir, d.DirSuffix))
+		m.mu.Lock()
+		delete(m.Qualities, d.Name)
+		m.mu.Unlock()
+		enqueueTier(inputPath, outputDir, d, m)
+	}
+	return m, len(missing), nil
+}
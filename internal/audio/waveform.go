@@ -0,0 +1,223 @@
+package audio
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	// analysisSampleRate is the mono sample rate tracks are decoded to for analysis.
+	// 11025Hz covers the frequency range needed for peaks and onset detection
+	// while keeping the capped tempo/key window small.
+	analysisSampleRate = 11025
+
+	waveformVersion = 1
+	WaveformFile    = "waveform.json"
+)
+
+// waveformResolutions are the bucket counts generated for each track, coarse to fine.
+var waveformResolutions = []int{256, 1024, 4096}
+
+// WaveformLevel holds min/max peaks for one resolution.
+// Peaks is flattened as [min0, max0, min1, max1, ...], scaled to -127..127.
+type WaveformLevel struct {
+	Buckets int    `json:"buckets"`
+	Peaks   []int8 `json:"peaks"`
+}
+
+// Waveform is written as waveform.json next to manifest.json.
+type Waveform struct {
+	Version     int             `json:"version"`
+	Duration    float64         `json:"duration"`
+	SegmentTime int             `json:"segment_time"`
+	Levels      []WaveformLevel `json:"levels"`
+	SegmentRMS  []float32       `json:"segment_rms"`
+}
+
+// pcmChunkSize is how many bytes of f32le output decodePCM hands on at a time.
+const pcmChunkSize = 256 << 10
+
+// maxPeakBlocks bounds the min/max blocks waveformBuilder keeps; when full,
+// neighbouring blocks are merged so memory stays constant however long the track is.
+const maxPeakBlocks = 16384
+
+// decodePCM decodes the input once into mono float32 samples at analysisSampleRate
+// and passes them to fn in chunks as ffmpeg produces them. It returns the number
+// of samples decoded.
+func decodePCM(inputPath string, fn func([]float32)) (int, error) {
+	inputPath = sanitizeInputPath(inputPath)
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-v", "error",
+		"-i", inputPath,
+		"-vn",
+		"-ac", "1",
+		"-ar", fmt.Sprint(analysisSampleRate),
+		"-f", "f32le",
+		"-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("ffmpeg decode: %w", err)
+	}
+
+	r := bufio.NewReaderSize(stdout, pcmChunkSize)
+	raw := make([]byte, pcmChunkSize)
+	samples := make([]float32, pcmChunkSize/4)
+	total := 0
+	for {
+		n, err := io.ReadFull(r, raw)
+		n -= n % 4
+		for i := 0; i < n/4; i++ {
+			samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[i*4:]))
+		}
+		if n > 0 {
+			fn(samples[:n/4])
+			total += n / 4
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("ffmpeg decode failed: %w", err)
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("ffmpeg decode produced no samples")
+	}
+	return total, nil
+}
+
+// waveformBuilder accumulates peaks and per-segment RMS from streamed samples.
+type waveformBuilder struct {
+	n int // samples seen
+
+	// Completed min/max blocks of blockSize samples each, plus the block in progress.
+	mins, maxs     []float32
+	blockSize      int
+	curMin, curMax float32
+	curN           int
+
+	segSum float64
+	segN   int
+	rms    []float32
+}
+
+func newWaveformBuilder() *waveformBuilder {
+	return &waveformBuilder{
+		mins:      make([]float32, 0, maxPeakBlocks),
+		maxs:      make([]float32, 0, maxPeakBlocks),
+		blockSize: 1,
+	}
+}
+
+func (w *waveformBuilder) add(samples []float32) {
+	perSeg := analysisSampleRate * SegmentDuration
+	for _, s := range samples {
+		w.n++
+
+		if w.curN == 0 || s < w.curMin {
+			w.curMin = s
+		}
+		if w.curN == 0 || s > w.curMax {
+			w.curMax = s
+		}
+		w.curN++
+		if w.curN == w.blockSize {
+			w.pushBlock()
+		}
+
+		w.segSum += float64(s) * float64(s)
+		w.segN++
+		if w.segN == perSeg {
+			w.flushSegment()
+		}
+	}
+}
+
+// pushBlock stores the block in progress, halving the stored blocks first if full.
+func (w *waveformBuilder) pushBlock() {
+	if len(w.mins) == maxPeakBlocks {
+		half := maxPeakBlocks / 2
+		for i := 0; i < half; i++ {
+			w.mins[i] = min(w.mins[2*i], w.mins[2*i+1])
+			w.maxs[i] = max(w.maxs[2*i], w.maxs[2*i+1])
+		}
+		w.mins, w.maxs = w.mins[:half], w.maxs[:half]
+		w.blockSize *= 2
+	}
+	w.mins = append(w.mins, w.curMin)
+	w.maxs = append(w.maxs, w.curMax)
+	w.curN = 0
+}
+
+func (w *waveformBuilder) flushSegment() {
+	w.rms = append(w.rms, float32(math.Sqrt(w.segSum/float64(w.segN))))
+	w.segSum, w.segN = 0, 0
+}
+
+// finish builds multi-resolution peaks and per-segment RMS from everything added.
+func (w *waveformBuilder) finish(duration float64) *Waveform {
+	if w.curN > 0 {
+		w.pushBlock()
+	}
+	if w.segN > 0 {
+		w.flushSegment()
+	}
+	wf := &Waveform{
+		Version:     waveformVersion,
+		Duration:    duration,
+		SegmentTime: SegmentDuration,
+		SegmentRMS:  w.rms,
+	}
+
+	blocks := len(w.mins)
+	for _, buckets := range waveformResolutions {
+		if buckets > w.n {
+			break
+		}
+		level := WaveformLevel{Buckets: buckets, Peaks: make([]int8, buckets*2)}
+		for b := 0; b < buckets; b++ {
+			start := b * blocks / buckets
+			end := (b + 1) * blocks / buckets
+			lo, hi := float32(0), float32(0)
+			for i := start; i < end; i++ {
+				lo = min(lo, w.mins[i])
+				hi = max(hi, w.maxs[i])
+			}
+			level.Peaks[b*2] = scalePeak(lo)
+			level.Peaks[b*2+1] = scalePeak(hi)
+		}
+		wf.Levels = append(wf.Levels, level)
+	}
+	return wf
+}
+
+func scalePeak(v float32) int8 {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	return int8(math.Round(float64(v) * 127))
+}
+
+func writeWaveform(outputDir string, wf *Waveform) error {
+	data, err := json.Marshal(wf)
+	if err != nil {
+		return fmt.Errorf("marshal waveform: %w", err)
+	}
+	return os.WriteFile(filepath.Join(outputDir, WaveformFile), data, 0644)
+}
@@ -33,6 +33,7 @@ type UserInfo struct {
 	UserID   int64
 	Username string
 	Role     string
+	Scopes   []string // set when authenticated by a personal access token; nil for sessions
 }
 
 var jwtSecret []byte
@@ -271,7 +272,8 @@ func tryAutoRenew(w http.ResponseWriter, r *http.Request, claims *Claims) {
 	}
 }
 
-// AuthMiddleware extracts JWT from cookie or Authorization header
+// AuthMiddleware extracts JWT from cookie or Authorization header. A personal
+// access token in the Authorization header is accepted for the routes its scopes cover.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var tokenStr string
@@ -283,7 +285,13 @@ func AuthMiddleware(next http.Handler) http.Handler {
 				tokenStr = auth[7:]
 			}
 		}
-		if tokenStr != "" {
+		if isAPIToken(tokenStr) {
+			if u, missing := apiTokenUser(r, tokenStr); u != nil {
+				r = r.WithContext(context.WithValue(r.Context(), UserContextKey, u))
+			} else if missing != "" {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+missing+`"`)
+			}
+		} else if tokenStr != "" {
 			if claims, err := ValidateToken(tokenStr); err == nil {
 				if _, err := validateClaimsAgainstDB(claims); err == nil {
 					tryAutoRenew(w, r, claims)
@@ -314,6 +322,15 @@ func RequireAuth(next http.Handler) http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if isAPIToken(tokenStr) {
+			u, _ := apiTokenUser(r, tokenStr)
+			if u == nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), UserContextKey, u)))
+			return
+		}
 		claims, err := ValidateToken(tokenStr)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -352,6 +369,10 @@ func ExtractUserFromRequest(r *http.Request) *UserInfo {
 	if tokenStr == "" {
 		return nil
 	}
+	if isAPIToken(tokenStr) {
+		u, _ := apiTokenUser(r, tokenStr)
+		return u
+	}
 	claims, err := ValidateToken(tokenStr)
 	if err != nil {
 		return nil
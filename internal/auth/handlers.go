@@ -9,11 +9,12 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/ratelimit"
 	"github.com/xingzihai/listen-together/internal/room"
+	"github.com/xingzihai/listen-together/pkg/protocol"
 )
 
 var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
@@ -21,6 +22,8 @@ var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{3,20}$`)
 type AuthHandlers struct {
 	DB      *db.DB
 	Manager *room.Manager
+	// OnRegister, if set, is called after a new account signs up.
+	OnRegister func(user *db.User)
 }
 
 type authRequest struct {
@@ -30,70 +33,9 @@ type authRequest struct {
 	NewPassword string `json:"new_password"`
 }
 
-const maxRateLimitEntries = 10000
-
-// --- Rate limiter ---
-type rateLimiter struct {
-	mu      sync.Mutex
-	records map[string][]time.Time
-}
-
-var regLimiter = &rateLimiter{records: make(map[string][]time.Time)}
-var loginLimiter = &rateLimiter{records: make(map[string][]time.Time)}
-var usernameLoginLimiter = &rateLimiter{records: make(map[string][]time.Time)}
-
-func (rl *rateLimiter) allow(ip string, maxCount int, window time.Duration) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	now := time.Now()
-	cutoff := now.Add(-window)
-	// Clean old entries
-	var valid []time.Time
-	for _, t := range rl.records[ip] {
-		if t.After(cutoff) {
-			valid = append(valid, t)
-		}
-	}
-	if len(valid) >= maxCount {
-		rl.records[ip] = valid
-		return false
-	}
-	// Enforce max entries limit
-	if len(rl.records) >= maxRateLimitEntries {
-		rl.cleanOldestEntries()
-	}
-	rl.records[ip] = append(valid, now)
-	return true
-}
-
-func (rl *rateLimiter) cleanOldestEntries() {
-	// Remove 10% of entries (oldest by last access)
-	toRemove := len(rl.records) / 10
-	if toRemove < 1 {
-		toRemove = 1
-	}
-	type entry struct {
-		ip   string
-		last time.Time
-	}
-	entries := make([]entry, 0, len(rl.records))
-	for ip, times := range rl.records {
-		if len(times) > 0 {
-			entries = append(entries, entry{ip, times[len(times)-1]})
-		}
-	}
-	// Sort by oldest last access
-	for i := 0; i < len(entries)-1; i++ {
-		for j := i + 1; j < len(entries); j++ {
-			if entries[j].last.Before(entries[i].last) {
-				entries[i], entries[j] = entries[j], entries[i]
-			}
-		}
-	}
-	for i := 0; i < toRemove && i < len(entries); i++ {
-		delete(rl.records, entries[i].ip)
-	}
-}
+var regLimiter = ratelimit.New()
+var loginLimiter = ratelimit.New()
+var usernameLoginLimiter = ratelimit.New()
 
 // GetClientIP extracts the client IP from the request.
 // Only trusts RemoteAddr to prevent X-Forwarded-For spoofing that bypasses rate limiting.
@@ -137,7 +79,7 @@ func (h *AuthHandlers) Register(w http.ResponseWriter, r *http.Request) {
 	}
 	// Rate limit: 5 per hour per IP
 	ip := GetClientIP(r)
-	if !regLimiter.allow(ip, 9999, time.Hour) { // TODO: restore to 5 after testing
+	if !regLimiter.Allow(ip, 9999, time.Hour) { // TODO: restore to 5 after testing
 		jsonError(w, "注册过于频繁，请稍后再试", 429)
 		return
 	}
@@ -164,6 +106,9 @@ func (h *AuthHandlers) Register(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "注册失败，用户名可能已存在", 400)
 		return
 	}
+	if h.OnRegister != nil {
+		h.OnRegister(user)
+	}
 	token, _ := GenerateToken(user.ID, user.Username, user.Role, user.PasswordVersion, user.SessionVersion)
 	setTokenCookieWithRequest(w, r, token)
 	jsonOK(w, map[string]interface{}{"user": user})
@@ -182,13 +127,13 @@ func (h *AuthHandlers) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	// Rate limit: 5 per minute per IP
 	ip := GetClientIP(r)
-	if !loginLimiter.allow(ip, 9999, time.Minute) { // TODO: restore to 5 after testing
+	if !loginLimiter.Allow(ip, 9999, time.Minute) { // TODO: restore to 5 after testing
 		jsonError(w, "登录尝试过于频繁，请稍后再试", 429)
 		return
 	}
 	// Rate limit: 5 per minute per username (prevents brute force on single account via multiple IPs)
 	username := strings.ToLower(req.Username)
-	if username != "" && !usernameLoginLimiter.allow(username, 9999, time.Minute) { // TODO: restore to 5 after testing
+	if username != "" && !usernameLoginLimiter.Allow(username, 9999, time.Minute) { // TODO: restore to 5 after testing
 		jsonError(w, "该账户登录尝试过于频繁，请稍后再试", 429)
 		return
 	}
@@ -421,45 +366,59 @@ func (h *AuthHandlers) AdminUpdateRole(w http.ResponseWriter, r *http.Request) {
 	if oldRole == "admin" && req.Role == "user" {
 		if h.Manager != nil {
 			h.Manager.CloseRoomsByOwnerID(target.ID)
-			h.Manager.SendToUserByUsername(target.Username, map[string]interface{}{
-				"type": "roleChanged",
-				"role": "user",
-			})
+			h.Manager.SendToUserByUsername(target.Username, protocol.RoleChangedEvent{Type: protocol.TypeRoleChanged, Role: "user"})
 		}
 	}
 	// If user promoted to admin, notify via WebSocket
 	if oldRole == "user" && req.Role == "admin" {
 		if h.Manager != nil {
-			h.Manager.SendToUserByUsername(target.Username, map[string]interface{}{
-				"type": "roleChanged",
-				"role": "admin",
-			})
+			h.Manager.SendToUserByUsername(target.Username, protocol.RoleChangedEvent{Type: protocol.TypeRoleChanged, Role: "admin"})
 		}
 	}
 	jsonOK(w, map[string]string{"message": "ok"})
 }
 
+// privateSettings are user_settings keys owned by their own endpoints (they
+// may hold secrets), hidden from and protected against /api/user/settings.
+var privateSettings = map[string]bool{"listenbrainz": true}
+
+// UserSettings handles GET and PUT /api/user/settings. PUT merges the given
+// top-level keys into the stored settings; a null value removes a key.
 func (h *AuthHandlers) UserSettings(w http.ResponseWriter, r *http.Request) {
 	user := GetUser(r)
 	if user == nil {
 		jsonError(w, "unauthorized", 401)
 		return
 	}
+	s, err := h.DB.GetUserSettings(user.UserID)
+	if err != nil {
+		jsonError(w, "db error", 500)
+		return
+	}
+	all := map[string]json.RawMessage{}
+	json.Unmarshal([]byte(s), &all)
 	switch r.Method {
 	case http.MethodGet:
-		s, err := h.DB.GetUserSettings(user.UserID)
-		if err != nil {
-			jsonError(w, "db error", 500)
-			return
+		for k := range privateSettings {
+			delete(all, k)
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(s))
+		jsonOK(w, all)
 	case http.MethodPut:
-		var raw json.RawMessage
-		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		var patch map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
 			jsonError(w, "invalid json", 400)
 			return
 		}
+		for k, v := range patch {
+			switch {
+			case privateSettings[k]:
+			case string(v) == "null":
+				delete(all, k)
+			default:
+				all[k] = v
+			}
+		}
+		raw, _ := json.Marshal(all)
 		if err := h.DB.SaveUserSettings(user.UserID, string(raw)); err != nil {
 			jsonError(w, "save failed", 500)
 			return
@@ -532,6 +491,12 @@ func (h *AuthHandlers) RegisterRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/user/settings", func(w http.ResponseWriter, r *http.Request) {
 		AuthMiddleware(http.HandlerFunc(h.UserSettings)).ServeHTTP(w, r)
 	})
+	mux.HandleFunc("/api/user/tokens", func(w http.ResponseWriter, r *http.Request) {
+		AuthMiddleware(http.HandlerFunc(h.APITokens)).ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/api/user/tokens/", func(w http.ResponseWriter, r *http.Request) {
+		AuthMiddleware(http.HandlerFunc(h.RevokeAPIToken)).ServeHTTP(w, r)
+	})
 	// Admin routes (owner only)
 	mux.HandleFunc("/api/admin/users", func(w http.ResponseWriter, r *http.Request) {
 		AuthMiddleware(http.HandlerFunc(h.AdminListUsers)).ServeHTTP(w, r)
@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Personal access tokens let scripts and bots act as a user without the
+// session cookie. They are sent as "Authorization: Bearer lt_pat_..." and only
+// reach the routes their scopes cover; everything else (account settings,
+// admin pages, token management itself) treats them as unauthenticated.
+
+const (
+	ScopeRoomControl   = "room:control"   // WebSocket: join rooms, play/pause/seek/skip
+	ScopePlaylistWrite = "playlist:write" // room playlist: queue, remove, reorder, mode
+	ScopeLibraryRead   = "library:read"   // browse and stream tracks, covers, lyrics
+)
+
+var allScopes = []string{ScopeRoomControl, ScopePlaylistWrite, ScopeLibraryRead}
+
+const (
+	apiTokenPrefix    = "lt_pat_"
+	maxAPITokens      = 20
+	maxAPITokenTTL    = 365 * 24 * 3600
+	apiTokenTouchStep = time.Minute // last_used_at resolution, bounds DB writes
+)
+
+func isAPIToken(s string) bool {
+	return strings.HasPrefix(s, apiTokenPrefix)
+}
+
+func hashAPIToken(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasScope reports whether the request was authorized for scope. Session
+// users have every scope.
+func (u *UserInfo) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredScope maps a request to the scope a token needs for it. ok is false
+// for routes tokens may not use at all; scope is "" for routes any token may use.
+func requiredScope(r *http.Request) (scope string, ok bool) {
+	p := r.URL.Path
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case p == "/api/auth/me":
+		return "", true
+	case p == "/ws", read && strings.HasPrefix(p, "/api/room/") && strings.HasSuffix(p, "/events"):
+		return ScopeRoomControl, true
+	case strings.HasPrefix(p, "/api/room/") && strings.Contains(p, "/playlist"):
+		return ScopePlaylistWrite, true
+	case !read:
+		return "", false
+	case p == "/api/library/files", p == "/api/library/favorites", p == "/api/library/smart", p == "/api/playlists",
+		strings.HasPrefix(p, "/api/library/files/"), strings.HasPrefix(p, "/api/library/segments/"),
+		strings.HasPrefix(p, "/api/library/cover/"), strings.HasPrefix(p, "/api/library/lyrics/"),
+		strings.HasPrefix(p, "/api/library/smart/"), strings.HasPrefix(p, "/api/playlists/"):
+		return ScopeLibraryRead, true
+	}
+	return "", false
+}
+
+// apiTokenUser resolves a personal access token for r. missing is the scope
+// the token lacked, if that is why it was refused.
+func apiTokenUser(r *http.Request, token string) (u *UserInfo, missing string) {
+	if authDB == nil {
+		return nil, ""
+	}
+	t, err := authDB.GetAPITokenByHash(hashAPIToken(token))
+	if err != nil {
+		return nil, ""
+	}
+	scopes := strings.Fields(t.Scopes)
+	u = &UserInfo{UserID: t.UserID, Scopes: scopes}
+	scope, ok := requiredScope(r)
+	if !ok {
+		return nil, ""
+	}
+	if scope != "" && !u.HasScope(scope) {
+		return nil, scope
+	}
+	user, err := authDB.GetUserByID(t.UserID)
+	if err != nil {
+		return nil, ""
+	}
+	u.Username, u.Role = user.Username, user.Role
+	if now := time.Now(); now.Unix()-t.LastUsedAt >= int64(apiTokenTouchStep/time.Second) {
+		authDB.TouchAPIToken(t.ID, now)
+	}
+	return u, ""
+}
+
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// apiTokenView is a token as its owner sees it.
+type apiTokenView struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Scopes     []string  `json:"scopes"`
+	ExpiresAt  int64     `json:"expires_at"`
+	LastUsedAt int64     `json:"last_used_at"`
+	RevokedAt  int64     `json:"revoked_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	Token      string    `json:"token,omitempty"` // only in the create response
+}
+
+// APITokens lists (GET) or creates (POST) the user's personal access tokens.
+func (h *AuthHandlers) APITokens(w http.ResponseWriter, r *http.Request) {
+	user := GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := h.DB.GetAPITokens(user.UserID)
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		views := make([]apiTokenView, 0, len(list))
+		for _, t := range list {
+			views = append(views, apiTokenView{ID: t.ID, Name: t.Name, Prefix: t.Prefix, Scopes: strings.Fields(t.Scopes),
+				ExpiresAt: t.ExpiresAt, LastUsedAt: t.LastUsedAt, RevokedAt: t.RevokedAt, CreatedAt: t.CreatedAt})
+		}
+		jsonOK(w, map[string]interface{}{"tokens": views, "scopes": allScopes})
+	case http.MethodPost:
+		var req struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn int64    `json:"expires_in"` // seconds, 0 = never
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			jsonError(w, "invalid json", 400)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len([]rune(req.Name)) > 64 {
+			jsonError(w, "名称不能为空且不超过64个字符", 400)
+			return
+		}
+		scopes, err := normalizeScopes(req.Scopes)
+		if err != nil {
+			jsonError(w, err.Error(), 400)
+			return
+		}
+		if req.ExpiresIn < 0 || req.ExpiresIn > maxAPITokenTTL {
+			jsonError(w, "有效期最长 365 天", 400)
+			return
+		}
+		if n, err := h.DB.CountActiveAPITokens(user.UserID); err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		} else if n >= maxAPITokens {
+			jsonError(w, fmt.Sprintf("最多只能有 %d 个有效令牌", maxAPITokens), 400)
+			return
+		}
+		var expiresAt int64
+		if req.ExpiresIn > 0 {
+			expiresAt = time.Now().Unix() + req.ExpiresIn
+		}
+		token, err := newAPIToken()
+		if err != nil {
+			jsonError(w, "生成失败", 500)
+			return
+		}
+		t, err := h.DB.CreateAPIToken(user.UserID, req.Name, hashAPIToken(token), token[:len(apiTokenPrefix)+6], strings.Join(scopes, " "), expiresAt)
+		if err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		jsonOK(w, apiTokenView{ID: t.ID, Name: t.Name, Prefix: t.Prefix, Scopes: scopes, ExpiresAt: t.ExpiresAt, CreatedAt: t.CreatedAt, Token: token})
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// RevokeAPIToken handles DELETE /api/user/tokens/{id}.
+func (h *AuthHandlers) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/user/tokens/"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	if err := h.DB.RevokeAPIToken(id, user.UserID); err == sql.ErrNoRows {
+		jsonError(w, "令牌不存在或已撤销", 404)
+		return
+	} else if err != nil {
+		jsonError(w, "撤销失败", 500)
+		return
+	}
+	jsonOK(w, map[string]string{"status": "ok"})
+}
+
+// normalizeScopes validates scopes and returns them deduplicated in canonical order.
+func normalizeScopes(scopes []string) ([]string, error) {
+	want := make(map[string]bool)
+	for _, s := range scopes {
+		known := false
+		for _, a := range allScopes {
+			if s == a {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("未知权限范围: %s", s)
+		}
+		want[s] = true
+	}
+	var out []string
+	for _, a := range allScopes {
+		if want[a] {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("至少选择一个权限范围")
+	}
+	return out, nil
+}
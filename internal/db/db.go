@@ -34,6 +34,22 @@ type AudioFile struct {
 	Qualities       string    `json:"qualities"`
 	CreatedAt       time.Time `json:"created_at"`
 	OwnerName       string    `json:"owner_name,omitempty"`
+	BPM             float64   `json:"bpm"`
+	Key             string    `json:"key"`
+	LeadingSilence  float64   `json:"leading_silence"`
+	EffectiveEnd    float64   `json:"effective_end"`
+	PlayCount       int       `json:"play_count"`
+	SkipCount       int       `json:"skip_count"`
+	LastPlayedAt    int64     `json:"last_played_at"` // unix seconds, 0 = never
+	// Processing holds tiers still being encoded or that failed; filled in by the
+	// library handlers, not stored.
+	Processing map[string]string `json:"processing,omitempty"`
+	// Aggregated and per-user ratings; filled in by FillTrackStats, not stored.
+	AvgRating     float64 `json:"avg_rating,omitempty"`
+	RatingCount   int     `json:"rating_count,omitempty"`
+	FavoriteCount int     `json:"favorite_count,omitempty"`
+	MyRating      int     `json:"my_rating,omitempty"`
+	Favorite      bool    `json:"favorite,omitempty"`
 }
 
 // LibraryShare represents a library sharing relationship
@@ -46,6 +62,8 @@ type LibraryShare struct {
 	SharedName   string    `json:"shared_name,omitempty"`
 	OwnerUID     int64     `json:"owner_uid,omitempty"`
 	SharedUID    int64     `json:"shared_uid,omitempty"`
+	GroupID      int64     `json:"group_id,omitempty"` // set for shares with a group
+	GroupName    string    `json:"group_name,omitempty"`
 }
 
 // Playlist represents a room's playlist
@@ -58,6 +76,16 @@ type Playlist struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// SmartPlaylist is a saved rule set that selects tracks when it is loaded.
+type SmartPlaylist struct {
+	ID        int64     `json:"id"`
+	OwnerID   int64     `json:"owner_id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
 // PlaylistItem represents an item in a playlist with audio info
 type PlaylistItem struct {
 	ID       int64  `json:"id"`
@@ -295,6 +323,14 @@ func (d *DB) init() error {
 	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN genre TEXT DEFAULT ''`)
 	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN year TEXT DEFAULT ''`)
 	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN lyrics TEXT DEFAULT ''`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN bpm REAL DEFAULT 0`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN musical_key TEXT DEFAULT ''`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN leading_silence REAL DEFAULT 0`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN effective_end REAL DEFAULT 0`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN lyrics_json TEXT DEFAULT ''`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN play_count INTEGER DEFAULT 0`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN skip_count INTEGER DEFAULT 0`)
+	d.conn.Exec(`ALTER TABLE audio_files ADD COLUMN last_played_at INTEGER DEFAULT 0`)
 	d.conn.Exec(`CREATE TABLE IF NOT EXISTS library_shares (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		owner_id INTEGER NOT NULL,
@@ -328,6 +364,148 @@ func (d *DB) init() error {
 		FOREIGN KEY(playlist_id) REFERENCES playlists(id) ON DELETE CASCADE,
 		FOREIGN KEY(audio_id) REFERENCES audio_files(id)
 	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS smart_playlists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS item_shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		shared_with_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		target_id INTEGER NOT NULL DEFAULT 0,
+		album TEXT NOT NULL DEFAULT '',
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(owner_id, shared_with_id, kind, target_id, album)
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_item_shares_shared_with ON item_shares(shared_with_id)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS listen_links (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		owner_id INTEGER NOT NULL,
+		audio_id INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		plays INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS user_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS group_members (
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(group_id, user_id)
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members(user_id)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS library_group_shares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner_id INTEGER NOT NULL,
+		group_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(owner_id, group_id)
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS room_invites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_code TEXT NOT NULL,
+		user_id INTEGER NOT NULL DEFAULT 0,
+		group_id INTEGER NOT NULL DEFAULT 0,
+		invited_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(room_code, user_id, group_id)
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS track_ratings (
+		user_id INTEGER NOT NULL,
+		audio_id INTEGER NOT NULL,
+		rating INTEGER NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, audio_id)
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_track_ratings_audio ON track_ratings(audio_id)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS track_favorites (
+		user_id INTEGER NOT NULL,
+		audio_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, audio_id)
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_track_favorites_audio ON track_favorites(audio_id)`)
+	// Subsonic token auth is md5(password+salt), so the app password has to be
+	// kept in the clear; it is random and separate from the login password.
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS subsonic_credentials (
+		user_id INTEGER PRIMARY KEY,
+		password TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	// Listens waiting to be submitted to each user's scrobbling service.
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS scrobble_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_scrobble_queue_due ON scrobble_queue(next_attempt_at)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		delivered_at INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		last_used_at INTEGER NOT NULL DEFAULT 0,
+		revoked_at INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS server_settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
+	d.conn.Exec(`CREATE TABLE IF NOT EXISTS watch_files (
+		path TEXT PRIMARY KEY,
+		size INTEGER NOT NULL,
+		mod_time INTEGER NOT NULL,
+		audio_id INTEGER,
+		error TEXT NOT NULL DEFAULT '',
+		scanned_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`)
 
 	// Seed owner account
 	ownerUsername := os.Getenv("OWNER_USERNAME")
@@ -554,6 +732,31 @@ func (d *DB) DeleteUser(id int64) ([]string, error) {
 		return nil, fmt.Errorf("delete library_shares: %w", err)
 	}
 
+	// Group memberships, group shares and invites of this user
+	for _, q := range []string{
+		"DELETE FROM group_members WHERE user_id=?",
+		"DELETE FROM library_group_shares WHERE owner_id=?",
+		"DELETE FROM room_invites WHERE user_id=? OR invited_by=?",
+		"DELETE FROM item_shares WHERE owner_id=? OR shared_with_id=?",
+		"DELETE FROM listen_links WHERE owner_id=?",
+		"DELETE FROM smart_playlists WHERE owner_id=?",
+		"DELETE FROM subsonic_credentials WHERE user_id=?",
+		"DELETE FROM user_settings WHERE user_id=?",
+		"DELETE FROM scrobble_queue WHERE user_id=?",
+		"DELETE FROM api_tokens WHERE user_id=?",
+		"DELETE FROM track_ratings WHERE user_id=? OR audio_id IN (SELECT id FROM audio_files WHERE owner_id=?)",
+		"DELETE FROM track_favorites WHERE user_id=? OR audio_id IN (SELECT id FROM audio_files WHERE owner_id=?)",
+	} {
+		args := []interface{}{id}
+		if strings.Count(q, "?") == 2 {
+			args = append(args, id)
+		}
+		if _, err := tx.Exec(q, args...); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("delete user grants: %w", err)
+		}
+	}
+
 	// 3. Delete playlist_items that reference this user's audio files
 	if _, err := tx.Exec("DELETE FROM playlist_items WHERE audio_id IN (SELECT id FROM audio_files WHERE owner_id=?)", id); err != nil {
 		tx.Rollback()
@@ -614,6 +817,30 @@ func (d *DB) ListUsers() ([]*User, error) {
 
 // --- Audio Library CRUD ---
 
+// audioFileCols lists audio_files columns in the order scanAudioFile expects.
+var audioFileCols = []string{"id", "owner_id", "filename", "original_name", "title", "artist", "album", "genre", "year", "lyrics", "cover_art", "duration", "size", "original_format", "original_bitrate", "qualities", "created_at",
+	"bpm", "musical_key", "leading_silence", "effective_end", "play_count", "skip_count", "last_played_at"}
+
+// audioFileColumns returns the audio_files column list, each qualified with prefix (e.g. "a.").
+func audioFileColumns(prefix string) string {
+	cols := make([]string, len(audioFileCols))
+	for i, c := range audioFileCols {
+		cols[i] = prefix + c
+	}
+	return strings.Join(cols, ",")
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAudioFile scans a row selected with audioFileColumns into f, followed by any extra columns.
+func scanAudioFile(row rowScanner, f *AudioFile, extra ...interface{}) error {
+	dest := []interface{}{&f.ID, &f.OwnerID, &f.Filename, &f.OriginalName, &f.Title, &f.Artist, &f.Album, &f.Genre, &f.Year, &f.Lyrics, &f.CoverArt, &f.Duration, &f.Size, &f.OriginalFormat, &f.OriginalBitrate, &f.Qualities, &f.CreatedAt,
+		&f.BPM, &f.Key, &f.LeadingSilence, &f.EffectiveEnd, &f.PlayCount, &f.SkipCount, &f.LastPlayedAt}
+	return row.Scan(append(dest, extra...)...)
+}
+
 func (d *DB) AddAudioFile(ownerID int64, filename, originalName, title, artist, album, genre, year, lyrics string, duration float64, size int64, originalFormat string, originalBitrate int, qualities, coverArt string) (*AudioFile, error) {
 	res, err := d.conn.Exec("INSERT INTO audio_files(owner_id,filename,original_name,title,artist,album,genre,year,lyrics,duration,size,original_format,original_bitrate,qualities,cover_art) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
 		ownerID, filename, originalName, title, artist, album, genre, year, lyrics, duration, size, originalFormat, originalBitrate, qualities, coverArt)
@@ -624,8 +851,43 @@ func (d *DB) AddAudioFile(ownerID int64, filename, originalName, title, artist,
 	return &AudioFile{ID: id, OwnerID: ownerID, Filename: filename, OriginalName: originalName, Title: title, Artist: artist, Album: album, Genre: genre, Year: year, Lyrics: lyrics, Duration: duration, Size: size, OriginalFormat: originalFormat, OriginalBitrate: originalBitrate, Qualities: qualities, CoverArt: coverArt, CreatedAt: time.Now()}, nil
 }
 
+// SetAudioAnalysis stores tempo, key and silence detected at ingest.
+func (d *DB) SetAudioAnalysis(id int64, bpm float64, key string, leadingSilence, effectiveEnd float64) error {
+	_, err := d.conn.Exec("UPDATE audio_files SET bpm=?, musical_key=?, leading_silence=?, effective_end=? WHERE id=?", bpm, key, leadingSilence, effectiveEnd, id)
+	return err
+}
+
+// GetLyricsTimeline returns the parsed lyrics timeline JSON for an audio file ("" if none).
+func (d *DB) GetLyricsTimeline(id int64) (string, error) {
+	var s sql.NullString
+	err := d.conn.QueryRow("SELECT lyrics_json FROM audio_files WHERE id=?", id).Scan(&s)
+	return s.String, err
+}
+
+// UpdateLyrics replaces both the raw lyrics text and the parsed timeline JSON.
+func (d *DB) UpdateLyrics(id int64, raw, timelineJSON string) error {
+	_, err := d.conn.Exec("UPDATE audio_files SET lyrics=?, lyrics_json=? WHERE id=?", raw, timelineJSON, id)
+	return err
+}
+
 func (d *DB) GetAudioFilesByOwner(ownerID int64) ([]*AudioFile, error) {
-	rows, err := d.conn.Query("SELECT id,owner_id,filename,original_name,title,artist,album,genre,year,lyrics,cover_art,duration,size,original_format,original_bitrate,qualities,created_at FROM audio_files WHERE owner_id=? ORDER BY created_at DESC", ownerID)
+	rows, err := d.conn.Query("SELECT "+audioFileColumns("")+" FROM audio_files WHERE owner_id=? ORDER BY created_at DESC", ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []*AudioFile
+	for rows.Next() {
+		f := &AudioFile{}
+		scanAudioFile(rows, f)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// GetAllAudioFiles returns every audio file in the library, oldest first.
+func (d *DB) GetAllAudioFiles() ([]*AudioFile, error) {
+	rows, err := d.conn.Query("SELECT " + audioFileColumns("") + " FROM audio_files ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -633,16 +895,21 @@ func (d *DB) GetAudioFilesByOwner(ownerID int64) ([]*AudioFile, error) {
 	var files []*AudioFile
 	for rows.Next() {
 		f := &AudioFile{}
-		rows.Scan(&f.ID, &f.OwnerID, &f.Filename, &f.OriginalName, &f.Title, &f.Artist, &f.Album, &f.Genre, &f.Year, &f.Lyrics, &f.CoverArt, &f.Duration, &f.Size, &f.OriginalFormat, &f.OriginalBitrate, &f.Qualities, &f.CreatedAt)
+		scanAudioFile(rows, f)
 		files = append(files, f)
 	}
 	return files, nil
 }
 
+// UpdateAudioTranscode records the result of re-processing a track from its original.
+func (d *DB) UpdateAudioTranscode(id int64, duration float64, originalFormat string, originalBitrate int, qualities string) error {
+	_, err := d.conn.Exec("UPDATE audio_files SET duration=?, original_format=?, original_bitrate=?, qualities=? WHERE id=?", duration, originalFormat, originalBitrate, qualities, id)
+	return err
+}
+
 func (d *DB) GetAudioFileByID(id int64) (*AudioFile, error) {
 	f := &AudioFile{}
-	err := d.conn.QueryRow("SELECT id,owner_id,filename,original_name,title,artist,album,genre,year,lyrics,cover_art,duration,size,original_format,original_bitrate,qualities,created_at FROM audio_files WHERE id=?", id).
-		Scan(&f.ID, &f.OwnerID, &f.Filename, &f.OriginalName, &f.Title, &f.Artist, &f.Album, &f.Genre, &f.Year, &f.Lyrics, &f.CoverArt, &f.Duration, &f.Size, &f.OriginalFormat, &f.OriginalBitrate, &f.Qualities, &f.CreatedAt)
+	err := scanAudioFile(d.conn.QueryRow("SELECT "+audioFileColumns("")+" FROM audio_files WHERE id=?", id), f)
 	if err != nil {
 		return nil, err
 	}
@@ -651,8 +918,7 @@ func (d *DB) GetAudioFileByID(id int64) (*AudioFile, error) {
 
 func (d *DB) GetAudioFileByUUID(uuid string) (*AudioFile, error) {
 	f := &AudioFile{}
-	err := d.conn.QueryRow("SELECT id,owner_id,filename,original_name,title,artist,album,genre,year,lyrics,cover_art,duration,size,original_format,original_bitrate,qualities,created_at FROM audio_files WHERE filename=?", uuid).
-		Scan(&f.ID, &f.OwnerID, &f.Filename, &f.OriginalName, &f.Title, &f.Artist, &f.Album, &f.Genre, &f.Year, &f.Lyrics, &f.CoverArt, &f.Duration, &f.Size, &f.OriginalFormat, &f.OriginalBitrate, &f.Qualities, &f.CreatedAt)
+	err := scanAudioFile(d.conn.QueryRow("SELECT "+audioFileColumns("")+" FROM audio_files WHERE filename=?", uuid), f)
 	if err != nil {
 		return nil, err
 	}
@@ -668,6 +934,20 @@ func (d *DB) DeleteAudioFile(id, ownerID int64) error {
 		tx.Rollback()
 		return fmt.Errorf("delete playlist_items: %w", err)
 	}
+	if _, err := tx.Exec("DELETE FROM item_shares WHERE kind='track' AND target_id=? AND owner_id=?", id, ownerID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete item_shares: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM listen_links WHERE audio_id=? AND owner_id=?", id, ownerID); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete listen_links: %w", err)
+	}
+	for _, q := range []string{"DELETE FROM track_ratings WHERE audio_id=?", "DELETE FROM track_favorites WHERE audio_id=?"} {
+		if _, err := tx.Exec(q, id); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("delete ratings: %w", err)
+		}
+	}
 	res, err := tx.Exec("DELETE FROM audio_files WHERE id=? AND owner_id=?", id, ownerID)
 	if err != nil {
 		tx.Rollback()
@@ -728,11 +1008,24 @@ func (d *DB) GetMyShares(ownerID int64) ([]*LibraryShare, error) {
 	return shares, nil
 }
 
+// accessCond is the WHERE condition under which the user bound to its four
+// placeholders may play audio_files row "a": they own it, the whole library is
+// shared with them directly or with one of their groups, or an unexpired item
+// share covers the track, its album or a playlist containing it.
+const accessCond = `(a.owner_id=?
+	OR a.owner_id IN (SELECT owner_id FROM library_shares WHERE shared_with_id=?)
+	OR a.owner_id IN (SELECT gs.owner_id FROM library_group_shares gs JOIN group_members gm ON gm.group_id=gs.group_id WHERE gm.user_id=?)
+	OR EXISTS (SELECT 1 FROM item_shares s WHERE s.shared_with_id=? AND s.owner_id=a.owner_id
+		AND (s.expires_at=0 OR s.expires_at>CAST(strftime('%s','now') AS INTEGER))
+		AND ((s.kind='track' AND s.target_id=a.id)
+			OR (s.kind='album' AND a.album!='' AND s.album=a.album)
+			OR (s.kind='playlist' AND a.id IN (SELECT audio_id FROM playlist_items WHERE playlist_id=s.target_id)))))`
+
 func (d *DB) GetAccessibleAudioFiles(userID int64) ([]*AudioFile, error) {
-	rows, err := d.conn.Query(`SELECT a.id,a.owner_id,a.filename,a.original_name,a.title,a.artist,a.album,a.genre,a.year,a.lyrics,a.cover_art,a.duration,a.size,a.original_format,a.original_bitrate,a.qualities,a.created_at,u.username
+	rows, err := d.conn.Query(`SELECT `+audioFileColumns("a.")+`,u.username
 		FROM audio_files a JOIN users u ON u.id=a.owner_id
-		WHERE a.owner_id=? OR a.owner_id IN (SELECT owner_id FROM library_shares WHERE shared_with_id=?)
-		ORDER BY a.created_at DESC`, userID, userID)
+		WHERE `+accessCond+`
+		ORDER BY a.created_at DESC`, userID, userID, userID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -740,7 +1033,7 @@ func (d *DB) GetAccessibleAudioFiles(userID int64) ([]*AudioFile, error) {
 	var files []*AudioFile
 	for rows.Next() {
 		f := &AudioFile{}
-		rows.Scan(&f.ID, &f.OwnerID, &f.Filename, &f.OriginalName, &f.Title, &f.Artist, &f.Album, &f.Genre, &f.Year, &f.Lyrics, &f.CoverArt, &f.Duration, &f.Size, &f.OriginalFormat, &f.OriginalBitrate, &f.Qualities, &f.CreatedAt, &f.OwnerName)
+		scanAudioFile(rows, f, &f.OwnerName)
 		files = append(files, f)
 	}
 	return files, nil
@@ -748,127 +1041,1253 @@ func (d *DB) GetAccessibleAudioFiles(userID int64) ([]*AudioFile, error) {
 
 func (d *DB) CanAccessAudioFile(userID, audioID int64) (bool, error) {
 	var count int
-	err := d.conn.QueryRow(`SELECT COUNT(*) FROM audio_files WHERE id=? AND (owner_id=? OR owner_id IN (SELECT owner_id FROM library_shares WHERE shared_with_id=?))`,
-		audioID, userID, userID).Scan(&count)
+	err := d.conn.QueryRow(`SELECT COUNT(*) FROM audio_files a WHERE a.id=? AND `+accessCond,
+		audioID, userID, userID, userID, userID).Scan(&count)
 	return count > 0, err
 }
 
-// --- Playlist CRUD ---
+// RecordTrackPlay counts one room play of a track: a skip when it was changed
+// early, otherwise a play, which also moves last_played_at.
+func (d *DB) RecordTrackPlay(audioID int64, skipped bool) error {
+	var err error
+	if skipped {
+		_, err = d.conn.Exec("UPDATE audio_files SET skip_count=skip_count+1 WHERE id=?", audioID)
+	} else {
+		_, err = d.conn.Exec("UPDATE audio_files SET play_count=play_count+1, last_played_at=? WHERE id=?", time.Now().Unix(), audioID)
+	}
+	return err
+}
 
-func (d *DB) CreatePlaylist(roomCode string, createdBy int64) (*Playlist, error) {
-	res, err := d.conn.Exec("INSERT INTO playlists(room_code,created_by) VALUES(?,?)", roomCode, createdBy)
+// --- Smart Playlists ---
+
+func (d *DB) CreateSmartPlaylist(ownerID int64, name, query string) (*SmartPlaylist, error) {
+	res, err := d.conn.Exec("INSERT INTO smart_playlists(owner_id,name,query) VALUES(?,?,?)", ownerID, name, query)
 	if err != nil {
 		return nil, err
 	}
 	id, _ := res.LastInsertId()
-	return &Playlist{ID: id, RoomCode: roomCode, CreatedBy: createdBy, PlayMode: "sequential", CurrentIndex: 0, CreatedAt: time.Now()}, nil
+	return d.GetSmartPlaylist(id)
 }
 
-func (d *DB) GetOrCreatePlaylist(roomCode string, createdBy int64) (*Playlist, error) {
-	d.conn.Exec("INSERT OR IGNORE INTO playlists(room_code,created_by) VALUES(?,?)", roomCode, createdBy)
-	p := &Playlist{}
-	err := d.conn.QueryRow("SELECT id,room_code,created_by,play_mode,current_index,created_at FROM playlists WHERE room_code=?", roomCode).
-		Scan(&p.ID, &p.RoomCode, &p.CreatedBy, &p.PlayMode, &p.CurrentIndex, &p.CreatedAt)
+func (d *DB) GetSmartPlaylist(id int64) (*SmartPlaylist, error) {
+	sp := &SmartPlaylist{}
+	err := d.conn.QueryRow("SELECT id,owner_id,name,query,created_at,updated_at FROM smart_playlists WHERE id=?", id).
+		Scan(&sp.ID, &sp.OwnerID, &sp.Name, &sp.Query, &sp.CreatedAt, &sp.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
-	return p, nil
+	return sp, nil
 }
 
-func (d *DB) GetPlaylistByRoom(roomCode string) (*Playlist, error) {
-	p := &Playlist{}
-	err := d.conn.QueryRow("SELECT id,room_code,created_by,play_mode,current_index,created_at FROM playlists WHERE room_code=?", roomCode).
-		Scan(&p.ID, &p.RoomCode, &p.CreatedBy, &p.PlayMode, &p.CurrentIndex, &p.CreatedAt)
+func (d *DB) GetSmartPlaylistsByOwner(ownerID int64) ([]*SmartPlaylist, error) {
+	rows, err := d.conn.Query("SELECT id,owner_id,name,query,created_at,updated_at FROM smart_playlists WHERE owner_id=? ORDER BY name", ownerID)
 	if err != nil {
 		return nil, err
 	}
-	return p, nil
+	defer rows.Close()
+	var list []*SmartPlaylist
+	for rows.Next() {
+		sp := &SmartPlaylist{}
+		rows.Scan(&sp.ID, &sp.OwnerID, &sp.Name, &sp.Query, &sp.CreatedAt, &sp.UpdatedAt)
+		list = append(list, sp)
+	}
+	return list, nil
 }
 
-func (d *DB) AddPlaylistItem(playlistID, audioID int64, _ int) (*PlaylistItem, error) {
-	tx, err := d.conn.Begin()
+// UpdateSmartPlaylist changes name and query; sql.ErrNoRows if ownerID doesn't own it.
+func (d *DB) UpdateSmartPlaylist(id, ownerID int64, name, query string) error {
+	res, err := d.conn.Exec("UPDATE smart_playlists SET name=?, query=?, updated_at=CURRENT_TIMESTAMP WHERE id=? AND owner_id=?", name, query, id, ownerID)
 	if err != nil {
-		return nil, fmt.Errorf("begin tx: %w", err)
+		return err
 	}
-	var pos int
-	if err := tx.QueryRow("SELECT COALESCE(MAX(position),0)+1 FROM playlist_items WHERE playlist_id=?", playlistID).Scan(&pos); err != nil {
-		tx.Rollback()
-		return nil, fmt.Errorf("get next position: %w", err)
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
 	}
-	res, err := tx.Exec("INSERT INTO playlist_items(playlist_id,audio_id,position) VALUES(?,?,?)", playlistID, audioID, pos)
+	return nil
+}
+
+func (d *DB) DeleteSmartPlaylist(id, ownerID int64) error {
+	res, err := d.conn.Exec("DELETE FROM smart_playlists WHERE id=? AND owner_id=?", id, ownerID)
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return err
 	}
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("commit: %w", err)
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
 	}
-	id, _ := res.LastInsertId()
-	return &PlaylistItem{ID: id, PlaylistID: playlistID, AudioID: audioID, Position: pos}, nil
+	return nil
 }
 
-func (d *DB) RemovePlaylistItem(playlistID, itemID int64) error {
-	_, err := d.conn.Exec("DELETE FROM playlist_items WHERE id=? AND playlist_id=?", itemID, playlistID)
+// --- Subsonic ---
+
+// GetSubsonicPassword returns userID's Subsonic app password and when it was
+// generated, or sql.ErrNoRows if there is none.
+func (d *DB) GetSubsonicPassword(userID int64) (string, time.Time, error) {
+	var pw string
+	var created time.Time
+	err := d.conn.QueryRow("SELECT password, created_at FROM subsonic_credentials WHERE user_id=?", userID).Scan(&pw, &created)
+	return pw, created, err
+}
+
+// SetSubsonicPassword stores (or replaces) userID's Subsonic app password.
+func (d *DB) SetSubsonicPassword(userID int64, password string) error {
+	_, err := d.conn.Exec(`INSERT INTO subsonic_credentials(user_id, password, created_at) VALUES(?,?,CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id) DO UPDATE SET password=excluded.password, created_at=CURRENT_TIMESTAMP`, userID, password)
 	return err
 }
 
-func (d *DB) GetPlaylistItems(playlistID int64) ([]*PlaylistItem, error) {
-	rows, err := d.conn.Query(`SELECT pi.id,pi.playlist_id,pi.audio_id,pi.position,a.title,a.artist,a.duration,a.filename,a.original_name,a.owner_id,a.qualities
-		FROM playlist_items pi JOIN audio_files a ON a.id=pi.audio_id WHERE pi.playlist_id=? ORDER BY pi.position`, playlistID)
+// DeleteSubsonicPassword revokes userID's Subsonic app password.
+func (d *DB) DeleteSubsonicPassword(userID int64) error {
+	res, err := d.conn.Exec("DELETE FROM subsonic_credentials WHERE user_id=?", userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	var items []*PlaylistItem
-	for rows.Next() {
-		i := &PlaylistItem{}
-		rows.Scan(&i.ID, &i.PlaylistID, &i.AudioID, &i.Position, &i.Title, &i.Artist, &i.Duration, &i.Filename, &i.OriginalName, &i.OwnerID, &i.Qualities)
-		items = append(items, i)
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
 	}
-	return items, nil
+	return nil
 }
 
-func (d *DB) UpdatePlayMode(playlistID int64, mode string) error {
-	_, err := d.conn.Exec("UPDATE playlists SET play_mode=? WHERE id=?", mode, playlistID)
+// --- Ratings & Favorites ---
+
+// SetRating stores userID's 1-5 star rating of a track; 0 removes it.
+func (d *DB) SetRating(userID, audioID int64, rating int) error {
+	if rating == 0 {
+		_, err := d.conn.Exec("DELETE FROM track_ratings WHERE user_id=? AND audio_id=?", userID, audioID)
+		return err
+	}
+	_, err := d.conn.Exec(`INSERT INTO track_ratings(user_id,audio_id,rating) VALUES(?,?,?)
+		ON CONFLICT(user_id,audio_id) DO UPDATE SET rating=excluded.rating, updated_at=CURRENT_TIMESTAMP`, userID, audioID, rating)
 	return err
 }
 
-func (d *DB) UpdateCurrentIndex(playlistID int64, index int) error {
-	_, err := d.conn.Exec("UPDATE playlists SET current_index=? WHERE id=?", index, playlistID)
+// SetFavorite marks or unmarks a track as one of userID's favorites.
+func (d *DB) SetFavorite(userID, audioID int64, favorite bool) error {
+	var err error
+	if favorite {
+		_, err = d.conn.Exec("INSERT OR IGNORE INTO track_favorites(user_id,audio_id) VALUES(?,?)", userID, audioID)
+	} else {
+		_, err = d.conn.Exec("DELETE FROM track_favorites WHERE user_id=? AND audio_id=?", userID, audioID)
+	}
 	return err
 }
 
-func (d *DB) GetNextPlaylistPosition(playlistID int64) (int, error) {
-	var pos int
-	err := d.conn.QueryRow("SELECT COALESCE(MAX(position),0)+1 FROM playlist_items WHERE playlist_id=?", playlistID).Scan(&pos)
-	return pos, err
+// TrackScore is the aggregated reception of a track.
+type TrackScore struct {
+	AvgRating     float64
+	RatingCount   int
+	FavoriteCount int
 }
 
-func (d *DB) ReorderPlaylistItems(playlistID int64, itemIDs []int64) error {
-	tx, err := d.conn.Begin()
+// GetTrackScores returns the aggregated ratings and favorites of the given tracks.
+// When userIDs is non-empty only those users' ratings and favorites count.
+func (d *DB) GetTrackScores(audioIDs, userIDs []int64) (map[int64]*TrackScore, error) {
+	scores := make(map[int64]*TrackScore, len(audioIDs))
+	if len(audioIDs) == 0 {
+		return scores, nil
+	}
+	for _, id := range audioIDs {
+		scores[id] = &TrackScore{}
+	}
+	where := "audio_id IN (" + placeholders(len(audioIDs)) + ")"
+	args := int64Args(audioIDs)
+	if len(userIDs) > 0 {
+		where += " AND user_id IN (" + placeholders(len(userIDs)) + ")"
+		args = append(args, int64Args(userIDs)...)
+	}
+
+	rows, err := d.conn.Query("SELECT audio_id,AVG(rating),COUNT(*) FROM track_ratings WHERE "+where+" GROUP BY audio_id", args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for i, id := range itemIDs {
-		if _, err := tx.Exec("UPDATE playlist_items SET position=? WHERE id=? AND playlist_id=?", i, id, playlistID); err != nil {
-			tx.Rollback()
-			return err
+	for rows.Next() {
+		var id int64
+		var avg float64
+		var n int
+		rows.Scan(&id, &avg, &n)
+		if sc := scores[id]; sc != nil {
+			sc.AvgRating, sc.RatingCount = avg, n
 		}
 	}
-	return tx.Commit()
+	rows.Close()
+
+	rows, err = d.conn.Query("SELECT audio_id,COUNT(*) FROM track_favorites WHERE "+where+" GROUP BY audio_id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var n int
+		rows.Scan(&id, &n)
+		if sc := scores[id]; sc != nil {
+			sc.FavoriteCount = n
+		}
+	}
+	return scores, nil
 }
 
-func (d *DB) GetUserSettings(userID int64) (string, error) {
-	var s string
-	err := d.conn.QueryRow("SELECT settings_json FROM user_settings WHERE user_id=?", userID).Scan(&s)
+// FillTrackStats fills in the aggregated and userID's own rating fields of files.
+func (d *DB) FillTrackStats(files []*AudioFile, userID int64) error {
+	if len(files) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(files))
+	for i, f := range files {
+		ids[i] = f.ID
+	}
+	scores, err := d.GetTrackScores(ids, nil)
 	if err != nil {
-		return "{}", nil
+		return err
 	}
-	return s, nil
+	mine := map[int64]int{}
+	rows, err := d.conn.Query("SELECT audio_id,rating FROM track_ratings WHERE user_id=?", userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var r int
+		rows.Scan(&id, &r)
+		mine[id] = r
+	}
+	rows.Close()
+	favs := map[int64]bool{}
+	rows, err = d.conn.Query("SELECT audio_id FROM track_favorites WHERE user_id=?", userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		favs[id] = true
+	}
+	for _, f := range files {
+		sc := scores[f.ID]
+		f.AvgRating, f.RatingCount, f.FavoriteCount = sc.AvgRating, sc.RatingCount, sc.FavoriteCount
+		f.MyRating, f.Favorite = mine[f.ID], favs[f.ID]
+	}
+	return nil
 }
 
-func (d *DB) SaveUserSettings(userID int64, settingsJSON string) error {
-	_, err := d.conn.Exec(`INSERT INTO user_settings(user_id, settings_json, updated_at) VALUES(?,?,CURRENT_TIMESTAMP)
-		ON CONFLICT(user_id) DO UPDATE SET settings_json=excluded.settings_json, updated_at=CURRENT_TIMESTAMP`, userID, settingsJSON)
+// GetFavoriteAudioFiles returns userID's favorites, most recent first. Tracks
+// loved in a room are listed even without library access, so people can find
+// out what was playing.
+func (d *DB) GetFavoriteAudioFiles(userID int64) ([]*AudioFile, error) {
+	return d.queryAudioFilesWithOwner(`JOIN track_favorites tf ON tf.audio_id=a.id WHERE tf.user_id=? ORDER BY tf.created_at DESC`, userID)
+}
+
+// GetRatedAudioFiles returns the tracks userID has rated, best first.
+func (d *DB) GetRatedAudioFiles(userID int64) ([]*AudioFile, error) {
+	return d.queryAudioFilesWithOwner(`JOIN track_ratings tr ON tr.audio_id=a.id WHERE tr.user_id=? ORDER BY tr.rating DESC, tr.updated_at DESC`, userID)
+}
+
+func (d *DB) queryAudioFilesWithOwner(tail string, args ...interface{}) ([]*AudioFile, error) {
+	rows, err := d.conn.Query(`SELECT `+audioFileColumns("a.")+`,u.username
+		FROM audio_files a JOIN users u ON u.id=a.owner_id `+tail, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []*AudioFile
+	for rows.Next() {
+		f := &AudioFile{}
+		scanAudioFile(rows, f, &f.OwnerName)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func int64Args(ids []int64) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// --- Groups ---
+
+// Group member roles.
+const (
+	GroupMember = "member"
+	GroupAdmin  = "admin"
+)
+
+// Group is a named set of users that shares and room invites can target.
+type Group struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	CreatedBy   int64     `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	MemberCount int       `json:"member_count"`
+	MyRole      string    `json:"my_role,omitempty"`
+}
+
+// GroupMemberInfo is one member of a group.
+type GroupMemberInfo struct {
+	UserID   int64     `json:"user_id"`
+	UID      int64     `json:"uid"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// CreateGroup creates a group with creatorID as its first admin.
+func (d *DB) CreateGroup(name string, creatorID int64) (*Group, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	res, err := tx.Exec("INSERT INTO user_groups(name,created_by) VALUES(?,?)", name, creatorID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	if _, err := tx.Exec("INSERT INTO group_members(group_id,user_id,role) VALUES(?,?,?)", id, creatorID, GroupAdmin); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return &Group{ID: id, Name: name, CreatedBy: creatorID, CreatedAt: time.Now(), MemberCount: 1, MyRole: GroupAdmin}, nil
+}
+
+// DeleteGroup removes a group together with its memberships, shares and invites.
+func (d *DB) DeleteGroup(id int64) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	for _, q := range []string{
+		"DELETE FROM group_members WHERE group_id=?",
+		"DELETE FROM library_group_shares WHERE group_id=?",
+		"DELETE FROM room_invites WHERE group_id=?",
+		"DELETE FROM user_groups WHERE id=?",
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const groupSelect = `SELECT g.id,g.name,g.created_by,g.created_at,
+	(SELECT COUNT(*) FROM group_members c WHERE c.group_id=g.id),
+	COALESCE((SELECT m.role FROM group_members m WHERE m.group_id=g.id AND m.user_id=?),'')
+	FROM user_groups g`
+
+func (d *DB) queryGroups(where string, args ...interface{}) ([]*Group, error) {
+	rows, err := d.conn.Query(groupSelect+" "+where+" ORDER BY g.name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []*Group
+	for rows.Next() {
+		g := &Group{}
+		rows.Scan(&g.ID, &g.Name, &g.CreatedBy, &g.CreatedAt, &g.MemberCount, &g.MyRole)
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// GetGroup returns a group, with MyRole filled in for userID.
+func (d *DB) GetGroup(id, userID int64) (*Group, error) {
+	groups, err := d.queryGroups("WHERE g.id=?", userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return groups[0], nil
+}
+
+// GetUserGroups returns the groups userID belongs to.
+func (d *DB) GetUserGroups(userID int64) ([]*Group, error) {
+	return d.queryGroups("WHERE g.id IN (SELECT group_id FROM group_members WHERE user_id=?)", userID, userID)
+}
+
+// GetAllGroups returns every group, with MyRole filled in for userID.
+func (d *DB) GetAllGroups(userID int64) ([]*Group, error) {
+	return d.queryGroups("", userID)
+}
+
+func (d *DB) GetGroupMembers(groupID int64) ([]*GroupMemberInfo, error) {
+	rows, err := d.conn.Query(`SELECT u.id,u.uid,u.username,m.role,m.added_at FROM group_members m
+		JOIN users u ON u.id=m.user_id WHERE m.group_id=? ORDER BY m.role='admin' DESC, u.username`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var members []*GroupMemberInfo
+	for rows.Next() {
+		m := &GroupMemberInfo{}
+		rows.Scan(&m.UserID, &m.UID, &m.Username, &m.Role, &m.AddedAt)
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+// SetGroupMember adds userID to a group or changes their role.
+func (d *DB) SetGroupMember(groupID, userID int64, role string) error {
+	_, err := d.conn.Exec(`INSERT INTO group_members(group_id,user_id,role) VALUES(?,?,?)
+		ON CONFLICT(group_id,user_id) DO UPDATE SET role=excluded.role`, groupID, userID, role)
+	return err
+}
+
+func (d *DB) RemoveGroupMember(groupID, userID int64) error {
+	_, err := d.conn.Exec("DELETE FROM group_members WHERE group_id=? AND user_id=?", groupID, userID)
+	return err
+}
+
+// CountGroupAdmins returns how many admins a group has.
+func (d *DB) CountGroupAdmins(groupID int64) int {
+	var n int
+	d.conn.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id=? AND role='admin'", groupID).Scan(&n)
+	return n
+}
+
+func (d *DB) ShareLibraryWithGroup(ownerID, groupID int64) error {
+	_, err := d.conn.Exec("INSERT OR IGNORE INTO library_group_shares(owner_id,group_id) VALUES(?,?)", ownerID, groupID)
+	return err
+}
+
+func (d *DB) UnshareLibraryWithGroup(ownerID, groupID int64) error {
+	_, err := d.conn.Exec("DELETE FROM library_group_shares WHERE owner_id=? AND group_id=?", ownerID, groupID)
+	return err
+}
+
+// GetMyGroupShares returns the groups an owner has shared their library with.
+func (d *DB) GetMyGroupShares(ownerID int64) ([]*LibraryShare, error) {
+	rows, err := d.conn.Query(`SELECT s.id,s.owner_id,s.created_at,g.id,g.name
+		FROM library_group_shares s JOIN user_groups g ON g.id=s.group_id WHERE s.owner_id=?`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var shares []*LibraryShare
+	for rows.Next() {
+		s := &LibraryShare{}
+		rows.Scan(&s.ID, &s.OwnerID, &s.CreatedAt, &s.GroupID, &s.GroupName)
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+// GetGroupSharedLibraries returns libraries shared with any group userID belongs to.
+func (d *DB) GetGroupSharedLibraries(userID int64) ([]*LibraryShare, error) {
+	rows, err := d.conn.Query(`SELECT s.id,s.owner_id,s.created_at,u.username,u.uid,g.id,g.name
+		FROM library_group_shares s JOIN user_groups g ON g.id=s.group_id JOIN users u ON u.id=s.owner_id
+		JOIN group_members m ON m.group_id=s.group_id WHERE m.user_id=? AND s.owner_id!=?`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var shares []*LibraryShare
+	for rows.Next() {
+		s := &LibraryShare{SharedWithID: userID}
+		rows.Scan(&s.ID, &s.OwnerID, &s.CreatedAt, &s.OwnerName, &s.OwnerUID, &s.GroupID, &s.GroupName)
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+// --- Room Invites ---
+
+// RoomInvite invites a user, or every member of a group, to a room.
+type RoomInvite struct {
+	ID          int64     `json:"id"`
+	RoomCode    string    `json:"room_code"`
+	UserID      int64     `json:"user_id,omitempty"`
+	GroupID     int64     `json:"group_id,omitempty"`
+	InvitedBy   int64     `json:"invited_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	Username    string    `json:"username,omitempty"`
+	GroupName   string    `json:"group_name,omitempty"`
+	InviterName string    `json:"inviter_name,omitempty"`
+}
+
+func (d *DB) CreateRoomInvite(roomCode string, userID, groupID, invitedBy int64) error {
+	_, err := d.conn.Exec(`INSERT INTO room_invites(room_code,user_id,group_id,invited_by) VALUES(?,?,?,?)
+		ON CONFLICT(room_code,user_id,group_id) DO UPDATE SET invited_by=excluded.invited_by, created_at=CURRENT_TIMESTAMP`,
+		roomCode, userID, groupID, invitedBy)
+	return err
+}
+
+func (d *DB) DeleteRoomInvite(id int64, roomCode string) error {
+	res, err := d.conn.Exec("DELETE FROM room_invites WHERE id=? AND room_code=?", id, roomCode)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const roomInviteSelect = `SELECT i.id,i.room_code,i.user_id,i.group_id,i.invited_by,i.created_at,
+	COALESCE(u.username,''),COALESCE(g.name,''),COALESCE(b.username,'')
+	FROM room_invites i LEFT JOIN users u ON u.id=i.user_id LEFT JOIN user_groups g ON g.id=i.group_id
+	LEFT JOIN users b ON b.id=i.invited_by`
+
+func (d *DB) queryRoomInvites(where string, args ...interface{}) ([]*RoomInvite, error) {
+	rows, err := d.conn.Query(roomInviteSelect+" WHERE "+where+" ORDER BY i.created_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var invites []*RoomInvite
+	for rows.Next() {
+		i := &RoomInvite{}
+		rows.Scan(&i.ID, &i.RoomCode, &i.UserID, &i.GroupID, &i.InvitedBy, &i.CreatedAt, &i.Username, &i.GroupName, &i.InviterName)
+		invites = append(invites, i)
+	}
+	return invites, nil
+}
+
+func (d *DB) GetRoomInvites(roomCode string) ([]*RoomInvite, error) {
+	return d.queryRoomInvites("i.room_code=?", roomCode)
+}
+
+// GetInvitesForUser returns invites addressed to userID directly or through a group.
+func (d *DB) GetInvitesForUser(userID int64) ([]*RoomInvite, error) {
+	return d.queryRoomInvites("i.user_id=? OR i.group_id IN (SELECT group_id FROM group_members WHERE user_id=?)", userID, userID)
+}
+
+// --- Item Sharing ---
+
+// Item share kinds.
+const (
+	ShareTrack    = "track"
+	ShareAlbum    = "album"
+	SharePlaylist = "playlist"
+)
+
+// ItemShare grants one user access to a single track, album or playlist of another.
+type ItemShare struct {
+	ID           int64     `json:"id"`
+	OwnerID      int64     `json:"owner_id"`
+	SharedWithID int64     `json:"shared_with_id"`
+	Kind         string    `json:"kind"`
+	TargetID     int64     `json:"target_id,omitempty"` // track or playlist id
+	Album        string    `json:"album,omitempty"`
+	ExpiresAt    int64     `json:"expires_at,omitempty"` // unix seconds, 0 = never
+	CreatedAt    time.Time `json:"created_at"`
+	OwnerName    string    `json:"owner_name,omitempty"`
+	SharedName   string    `json:"shared_name,omitempty"`
+	SharedUID    int64     `json:"shared_uid,omitempty"`
+	Label        string    `json:"label,omitempty"` // track title or playlist room code
+}
+
+// ShareItem creates an item share, or updates the expiry of an identical one.
+func (d *DB) ShareItem(s *ItemShare) (*ItemShare, error) {
+	_, err := d.conn.Exec(`INSERT INTO item_shares(owner_id,shared_with_id,kind,target_id,album,expires_at) VALUES(?,?,?,?,?,?)
+		ON CONFLICT(owner_id,shared_with_id,kind,target_id,album) DO UPDATE SET expires_at=excluded.expires_at`,
+		s.OwnerID, s.SharedWithID, s.Kind, s.TargetID, s.Album, s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	out := *s
+	err = d.conn.QueryRow(`SELECT id,created_at FROM item_shares WHERE owner_id=? AND shared_with_id=? AND kind=? AND target_id=? AND album=?`,
+		s.OwnerID, s.SharedWithID, s.Kind, s.TargetID, s.Album).Scan(&out.ID, &out.CreatedAt)
+	return &out, err
+}
+
+func (d *DB) DeleteItemShare(id, ownerID int64) error {
+	res, err := d.conn.Exec("DELETE FROM item_shares WHERE id=? AND owner_id=?", id, ownerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const itemShareSelect = `SELECT s.id,s.owner_id,s.shared_with_id,s.kind,s.target_id,s.album,s.expires_at,s.created_at,
+	o.username,t.username,t.uid,COALESCE(a.title,p.room_code,'')
+	FROM item_shares s JOIN users o ON o.id=s.owner_id JOIN users t ON t.id=s.shared_with_id
+	LEFT JOIN audio_files a ON s.kind='track' AND a.id=s.target_id
+	LEFT JOIN playlists p ON s.kind='playlist' AND p.id=s.target_id`
+
+func (d *DB) queryItemShares(where string, arg int64) ([]*ItemShare, error) {
+	rows, err := d.conn.Query(itemShareSelect+" WHERE "+where+" ORDER BY s.created_at DESC", arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var shares []*ItemShare
+	for rows.Next() {
+		s := &ItemShare{}
+		rows.Scan(&s.ID, &s.OwnerID, &s.SharedWithID, &s.Kind, &s.TargetID, &s.Album, &s.ExpiresAt, &s.CreatedAt,
+			&s.OwnerName, &s.SharedName, &s.SharedUID, &s.Label)
+		shares = append(shares, s)
+	}
+	return shares, nil
+}
+
+// GetMyItemShares returns the item shares an owner has granted, including expired ones.
+func (d *DB) GetMyItemShares(ownerID int64) ([]*ItemShare, error) {
+	return d.queryItemShares("s.owner_id=?", ownerID)
+}
+
+// GetItemSharesWithMe returns the unexpired item shares granted to a user.
+func (d *DB) GetItemSharesWithMe(userID int64) ([]*ItemShare, error) {
+	return d.queryItemShares("s.shared_with_id=? AND (s.expires_at=0 OR s.expires_at>CAST(strftime('%s','now') AS INTEGER))", userID)
+}
+
+// CanAccessPlaylist reports whether userID created the playlist or has an
+// unexpired item share for it.
+func (d *DB) CanAccessPlaylist(userID, playlistID int64) bool {
+	var n int
+	d.conn.QueryRow(`SELECT COUNT(*) FROM playlists p WHERE p.id=? AND (p.created_by=? OR EXISTS (
+		SELECT 1 FROM item_shares s WHERE s.kind=? AND s.target_id=p.id AND s.shared_with_id=?
+		AND (s.expires_at=0 OR s.expires_at>CAST(strftime('%s','now') AS INTEGER))))`,
+		playlistID, userID, SharePlaylist, userID).Scan(&n)
+	return n > 0
+}
+
+// HasAlbum reports whether ownerID has at least one track on album.
+func (d *DB) HasAlbum(ownerID int64, album string) bool {
+	var n int
+	d.conn.QueryRow("SELECT COUNT(*) FROM audio_files WHERE owner_id=? AND album=?", ownerID, album).Scan(&n)
+	return n > 0
+}
+
+// --- Listen Links ---
+
+// ListenLink is an unauthenticated, revocable link to a single track.
+type ListenLink struct {
+	ID        int64     `json:"id"`
+	Token     string    `json:"token"`
+	OwnerID   int64     `json:"owner_id"`
+	AudioID   int64     `json:"audio_id"`
+	ExpiresAt int64     `json:"expires_at,omitempty"` // unix seconds, 0 = never
+	Plays     int64     `json:"plays"`
+	CreatedAt time.Time `json:"created_at"`
+	Title     string    `json:"title,omitempty"`
+}
+
+func (d *DB) CreateListenLink(token string, ownerID, audioID, expiresAt int64) (*ListenLink, error) {
+	res, err := d.conn.Exec("INSERT INTO listen_links(token,owner_id,audio_id,expires_at) VALUES(?,?,?,?)", token, ownerID, audioID, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &ListenLink{ID: id, Token: token, OwnerID: ownerID, AudioID: audioID, ExpiresAt: expiresAt, CreatedAt: time.Now()}, nil
+}
+
+// GetListenLink returns the link for token if it exists and has not expired.
+func (d *DB) GetListenLink(token string) (*ListenLink, error) {
+	l := &ListenLink{}
+	err := d.conn.QueryRow(`SELECT id,token,owner_id,audio_id,expires_at,plays,created_at FROM listen_links
+		WHERE token=? AND (expires_at=0 OR expires_at>CAST(strftime('%s','now') AS INTEGER))`, token).
+		Scan(&l.ID, &l.Token, &l.OwnerID, &l.AudioID, &l.ExpiresAt, &l.Plays, &l.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (d *DB) GetListenLinksByOwner(ownerID int64) ([]*ListenLink, error) {
+	rows, err := d.conn.Query(`SELECT l.id,l.token,l.owner_id,l.audio_id,l.expires_at,l.plays,l.created_at,a.title
+		FROM listen_links l JOIN audio_files a ON a.id=l.audio_id WHERE l.owner_id=? ORDER BY l.created_at DESC`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []*ListenLink
+	for rows.Next() {
+		l := &ListenLink{}
+		rows.Scan(&l.ID, &l.Token, &l.OwnerID, &l.AudioID, &l.ExpiresAt, &l.Plays, &l.CreatedAt, &l.Title)
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (d *DB) DeleteListenLink(id, ownerID int64) error {
+	res, err := d.conn.Exec("DELETE FROM listen_links WHERE id=? AND owner_id=?", id, ownerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *DB) IncrementListenLinkPlays(id int64) {
+	d.conn.Exec("UPDATE listen_links SET plays=plays+1 WHERE id=?", id)
+}
+
+// --- Playlist CRUD ---
+
+func (d *DB) CreatePlaylist(roomCode string, createdBy int64) (*Playlist, error) {
+	res, err := d.conn.Exec("INSERT INTO playlists(room_code,created_by) VALUES(?,?)", roomCode, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &Playlist{ID: id, RoomCode: roomCode, CreatedBy: createdBy, PlayMode: "sequential", CurrentIndex: 0, CreatedAt: time.Now()}, nil
+}
+
+func (d *DB) GetOrCreatePlaylist(roomCode string, createdBy int64) (*Playlist, error) {
+	d.conn.Exec("INSERT OR IGNORE INTO playlists(room_code,created_by) VALUES(?,?)", roomCode, createdBy)
+	p := &Playlist{}
+	err := d.conn.QueryRow("SELECT id,room_code,created_by,play_mode,current_index,created_at FROM playlists WHERE room_code=?", roomCode).
+		Scan(&p.ID, &p.RoomCode, &p.CreatedBy, &p.PlayMode, &p.CurrentIndex, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (d *DB) GetPlaylistByRoom(roomCode string) (*Playlist, error) {
+	p := &Playlist{}
+	err := d.conn.QueryRow("SELECT id,room_code,created_by,play_mode,current_index,created_at FROM playlists WHERE room_code=?", roomCode).
+		Scan(&p.ID, &p.RoomCode, &p.CreatedBy, &p.PlayMode, &p.CurrentIndex, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (d *DB) GetPlaylistByID(id int64) (*Playlist, error) {
+	p := &Playlist{}
+	err := d.conn.QueryRow("SELECT id,room_code,created_by,play_mode,current_index,created_at FROM playlists WHERE id=?", id).
+		Scan(&p.ID, &p.RoomCode, &p.CreatedBy, &p.PlayMode, &p.CurrentIndex, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetPlaylistsByCreator returns every playlist created by a user.
+func (d *DB) GetPlaylistsByCreator(userID int64) ([]*Playlist, error) {
+	rows, err := d.conn.Query("SELECT id,room_code,created_by,play_mode,current_index,created_at FROM playlists WHERE created_by=? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var lists []*Playlist
+	for rows.Next() {
+		p := &Playlist{}
+		rows.Scan(&p.ID, &p.RoomCode, &p.CreatedBy, &p.PlayMode, &p.CurrentIndex, &p.CreatedAt)
+		lists = append(lists, p)
+	}
+	return lists, nil
+}
+
+func (d *DB) AddPlaylistItem(playlistID, audioID int64, _ int) (*PlaylistItem, error) {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	var pos int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position),0)+1 FROM playlist_items WHERE playlist_id=?", playlistID).Scan(&pos); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("get next position: %w", err)
+	}
+	res, err := tx.Exec("INSERT INTO playlist_items(playlist_id,audio_id,position) VALUES(?,?,?)", playlistID, audioID, pos)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	return &PlaylistItem{ID: id, PlaylistID: playlistID, AudioID: audioID, Position: pos}, nil
+}
+
+// ReplacePlaylistItems sets a playlist's items to audioIDs in order, or appends
+// them when replace is false.
+func (d *DB) ReplacePlaylistItems(playlistID int64, audioIDs []int64, replace bool) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	var pos int
+	if replace {
+		if _, err := tx.Exec("DELETE FROM playlist_items WHERE playlist_id=?", playlistID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else if err := tx.QueryRow("SELECT COALESCE(MAX(position),0) FROM playlist_items WHERE playlist_id=?", playlistID).Scan(&pos); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("get next position: %w", err)
+	}
+	for _, id := range audioIDs {
+		pos++
+		if _, err := tx.Exec("INSERT INTO playlist_items(playlist_id,audio_id,position) VALUES(?,?,?)", playlistID, id, pos); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if replace {
+		if _, err := tx.Exec("UPDATE playlists SET current_index=0 WHERE id=?", playlistID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *DB) RemovePlaylistItem(playlistID, itemID int64) error {
+	_, err := d.conn.Exec("DELETE FROM playlist_items WHERE id=? AND playlist_id=?", itemID, playlistID)
+	return err
+}
+
+func (d *DB) GetPlaylistItems(playlistID int64) ([]*PlaylistItem, error) {
+	rows, err := d.conn.Query(`SELECT pi.id,pi.playlist_id,pi.audio_id,pi.position,a.title,a.artist,a.duration,a.filename,a.original_name,a.owner_id,a.qualities
+		FROM playlist_items pi JOIN audio_files a ON a.id=pi.audio_id WHERE pi.playlist_id=? ORDER BY pi.position`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*PlaylistItem
+	for rows.Next() {
+		i := &PlaylistItem{}
+		rows.Scan(&i.ID, &i.PlaylistID, &i.AudioID, &i.Position, &i.Title, &i.Artist, &i.Duration, &i.Filename, &i.OriginalName, &i.OwnerID, &i.Qualities)
+		items = append(items, i)
+	}
+	return items, nil
+}
+
+func (d *DB) UpdatePlayMode(playlistID int64, mode string) error {
+	_, err := d.conn.Exec("UPDATE playlists SET play_mode=? WHERE id=?", mode, playlistID)
+	return err
+}
+
+func (d *DB) UpdateCurrentIndex(playlistID int64, index int) error {
+	_, err := d.conn.Exec("UPDATE playlists SET current_index=? WHERE id=?", index, playlistID)
+	return err
+}
+
+func (d *DB) GetNextPlaylistPosition(playlistID int64) (int, error) {
+	var pos int
+	err := d.conn.QueryRow("SELECT COALESCE(MAX(position),0)+1 FROM playlist_items WHERE playlist_id=?", playlistID).Scan(&pos)
+	return pos, err
+}
+
+func (d *DB) ReorderPlaylistItems(playlistID int64, itemIDs []int64) error {
+	tx, err := d.conn.Begin()
+	if err != nil {
+		return err
+	}
+	for i, id := range itemIDs {
+		if _, err := tx.Exec("UPDATE playlist_items SET position=? WHERE id=? AND playlist_id=?", i, id, playlistID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *DB) GetUserSettings(userID int64) (string, error) {
+	var s string
+	err := d.conn.QueryRow("SELECT settings_json FROM user_settings WHERE user_id=?", userID).Scan(&s)
+	if err != nil {
+		return "{}", nil
+	}
+	return s, nil
+}
+
+func (d *DB) SaveUserSettings(userID int64, settingsJSON string) error {
+	_, err := d.conn.Exec(`INSERT INTO user_settings(user_id, settings_json, updated_at) VALUES(?,?,CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id) DO UPDATE SET settings_json=excluded.settings_json, updated_at=CURRENT_TIMESTAMP`, userID, settingsJSON)
+	return err
+}
+
+// --- Webhooks ---
+
+// Webhook is an outgoing HTTP endpoint notified of server events.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    string    `json:"events"` // comma-separated event names, "" for all
+	Enabled   bool      `json:"enabled"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent (or to be sent) to a webhook.
+type WebhookDelivery struct {
+	ID            int64     `json:"id"`
+	WebhookID     int64     `json:"webhook_id"`
+	Event         string    `json:"event"`
+	Payload       string    `json:"payload"`
+	Status        string    `json:"status"` // pending, sending (test pings), delivered, failed
+	Attempts      int       `json:"attempts"`
+	ResponseCode  int       `json:"response_code"`
+	Error         string    `json:"error"`
+	NextAttemptAt int64     `json:"next_attempt_at"`
+	DeliveredAt   int64     `json:"delivered_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const webhookColumns = "id,url,secret,events,enabled,created_by,created_at"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	wh := &Webhook{}
+	err := row.Scan(&wh.ID, &wh.URL, &wh.Secret, &wh.Events, &wh.Enabled, &wh.CreatedBy, &wh.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func (d *DB) CreateWebhook(url, secret, events string, enabled bool, createdBy int64) (*Webhook, error) {
+	res, err := d.conn.Exec("INSERT INTO webhooks(url,secret,events,enabled,created_by) VALUES(?,?,?,?,?)", url, secret, events, enabled, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return d.GetWebhook(id)
+}
+
+func (d *DB) GetWebhook(id int64) (*Webhook, error) {
+	return scanWebhook(d.conn.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id=?", id))
+}
+
+func (d *DB) ListWebhooks() ([]*Webhook, error) {
+	rows, err := d.conn.Query("SELECT " + webhookColumns + " FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*Webhook
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, wh)
+	}
+	return list, rows.Err()
+}
+
+// UpdateWebhook saves the URL, secret, events and enabled flag of wh.
+func (d *DB) UpdateWebhook(wh *Webhook) error {
+	_, err := d.conn.Exec("UPDATE webhooks SET url=?, secret=?, events=?, enabled=? WHERE id=?", wh.URL, wh.Secret, wh.Events, wh.Enabled, wh.ID)
+	return err
+}
+
+// DeleteWebhook removes a webhook and its delivery log.
+func (d *DB) DeleteWebhook(id int64) error {
+	res, err := d.conn.Exec("DELETE FROM webhooks WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = d.conn.Exec("DELETE FROM webhook_deliveries WHERE webhook_id=?", id)
+	return err
+}
+
+const deliveryColumns = "id,webhook_id,event,payload,status,attempts,response_code,error,next_attempt_at,delivered_at,created_at"
+
+func scanDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	defer rows.Close()
+	var list []*WebhookDelivery
+	for rows.Next() {
+		dl := &WebhookDelivery{}
+		if err := rows.Scan(&dl.ID, &dl.WebhookID, &dl.Event, &dl.Payload, &dl.Status, &dl.Attempts, &dl.ResponseCode,
+			&dl.Error, &dl.NextAttemptAt, &dl.DeliveredAt, &dl.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, dl)
+	}
+	return list, rows.Err()
+}
+
+// AddWebhookDelivery queues event for webhookID, due immediately.
+func (d *DB) AddWebhookDelivery(webhookID int64, event, payload string) (*WebhookDelivery, error) {
+	res, err := d.conn.Exec("INSERT INTO webhook_deliveries(webhook_id,event,payload) VALUES(?,?,?)", webhookID, event, payload)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &WebhookDelivery{ID: id, WebhookID: webhookID, Event: event, Payload: payload, Status: "pending", CreatedAt: time.Now()}, nil
+}
+
+// AddSendingWebhookDelivery logs a delivery its caller is about to send itself.
+// It is never due, so the dispatcher leaves it alone.
+func (d *DB) AddSendingWebhookDelivery(webhookID int64, event, payload string) (*WebhookDelivery, error) {
+	res, err := d.conn.Exec("INSERT INTO webhook_deliveries(webhook_id,event,payload,status) VALUES(?,?,?,'sending')", webhookID, event, payload)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &WebhookDelivery{ID: id, WebhookID: webhookID, Event: event, Payload: payload, Status: "sending", CreatedAt: time.Now()}, nil
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries of webhookID
+// due by now, oldest first.
+func (d *DB) GetDueWebhookDeliveries(webhookID int64, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	rows, err := d.conn.Query("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id=? AND status='pending' AND next_attempt_at<=? ORDER BY id LIMIT ?", webhookID, now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// GetWebhookDeliveries returns the latest deliveries of webhookID, newest first.
+func (d *DB) GetWebhookDeliveries(webhookID int64, limit int) ([]*WebhookDelivery, error) {
+	rows, err := d.conn.Query("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE webhook_id=? ORDER BY id DESC LIMIT ?", webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// UpdateWebhookDelivery saves the outcome of an attempt.
+func (d *DB) UpdateWebhookDelivery(dl *WebhookDelivery) error {
+	_, err := d.conn.Exec("UPDATE webhook_deliveries SET status=?, attempts=?, response_code=?, error=?, next_attempt_at=?, delivered_at=? WHERE id=?",
+		dl.Status, dl.Attempts, dl.ResponseCode, dl.Error, dl.NextAttemptAt, dl.DeliveredAt, dl.ID)
+	return err
+}
+
+// PruneWebhookDeliveries keeps only the newest keep deliveries of webhookID.
+func (d *DB) PruneWebhookDeliveries(webhookID int64, keep int) error {
+	_, err := d.conn.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id=? AND id NOT IN
+		(SELECT id FROM webhook_deliveries WHERE webhook_id=? ORDER BY id DESC LIMIT ?)`, webhookID, webhookID, keep)
+	return err
+}
+
+// --- API tokens ---
+
+// APIToken is a personal access token. Only a hash of the secret is stored;
+// Prefix keeps enough of it for the owner to tell tokens apart.
+type APIToken struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"-"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Scopes     string    `json:"-"` // space-separated scope names
+	ExpiresAt  int64     `json:"expires_at"`   // unix seconds, 0 = never
+	LastUsedAt int64     `json:"last_used_at"` // unix seconds, 0 = never used
+	RevokedAt  int64     `json:"revoked_at"`   // unix seconds, 0 = active
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const apiTokenColumns = "id,user_id,name,prefix,scopes,expires_at,last_used_at,revoked_at,created_at"
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*APIToken, error) {
+	t := &APIToken{}
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.RevokedAt, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (d *DB) CreateAPIToken(userID int64, name, hash, prefix, scopes string, expiresAt int64) (*APIToken, error) {
+	res, err := d.conn.Exec("INSERT INTO api_tokens(user_id,name,token_hash,prefix,scopes,expires_at) VALUES(?,?,?,?,?,?)",
+		userID, name, hash, prefix, scopes, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &APIToken{ID: id, UserID: userID, Name: name, Prefix: prefix, Scopes: scopes, ExpiresAt: expiresAt, CreatedAt: time.Now()}, nil
+}
+
+// GetAPITokenByHash returns the token with the given hash if it is neither
+// revoked nor expired.
+func (d *DB) GetAPITokenByHash(hash string) (*APIToken, error) {
+	return scanAPIToken(d.conn.QueryRow("SELECT "+apiTokenColumns+` FROM api_tokens
+		WHERE token_hash=? AND revoked_at=0 AND (expires_at=0 OR expires_at>CAST(strftime('%s','now') AS INTEGER))`, hash))
+}
+
+// GetAPITokens returns all of userID's tokens, including revoked ones, newest first.
+func (d *DB) GetAPITokens(userID int64) ([]*APIToken, error) {
+	rows, err := d.conn.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id=? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// CountActiveAPITokens counts userID's tokens that are neither revoked nor expired.
+func (d *DB) CountActiveAPITokens(userID int64) (int, error) {
+	var n int
+	err := d.conn.QueryRow(`SELECT COUNT(*) FROM api_tokens WHERE user_id=? AND revoked_at=0
+		AND (expires_at=0 OR expires_at>CAST(strftime('%s','now') AS INTEGER))`, userID).Scan(&n)
+	return n, err
+}
+
+// RevokeAPIToken revokes one of userID's active tokens.
+func (d *DB) RevokeAPIToken(id, userID int64) error {
+	res, err := d.conn.Exec("UPDATE api_tokens SET revoked_at=? WHERE id=? AND user_id=? AND revoked_at=0", time.Now().Unix(), id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *DB) TouchAPIToken(id int64, at time.Time) {
+	d.conn.Exec("UPDATE api_tokens SET last_used_at=? WHERE id=?", at.Unix(), id)
+}
+
+// --- Scrobble queue ---
+
+// QueuedScrobble is one listen waiting for submission; Payload is the
+// service's JSON for it.
+type QueuedScrobble struct {
+	ID        int64
+	UserID    int64
+	Payload   string
+	Attempts  int
+	LastError string
+}
+
+// EnqueueScrobble queues a listen for userID, due immediately.
+func (d *DB) EnqueueScrobble(userID int64, payload string) error {
+	_, err := d.conn.Exec("INSERT INTO scrobble_queue(user_id,payload) VALUES(?,?)", userID, payload)
+	return err
+}
+
+// GetDueScrobbles returns up to limit queued listens due by now, oldest first.
+func (d *DB) GetDueScrobbles(now time.Time, limit int) ([]*QueuedScrobble, error) {
+	rows, err := d.conn.Query("SELECT id,user_id,payload,attempts,last_error FROM scrobble_queue WHERE next_attempt_at<=? ORDER BY id LIMIT ?", now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*QueuedScrobble
+	for rows.Next() {
+		q := &QueuedScrobble{}
+		if err := rows.Scan(&q.ID, &q.UserID, &q.Payload, &q.Attempts, &q.LastError); err != nil {
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, rows.Err()
+}
+
+// DeleteScrobbles removes submitted or abandoned listens.
+func (d *DB) DeleteScrobbles(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := d.conn.Exec("DELETE FROM scrobble_queue WHERE id IN (?"+strings.Repeat(",?", len(ids)-1)+")", args...)
+	return err
+}
+
+// RetryScrobbles records a failed attempt and reschedules the listens for next.
+func (d *DB) RetryScrobbles(ids []int64, next time.Time, lastErr string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := []interface{}{next.Unix(), lastErr}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := d.conn.Exec("UPDATE scrobble_queue SET attempts=attempts+1, next_attempt_at=?, last_error=? WHERE id IN (?"+strings.Repeat(",?", len(ids)-1)+")", args...)
+	return err
+}
+
+// CountQueuedScrobbles returns how many of userID's listens are still queued
+// and the last error recorded for them.
+func (d *DB) CountQueuedScrobbles(userID int64) (int, string, error) {
+	var n int
+	var lastErr string
+	err := d.conn.QueryRow("SELECT COUNT(*), COALESCE(MAX(last_error),'') FROM scrobble_queue WHERE user_id=?", userID).Scan(&n, &lastErr)
+	return n, lastErr, err
+}
+
+// GetServerSetting returns the value stored under key, or "" if unset.
+func (d *DB) GetServerSetting(key string) (string, error) {
+	var v string
+	err := d.conn.QueryRow("SELECT value FROM server_settings WHERE key=?", key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return v, err
+}
+
+func (d *DB) SetServerSetting(key, value string) error {
+	_, err := d.conn.Exec(`INSERT INTO server_settings(key, value, updated_at) VALUES(?,?,CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET value=excluded.value, updated_at=CURRENT_TIMESTAMP`, key, value)
+	return err
+}
+
+// WatchFile records a file seen by the folder watcher and what became of it.
+type WatchFile struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   int64     `json:"mod_time"`
+	AudioID   int64     `json:"audio_id,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// GetWatchFiles returns every file the folder watcher has processed, keyed by path.
+func (d *DB) GetWatchFiles() (map[string]*WatchFile, error) {
+	rows, err := d.conn.Query("SELECT path,size,mod_time,COALESCE(audio_id,0),error,scanned_at FROM watch_files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make(map[string]*WatchFile)
+	for rows.Next() {
+		f := &WatchFile{}
+		rows.Scan(&f.Path, &f.Size, &f.ModTime, &f.AudioID, &f.Error, &f.ScannedAt)
+		files[f.Path] = f
+	}
+	return files, nil
+}
+
+// GetFailedWatchFiles returns the most recent files the folder watcher could not import.
+func (d *DB) GetFailedWatchFiles(limit int) ([]*WatchFile, error) {
+	rows, err := d.conn.Query("SELECT path,size,mod_time,COALESCE(audio_id,0),error,scanned_at FROM watch_files WHERE error!='' ORDER BY scanned_at DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []*WatchFile
+	for rows.Next() {
+		f := &WatchFile{}
+		rows.Scan(&f.Path, &f.Size, &f.ModTime, &f.AudioID, &f.Error, &f.ScannedAt)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func (d *DB) SaveWatchFile(f *WatchFile) error {
+	var audioID interface{}
+	if f.AudioID > 0 {
+		audioID = f.AudioID
+	}
+	_, err := d.conn.Exec(`INSERT INTO watch_files(path,size,mod_time,audio_id,error,scanned_at) VALUES(?,?,?,?,?,CURRENT_TIMESTAMP)
+		ON CONFLICT(path) DO UPDATE SET size=excluded.size, mod_time=excluded.mod_time, audio_id=excluded.audio_id, error=excluded.error, scanned_at=CURRENT_TIMESTAMP`,
+		f.Path, f.Size, f.ModTime, audioID, f.Error)
 	return err
 }
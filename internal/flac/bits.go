@@ -0,0 +1,135 @@
+package flac
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// bitReader reads big-endian bit fields from a byte slice.
+type bitReader struct {
+	buf []byte
+	pos int // bit offset
+}
+
+func (b *bitReader) read(n uint) (uint64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	if b.pos+int(n) > len(b.buf)*8 {
+		return 0, errEOF
+	}
+	var v uint64
+	for n > 0 {
+		off := uint(b.pos & 7)
+		avail := 8 - off
+		take := avail
+		if n < take {
+			take = n
+		}
+		v = v<<take | uint64(b.buf[b.pos>>3]>>(avail-take))&(1<<take-1)
+		b.pos += int(take)
+		n -= take
+	}
+	return v, nil
+}
+
+// mustRead is read for fields whose presence was already length-checked.
+func (b *bitReader) mustRead(n uint) uint64 {
+	v, _ := b.read(n)
+	return v
+}
+
+// readSigned reads an n-bit two's complement value.
+func (b *bitReader) readSigned(n uint) (int32, error) {
+	v, err := b.read(n)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return int32(int64(v<<(64-n)) >> (64 - n)), nil
+}
+
+// readUnary counts zero bits up to and including the next one bit.
+func (b *bitReader) readUnary() (uint64, error) {
+	var n uint64
+	for {
+		i := b.pos >> 3
+		if i >= len(b.buf) {
+			return 0, errEOF
+		}
+		off := uint(b.pos & 7)
+		x := b.buf[i] << off
+		if x == 0 {
+			n += uint64(8 - off)
+			b.pos += int(8 - off)
+			continue
+		}
+		lz := bits.LeadingZeros8(x)
+		n += uint64(lz)
+		b.pos += lz + 1
+		return n, nil
+	}
+}
+
+// readUTF8 reads the UTF-8-style coded frame or sample number.
+func (b *bitReader) readUTF8() (uint64, error) {
+	first, err := b.read(8)
+	if err != nil {
+		return 0, err
+	}
+	n := bits.LeadingZeros8(^uint8(first))
+	switch {
+	case n == 0:
+		return first, nil
+	case n == 1 || n > 7:
+		return 0, errors.New("flac: invalid coded number")
+	}
+	v := first & (1<<(7-n) - 1)
+	for i := 1; i < n; i++ {
+		c, err := b.read(8)
+		if err != nil {
+			return 0, err
+		}
+		if c&0xc0 != 0x80 {
+			return 0, errors.New("flac: invalid coded number")
+		}
+		v = v<<6 | c&0x3f
+	}
+	return v, nil
+}
+
+var crc8Table, crc16Table = func() (t8 [256]uint8, t16 [256]uint16) {
+	for i := 0; i < 256; i++ {
+		c8 := uint8(i)
+		c16 := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		t8[i], t16[i] = c8, c16
+	}
+	return
+}()
+
+func crc8(data []byte) uint8 {
+	var c uint8
+	for _, x := range data {
+		c = crc8Table[c^x]
+	}
+	return c
+}
+
+func crc16(data []byte) uint16 {
+	var c uint16
+	for _, x := range data {
+		c = c<<8 ^ crc16Table[uint8(c>>8)^x]
+	}
+	return c
+}
@@ -0,0 +1,554 @@
+package flac
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// A minimal FLAC encoder used only to generate the fixtures in testdata. It
+// is written from the format specification rather than from the decoder, and
+// lets each fixture force the channel assignments, subframe types and
+// residual codings the decoder must handle. Regenerate the fixtures with
+//
+//	go test ./internal/flac -update
+
+// fixture describes one file in testdata.
+type fixture struct {
+	name       string
+	channels   int
+	bps        int
+	rate       int
+	blockSize  int
+	frames     int // samples per channel
+	mode       int // channel assignment for stereo: 1 independent, or chanLeftSide..chanMidSide
+	rateCode   int // frame header sample rate code; 0 refers to STREAMINFO
+	sizeCode   int // frame header sample size code; 0 refers to STREAMINFO
+	subframes  []subframeSpec
+	synthesize func(r *rand.Rand, ch, i int) int32
+}
+
+// subframeSpec picks the coding of every subframe in a frame; a fixture's
+// specs are used in turn, one per frame.
+type subframeSpec struct {
+	kind      int // subVerbatim, subFixed or subLPC
+	order     int
+	precision int // LPC coefficient precision
+	method    int // residual coding method: 0 for 4-bit, 1 for 5-bit Rice parameters
+	partOrder int
+	escape    bool // write odd partitions unencoded
+}
+
+const (
+	subVerbatim = iota
+	subFixed
+	subLPC
+)
+
+func tone(i int, freq, rate float64, amp float64) float64 {
+	return amp * math.Sin(2*math.Pi*freq*float64(i)/rate)
+}
+
+var fixtures = []fixture{
+	{
+		// Wasted bits on the left, a silent (constant) start on the right,
+		// every fixed order and verbatim, a short final block.
+		name: "independent", channels: 2, bps: 16, rate: 44100, blockSize: 576, frames: 3000,
+		mode: 1, rateCode: 9, sizeCode: 4,
+		subframes: []subframeSpec{
+			{kind: subFixed, order: 0},
+			{kind: subFixed, order: 1, partOrder: 2},
+			{kind: subFixed, order: 2, method: 1},
+			{kind: subFixed, order: 3, partOrder: 3},
+			{kind: subFixed, order: 4},
+			{kind: subVerbatim},
+		},
+		synthesize: func(r *rand.Rand, ch, i int) int32 {
+			if ch == 0 {
+				return int32(tone(i, 440, 44100, 2000)) * 4
+			}
+			if i < 576 {
+				return -7
+			}
+			return int32(tone(i, 660, 44100, 9000) + r.NormFloat64()*300)
+		},
+	},
+	{
+		name: "left_side", channels: 2, bps: 16, rate: 44100, blockSize: 1152, frames: 3000,
+		mode: chanLeftSide,
+		subframes: []subframeSpec{
+			{kind: subFixed, order: 2, partOrder: 1},
+			{kind: subLPC, order: 4, precision: 12},
+			{kind: subFixed, order: 3},
+		},
+		synthesize: stereoSignal(44100, 16),
+	},
+	{
+		name: "side_right", channels: 2, bps: 16, rate: 48000, blockSize: 1024, frames: 3000,
+		mode: chanSideRight, rateCode: 10, sizeCode: 4,
+		subframes: []subframeSpec{
+			{kind: subLPC, order: 6, precision: 10, partOrder: 2},
+			{kind: subFixed, order: 2},
+		},
+		synthesize: stereoSignal(48000, 16),
+	},
+	{
+		name: "mid_side", channels: 2, bps: 24, rate: 96000, blockSize: 4096, frames: 6000,
+		mode: chanMidSide, rateCode: 11, sizeCode: 6,
+		subframes: []subframeSpec{
+			{kind: subLPC, order: 8, precision: 14, method: 1, partOrder: 4},
+			{kind: subFixed, order: 3, method: 1},
+		},
+		synthesize: stereoSignal(96000, 24),
+	},
+	{
+		// Orders well past the fixed predictors, up to the maximum of 32.
+		name: "lpc_high_order", channels: 1, bps: 16, rate: 11025, blockSize: 2048, frames: 5000,
+		rateCode: 13, sizeCode: 4,
+		subframes: []subframeSpec{
+			{kind: subLPC, order: 12, precision: 15, partOrder: 3},
+			{kind: subLPC, order: 32, precision: 12, method: 1, partOrder: 5},
+			{kind: subLPC, order: 5, precision: 8},
+		},
+		synthesize: func(r *rand.Rand, ch, i int) int32 {
+			return int32(tone(i, 300, 11025, 8000) + tone(i, 1210, 11025, 3000) + tone(i, 2500, 11025, 1000) + r.NormFloat64()*50)
+		},
+	},
+	{
+		// Small blocks so frame numbers need multi-byte UTF-8, and escaped
+		// partitions both for loud noise and for silence (zero width).
+		name: "rice_escape", channels: 2, bps: 16, rate: 44100, blockSize: 64, frames: 64 * 150,
+		mode: 1, rateCode: 9, sizeCode: 4,
+		subframes: []subframeSpec{
+			{kind: subFixed, order: 2, partOrder: 2, escape: true},
+			{kind: subLPC, order: 8, precision: 12, method: 1, partOrder: 3, escape: true},
+			{kind: subFixed, order: 0, partOrder: 1, escape: true},
+		},
+		synthesize: func(r *rand.Rand, ch, i int) int32 {
+			switch (i / 16) % 4 {
+			case 0:
+				return int32(r.Intn(65536) - 32768)
+			case 1:
+				return 0
+			}
+			return int32(tone(i, 220*float64(ch+1), 44100, 12000))
+		},
+	},
+}
+
+// stereoSignal returns correlated left and right channels, so the side
+// channel is much quieter than either.
+func stereoSignal(rate float64, bps int) func(r *rand.Rand, ch, i int) int32 {
+	amp := float64(int(1)<<(bps-1)) * 0.4
+	return func(r *rand.Rand, ch, i int) int32 {
+		v := tone(i, 330, rate, amp) + tone(i, 1000, rate, amp/4)
+		if ch == 1 {
+			v = 0.9*v + tone(i, 1500, rate, amp/20)
+		}
+		return int32(v + r.NormFloat64()*amp/2000)
+	}
+}
+
+// samples synthesizes the fixture's PCM, one slice per channel.
+func (f *fixture) samples() [][]int32 {
+	r := rand.New(rand.NewSource(int64(len(f.name))))
+	out := make([][]int32, f.channels)
+	for ch := range out {
+		out[ch] = make([]int32, f.frames)
+	}
+	lim := int32(1) << (f.bps - 1)
+	for i := 0; i < f.frames; i++ {
+		for ch := range out {
+			v := f.synthesize(r, ch, i)
+			out[ch][i] = max(min(v, lim-1), -lim)
+		}
+	}
+	return out
+}
+
+// pcmBytes returns samples interleaved as signed little-endian integers of
+// the sample width, the layout STREAMINFO's MD5 is computed over.
+func pcmBytes(samples [][]int32, bps int) []byte {
+	width := (bps + 7) / 8
+	var out []byte
+	var tmp [4]byte
+	for i := range samples[0] {
+		for ch := range samples {
+			binary.LittleEndian.PutUint32(tmp[:], uint32(samples[ch][i]))
+			out = append(out, tmp[:width]...)
+		}
+	}
+	return out
+}
+
+// writeFixture encodes f and writes NAME.flac and its reference NAME.pcm.
+func writeFixture(dir string, f *fixture) error {
+	samples := f.samples()
+	pcm := pcmBytes(samples, f.bps)
+	w := &bitWriter{}
+	w.bytes([]byte("fLaC"))
+	w.write(1, 1) // last metadata block
+	w.write(0, 7) // STREAMINFO
+	w.write(34, 24)
+	w.write(uint64(f.blockSize), 16)
+	w.write(uint64(f.blockSize), 16)
+	w.write(0, 24) // frame sizes unknown
+	w.write(0, 24)
+	w.write(uint64(f.rate), 20)
+	w.write(uint64(f.channels-1), 3)
+	w.write(uint64(f.bps-1), 5)
+	w.write(uint64(f.frames), 36)
+	sum := md5.Sum(pcm)
+	w.bytes(sum[:])
+
+	for n, start := 0, 0; start < f.frames; n, start = n+1, start+f.blockSize {
+		end := min(start+f.blockSize, f.frames)
+		block := make([][]int32, f.channels)
+		for ch := range block {
+			block[ch] = samples[ch][start:end]
+		}
+		f.encodeFrame(w, n, block, f.subframes[n%len(f.subframes)])
+	}
+	if err := os.WriteFile(filepath.Join(dir, f.name+".flac"), w.buf, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, f.name+".pcm"), pcm, 0644)
+}
+
+func (f *fixture) encodeFrame(w *bitWriter, num int, block [][]int32, spec subframeSpec) {
+	start := len(w.buf)
+	n := len(block[0])
+	w.write(0x3ffe, 14)
+	w.write(0, 1)
+	w.write(0, 1) // fixed block size
+	sizeCode, sizeBits := blockSizeCode(n)
+	w.write(uint64(sizeCode), 4)
+	w.write(uint64(f.rateCode), 4)
+	assignment := f.channels - 1
+	if f.channels == 2 {
+		assignment = f.mode
+	}
+	w.write(uint64(assignment), 4)
+	w.write(uint64(f.sizeCode), 3)
+	w.write(0, 1)
+	w.bytes(utf8Number(uint64(num)))
+	w.write(uint64(n-1), sizeBits)
+	switch f.rateCode {
+	case 12:
+		w.write(uint64(f.rate/1000), 8)
+	case 13:
+		w.write(uint64(f.rate), 16)
+	case 14:
+		w.write(uint64(f.rate/10), 16)
+	}
+	w.bytes([]byte{specCRC8(w.buf[start:])})
+
+	chans := block
+	bps := []int{f.bps, f.bps}
+	if f.channels == 2 && f.mode != 1 {
+		l, r := block[0], block[1]
+		mid, side := make([]int32, n), make([]int32, n)
+		for i := range l {
+			mid[i], side[i] = (l[i]+r[i])>>1, l[i]-r[i]
+		}
+		switch f.mode {
+		case chanLeftSide:
+			chans, bps = [][]int32{l, side}, []int{f.bps, f.bps + 1}
+		case chanSideRight:
+			chans, bps = [][]int32{side, r}, []int{f.bps + 1, f.bps}
+		case chanMidSide:
+			chans, bps = [][]int32{mid, side}, []int{f.bps, f.bps + 1}
+		}
+	}
+	for ch, x := range chans {
+		encodeSubframe(w, x, bps[min(ch, 1)], spec)
+	}
+	w.align()
+	crc := specCRC16(w.buf[start:])
+	w.bytes([]byte{byte(crc >> 8), byte(crc)})
+}
+
+// blockSizeCode returns the frame header code for n and the width of the
+// explicit size that follows the frame number, if any.
+func blockSizeCode(n int) (code int, bits uint) {
+	switch n {
+	case 192:
+		return 1, 0
+	case 576, 1152, 2304, 4608:
+		return 2 + int(math.Log2(float64(n/576))), 0
+	case 256, 512, 1024, 2048, 4096, 8192, 16384, 32768:
+		return 8 + int(math.Log2(float64(n/256))), 0
+	}
+	if n <= 256 {
+		return 6, 8
+	}
+	return 7, 16
+}
+
+// utf8Number codes v the way frame headers do, as UTF-8 extended to 36 bits.
+func utf8Number(v uint64) []byte {
+	if v < 0x80 {
+		return []byte{byte(v)}
+	}
+	n := 1 // continuation bytes
+	for v >= 1<<(5*n+6) {
+		n++
+	}
+	out := make([]byte, n+1)
+	for i := n; i > 0; i-- {
+		out[i] = 0x80 | byte(v&0x3f)
+		v >>= 6
+	}
+	out[0] = byte(0xff)<<(7-n) | byte(v)
+	return out
+}
+
+func encodeSubframe(w *bitWriter, x []int32, bps int, spec subframeSpec) {
+	constant := true
+	var bitsSet int32
+	for _, v := range x {
+		constant = constant && v == x[0]
+		bitsSet |= v
+	}
+	if constant {
+		w.write(0, 8)
+		w.writeSigned(int64(x[0]), uint(bps))
+		return
+	}
+	wasted := 0
+	for bitsSet&1 == 0 {
+		bitsSet >>= 1
+		wasted++
+	}
+	if wasted > 0 {
+		shifted := make([]int32, len(x))
+		for i, v := range x {
+			shifted[i] = v >> wasted
+		}
+		x, bps = shifted, bps-wasted
+	}
+	header := func(typ int) {
+		w.write(0, 1)
+		w.write(uint64(typ), 6)
+		if wasted > 0 {
+			w.write(1, 1)
+			w.writeUnary(uint64(wasted - 1))
+		} else {
+			w.write(0, 1)
+		}
+	}
+
+	switch spec.kind {
+	case subVerbatim:
+		header(1)
+		for _, v := range x {
+			w.writeSigned(int64(v), uint(bps))
+		}
+	case subFixed:
+		header(8 + spec.order)
+		for _, v := range x[:spec.order] {
+			w.writeSigned(int64(v), uint(bps))
+		}
+		res := make([]int64, 0, len(x))
+		for i := spec.order; i < len(x); i++ {
+			var pred int64
+			switch spec.order {
+			case 1:
+				pred = int64(x[i-1])
+			case 2:
+				pred = 2*int64(x[i-1]) - int64(x[i-2])
+			case 3:
+				pred = 3*int64(x[i-1]) - 3*int64(x[i-2]) + int64(x[i-3])
+			case 4:
+				pred = 4*int64(x[i-1]) - 6*int64(x[i-2]) + 4*int64(x[i-3]) - int64(x[i-4])
+			}
+			res = append(res, int64(x[i])-pred)
+		}
+		writeResidual(w, res, len(x), spec)
+	case subLPC:
+		coeffs, shift := quantizedLPC(x, spec.order, spec.precision)
+		header(32 + spec.order - 1)
+		for _, v := range x[:spec.order] {
+			w.writeSigned(int64(v), uint(bps))
+		}
+		w.write(uint64(spec.precision-1), 4)
+		w.writeSigned(int64(shift), 5)
+		for _, c := range coeffs {
+			w.writeSigned(int64(c), uint(spec.precision))
+		}
+		res := make([]int64, 0, len(x))
+		for i := spec.order; i < len(x); i++ {
+			var sum int64
+			for j, c := range coeffs {
+				sum += int64(c) * int64(x[i-1-j])
+			}
+			res = append(res, int64(x[i])-sum>>shift)
+		}
+		writeResidual(w, res, len(x), spec)
+	}
+}
+
+// quantizedLPC fits an order-th predictor to x with Levinson-Durbin and
+// quantizes it to precision-bit coefficients. Coefficient j applies to the
+// sample j+1 back.
+func quantizedLPC(x []int32, order, precision int) ([]int32, int) {
+	autoc := make([]float64, order+1)
+	for lag := range autoc {
+		for i := lag; i < len(x); i++ {
+			autoc[lag] += float64(x[i]) * float64(x[i-lag])
+		}
+	}
+	autoc[0] *= 1 + 1e-9
+	a := make([]float64, order)
+	errPow := autoc[0]
+	for i := 0; i < order && errPow > 0; i++ {
+		k := autoc[i+1]
+		for j := 0; j < i; j++ {
+			k -= a[j] * autoc[i-j]
+		}
+		k /= errPow
+		prev := append([]float64(nil), a[:i]...)
+		a[i] = k
+		for j := 0; j < i; j++ {
+			a[j] = prev[j] - k*prev[i-1-j]
+		}
+		errPow *= 1 - k*k
+	}
+	cmax := 0.0
+	for _, c := range a {
+		cmax = math.Max(cmax, math.Abs(c))
+	}
+	shift := 15
+	if cmax > 0 {
+		_, exp := math.Frexp(cmax)
+		shift = min(max(precision-1-exp, 0), 15)
+	}
+	lim := int32(1) << (precision - 1)
+	q := make([]int32, order)
+	for i, c := range a {
+		q[i] = max(min(int32(math.Round(c*float64(int(1)<<shift))), lim-1), -lim)
+	}
+	return q, shift
+}
+
+// writeResidual Rice-codes res, the residual of a block of n samples, with
+// the best parameter per partition.
+func writeResidual(w *bitWriter, res []int64, n int, spec subframeSpec) {
+	w.write(uint64(spec.method), 2)
+	w.write(uint64(spec.partOrder), 4)
+	paramBits, escape := uint(4), uint64(15)
+	if spec.method == 1 {
+		paramBits, escape = 5, 31
+	}
+	order := n - len(res)
+	i := 0
+	for part := 0; part < 1<<spec.partOrder; part++ {
+		count := n >> spec.partOrder
+		if part == 0 {
+			count -= order
+		}
+		vals := res[i : i+count]
+		i += count
+		if spec.escape && part%2 == 1 {
+			width := uint(0) // zero width: every value is 0
+			for _, v := range vals {
+				for v != 0 && (width == 0 || v < -1<<(width-1) || v >= 1<<(width-1)) {
+					width++
+				}
+			}
+			w.write(escape, paramBits)
+			w.write(uint64(width), 5)
+			for _, v := range vals {
+				w.writeSigned(v, width)
+			}
+			continue
+		}
+		best, bestBits := uint64(0), uint64(math.MaxUint64)
+		for k := uint64(0); k < escape; k++ {
+			total := uint64(0)
+			for _, v := range vals {
+				total += zigzag(v)>>k + 1 + k
+			}
+			if total < bestBits {
+				best, bestBits = k, total
+			}
+		}
+		w.write(best, paramBits)
+		for _, v := range vals {
+			u := zigzag(v)
+			w.writeUnary(u >> best)
+			w.write(u&(1<<best-1), uint(best))
+		}
+	}
+}
+
+func zigzag(v int64) uint64 { return uint64(v<<1) ^ uint64(v>>63) }
+
+// bitWriter appends big-endian bit fields.
+type bitWriter struct {
+	buf  []byte
+	bits uint // bits used in the last byte, 0 if it is full
+}
+
+func (w *bitWriter) write(v uint64, n uint) {
+	for n > 0 {
+		n--
+		if w.bits == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>n&1) << (7 - w.bits)
+		w.bits = (w.bits + 1) & 7
+	}
+}
+
+func (w *bitWriter) writeSigned(v int64, n uint) { w.write(uint64(v)&(1<<n-1), n) }
+
+func (w *bitWriter) writeUnary(q uint64) {
+	for ; q > 0; q-- {
+		w.write(0, 1)
+	}
+	w.write(1, 1)
+}
+
+func (w *bitWriter) bytes(b []byte) {
+	for _, c := range b {
+		w.write(uint64(c), 8)
+	}
+}
+
+func (w *bitWriter) align() { w.bits = 0 }
+
+// specCRC8 and specCRC16 are bitwise versions of the frame CRCs: polynomials
+// x^8+x^2+x+1 and x^16+x^15+x^2+1, zero initial value.
+func specCRC8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func specCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,481 @@
+// Package flac decodes FLAC streams such as the segments written by the
+// transcoder. It supports everything ffmpeg's encoder emits: fixed and
+// variable block sizes, constant, verbatim, fixed and LPC subframes, wasted
+// bits, both Rice coding methods and all stereo decorrelation modes.
+package flac
+
+import (
+	"errors"
+	"fmt"
+)
+
+// StreamInfo is the STREAMINFO metadata block.
+type StreamInfo struct {
+	MinBlockSize  int
+	MaxBlockSize  int
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	TotalSamples  int64 // 0 if unknown, as in segmented output
+}
+
+// Stream is a fully decoded FLAC stream.
+type Stream struct {
+	Info StreamInfo
+	// Samples holds one slice per channel of signed samples at Info.BitsPerSample.
+	Samples [][]int32
+}
+
+// Frames returns the number of decoded samples per channel.
+func (s *Stream) Frames() int {
+	if len(s.Samples) == 0 {
+		return 0
+	}
+	return len(s.Samples[0])
+}
+
+var (
+	ErrNotFLAC = errors.New("flac: missing fLaC marker")
+	errSync    = errors.New("flac: lost frame sync")
+	errEOF     = errors.New("flac: unexpected end of data")
+)
+
+// Decode decodes a complete FLAC file held in memory.
+func Decode(data []byte) (*Stream, error) {
+	if len(data) < 4 || string(data[:4]) != "fLaC" {
+		return nil, ErrNotFLAC
+	}
+	info, pos, err := readMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stream{Info: info, Samples: make([][]int32, info.Channels)}
+	if info.TotalSamples > 0 {
+		for ch := range s.Samples {
+			s.Samples[ch] = make([]int32, 0, info.TotalSamples)
+		}
+	}
+	d := &frameDecoder{info: info}
+	for pos < len(data) {
+		n, err := d.decodeFrame(data[pos:], s.Samples)
+		if err != nil {
+			return nil, fmt.Errorf("frame at byte %d: %w", pos, err)
+		}
+		pos += n
+	}
+	return s, nil
+}
+
+func readMetadata(data []byte) (StreamInfo, int, error) {
+	var info StreamInfo
+	pos, seen := 4, false
+	for {
+		if pos+4 > len(data) {
+			return info, 0, errEOF
+		}
+		last := data[pos]&0x80 != 0
+		typ := data[pos] & 0x7f
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+length > len(data) {
+			return info, 0, errEOF
+		}
+		if typ == 0 {
+			if length < 34 {
+				return info, 0, errors.New("flac: short STREAMINFO")
+			}
+			b := &bitReader{buf: data[pos : pos+length]}
+			info.MinBlockSize = int(b.mustRead(16))
+			info.MaxBlockSize = int(b.mustRead(16))
+			b.mustRead(24) // min frame size
+			b.mustRead(24) // max frame size
+			info.SampleRate = int(b.mustRead(20))
+			info.Channels = int(b.mustRead(3)) + 1
+			info.BitsPerSample = int(b.mustRead(5)) + 1
+			info.TotalSamples = int64(b.mustRead(36))
+			seen = true
+		}
+		pos += length
+		if last {
+			break
+		}
+	}
+	if !seen {
+		return info, 0, errors.New("flac: no STREAMINFO block")
+	}
+	return info, pos, nil
+}
+
+type frameDecoder struct {
+	info StreamInfo
+	// scratch buffers reused across frames
+	chans    [8][]int32
+	residual []int32
+}
+
+var blockSizes = [16]int{0, 192, 576, 1152, 2304, 4608, -1, -2, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
+
+var sampleRates = [12]int{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}
+
+var sampleSizes = [8]int{0, 8, 12, -1, 16, 20, 24, 32}
+
+const (
+	chanLeftSide  = 8
+	chanSideRight = 9
+	chanMidSide   = 10
+)
+
+// decodeFrame decodes one frame from the start of data, appends its samples
+// to out and returns the number of bytes consumed.
+func (d *frameDecoder) decodeFrame(data []byte, out [][]int32) (int, error) {
+	b := &bitReader{buf: data}
+	if len(data) < 2 || data[0] != 0xff || data[1]&0xfe != 0xf8 {
+		return 0, errSync
+	}
+	b.pos = 16
+	bsCode, err := b.read(4)
+	if err != nil {
+		return 0, err
+	}
+	srCode, _ := b.read(4)
+	chanCode, _ := b.read(4)
+	ssCode, _ := b.read(3)
+	b.read(1) // reserved
+	if _, err := b.readUTF8(); err != nil {
+		return 0, err
+	}
+
+	blockSize := blockSizes[bsCode]
+	switch blockSize {
+	case 0:
+		return 0, errors.New("flac: reserved block size")
+	case -1:
+		v, err := b.read(8)
+		if err != nil {
+			return 0, err
+		}
+		blockSize = int(v) + 1
+	case -2:
+		v, err := b.read(16)
+		if err != nil {
+			return 0, err
+		}
+		blockSize = int(v) + 1
+	}
+
+	rate := d.info.SampleRate
+	switch {
+	case srCode >= 1 && srCode <= 11:
+		rate = sampleRates[srCode]
+	case srCode == 12:
+		v, err := b.read(8)
+		if err != nil {
+			return 0, err
+		}
+		rate = int(v) * 1000
+	case srCode == 13:
+		v, err := b.read(16)
+		if err != nil {
+			return 0, err
+		}
+		rate = int(v)
+	case srCode == 14:
+		v, err := b.read(16)
+		if err != nil {
+			return 0, err
+		}
+		rate = int(v) * 10
+	case srCode == 15:
+		return 0, errors.New("flac: invalid sample rate code")
+	}
+	if rate != d.info.SampleRate {
+		return 0, fmt.Errorf("flac: sample rate changed mid-stream (%d)", rate)
+	}
+
+	bps := d.info.BitsPerSample
+	if ssCode != 0 {
+		bps = sampleSizes[ssCode]
+		if bps < 0 {
+			return 0, errors.New("flac: reserved sample size")
+		}
+	}
+
+	channels := int(chanCode) + 1
+	if chanCode >= chanLeftSide {
+		if chanCode > chanMidSide {
+			return 0, errors.New("flac: reserved channel assignment")
+		}
+		channels = 2
+	}
+	if channels != d.info.Channels {
+		return 0, fmt.Errorf("flac: channel count changed mid-stream (%d)", channels)
+	}
+
+	headerLen := b.pos / 8
+	if headerLen >= len(data) {
+		return 0, errEOF
+	}
+	if crc8(data[:headerLen]) != data[headerLen] {
+		return 0, errors.New("flac: frame header CRC mismatch")
+	}
+	b.pos += 8
+
+	for ch := 0; ch < channels; ch++ {
+		sbps := bps
+		if (chanCode == chanLeftSide && ch == 1) || (chanCode == chanSideRight && ch == 0) || (chanCode == chanMidSide && ch == 1) {
+			sbps++ // side channel carries one extra bit
+		}
+		if cap(d.chans[ch]) < blockSize {
+			d.chans[ch] = make([]int32, blockSize)
+		}
+		d.chans[ch] = d.chans[ch][:blockSize]
+		if err := d.decodeSubframe(b, d.chans[ch], sbps); err != nil {
+			return 0, fmt.Errorf("channel %d: %w", ch, err)
+		}
+	}
+
+	// Byte-align, then check the frame footer CRC
+	b.pos = (b.pos + 7) &^ 7
+	end := b.pos / 8
+	if end+2 > len(data) {
+		return 0, errEOF
+	}
+	if crc16(data[:end]) != uint16(data[end])<<8|uint16(data[end+1]) {
+		return 0, errors.New("flac: frame CRC mismatch")
+	}
+
+	decorrelate(int(chanCode), d.chans[:channels])
+	for ch := 0; ch < channels; ch++ {
+		out[ch] = append(out[ch], d.chans[ch]...)
+	}
+	return end + 2, nil
+}
+
+func decorrelate(mode int, c [][]int32) {
+	switch mode {
+	case chanLeftSide:
+		for i, side := range c[1] {
+			c[1][i] = c[0][i] - side
+		}
+	case chanSideRight:
+		for i, side := range c[0] {
+			c[0][i] = side + c[1][i]
+		}
+	case chanMidSide:
+		for i, side := range c[1] {
+			mid := c[0][i]<<1 | side&1
+			c[0][i] = (mid + side) >> 1
+			c[1][i] = (mid - side) >> 1
+		}
+	}
+}
+
+func (d *frameDecoder) decodeSubframe(b *bitReader, out []int32, bps int) error {
+	hdr, err := b.read(8)
+	if err != nil {
+		return err
+	}
+	if hdr&0x80 != 0 {
+		return errors.New("flac: subframe padding bit set")
+	}
+	typ := int(hdr>>1) & 0x3f
+	wasted := 0
+	if hdr&1 != 0 {
+		n, err := b.readUnary()
+		if err != nil {
+			return err
+		}
+		wasted = int(n) + 1
+		bps -= wasted
+		if bps <= 0 {
+			return errors.New("flac: invalid wasted bits")
+		}
+	}
+
+	switch {
+	case typ == 0: // constant
+		v, err := b.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = v
+		}
+	case typ == 1: // verbatim
+		for i := range out {
+			v, err := b.readSigned(uint(bps))
+			if err != nil {
+				return err
+			}
+			out[i] = v
+		}
+	case typ >= 8 && typ <= 12:
+		if err := d.decodeFixed(b, out, bps, typ-8); err != nil {
+			return err
+		}
+	case typ >= 32:
+		if err := d.decodeLPC(b, out, bps, typ-31); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("flac: reserved subframe type %d", typ)
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= uint(wasted)
+		}
+	}
+	return nil
+}
+
+func (d *frameDecoder) readWarmup(b *bitReader, out []int32, bps, order int) error {
+	if order > len(out) {
+		return errors.New("flac: predictor order exceeds block size")
+	}
+	for i := 0; i < order; i++ {
+		v, err := b.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		out[i] = v
+	}
+	return nil
+}
+
+func (d *frameDecoder) decodeFixed(b *bitReader, out []int32, bps, order int) error {
+	if err := d.readWarmup(b, out, bps, order); err != nil {
+		return err
+	}
+	res, err := d.readResidual(b, len(out), order)
+	if err != nil {
+		return err
+	}
+	for i := order; i < len(out); i++ {
+		r := res[i-order]
+		switch order {
+		case 0:
+			out[i] = r
+		case 1:
+			out[i] = r + out[i-1]
+		case 2:
+			out[i] = r + 2*out[i-1] - out[i-2]
+		case 3:
+			out[i] = r + 3*out[i-1] - 3*out[i-2] + out[i-3]
+		case 4:
+			out[i] = r + 4*out[i-1] - 6*out[i-2] + 4*out[i-3] - out[i-4]
+		}
+	}
+	return nil
+}
+
+func (d *frameDecoder) decodeLPC(b *bitReader, out []int32, bps, order int) error {
+	if err := d.readWarmup(b, out, bps, order); err != nil {
+		return err
+	}
+	p, err := b.read(4)
+	if err != nil {
+		return err
+	}
+	if p == 15 {
+		return errors.New("flac: invalid LPC precision")
+	}
+	precision := uint(p) + 1
+	shift, err := b.readSigned(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return errors.New("flac: negative LPC shift")
+	}
+	var coeffs [32]int64
+	for i := 0; i < order; i++ {
+		c, err := b.readSigned(precision)
+		if err != nil {
+			return err
+		}
+		coeffs[i] = int64(c)
+	}
+	res, err := d.readResidual(b, len(out), order)
+	if err != nil {
+		return err
+	}
+	for i := order; i < len(out); i++ {
+		var sum int64
+		for j := 0; j < order; j++ {
+			sum += coeffs[j] * int64(out[i-1-j])
+		}
+		out[i] = res[i-order] + int32(sum>>uint(shift))
+	}
+	return nil
+}
+
+// readResidual reads the Rice-coded residual for a block of n samples whose
+// first order samples are warm-up samples.
+func (d *frameDecoder) readResidual(b *bitReader, n, order int) ([]int32, error) {
+	method, err := b.read(2)
+	if err != nil {
+		return nil, err
+	}
+	if method > 1 {
+		return nil, errors.New("flac: reserved residual coding method")
+	}
+	paramBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+	po, err := b.read(4)
+	if err != nil {
+		return nil, err
+	}
+	partitions := 1 << po
+	if n%partitions != 0 || n>>po < order {
+		return nil, errors.New("flac: invalid partition order")
+	}
+	if cap(d.residual) < n {
+		d.residual = make([]int32, n)
+	}
+	res := d.residual[:n-order]
+	i := 0
+	for part := 0; part < partitions; part++ {
+		count := n >> po
+		if part == 0 {
+			count -= order
+		}
+		param, err := b.read(paramBits)
+		if err != nil {
+			return nil, err
+		}
+		if param == escape {
+			width, err := b.read(5)
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j < count; j++ {
+				v := int32(0)
+				if width > 0 {
+					if v, err = b.readSigned(uint(width)); err != nil {
+						return nil, err
+					}
+				}
+				res[i] = v
+				i++
+			}
+			continue
+		}
+		for j := 0; j < count; j++ {
+			q, err := b.readUnary()
+			if err != nil {
+				return nil, err
+			}
+			r, err := b.read(uint(param))
+			if err != nil {
+				return nil, err
+			}
+			u := q<<param | r
+			res[i] = int32(u>>1) ^ -int32(u&1)
+			i++
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,155 @@
+package flac
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate the fixtures in testdata")
+
+func TestDecodeFixtures(t *testing.T) {
+	if *update {
+		for i := range fixtures {
+			if err := writeFixture("testdata", &fixtures[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, f := range fixtures {
+		t.Run(f.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", f.name+".flac"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pcm, err := os.ReadFile(filepath.Join("testdata", f.name+".pcm"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The STREAMINFO MD5 ties the file to its reference PCM.
+			if sum := md5.Sum(pcm); !bytes.Equal(data[26:42], sum[:]) {
+				t.Fatalf("reference PCM doesn't match the STREAMINFO MD5")
+			}
+
+			s, err := Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := StreamInfo{MinBlockSize: f.blockSize, MaxBlockSize: f.blockSize, SampleRate: f.rate,
+				Channels: f.channels, BitsPerSample: f.bps, TotalSamples: int64(f.frames)}
+			if s.Info != want {
+				t.Errorf("info = %+v, want %+v", s.Info, want)
+			}
+			if s.Frames() != f.frames {
+				t.Fatalf("decoded %d frames, want %d", s.Frames(), f.frames)
+			}
+			if got := pcmBytes(s.Samples, s.Info.BitsPerSample); !bytes.Equal(got, pcm) {
+				width := (f.bps + 7) / 8 * f.channels
+				for i := 0; i < len(pcm); i += width {
+					if !bytes.Equal(got[i:i+width], pcm[i:i+width]) {
+						t.Fatalf("first mismatch at frame %d: got % x, want % x", i/width, got[i:i+width], pcm[i:i+width])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeDetectsCorruption(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "mid_side.flac"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(data[:len(data)-1]); err == nil {
+		t.Error("truncated stream decoded without error")
+	}
+	bad := bytes.Clone(data)
+	bad[len(bad)/2] ^= 0x10
+	if _, err := Decode(bad); err == nil {
+		t.Error("corrupted stream decoded without error")
+	}
+	if _, err := Decode([]byte("RIFF....WAVE")); !errors.Is(err, ErrNotFLAC) {
+		t.Errorf("err = %v, want ErrNotFLAC", err)
+	}
+}
+
+// ffmpegSegments is real transcoder output checked into the web test assets:
+// ffmpeg's FLAC encoder (Lavf59) with its adaptive choice of independent,
+// left/side, side/right and mid/side stereo and LPC orders 3 to 8. Segmented
+// output carries no STREAMINFO MD5, so the digests of the decoded PCM
+// (interleaved s16le) were taken from a separate decoder written from the
+// format specification, which also agrees with every fixture above.
+var ffmpegSegments = []struct {
+	name string
+	md5  string
+}{
+	{"seg_000", "1e29a6c54651331ebe137a29622339aa"},
+	{"seg_001", "72f178efa1dcf9d7d068301af70dc8e9"},
+}
+
+func TestDecodeFFmpegSegments(t *testing.T) {
+	for _, seg := range ffmpegSegments {
+		t.Run(seg.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("..", "..", "web", "static", "test-audio", seg.name+".flac"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := StreamInfo{MinBlockSize: 4608, MaxBlockSize: 4608, SampleRate: 44100, Channels: 2, BitsPerSample: 16}
+			if s.Info != want {
+				t.Errorf("info = %+v, want %+v", s.Info, want)
+			}
+			if s.Frames() != 48*4608 {
+				t.Errorf("decoded %d frames, want %d", s.Frames(), 48*4608)
+			}
+			if sum := md5.Sum(pcmBytes(s.Samples, s.Info.BitsPerSample)); hex.EncodeToString(sum[:]) != seg.md5 {
+				t.Errorf("decoded PCM MD5 = %x, want %s", sum, seg.md5)
+			}
+		})
+	}
+}
+
+// TestDecodeReferenceFiles decodes files made by reference encoders from the
+// fixtures' PCM, as described in testdata/reference/README.md. Each must match
+// its own STREAMINFO MD5 and the PCM it was encoded from.
+func TestDecodeReferenceFiles(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "reference", "*.flac"))
+	if len(files) == 0 {
+		t.Skip("no reference-encoded files in testdata/reference")
+	}
+	for _, path := range files {
+		name := filepath.Base(path)
+		t.Run(name, func(t *testing.T) {
+			fixture, _, _ := strings.Cut(name, ".")
+			pcm, err := os.ReadFile(filepath.Join("testdata", fixture+".pcm"))
+			if err != nil {
+				t.Fatalf("no source PCM for %s: %v", name, err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := pcmBytes(s.Samples, s.Info.BitsPerSample)
+			sum := md5.Sum(got)
+			if !bytes.Equal(data[26:42], sum[:]) {
+				t.Errorf("decoded PCM MD5 = %x, STREAMINFO has %x", sum, data[26:42])
+			}
+			if !bytes.Equal(got, pcm) {
+				t.Errorf("decoded PCM differs from %s.pcm (%d bytes, want %d)", fixture, len(got), len(pcm))
+			}
+		})
+	}
+}
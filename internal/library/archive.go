@@ -0,0 +1,656 @@
+package library
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/lyrics"
+)
+
+// A library archive is a zip holding manifest.json plus, per track,
+// tracks/{id}/audio.{ext}, an optional cover.jpg and an optional lyrics file.
+// Track IDs in the archive are the exporting instance's; import assigns new ones.
+
+const (
+	archiveVersion = 1
+	maxImportSize  = 8 << 30 // 8GB
+)
+
+// TierOriginal exports each track's original upload.
+const TierOriginal = "original"
+
+var tierPreference = []string{"lossless", "high", "medium", "low"}
+
+type archiveManifest struct {
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Tier       string            `json:"tier"`
+	Tracks     []archiveTrack    `json:"tracks"`
+	Playlists  []archivePlaylist `json:"playlists"`
+}
+
+type archiveTrack struct {
+	ID           int64     `json:"id"`
+	OriginalName string    `json:"original_name"`
+	Title        string    `json:"title"`
+	Artist       string    `json:"artist"`
+	Album        string    `json:"album"`
+	Genre        string    `json:"genre"`
+	Year         string    `json:"year"`
+	Duration     float64   `json:"duration"`
+	BPM          float64   `json:"bpm,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	Audio        string    `json:"audio"`
+	AudioSource  string    `json:"audio_source"` // "original" or the tier it was rebuilt from
+	Cover        string    `json:"cover,omitempty"`
+	Lyrics       string    `json:"lyrics,omitempty"`
+}
+
+type archivePlaylist struct {
+	RoomCode string  `json:"room_code"`
+	PlayMode string  `json:"play_mode"`
+	Tracks   []int64 `json:"tracks"`
+}
+
+// ImportReport describes the outcome of an archive import.
+type ImportReport struct {
+	Imported         []ImportedTrack `json:"imported"`
+	Failed           []ImportFailure `json:"failed"`
+	Playlists        []string        `json:"playlists"`
+	SkippedPlaylists []string        `json:"skipped_playlists"`
+}
+
+type ImportedTrack struct {
+	SourceID int64  `json:"source_id"`
+	ID       int64  `json:"id"`
+	Title    string `json:"title"`
+}
+
+type ImportFailure struct {
+	SourceID int64  `json:"source_id"`
+	Title    string `json:"title"`
+	Error    string `json:"error"`
+}
+
+// ExportArchive writes ownerID's library to w as a zip archive. tier is
+// TierOriginal or a quality name; tracks lacking it fall back to their best tier.
+func (h *LibraryHandlers) ExportArchive(ownerID int64, tier string, w io.Writer) error {
+	if tier == "" {
+		tier = TierOriginal
+	}
+	if tier != TierOriginal && !containsString(tierPreference, tier) {
+		return fmt.Errorf("unknown tier %q", tier)
+	}
+	files, err := h.DB.GetAudioFilesByOwner(ownerID)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.MkdirTemp("", "lt-export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	zw := zip.NewWriter(w)
+	m := archiveManifest{Version: archiveVersion, ExportedAt: time.Now().UTC(), Tier: tier, Tracks: []archiveTrack{}, Playlists: []archivePlaylist{}}
+	exported := map[int64]bool{}
+	for _, af := range files {
+		t, err := h.exportTrack(zw, tmp, af, tier)
+		if err != nil {
+			log.Printf("export: skipping track %d: %v", af.ID, err)
+			continue
+		}
+		m.Tracks = append(m.Tracks, *t)
+		exported[af.ID] = true
+	}
+
+	lists, _ := h.DB.GetPlaylistsByCreator(ownerID)
+	for _, pl := range lists {
+		items, _ := h.DB.GetPlaylistItems(pl.ID)
+		ap := archivePlaylist{RoomCode: pl.RoomCode, PlayMode: pl.PlayMode}
+		for _, it := range items {
+			// Tracks from other people's libraries are not in the archive.
+			if exported[it.AudioID] {
+				ap.Tracks = append(ap.Tracks, it.AudioID)
+			}
+		}
+		if len(ap.Tracks) > 0 {
+			m.Playlists = append(m.Playlists, ap)
+		}
+	}
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (h *LibraryHandlers) exportTrack(zw *zip.Writer, tmp string, af *db.AudioFile, tier string) (*archiveTrack, error) {
+	dir := fmt.Sprintf("tracks/%d/", af.ID)
+	t := &archiveTrack{
+		ID: af.ID, OriginalName: af.OriginalName, Title: af.Title, Artist: af.Artist, Album: af.Album,
+		Genre: af.Genre, Year: af.Year, Duration: af.Duration, BPM: af.BPM, Key: af.Key, CreatedAt: af.CreatedAt,
+	}
+
+	// Audio: the original if asked for and still present, else a rebuilt tier.
+	var src io.ReadCloser
+	if tier == TierOriginal {
+		if key := h.originalKey(af); key != "" {
+			rc, err := openObject(h.Store, h.DataDir, key)
+			if err == nil {
+				src, t.Audio, t.AudioSource = rc, dir+"audio"+path.Ext(key), TierOriginal
+			}
+		}
+	}
+	if src == nil {
+		p, q, err := h.materializeTier(tmp, af, tier)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		src, t.Audio, t.AudioSource = f, dir+"audio.flac", q
+	}
+	err := copyToZip(zw, t.Audio, src, zip.Store) // audio is already compressed
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if af.CoverArt != "" {
+		if rc, err := openObject(h.Store, h.DataDir, trackKey(af)+"/"+af.CoverArt); err == nil {
+			t.Cover = dir + "cover.jpg"
+			err = copyToZip(zw, t.Cover, rc, zip.Store)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if af.Lyrics != "" {
+		ext := ".txt"
+		if l := lyrics.Load("", af.Lyrics); l != nil && l.Synced {
+			ext = "." + l.Format
+		}
+		t.Lyrics = dir + "lyrics" + ext
+		if err := copyToZip(zw, t.Lyrics, strings.NewReader(af.Lyrics), zip.Deflate); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// originalKey returns the storage key of af's original, or "" if it was dropped.
+func (h *LibraryHandlers) originalKey(af *db.AudioFile) string {
+	if p := findOriginal(trackDir(h.DataDir, af)); p != "" {
+		return trackKey(af) + "/" + filepath.Base(p)
+	}
+	if h.Store.Local() {
+		return ""
+	}
+	keys, _ := h.Store.List(trackKey(af))
+	for _, key := range keys {
+		if matched, _ := path.Match("original.*", path.Base(key)); matched {
+			return key
+		}
+	}
+	return ""
+}
+
+// materializeTier joins the segments of af's preferred tier (or the best one
+// available) into a single FLAC under tmp and returns its path and tier name.
+func (h *LibraryHandlers) materializeTier(tmp string, af *db.AudioFile, want string) (string, string, error) {
+	m, err := h.loadManifest(af)
+	if err != nil {
+		return "", "", fmt.Errorf("manifest: %w", err)
+	}
+	order := tierPreference
+	if containsString(tierPreference, want) {
+		order = append([]string{want}, tierPreference...)
+	}
+	var q string
+	var info *audio.QualityInfo
+	for _, name := range order {
+		if qi := m.Qualities[name]; qi != nil && len(qi.Segments) > 0 {
+			q, info = name, qi
+			break
+		}
+	}
+	if info == nil {
+		return "", "", errors.New("no complete tier")
+	}
+
+	work := filepath.Join(tmp, strconv.FormatInt(af.ID, 10))
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return "", "", err
+	}
+	segs := make([]string, len(info.Segments))
+	for i, name := range info.Segments {
+		key := trackKey(af) + "/segments_" + q + "/" + name
+		if local := filepath.Join(h.DataDir, filepath.FromSlash(key)); fileExists(local) {
+			segs[i] = local
+			continue
+		}
+		rc, err := h.Store.Open(key)
+		if err != nil {
+			return "", "", err
+		}
+		segs[i] = filepath.Join(work, fmt.Sprintf("seg_%03d%s", i, path.Ext(name)))
+		out, err := os.Create(segs[i])
+		if err == nil {
+			_, err = io.Copy(out, rc)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+		rc.Close()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	outPath := filepath.Join(work, "audio.flac")
+	if err := audio.ConcatSegments(segs, outPath); err != nil {
+		return "", "", err
+	}
+	return outPath, q, nil
+}
+
+func copyToZip(zw *zip.Writer, name string, src io.Reader, method uint16) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// ImportArchive recreates the tracks and playlists of the archive at archivePath
+// under ownerID. Playlists whose room code is already taken are skipped.
+func (h *LibraryHandlers) ImportArchive(ownerID int64, archivePath string) (*ImportReport, error) {
+	zr, m, err := openArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return h.importArchive(ownerID, zr, m, nil)
+}
+
+// openArchive opens archivePath and reads its manifest.
+func openArchive(archivePath string) (*zip.ReadCloser, *archiveManifest, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, nil, &ingestError{Msg: "无效的归档文件", Code: 400, Err: err}
+	}
+	var mf *zip.File
+	for _, f := range zr.File {
+		if f.Name == "manifest.json" {
+			mf = f
+		}
+	}
+	if mf == nil {
+		zr.Close()
+		return nil, nil, &ingestError{Msg: "归档缺少 manifest.json", Code: 400}
+	}
+	var m archiveManifest
+	if err := readZipJSON(mf, &m); err != nil {
+		zr.Close()
+		return nil, nil, &ingestError{Msg: "manifest.json 格式错误", Code: 400, Err: err}
+	}
+	if m.Version != archiveVersion {
+		zr.Close()
+		return nil, nil, &ingestError{Msg: fmt.Sprintf("不支持的归档版本 %d", m.Version), Code: 400}
+	}
+	return zr, &m, nil
+}
+
+// importArchive imports an opened archive. progress, if set, is called before
+// each track with the number of tracks done so far.
+func (h *LibraryHandlers) importArchive(ownerID int64, zr *zip.ReadCloser, m *archiveManifest, progress func(done int, current string)) (*ImportReport, error) {
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	tmp, err := os.MkdirTemp("", "lt-import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	report := &ImportReport{Imported: []ImportedTrack{}, Failed: []ImportFailure{}, Playlists: []string{}, SkippedPlaylists: []string{}}
+	idMap := map[int64]int64{}
+	for i, t := range m.Tracks {
+		if progress != nil {
+			progress(i, t.Title)
+		}
+		af, err := h.importTrack(ownerID, entries, tmp, t)
+		if err != nil {
+			report.Failed = append(report.Failed, ImportFailure{SourceID: t.ID, Title: t.Title, Error: err.Error()})
+			continue
+		}
+		idMap[t.ID] = af.ID
+		report.Imported = append(report.Imported, ImportedTrack{SourceID: t.ID, ID: af.ID, Title: af.Title})
+	}
+
+	for _, ap := range m.Playlists {
+		if ap.RoomCode == "" {
+			continue
+		}
+		if _, err := h.DB.GetPlaylistByRoom(ap.RoomCode); err == nil {
+			report.SkippedPlaylists = append(report.SkippedPlaylists, ap.RoomCode)
+			continue
+		}
+		pl, err := h.DB.CreatePlaylist(ap.RoomCode, ownerID)
+		if err != nil {
+			report.SkippedPlaylists = append(report.SkippedPlaylists, ap.RoomCode)
+			continue
+		}
+		if ap.PlayMode != "" {
+			h.DB.UpdatePlayMode(pl.ID, ap.PlayMode)
+		}
+		for _, src := range ap.Tracks {
+			if id, ok := idMap[src]; ok {
+				h.DB.AddPlaylistItem(pl.ID, id, 0)
+			}
+		}
+		report.Playlists = append(report.Playlists, ap.RoomCode)
+	}
+	return report, nil
+}
+
+func (h *LibraryHandlers) importTrack(ownerID int64, entries map[string]*zip.File, tmp string, t archiveTrack) (*db.AudioFile, error) {
+	af := entries[t.Audio]
+	if af == nil {
+		return nil, fmt.Errorf("missing %s", t.Audio)
+	}
+	over := trackMeta{Title: t.Title, Artist: t.Artist, Album: t.Album, Genre: t.Genre, Year: t.Year}
+	if f := entries[t.Lyrics]; t.Lyrics != "" && f != nil {
+		data, err := readZipFile(f, maxLyricsSize)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Lyrics, err)
+		}
+		over.Lyrics = string(data)
+	}
+	if f := entries[t.Cover]; t.Cover != "" && f != nil {
+		over.CoverPath = filepath.Join(tmp, fmt.Sprintf("cover_%d.jpg", t.ID))
+		if err := extractZipFile(f, over.CoverPath, maxUploadSize); err != nil {
+			return nil, fmt.Errorf("%s: %w", t.Cover, err)
+		}
+	}
+
+	// Keep the original name but with the extension of the audio actually shipped.
+	name := t.OriginalName
+	if name == "" {
+		name = t.Title
+	}
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + path.Ext(t.Audio)
+
+	rc, err := af.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return h.ingestTrack(ownerID, rc, name, trackMeta{}, over)
+}
+
+// errEntryTooLarge is returned for archive entries over their size limit,
+// rather than importing a truncated copy.
+var errEntryTooLarge = errors.New("归档条目过大")
+
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, errEntryTooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errEntryTooLarge
+	}
+	return data, nil
+}
+
+func readZipJSON(f *zip.File, v interface{}) error {
+	data, err := readZipFile(f, 64<<20)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func extractZipFile(f *zip.File, dst string, limit int64) error {
+	if f.UncompressedSize64 > uint64(limit) {
+		return errEntryTooLarge
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	// The header size can lie; copy one byte past the limit to catch that
+	n, err := io.Copy(out, io.LimitReader(rc, limit+1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > limit {
+		err = errEntryTooLarge
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportLibrary streams the caller's library as a zip archive.
+// GET /api/library/export?tier=original|lossless|high|medium|low
+func (h *LibraryHandlers) ExportLibrary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	tier := r.URL.Query().Get("tier")
+	if tier == "" {
+		tier = TierOriginal
+	}
+	if tier != TierOriginal && !containsString(tierPreference, tier) {
+		jsonError(w, "无效的音质", 400)
+		return
+	}
+
+	name := fmt.Sprintf("library-%s-%s.zip", user.Username, time.Now().Format("20060102"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if err := h.ExportArchive(user.UserID, tier, w); err != nil {
+		// Headers are already sent; the truncated zip will fail to open.
+		log.Printf("export library for user %d: %v", user.UserID, err)
+	}
+}
+
+// ImportJob tracks a library archive import started from the API.
+type ImportJob struct {
+	ID         string        `json:"id"`
+	OwnerID    int64         `json:"-"`
+	Total      int           `json:"total"`
+	Done       int           `json:"done"`
+	Current    string        `json:"current,omitempty"`
+	Running    bool          `json:"running"`
+	Error      string        `json:"error,omitempty"`
+	Report     *ImportReport `json:"report,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+// ImportLibrary starts importing a library archive into the caller's library.
+// POST /api/library/import (raw zip body, or multipart field "archive")
+// The archive is checked and saved, then imported in the background; poll
+// GET /api/library/import/{jobID} for progress and the report.
+func (h *LibraryHandlers) ImportLibrary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := h.requireAdmin(r)
+	if user == nil {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var src io.Reader = r.Body
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "multipart/form-data" {
+		mr, err := r.MultipartReader()
+		if err != nil {
+			jsonError(w, "读取文件失败", 400)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				jsonError(w, "缺少 archive 文件", 400)
+				return
+			}
+			if part.FormName() == "archive" {
+				src = part
+				break
+			}
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "lt-import-*.zip")
+	if err != nil {
+		jsonError(w, "保存文件失败", 500)
+		return
+	}
+	_, err = io.Copy(tmp, src)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		jsonError(w, "读取文件失败", 400)
+		return
+	}
+
+	zr, m, err := openArchive(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		writeIngestError(w, err)
+		return
+	}
+
+	job := &ImportJob{ID: uuid.New().String(), OwnerID: user.UserID, Total: len(m.Tracks), Running: true, StartedAt: time.Now()}
+	h.jobsMu.Lock()
+	if h.importJobs == nil {
+		h.importJobs = make(map[string]*ImportJob)
+	}
+	h.importJobs[job.ID] = job
+	snapshot := *job
+	h.jobsMu.Unlock()
+
+	h.bg.Add(1)
+	go func() {
+		defer h.bg.Done()
+		defer os.Remove(tmp.Name())
+		defer zr.Close()
+		h.runImport(job, zr, m)
+	}()
+	jsonOK(w, snapshot)
+}
+
+func (h *LibraryHandlers) runImport(job *ImportJob, zr *zip.ReadCloser, m *archiveManifest) {
+	report, err := h.importArchive(job.OwnerID, zr, m, func(done int, current string) {
+		h.jobsMu.Lock()
+		job.Done, job.Current = done, current
+		h.jobsMu.Unlock()
+	})
+	h.jobsMu.Lock()
+	now := time.Now()
+	job.Done, job.Current, job.Running, job.FinishedAt = job.Total, "", false, &now
+	job.Report = report
+	if err != nil {
+		job.Error = err.Error()
+	}
+	h.jobsMu.Unlock()
+	if err != nil {
+		log.Printf("import job %s failed: %v", job.ID, err)
+	} else {
+		log.Printf("import job %s finished: %d imported, %d failed", job.ID, len(report.Imported), len(report.Failed))
+	}
+}
+
+// GetImportJob handles GET /api/library/import/{jobID}. Jobs are only visible
+// to the user who started them.
+func (h *LibraryHandlers) GetImportJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/library/import/"), "/")
+
+	h.jobsMu.Lock()
+	job, ok := h.importJobs[id]
+	var snapshot ImportJob
+	if ok {
+		snapshot = *job
+	}
+	h.jobsMu.Unlock()
+	if !ok || snapshot.OwnerID != user.UserID {
+		jsonError(w, "任务不存在", 404)
+		return
+	}
+	jsonOK(w, snapshot)
+}
@@ -0,0 +1,118 @@
+package library
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// fileSorters maps the ListFiles "sort" parameter to an ascending comparison.
+var fileSorters = map[string]func(a, b *db.AudioFile) bool{
+	"title":      func(a, b *db.AudioFile) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) },
+	"artist":     func(a, b *db.AudioFile) bool { return strings.ToLower(a.Artist) < strings.ToLower(b.Artist) },
+	"album":      func(a, b *db.AudioFile) bool { return strings.ToLower(a.Album) < strings.ToLower(b.Album) },
+	"duration":   func(a, b *db.AudioFile) bool { return a.Duration < b.Duration },
+	"created_at": func(a, b *db.AudioFile) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"bpm":        func(a, b *db.AudioFile) bool { return a.BPM < b.BPM },
+	"key":        func(a, b *db.AudioFile) bool { return audio.CamelotSortKey(a.Key) < audio.CamelotSortKey(b.Key) },
+	"rating": func(a, b *db.AudioFile) bool {
+		if a.AvgRating != b.AvgRating {
+			return a.AvgRating < b.AvgRating
+		}
+		return a.RatingCount < b.RatingCount
+	},
+	"favorites":   func(a, b *db.AudioFile) bool { return a.FavoriteCount < b.FavoriteCount },
+	"my_rating":   func(a, b *db.AudioFile) bool { return a.MyRating < b.MyRating },
+	"plays":       func(a, b *db.AudioFile) bool { return a.PlayCount < b.PlayCount },
+	"skips":       func(a, b *db.AudioFile) bool { return a.SkipCount < b.SkipCount },
+	"last_played": func(a, b *db.AudioFile) bool { return a.LastPlayedAt < b.LastPlayedAt },
+}
+
+// filterAudioFiles applies the ListFiles search filters and sort order.
+// Supported parameters: q, bpm_min, bpm_max, key (e.g. "Am" or "8A"), favorite
+// (true), min_rating, idle_days (not played in that many days), sort, order (asc|desc). Rating filters and sorts need
+// FillTrackStats to have run first.
+func filterAudioFiles(files []*db.AudioFile, q url.Values) ([]*db.AudioFile, error) {
+	bpmMin, err := parseFloatParam(q, "bpm_min")
+	if err != nil {
+		return nil, err
+	}
+	bpmMax, err := parseFloatParam(q, "bpm_max")
+	if err != nil {
+		return nil, err
+	}
+	minRating, err := parseFloatParam(q, "min_rating")
+	if err != nil {
+		return nil, err
+	}
+	idleDays, err := parseFloatParam(q, "idle_days")
+	if err != nil {
+		return nil, err
+	}
+	var playedBefore int64
+	if idleDays > 0 {
+		playedBefore = time.Now().Add(-time.Duration(idleDays * 24 * float64(time.Hour))).Unix()
+	}
+	favOnly := q.Get("favorite") == "true"
+	search := strings.ToLower(strings.TrimSpace(q.Get("q")))
+	key := strings.TrimSpace(q.Get("key"))
+
+	out := files[:0]
+	for _, f := range files {
+		if bpmMin > 0 && f.BPM < bpmMin {
+			continue
+		}
+		if bpmMax > 0 && (f.BPM == 0 || f.BPM > bpmMax) {
+			continue
+		}
+		if key != "" && !strings.EqualFold(f.Key, key) && !strings.EqualFold(audio.CamelotCode(f.Key), key) {
+			continue
+		}
+		if playedBefore > 0 && f.LastPlayedAt >= playedBefore {
+			continue
+		}
+		if favOnly && !f.Favorite {
+			continue
+		}
+		if minRating > 0 && f.AvgRating < minRating {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(f.Title+"\x00"+f.Artist+"\x00"+f.Album), search) {
+			continue
+		}
+		out = append(out, f)
+	}
+
+	if by := q.Get("sort"); by != "" {
+		less, ok := fileSorters[by]
+		if !ok {
+			return nil, fmt.Errorf("不支持的排序字段: %s", by)
+		}
+		desc := q.Get("order") == "desc"
+		sort.SliceStable(out, func(i, j int) bool {
+			if desc {
+				return less(out[j], out[i])
+			}
+			return less(out[i], out[j])
+		})
+	}
+	return out, nil
+}
+
+func parseFloatParam(q url.Values, name string) (float64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return f, nil
+}
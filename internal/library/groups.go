@@ -0,0 +1,219 @@
+package library
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+const maxGroupNameLen = 64
+
+// canManageGroup reports whether user may change a group's members: group
+// admins and the site owner can.
+func canManageGroup(g *db.Group, user *auth.UserInfo) bool {
+	return g.MyRole == db.GroupAdmin || user.Role == "owner"
+}
+
+// canUseGroup reports whether user may target a group with a share or invite.
+func canUseGroup(g *db.Group, user *auth.UserInfo) bool {
+	return g.MyRole != "" || user.Role == "owner"
+}
+
+// Groups handles /api/groups: GET lists the caller's groups (every group for
+// the site owner), POST {"name": "..."} creates one with the caller as admin.
+func (h *LibraryHandlers) Groups(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var groups []*db.Group
+		var err error
+		if user.Role == "owner" {
+			groups, err = h.DB.GetAllGroups(user.UserID)
+		} else {
+			groups, err = h.DB.GetUserGroups(user.UserID)
+		}
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		if groups == nil {
+			groups = []*db.Group{}
+		}
+		jsonOK(w, groups)
+	case http.MethodPost:
+		if h.requireAdmin(r) == nil {
+			jsonError(w, "forbidden", 403)
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len([]rune(req.Name)) > maxGroupNameLen {
+			jsonError(w, "群组名称无效", 400)
+			return
+		}
+		g, err := h.DB.CreateGroup(req.Name, user.UserID)
+		if err != nil {
+			jsonError(w, "群组名称已存在", 409)
+			return
+		}
+		jsonOK(w, g)
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// Group handles a single group:
+//
+//	GET    /api/groups/{id}                 group and members (members only)
+//	DELETE /api/groups/{id}                 delete (group admin)
+//	POST   /api/groups/{id}/members         {"user_uid": 10001, "role": "member"}
+//	PUT    /api/groups/{id}/members/{uid}   {"role": "admin"}
+//	DELETE /api/groups/{id}/members/{uid}   remove (group admin, or yourself to leave)
+func (h *LibraryHandlers) Group(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/groups/"), "/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	g, err := h.DB.GetGroup(id, user.UserID)
+	if err != nil {
+		jsonError(w, "群组不存在", 404)
+		return
+	}
+	if !canUseGroup(g, user) {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		members, _ := h.DB.GetGroupMembers(g.ID)
+		if members == nil {
+			members = []*db.GroupMemberInfo{}
+		}
+		jsonOK(w, map[string]interface{}{"group": g, "members": members})
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !canManageGroup(g, user) {
+			jsonError(w, "forbidden", 403)
+			return
+		}
+		if err := h.DB.DeleteGroup(g.ID); err != nil {
+			jsonError(w, "删除失败", 500)
+			return
+		}
+		jsonOK(w, map[string]string{"message": "ok"})
+	case len(parts) == 2 && parts[1] == "members" && r.Method == http.MethodPost:
+		var req struct {
+			UserUID int64  `json:"user_uid"`
+			Role    string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		h.setGroupMember(w, g, user, req.UserUID, req.Role)
+	case len(parts) == 3 && parts[1] == "members":
+		uid, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			jsonError(w, "invalid uid", 400)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var req struct {
+				Role string `json:"role"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				jsonError(w, "invalid request", 400)
+				return
+			}
+			h.setGroupMember(w, g, user, uid, req.Role)
+		case http.MethodDelete:
+			h.removeGroupMember(w, g, user, uid)
+		default:
+			jsonError(w, "method not allowed", 405)
+		}
+	default:
+		jsonError(w, "not found", 404)
+	}
+}
+
+func (h *LibraryHandlers) setGroupMember(w http.ResponseWriter, g *db.Group, user *auth.UserInfo, uid int64, role string) {
+	if !canManageGroup(g, user) {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	if role == "" {
+		role = db.GroupMember
+	}
+	if role != db.GroupMember && role != db.GroupAdmin {
+		jsonError(w, "无效的角色", 400)
+		return
+	}
+	target, err := h.DB.GetUserByUID(uid)
+	if err != nil {
+		jsonError(w, "用户不存在", 404)
+		return
+	}
+	if role == db.GroupMember && h.isLastGroupAdmin(g.ID, target.ID) {
+		jsonError(w, "群组至少需要一名管理员", 400)
+		return
+	}
+	if err := h.DB.SetGroupMember(g.ID, target.ID, role); err != nil {
+		jsonError(w, "操作失败", 500)
+		return
+	}
+	jsonOK(w, map[string]string{"message": "ok"})
+}
+
+func (h *LibraryHandlers) removeGroupMember(w http.ResponseWriter, g *db.Group, user *auth.UserInfo, uid int64) {
+	target, err := h.DB.GetUserByUID(uid)
+	if err != nil {
+		jsonError(w, "用户不存在", 404)
+		return
+	}
+	if target.ID != user.UserID && !canManageGroup(g, user) {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	if h.isLastGroupAdmin(g.ID, target.ID) {
+		jsonError(w, "群组至少需要一名管理员", 400)
+		return
+	}
+	if err := h.DB.RemoveGroupMember(g.ID, target.ID); err != nil {
+		jsonError(w, "操作失败", 500)
+		return
+	}
+	jsonOK(w, map[string]string{"message": "ok"})
+}
+
+// isLastGroupAdmin reports whether userID is the only admin of the group.
+func (h *LibraryHandlers) isLastGroupAdmin(groupID, userID int64) bool {
+	members, _ := h.DB.GetGroupMembers(groupID)
+	for _, m := range members {
+		if m.UserID == userID {
+			return m.Role == db.GroupAdmin && h.DB.CountGroupAdmins(groupID) == 1
+		}
+	}
+	return false
+}
@@ -3,21 +3,24 @@ package library
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/xingzihai/listen-together/internal/audio"
 	"github.com/xingzihai/listen-together/internal/auth"
 	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/lyrics"
 	"github.com/xingzihai/listen-together/internal/room"
+	"github.com/xingzihai/listen-together/internal/storage"
 )
 
 const maxUploadSize = 50 << 20 // 50MB
@@ -26,6 +29,35 @@ type LibraryHandlers struct {
 	DB      *db.DB
 	DataDir string
 	Manager *room.Manager
+	Store   storage.Store
+	// OnTrackAdded, if set, is called after a track is uploaded or imported.
+	OnTrackAdded func(af *db.AudioFile)
+
+	jobsMu     sync.Mutex
+	jobs       map[string]*RetranscodeJob
+	activeJob  *RetranscodeJob
+	importJobs map[string]*ImportJob
+
+	bg sync.WaitGroup // background finalization of ingested tracks
+
+	watchMu     sync.Mutex
+	watchKick   chan struct{}
+	watchStatus WatchStatus
+}
+
+// Wait blocks until background work started by ingests has finished.
+func (h *LibraryHandlers) Wait() {
+	h.bg.Wait()
+}
+
+// JSONError and JSONOK write responses in the API's JSON format, for
+// handlers outside this package.
+func JSONError(w http.ResponseWriter, msg string, code int) {
+	jsonError(w, msg, code)
+}
+
+func JSONOK(w http.ResponseWriter, v interface{}) {
+	jsonOK(w, v)
 }
 
 func jsonError(w http.ResponseWriter, msg string, code int) {
@@ -121,113 +153,9 @@ func (h *LibraryHandlers) Upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-
-	// Extension whitelist
-	allowedExts := map[string]bool{
-		".mp3": true, ".flac": true, ".wav": true, ".m4a": true, ".ogg": true,
-		".aac": true, ".wma": true, ".opus": true, ".ape": true, ".aif": true, ".aiff": true,
-	}
-	if !allowedExts[ext] {
-		jsonError(w, "不支持的文件格式", 400)
-		return
-	}
-
-	// Magic bytes validation (real check, not just http.DetectContentType)
-	buf := make([]byte, 512)
-	n, err := file.Read(buf)
-	if err != nil && err != io.EOF {
-		jsonError(w, "读取文件失败", 400)
-		return
-	}
-	if !isAudioMagic(buf[:n]) {
-		jsonError(w, "文件内容与音频格式不匹配", 400)
-		return
-	}
-	// Seek back to start after reading magic bytes
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		jsonError(w, "读取文件失败", 400)
-		return
-	}
-	audioID := uuid.New().String()
-	userDir := filepath.Join(h.DataDir, "library", strconv.FormatInt(user.UserID, 10))
-	audioDir := filepath.Join(userDir, audioID)
-	os.MkdirAll(audioDir, 0755)
-	originalName := "original" + ext
-	storedPath := filepath.Join(audioDir, originalName)
-
-	out, err := os.Create(storedPath)
-	if err != nil {
-		jsonError(w, "保存文件失败", 500)
-		return
-	}
-	written, err := io.Copy(out, file)
-	out.Close()
+	af, err := h.ingestTrack(user.UserID, file, header.Filename, trackMeta{Artist: r.FormValue("artist")}, trackMeta{})
 	if err != nil {
-		os.RemoveAll(audioDir)
-		jsonError(w, "保存文件失败", 500)
-		return
-	}
-
-	// Multi-quality segmentation
-	manifest, probe, err := audio.ProcessAudioMultiQuality(storedPath, audioDir, header.Filename)
-	if err != nil {
-		os.RemoveAll(audioDir)
-		jsonError(w, fmt.Sprintf("音频处理失败: %v", err), 500)
-		return
-	}
-
-	qualityNames := audio.QualityNames(probe)
-	qualitiesJSON, _ := json.Marshal(qualityNames)
-
-	title := strings.TrimSuffix(header.Filename, ext)
-	artist := r.FormValue("artist")
-	album := ""
-	genre := ""
-	year := ""
-	lyrics := ""
-
-	// Extract metadata from audio file tags
-	meta, err := audio.ExtractMetadata(storedPath)
-	if err == nil {
-		if meta.Title != "" {
-			title = meta.Title
-		}
-		if meta.Artist != "" {
-			artist = meta.Artist
-		}
-		if meta.Album != "" {
-			album = meta.Album
-		}
-		if meta.Genre != "" {
-			genre = meta.Genre
-		}
-		if meta.Year != "" {
-			year = meta.Year
-		}
-		if meta.Lyrics != "" {
-			lyrics = meta.Lyrics
-		}
-	}
-
-	// If no lyrics from format tags, try stream tags
-	if lyrics == "" {
-		if lrc, err := audio.ExtractLyrics(storedPath); err == nil && lrc != "" {
-			lyrics = lrc
-		}
-	}
-
-	// Extract cover art
-	coverArt := ""
-	coverPath := filepath.Join(audioDir, "cover.jpg")
-	if err := audio.ExtractCoverArt(storedPath, coverPath); err == nil {
-		coverArt = "cover.jpg"
-	}
-
-	af, err := h.DB.AddAudioFile(user.UserID, audioID, header.Filename, title, artist, album, genre, year, lyrics, manifest.Duration, written, probe.Format, probe.Bitrate, string(qualitiesJSON), coverArt)
-	if err != nil {
-		os.RemoveAll(audioDir)
-		jsonError(w, "保存记录失败", 500)
+		writeIngestError(w, err)
 		return
 	}
 	jsonOK(w, af)
@@ -269,9 +197,16 @@ func (h *LibraryHandlers) ListFiles(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "查询失败", 500)
 		return
 	}
+	h.DB.FillTrackStats(files, user.UserID)
+	files, err = filterAudioFiles(files, r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
 	if files == nil {
 		files = []*db.AudioFile{}
 	}
+	h.withProcessing(files)
 	jsonOK(w, files)
 }
 
@@ -308,8 +243,15 @@ func (h *LibraryHandlers) DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	diskPath := filepath.Join(h.DataDir, "library", strconv.FormatInt(af.OwnerID, 10), af.Filename)
+	diskPath := trackDir(h.DataDir, af)
 	os.RemoveAll(diskPath)
+	audio.ClearTierStatus(diskPath)
+	h.dropStreamCache(af.ID)
+	if !h.Store.Local() {
+		if err := h.Store.DeletePrefix(trackKey(af)); err != nil {
+			log.Printf("delete %s from store: %v", trackKey(af), err)
+		}
+	}
 
 	jsonOK(w, map[string]string{"message": "ok"})
 }
@@ -327,12 +269,31 @@ func (h *LibraryHandlers) Share(w http.ResponseWriter, r *http.Request) {
 
 	var req struct {
 		SharedWithUID int64 `json:"shared_with_uid"`
+		GroupID       int64 `json:"group_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		jsonError(w, "invalid request", 400)
 		return
 	}
 
+	if req.GroupID != 0 {
+		g, err := h.DB.GetGroup(req.GroupID, user.UserID)
+		if err != nil {
+			jsonError(w, "群组不存在", 404)
+			return
+		}
+		if !canUseGroup(g, user) {
+			jsonError(w, "只能共享给自己所在的群组", 403)
+			return
+		}
+		if err := h.DB.ShareLibraryWithGroup(user.UserID, g.ID); err != nil {
+			jsonError(w, "共享失败", 500)
+			return
+		}
+		jsonOK(w, map[string]string{"message": "ok"})
+		return
+	}
+
 	target, err := h.DB.GetUserByUID(req.SharedWithUID)
 	if err != nil {
 		jsonError(w, "用户不存在", 404)
@@ -366,6 +327,20 @@ func (h *LibraryHandlers) Unshare(w http.ResponseWriter, r *http.Request) {
 	}
 
 	uidStr := strings.TrimPrefix(r.URL.Path, "/api/library/share/")
+	// /api/library/share/group/{groupID}
+	if gidStr, ok := strings.CutPrefix(uidStr, "group/"); ok {
+		gid, err := strconv.ParseInt(gidStr, 10, 64)
+		if err != nil {
+			jsonError(w, "invalid group id", 400)
+			return
+		}
+		if err := h.DB.UnshareLibraryWithGroup(user.UserID, gid); err != nil {
+			jsonError(w, "取消共享失败", 500)
+			return
+		}
+		jsonOK(w, map[string]string{"message": "ok"})
+		return
+	}
 	uid, err := strconv.ParseInt(uidStr, 10, 64)
 	if err != nil {
 		jsonError(w, "invalid uid", 400)
@@ -397,17 +372,24 @@ func (h *LibraryHandlers) ListShares(w http.ResponseWriter, r *http.Request) {
 	}
 
 	myShares, _ := h.DB.GetMyShares(user.UserID)
+	myGroupShares, _ := h.DB.GetMyGroupShares(user.UserID)
 	sharedWithMe, _ := h.DB.GetSharedLibraries(user.UserID)
+	viaGroups, _ := h.DB.GetGroupSharedLibraries(user.UserID)
+	sharedWithMe = append(sharedWithMe, viaGroups...)
 	if myShares == nil {
 		myShares = []*db.LibraryShare{}
 	}
+	if myGroupShares == nil {
+		myGroupShares = []*db.LibraryShare{}
+	}
 	if sharedWithMe == nil {
 		sharedWithMe = []*db.LibraryShare{}
 	}
 
 	jsonOK(w, map[string]interface{}{
-		"my_shares":      myShares,
-		"shared_with_me": sharedWithMe,
+		"my_shares":       myShares,
+		"my_group_shares": myGroupShares,
+		"shared_with_me":  sharedWithMe,
 	})
 }
 
@@ -451,27 +433,22 @@ func (h *LibraryHandlers) GetSegments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	audioDir := filepath.Join(h.DataDir, "library", strconv.FormatInt(af.OwnerID, 10), af.Filename)
-	manifestPath := filepath.Join(audioDir, "manifest.json")
-	data, err := os.ReadFile(manifestPath)
+	manifest, err := h.loadManifest(af)
 	if err != nil {
 		jsonError(w, "manifest not found", 404)
 		return
 	}
 
-	var manifest audio.MultiQualityManifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
-		jsonError(w, "invalid manifest", 500)
-		return
-	}
-
 	qi, ok := manifest.Qualities[quality]
 	if !ok {
 		jsonError(w, "quality not available", 404)
 		return
 	}
 
+	exp := time.Now().Add(auth.SegmentTokenTTL() + time.Duration(manifest.Duration*float64(time.Second)))
 	jsonOK(w, map[string]interface{}{
+		"segment_token": auth.SignSegmentToken(af.OwnerID, af.Filename, exp),
+		"token_expires": exp.Unix(),
 		"quality":      quality,
 		"format":       qi.Format,
 		"bitrate":      qi.Bitrate,
@@ -490,6 +467,48 @@ func (h *LibraryHandlers) GetSegments(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// GetWaveform returns the precomputed waveform peaks for an audio file.
+// GET /api/library/files/{id}/waveform
+func (h *LibraryHandlers) GetWaveform(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/library/files/")
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) != 2 || parts[1] != "waveform" {
+		jsonError(w, "invalid path", 400)
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+
+	af, err := h.DB.GetAudioFileByID(id)
+	if err != nil {
+		jsonError(w, "not found", 404)
+		return
+	}
+
+	canAccess, _ := h.DB.CanAccessAudioFile(user.UserID, id)
+	if !canAccess && (h.Manager == nil || !h.Manager.IsUserInRoomWithAudio(user.UserID, id)) {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("Content-Type", "application/json")
+	h.serveObject(w, r, trackKey(af)+"/"+audio.WaveformFile)
+}
+
 // ServeSegmentFile serves a segment file.
 // GET /api/library/segments/{userID}/{audioID}/{quality}/{filename}
 func (h *LibraryHandlers) ServeSegmentFile(w http.ResponseWriter, r *http.Request) {
@@ -541,8 +560,41 @@ func (h *LibraryHandlers) ServeSegmentFile(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Use DB owner ID for path, not URL parameter (prevent path manipulation)
-	ownerIDStr := strconv.FormatInt(af.OwnerID, 10)
-	filePath := filepath.Join(h.DataDir, "library", ownerIDStr, audioID, "segments_"+quality, filename)
+	h.sendSegment(w, r, trackKey(af)+"/segments_"+quality+"/"+filename, quality, filename)
+}
+
+// ServeSignedSegment serves a segment authorised by an ?st= token instead of a
+// session, without touching the database. Invalid or expired tokens fall back
+// to the regular session check.
+// GET /api/library/segments/{userID}/{audioID}/{quality}/{filename}?st=...
+func (h *LibraryHandlers) ServeSignedSegment(w http.ResponseWriter, r *http.Request, fallback http.HandlerFunc) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/library/segments/"), "/")
+	if len(parts) != 4 {
+		http.NotFound(w, r)
+		return
+	}
+	ownerID, err := strconv.ParseInt(parts[0], 10, 64)
+	audioID, quality, filename := parts[1], parts[2], parts[3]
+	validQ := map[string]bool{"lossless": true, "high": true, "medium": true, "low": true}
+	if err != nil || !validQ[quality] || !segmentNameRe.MatchString(filename) || strings.ContainsAny(audioID, `./\`) {
+		http.NotFound(w, r)
+		return
+	}
+	if !auth.VerifySegmentToken(r.URL.Query().Get("st"), ownerID, audioID) {
+		fallback(w, r)
+		return
+	}
+	h.sendSegment(w, r, path.Join("library", parts[0], audioID, "segments_"+quality, filename), quality, filename)
+}
+
+// segmentNameRe matches segment files written by the audio package.
+var segmentNameRe = regexp.MustCompile(`^seg_\d{3,}\.(flac|m4a|webm)$`)
+
+// sendSegment writes a segment response. With SEGMENT_ACCEL_PREFIX set (e.g.
+// "/_segments/"), the body is left to nginx via X-Accel-Redirect; the prefix
+// must map to an internal location rooted at the data directory, so it only
+// applies to the local store.
+func (h *LibraryHandlers) sendSegment(w http.ResponseWriter, r *http.Request, key, quality, filename string) {
 	w.Header().Set("Cache-Control", "public, max-age=31536000")
 	if quality == "lossless" {
 		w.Header().Set("Content-Type", "audio/flac")
@@ -551,7 +603,11 @@ func (h *LibraryHandlers) ServeSegmentFile(w http.ResponseWriter, r *http.Reques
 	} else {
 		w.Header().Set("Content-Type", "audio/mp4")
 	}
-	http.ServeFile(w, r, filePath)
+	if prefix := os.Getenv("SEGMENT_ACCEL_PREFIX"); prefix != "" && h.Store.Local() {
+		w.Header().Set("X-Accel-Redirect", strings.TrimSuffix(prefix, "/")+"/"+key)
+		return
+	}
+	h.serveObject(w, r, key)
 }
 
 // ServeCoverArt serves cover art for an audio file.
@@ -609,21 +665,12 @@ func (h *LibraryHandlers) ServeCoverArt(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Use DB owner ID for path, not URL parameter
-	ownerIDStr := strconv.FormatInt(af.OwnerID, 10)
-	filePath := filepath.Join(h.DataDir, "library", ownerIDStr, audioUUID, "cover.jpg")
-
-	// Verify file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.NotFound(w, r)
-		return
-	}
-
 	w.Header().Set("Cache-Control", "public, max-age=31536000")
 	w.Header().Set("Content-Type", "image/jpeg")
-	http.ServeFile(w, r, filePath)
+	h.serveObject(w, r, trackKey(af)+"/cover.jpg")
 }
 
-// GetLyrics returns plain text lyrics for an audio file.
+// GetLyrics returns plain text lyrics for an audio file, or the parsed timeline with ?format=json.
 // GET /api/library/lyrics/{userID}/{audioUUID}
 func (h *LibraryHandlers) GetLyrics(w http.ResponseWriter, r *http.Request) {
 	user := auth.GetUser(r)
@@ -651,12 +698,22 @@ func (h *LibraryHandlers) GetLyrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	canAccess, _ := h.DB.CanAccessAudioFile(user.UserID, af.ID)
-	if !canAccess && (h.Manager == nil || !h.Manager.IsUserInRoomWithAudio(user.UserID, af.ID)) {
+	if !h.lyricsAuthorized(user, af.ID) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
+	// ?format=json returns the parsed timeline (lines, word timings, translations)
+	if wantsJSON(r) {
+		timeline, _ := h.DB.GetLyricsTimeline(af.ID)
+		l := lyrics.Load(timeline, af.Lyrics)
+		if l == nil {
+			l = &lyrics.Lyrics{Format: "text", Lines: []lyrics.Line{}}
+		}
+		jsonOK(w, l)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Write([]byte(af.Lyrics))
 }
@@ -670,20 +727,76 @@ func (h *LibraryHandlers) RegisterRoutes(mux *http.ServeMux) {
 
 	mux.HandleFunc("/api/library/upload", wrap(h.Upload))
 	mux.HandleFunc("/api/library/files", wrap(h.ListFiles))
-	mux.HandleFunc("/api/library/segments/", wrap(h.ServeSegmentFile))
+	mux.HandleFunc("/api/library/favorites", wrap(h.Favorites))
+	mux.HandleFunc("/api/library/ratings", wrap(h.Ratings))
+	mux.HandleFunc("/api/library/smart", wrap(h.SmartPlaylists))
+	mux.HandleFunc("/api/library/smart/", wrap(h.SmartPlaylist))
+	mux.HandleFunc("/api/library/export", wrap(h.ExportLibrary))
+	mux.HandleFunc("/api/library/import", wrap(h.ImportLibrary))
+	mux.HandleFunc("/api/library/import/", wrap(h.GetImportJob))
+	mux.HandleFunc("/api/library/segments/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("st") != "" {
+			h.ServeSignedSegment(w, r, wrap(h.ServeSegmentFile))
+			return
+		}
+		wrap(h.ServeSegmentFile)(w, r)
+	})
 	mux.HandleFunc("/api/library/cover/", wrap(h.ServeCoverArt))
 	mux.HandleFunc("/api/library/lyrics/", wrap(h.GetLyrics))
-	mux.HandleFunc("/api/library/files/", wrap(func(w http.ResponseWriter, r *http.Request) {
+	files := wrap(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/stream") {
+			h.GetStream(w, r)
+			return
+		}
 		if strings.Contains(path, "/segments/") {
 			h.GetSegments(w, r)
 			return
 		}
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/waveform") {
+			h.GetWaveform(w, r)
+			return
+		}
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/lyrics") {
+			h.UploadLyrics(w, r)
+			return
+		}
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/rating") || strings.HasSuffix(strings.TrimSuffix(path, "/"), "/favorite") {
+			h.TrackRating(w, r)
+			return
+		}
+		if strings.HasSuffix(strings.TrimSuffix(path, "/"), "/status") {
+			h.GetStatus(w, r)
+			return
+		}
 		h.DeleteFile(w, r)
-	}))
+	})
+	mux.HandleFunc("/api/library/files/", func(w http.ResponseWriter, r *http.Request) {
+		// Signed stream URLs (exported playlists) work without a session.
+		if strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/stream") {
+			h.ServeStream(w, r, files)
+			return
+		}
+		files(w, r)
+	})
 	mux.HandleFunc("/api/library/share", wrap(h.Share))
 	mux.HandleFunc("/api/library/share/", wrap(h.Unshare))
 	mux.HandleFunc("/api/library/shares", wrap(h.ListShares))
+	mux.HandleFunc("/api/groups", wrap(h.Groups))
+	mux.HandleFunc("/api/groups/", wrap(h.Group))
+	mux.HandleFunc("/api/library/shares/items", wrap(h.ItemShares))
+	mux.HandleFunc("/api/library/shares/items/", wrap(h.DeleteItemShare))
+	mux.HandleFunc("/api/library/links", wrap(h.ListenLinks))
+	mux.HandleFunc("/api/library/links/", wrap(h.DeleteListenLink))
+	// Listen links are public: the token is the credential.
+	mux.HandleFunc("/api/listen/", h.ServeListenLink)
+	mux.HandleFunc("/listen/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./web/static/listen.html")
+	})
+	mux.HandleFunc("/api/admin/library/retranscode", wrap(h.StartRetranscode))
+	mux.HandleFunc("/api/admin/library/retranscode/", wrap(h.GetRetranscodeJob))
+	mux.HandleFunc("/api/admin/library/watch", wrap(h.FolderWatch))
+	mux.HandleFunc("/api/admin/library/watch/scan", wrap(h.ScanFolderWatch))
 
 	// Serve library page
 	mux.HandleFunc("/library", func(w http.ResponseWriter, r *http.Request) {
@@ -1000,8 +1113,27 @@ func (h *PlaylistHandlers) RegisterRoutes(mux *http.ServeMux) {
 			h.Reorder(w, r)
 			return
 		}
+		// /api/room/{code}/playlist/export, /api/room/{code}/playlist/import
+		if strings.HasSuffix(path, "/playlist/export") {
+			h.ExportRoomPlaylist(w, r)
+			return
+		}
+		if strings.HasSuffix(path, "/playlist/import") {
+			h.ImportRoomPlaylist(w, r)
+			return
+		}
+		// /api/room/{code}/playlist/load
+		if strings.HasSuffix(path, "/playlist/load") {
+			h.LoadSmartPlaylist(w, r)
+			return
+		}
 		// /api/room/{code}/playlist/{item_id} (DELETE)
 		parts := strings.Split(strings.TrimPrefix(path, "/api/room/"), "/")
+		// /api/room/{code}/invites[/{id}]
+		if len(parts) >= 2 && parts[1] == "invites" {
+			h.RoomInvites(w, r)
+			return
+		}
 		if len(parts) >= 3 && parts[1] == "playlist" {
 			if r.Method == http.MethodDelete {
 				h.RemoveItem(w, r)
@@ -1015,6 +1147,9 @@ func (h *PlaylistHandlers) RegisterRoutes(mux *http.ServeMux) {
 		}
 		jsonError(w, "not found", 404)
 	}))
+	mux.HandleFunc("/api/rooms/invites", wrap(h.MyInvites))
+	mux.HandleFunc("/api/playlists", wrap(h.SavedPlaylists))
+	mux.HandleFunc("/api/playlists/", wrap(h.SavedPlaylists))
 }
 
 func extractRoomCode(path string) string {
@@ -0,0 +1,190 @@
+package library
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// allowedAudioExts is the upload extension whitelist.
+var allowedAudioExts = map[string]bool{
+	".mp3": true, ".flac": true, ".wav": true, ".m4a": true, ".ogg": true,
+	".aac": true, ".wma": true, ".opus": true, ".ape": true, ".aif": true, ".aiff": true,
+}
+
+// trackMeta carries metadata supplied alongside an audio file. Empty fields are ignored.
+type trackMeta struct {
+	Title, Artist, Album, Genre, Year string
+	Lyrics                            string
+	CoverPath                         string // cover image to use instead of extracting one
+}
+
+// ingestError carries the user-facing message and HTTP status for a failed ingest.
+type ingestError struct {
+	Msg  string
+	Code int
+	Err  error
+}
+
+func (e *ingestError) Error() string {
+	if e.Err != nil {
+		return e.Msg + ": " + e.Err.Error()
+	}
+	return e.Msg
+}
+
+func (e *ingestError) Unwrap() error { return e.Err }
+
+func writeIngestError(w http.ResponseWriter, err error) {
+	var ie *ingestError
+	if errors.As(err, &ie) {
+		jsonError(w, ie.Msg, ie.Code)
+		return
+	}
+	jsonError(w, err.Error(), 500)
+}
+
+// ingestTrack stores src as a new library track owned by ownerID: it validates
+// the format, segments it, reads tags, extracts cover art and records it in the
+// database. Tag values win over defaults; overrides win over tags.
+func (h *LibraryHandlers) ingestTrack(ownerID int64, src io.Reader, originalName string, defaults, overrides trackMeta) (*db.AudioFile, error) {
+	ext := strings.ToLower(filepath.Ext(originalName))
+
+	// Extension whitelist
+	if !allowedAudioExts[ext] {
+		return nil, &ingestError{Msg: "不支持的文件格式", Code: 400}
+	}
+
+	// Magic bytes validation (real check, not just http.DetectContentType)
+	br := bufio.NewReaderSize(src, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, &ingestError{Msg: "读取文件失败", Code: 400, Err: err}
+	}
+	if !isAudioMagic(head) {
+		return nil, &ingestError{Msg: "文件内容与音频格式不匹配", Code: 400}
+	}
+
+	audioID := uuid.New().String()
+	userDir := filepath.Join(h.DataDir, "library", strconv.FormatInt(ownerID, 10))
+	audioDir := filepath.Join(userDir, audioID)
+	os.MkdirAll(audioDir, 0755)
+	storedPath := filepath.Join(audioDir, "original"+ext)
+
+	out, err := os.Create(storedPath)
+	if err != nil {
+		return nil, &ingestError{Msg: "保存文件失败", Code: 500, Err: err}
+	}
+	written, err := io.Copy(out, br)
+	out.Close()
+	if err != nil {
+		os.RemoveAll(audioDir)
+		return nil, &ingestError{Msg: "保存文件失败", Code: 500, Err: err}
+	}
+
+	// Multi-quality segmentation
+	manifest, probe, err := audio.ProcessAudioMultiQuality(storedPath, audioDir, originalName)
+	if err != nil {
+		os.RemoveAll(audioDir)
+		return nil, &ingestError{Msg: fmt.Sprintf("音频处理失败: %v", err), Code: 500, Err: err}
+	}
+
+	qualityNames := audio.QualityNames(probe)
+	qualitiesJSON, _ := json.Marshal(qualityNames)
+
+	meta := trackMeta{Title: strings.TrimSuffix(originalName, filepath.Ext(originalName))}
+	meta.merge(defaults)
+
+	// Extract metadata from audio file tags
+	if tags, err := audio.ExtractMetadata(storedPath); err == nil {
+		meta.merge(trackMeta{Title: tags.Title, Artist: tags.Artist, Album: tags.Album, Genre: tags.Genre, Year: tags.Year, Lyrics: tags.Lyrics})
+	}
+
+	// If no lyrics from format tags, try stream tags
+	if meta.Lyrics == "" {
+		if lrc, err := audio.ExtractLyrics(storedPath); err == nil && lrc != "" {
+			meta.Lyrics = lrc
+		}
+	}
+	meta.merge(overrides)
+
+	// Cover art: supplied file, else extracted from the audio
+	coverArt := ""
+	coverPath := filepath.Join(audioDir, "cover.jpg")
+	if meta.CoverPath != "" {
+		if copyFile(meta.CoverPath, coverPath) == nil {
+			coverArt = "cover.jpg"
+		}
+	} else if err := audio.ExtractCoverArt(storedPath, coverPath); err == nil {
+		coverArt = "cover.jpg"
+	}
+
+	af, err := h.DB.AddAudioFile(ownerID, audioID, originalName, meta.Title, meta.Artist, meta.Album, meta.Genre, meta.Year, meta.Lyrics, manifest.Duration, written, probe.Format, probe.Bitrate, string(qualitiesJSON), coverArt)
+	if err != nil {
+		os.RemoveAll(audioDir)
+		return nil, &ingestError{Msg: "保存记录失败", Code: 500, Err: err}
+	}
+	if meta.Lyrics != "" {
+		h.storeLyricsTimeline(af.ID, meta.Lyrics)
+	}
+	if a := manifest.Analysis; a != nil {
+		if err := h.DB.SetAudioAnalysis(af.ID, a.BPM, a.Key, a.LeadingSilence, a.EffectiveEnd); err == nil {
+			af.BPM, af.Key, af.LeadingSilence, af.EffectiveEnd = a.BPM, a.Key, a.LeadingSilence, a.EffectiveEnd
+		}
+	}
+	h.bg.Add(1)
+	go func() {
+		defer h.bg.Done()
+		finalizeTrack(h.Store, h.DataDir, audioDir, storedPath, manifest, qualityNames)
+	}()
+	af.Processing = audio.TierStatuses(audioDir)
+	log.Printf("ingested %q for user %d as %s", originalName, ownerID, audioID)
+	if h.OnTrackAdded != nil {
+		h.OnTrackAdded(af)
+	}
+	return af, nil
+}
+
+// merge copies the non-empty fields of o into m.
+func (m *trackMeta) merge(o trackMeta) {
+	for _, f := range []struct {
+		dst *string
+		src string
+	}{
+		{&m.Title, o.Title}, {&m.Artist, o.Artist}, {&m.Album, o.Album}, {&m.Genre, o.Genre},
+		{&m.Year, o.Year}, {&m.Lyrics, o.Lyrics}, {&m.CoverPath, o.CoverPath},
+	} {
+		if f.src != "" {
+			*f.dst = f.src
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,138 @@
+package library
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Room invites let a room owner point users, or whole groups, at their room.
+// Rooms stay joinable by code; invites only make the room show up for the
+// invitees while it exists.
+
+// RoomInvites handles the invites of one room (room owner only):
+//
+//	GET    /api/room/{code}/invites
+//	POST   /api/room/{code}/invites       {"user_uid": 10001} or {"group_id": 3}
+//	DELETE /api/room/{code}/invites/{id}
+func (h *PlaylistHandlers) RoomInvites(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/room/"), "/"), "/")
+	code := parts[0]
+	if !h.isRoomOwner(user.UserID, code) {
+		jsonError(w, "只有房主可以管理邀请", 403)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		invites, _ := h.DB.GetRoomInvites(code)
+		if invites == nil {
+			invites = []*db.RoomInvite{}
+		}
+		jsonOK(w, invites)
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		var req struct {
+			UserUID int64 `json:"user_uid"`
+			GroupID int64 `json:"group_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		var userID, groupID int64
+		if req.GroupID != 0 {
+			g, err := h.DB.GetGroup(req.GroupID, user.UserID)
+			if err != nil {
+				jsonError(w, "群组不存在", 404)
+				return
+			}
+			if !canUseGroup(g, user) {
+				jsonError(w, "只能邀请自己所在的群组", 403)
+				return
+			}
+			groupID = g.ID
+		} else {
+			target, err := h.DB.GetUserByUID(req.UserUID)
+			if err != nil {
+				jsonError(w, "用户不存在", 404)
+				return
+			}
+			userID = target.ID
+		}
+		if err := h.DB.CreateRoomInvite(code, userID, groupID, user.UserID); err != nil {
+			jsonError(w, "邀请失败", 500)
+			return
+		}
+		jsonOK(w, map[string]string{"message": "ok"})
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		id, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			jsonError(w, "invalid id", 400)
+			return
+		}
+		if err := h.DB.DeleteRoomInvite(id, code); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				jsonError(w, "邀请不存在", 404)
+				return
+			}
+			jsonError(w, "删除失败", 500)
+			return
+		}
+		jsonOK(w, map[string]string{"message": "ok"})
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+type myInvite struct {
+	*db.RoomInvite
+	OwnerName   string `json:"owner_name"`
+	ClientCount int    `json:"client_count"`
+}
+
+// MyInvites handles GET /api/rooms/invites: rooms the caller is invited to,
+// directly or through a group, that are currently open.
+func (h *PlaylistHandlers) MyInvites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	invites, err := h.DB.GetInvitesForUser(user.UserID)
+	if err != nil {
+		jsonError(w, "查询失败", 500)
+		return
+	}
+	out := []myInvite{}
+	seen := map[string]bool{}
+	for _, inv := range invites {
+		if seen[inv.RoomCode] || h.Manager == nil {
+			continue
+		}
+		rm := h.Manager.GetRoom(inv.RoomCode)
+		if rm == nil {
+			continue
+		}
+		seen[inv.RoomCode] = true
+		rm.Mu.RLock()
+		owner := rm.OwnerName
+		rm.Mu.RUnlock()
+		out = append(out, myInvite{RoomInvite: inv, OwnerName: owner, ClientCount: rm.ClientCount()})
+	}
+	jsonOK(w, out)
+}
@@ -0,0 +1,131 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/lyrics"
+)
+
+const maxLyricsSize = 512 << 10 // 512KB per lyrics file
+
+var allowedLyricsExts = map[string]bool{".lrc": true, ".srt": true, ".ttml": true, ".xml": true, ".dfxp": true, ".txt": true}
+
+// storeLyricsTimeline parses raw lyrics and stores the structured timeline next to it.
+func (h *LibraryHandlers) storeLyricsTimeline(audioID int64, raw string) {
+	l := lyrics.Load("", raw)
+	if l == nil {
+		return
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+	h.DB.UpdateLyrics(audioID, raw, string(data))
+}
+
+// UploadLyrics replaces a track's lyrics with an uploaded .lrc/.srt/.ttml file,
+// optionally merged with a translation file.
+// POST /api/library/files/{id}/lyrics (multipart: lyrics, translation)
+func (h *LibraryHandlers) UploadLyrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := h.requireAdmin(r)
+	if user == nil {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/library/files/")
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) != 2 || parts[1] != "lyrics" {
+		jsonError(w, "invalid path", 400)
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	af, err := h.DB.GetAudioFileByID(id)
+	if err != nil {
+		jsonError(w, "文件不存在", 404)
+		return
+	}
+	if af.OwnerID != user.UserID {
+		jsonError(w, "只能修改自己的文件", 403)
+		return
+	}
+
+	if err := r.ParseMultipartForm(2 * maxLyricsSize); err != nil {
+		jsonError(w, "歌词文件太大", 400)
+		return
+	}
+	parsed, err := readLyricsFile(r, "lyrics")
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
+	if parsed == nil {
+		jsonError(w, "缺少歌词文件", 400)
+		return
+	}
+	translation, err := readLyricsFile(r, "translation")
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
+	parsed.MergeTranslation(translation)
+
+	data, err := json.Marshal(parsed)
+	if err != nil {
+		jsonError(w, "歌词解析失败", 500)
+		return
+	}
+	// Keep the raw column as LRC so clients that only parse LRC keep working.
+	if err := h.DB.UpdateLyrics(id, parsed.ToLRC(), string(data)); err != nil {
+		jsonError(w, "保存歌词失败", 500)
+		return
+	}
+	jsonOK(w, parsed)
+}
+
+// readLyricsFile parses the multipart file field, returning nil if it is absent.
+func readLyricsFile(r *http.Request, field string) (*lyrics.Lyrics, error) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, nil
+	}
+	defer file.Close()
+	if !allowedLyricsExts[strings.ToLower(filepath.Ext(header.Filename))] {
+		return nil, errors.New("不支持的歌词格式")
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxLyricsSize+1))
+	if err != nil || len(data) > maxLyricsSize {
+		return nil, errors.New("歌词文件太大")
+	}
+	l, err := lyrics.Parse(string(data), header.Filename)
+	if err != nil || len(l.Lines) == 0 {
+		return nil, errors.New("无法解析歌词文件")
+	}
+	return l, nil
+}
+
+// wantsJSON reports whether the client asked for structured lyrics.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// lyricsAuthorized is the access check shared by lyrics endpoints.
+func (h *LibraryHandlers) lyricsAuthorized(user *auth.UserInfo, audioID int64) bool {
+	canAccess, _ := h.DB.CanAccessAudioFile(user.UserID, audioID)
+	return canAccess || (h.Manager != nil && h.Manager.IsUserInRoomWithAudio(user.UserID, audioID))
+}
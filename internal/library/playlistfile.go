@@ -0,0 +1,624 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Playlist files (M3U8, PLS, XSPF) carry absolute stream URLs signed with a
+// stream token for the exporting user, so they play in any player until the
+// signature expires.
+// Imported files are matched against the caller's accessible tracks by title,
+// artist, file name and duration.
+
+const (
+	// Exported links outlive the session that made them, so they stay short;
+	// access is re-checked on every request anyway.
+	defaultExportExpiry = 24 * time.Hour
+	maxExportExpiry     = 7 * 24 * time.Hour
+	maxImportEntries    = 5000
+	// An entry matches a track when its title is this similar ...
+	minTitleSimilarity = 0.7
+	// ... and the weighted score over all known fields reaches this.
+	minMatchScore = 0.75
+)
+
+var playlistContentTypes = map[string]string{
+	"m3u8": "audio/x-mpegurl; charset=utf-8",
+	"pls":  "audio/x-scpls; charset=utf-8",
+	"xspf": "application/xspf+xml; charset=utf-8",
+}
+
+type playlistEntry struct {
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist,omitempty"`
+	Album    string  `json:"album,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Location string  `json:"location,omitempty"`
+}
+
+// PublicBaseURL returns the externally visible origin, from PUBLIC_URL or the request.
+func PublicBaseURL(r *http.Request) string {
+	if u := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/"); u != "" {
+		return u
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// exportExpiry reads ?expires_in= (seconds) for exported stream URLs.
+func exportExpiry(r *http.Request) (time.Time, bool) {
+	v := r.URL.Query().Get("expires_in")
+	if v == "" {
+		return time.Now().Add(defaultExportExpiry), true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || time.Duration(n)*time.Second > maxExportExpiry {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(n) * time.Second), true
+}
+
+// writePlaylistExport signs stream URLs for files and writes them as a playlist
+// file in the format given by ?format= (m3u8, pls or xspf).
+func writePlaylistExport(w http.ResponseWriter, r *http.Request, userID int64, title string, files []*db.AudioFile) {
+	format := r.URL.Query().Get("format")
+	if format == "" || format == "m3u" {
+		format = "m3u8"
+	}
+	ct, ok := playlistContentTypes[format]
+	if !ok {
+		jsonError(w, "不支持的格式", 400)
+		return
+	}
+	exp, ok := exportExpiry(r)
+	if !ok {
+		jsonError(w, "无效的有效期", 400)
+		return
+	}
+	base := PublicBaseURL(r)
+	entries := make([]playlistEntry, len(files))
+	for i, af := range files {
+		entries[i] = playlistEntry{
+			Title:    af.Title,
+			Artist:   af.Artist,
+			Album:    af.Album,
+			Duration: af.Duration,
+			Location: streamURL(base, af, auth.SignStreamToken(userID, af.ID, exp)),
+		}
+	}
+	var buf bytes.Buffer
+	if err := writePlaylistFile(&buf, format, title, entries); err != nil {
+		jsonError(w, "导出失败", 500)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, sanitizeFilename(title), format))
+	w.Write(buf.Bytes())
+}
+
+func sanitizeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`"\/:*?<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "playlist"
+	}
+	return s
+}
+
+// --- Writers ---
+
+type xspfTrack struct {
+	Location string `xml:"location,omitempty"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func writePlaylistFile(w io.Writer, format, title string, entries []playlistEntry) error {
+	switch format {
+	case "m3u8":
+		bw := bufio.NewWriter(w)
+		bw.WriteString("#EXTM3U\n")
+		if title != "" {
+			fmt.Fprintf(bw, "#PLAYLIST:%s\n", oneLine(title))
+		}
+		for _, e := range entries {
+			fmt.Fprintf(bw, "#EXTINF:%d,%s\n%s\n", int(math.Round(e.Duration)), oneLine(entryLabel(e)), e.Location)
+		}
+		return bw.Flush()
+	case "pls":
+		bw := bufio.NewWriter(w)
+		bw.WriteString("[playlist]\n")
+		for i, e := range entries {
+			n := i + 1
+			fmt.Fprintf(bw, "File%d=%s\nTitle%d=%s\nLength%d=%d\n", n, e.Location, n, oneLine(entryLabel(e)), n, int(math.Round(e.Duration)))
+		}
+		fmt.Fprintf(bw, "NumberOfEntries=%d\nVersion=2\n", len(entries))
+		return bw.Flush()
+	case "xspf":
+		pl := xspfPlaylist{Version: "1", XMLNS: "http://xspf.org/ns/0/", Title: title}
+		for _, e := range entries {
+			pl.Tracks = append(pl.Tracks, xspfTrack{Location: e.Location, Title: e.Title, Creator: e.Artist, Album: e.Album, Duration: int64(e.Duration * 1000)})
+		}
+		io.WriteString(w, xml.Header)
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		return enc.Encode(pl)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func entryLabel(e playlistEntry) string {
+	if e.Artist != "" {
+		return e.Artist + " - " + e.Title
+	}
+	return e.Title
+}
+
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// --- Parsers ---
+
+// parsePlaylistFile reads an M3U/M3U8, PLS or XSPF file, detected by content.
+func parsePlaylistFile(data []byte) ([]playlistEntry, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(data)
+	var entries []playlistEntry
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		var pl xspfPlaylist
+		if err := xml.Unmarshal(trimmed, &pl); err != nil {
+			return nil, fmt.Errorf("无法解析 XSPF: %v", err)
+		}
+		for _, t := range pl.Tracks {
+			entries = append(entries, playlistEntry{Title: t.Title, Artist: t.Creator, Album: t.Album, Duration: float64(t.Duration) / 1000, Location: t.Location})
+		}
+	case len(trimmed) >= 10 && strings.EqualFold(string(trimmed[:10]), "[playlist]"):
+		entries = parsePLS(string(trimmed))
+	default:
+		entries = parseM3U(string(trimmed))
+	}
+	for i := range entries {
+		fillFromLocation(&entries[i])
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("播放列表为空或格式无法识别")
+	}
+	if len(entries) > maxImportEntries {
+		return nil, fmt.Errorf("播放列表条目过多（最多 %d 条）", maxImportEntries)
+	}
+	return entries, nil
+}
+
+func parseM3U(s string) []playlistEntry {
+	var entries []playlistEntry
+	var pending *playlistEntry
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			dur, info, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			// Attributes (tvg-id="..." etc.) may follow the duration.
+			dur, _, _ = strings.Cut(strings.TrimSpace(dur), " ")
+			d, _ := strconv.ParseFloat(dur, 64)
+			e := playlistEntry{Duration: math.Max(d, 0)}
+			e.Artist, e.Title = splitArtistTitle(strings.TrimSpace(info))
+			pending = &e
+		case strings.HasPrefix(line, "#"):
+		default:
+			e := playlistEntry{}
+			if pending != nil {
+				e = *pending
+				pending = nil
+			}
+			e.Location = line
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func parsePLS(s string) []playlistEntry {
+	byIndex := map[int]*playlistEntry{}
+	for _, line := range strings.Split(s, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		lk := strings.ToLower(k)
+		var field string
+		for _, f := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(lk, f) {
+				field = f
+				break
+			}
+		}
+		n, err := strconv.Atoi(lk[len(field):])
+		if field == "" || err != nil || n <= 0 || n > maxImportEntries {
+			continue
+		}
+		e := byIndex[n]
+		if e == nil {
+			e = &playlistEntry{}
+			byIndex[n] = e
+		}
+		switch field {
+		case "file":
+			e.Location = v
+		case "title":
+			e.Artist, e.Title = splitArtistTitle(v)
+		case "length":
+			d, _ := strconv.ParseFloat(v, 64)
+			e.Duration = math.Max(d, 0)
+		}
+	}
+	idx := make([]int, 0, len(byIndex))
+	for n := range byIndex {
+		idx = append(idx, n)
+	}
+	sort.Ints(idx)
+	entries := make([]playlistEntry, 0, len(idx))
+	for _, n := range idx {
+		entries = append(entries, *byIndex[n])
+	}
+	return entries
+}
+
+// splitArtistTitle splits "Artist - Title" labels.
+func splitArtistTitle(s string) (string, string) {
+	if a, t, ok := strings.Cut(s, " - "); ok {
+		return strings.TrimSpace(a), strings.TrimSpace(t)
+	}
+	return "", s
+}
+
+// fillFromLocation derives a missing title (and artist) from the file name.
+func fillFromLocation(e *playlistEntry) {
+	if e.Title != "" || e.Location == "" {
+		return
+	}
+	e.Artist, e.Title = splitArtistTitle(locationBase(e.Location))
+}
+
+func locationBase(loc string) string {
+	if u, err := url.Parse(loc); err == nil && u.Scheme != "" && len(u.Scheme) > 1 {
+		loc = u.Path
+	} else if un, err := url.PathUnescape(loc); err == nil {
+		loc = un
+	}
+	loc = strings.ReplaceAll(loc, `\`, "/")
+	base := path.Base(loc)
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// --- Matching ---
+
+type playlistMatch struct {
+	Index         int           `json:"index"`
+	Entry         playlistEntry `json:"entry"`
+	AudioID       int64         `json:"audio_id"`
+	MatchedTitle  string        `json:"matched_title"`
+	MatchedArtist string        `json:"matched_artist,omitempty"`
+	Score         float64       `json:"score"`
+}
+
+type playlistUnmatched struct {
+	Index int           `json:"index"`
+	Entry playlistEntry `json:"entry"`
+}
+
+type matchCandidate struct {
+	af                  *db.AudioFile
+	title, artist, file []uint64
+}
+
+// normalizeForMatch lowercases s, drops bracketed suffixes such as
+// "(Remastered 2011)" and reduces punctuation to single spaces.
+func normalizeForMatch(s string) string {
+	var b strings.Builder
+	depth := 0
+	space := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r == '(' || r == '[' || r == '（' || r == '【':
+			depth++
+		case r == ')' || r == ']' || r == '）' || r == '】':
+			if depth > 0 {
+				depth--
+			}
+		case depth > 0:
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// bigrams returns the sorted rune bigrams of a normalized string; strings of a
+// single rune yield that rune alone so short CJK titles still compare.
+func bigrams(s string) []uint64 {
+	rs := []rune(normalizeForMatch(s))
+	if len(rs) == 1 {
+		return []uint64{uint64(rs[0])}
+	}
+	out := make([]uint64, 0, len(rs))
+	for i := 0; i+1 < len(rs); i++ {
+		out = append(out, uint64(rs[i])<<32|uint64(rs[i+1]))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// dice is the Sørensen–Dice coefficient of two sorted bigram multisets.
+func dice(a, b []uint64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			common++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return 2 * float64(common) / float64(len(a)+len(b))
+}
+
+// matchPlaylistEntries pairs each entry with its most similar track, if any is
+// similar enough.
+func matchPlaylistEntries(entries []playlistEntry, files []*db.AudioFile) ([]playlistMatch, []playlistUnmatched) {
+	cands := make([]matchCandidate, len(files))
+	for i, af := range files {
+		cands[i] = matchCandidate{
+			af:     af,
+			title:  bigrams(af.Title),
+			artist: bigrams(af.Artist),
+			file:   bigrams(strings.TrimSuffix(af.OriginalName, path.Ext(af.OriginalName))),
+		}
+	}
+	matched := []playlistMatch{}
+	unmatched := []playlistUnmatched{}
+	for i, e := range entries {
+		title, artist := bigrams(e.Title), bigrams(e.Artist)
+		var file []uint64
+		if e.Location != "" {
+			file = bigrams(locationBase(e.Location))
+		}
+		best, bestScore := -1, 0.0
+		for j, c := range cands {
+			t := math.Max(dice(title, c.title), dice(file, c.file))
+			if t < minTitleSimilarity {
+				continue
+			}
+			score, weight := 0.6*t, 0.6
+			if len(artist) > 0 && len(c.artist) > 0 {
+				score += 0.25 * dice(artist, c.artist)
+				weight += 0.25
+			}
+			if e.Duration > 0 && c.af.Duration > 0 {
+				diff := math.Abs(e.Duration - c.af.Duration)
+				score += 0.15 * math.Max(0, math.Min(1, (15-diff)/13))
+				weight += 0.15
+			}
+			if score /= weight; score > bestScore {
+				best, bestScore = j, score
+			}
+		}
+		if best < 0 || bestScore < minMatchScore {
+			unmatched = append(unmatched, playlistUnmatched{Index: i, Entry: e})
+			continue
+		}
+		af := cands[best].af
+		matched = append(matched, playlistMatch{
+			Index: i, Entry: e, AudioID: af.ID, MatchedTitle: af.Title, MatchedArtist: af.Artist,
+			Score: math.Round(bestScore*100) / 100,
+		})
+	}
+	return matched, unmatched
+}
+
+// --- Handlers ---
+
+// accessibleItemFiles returns the tracks of items that userID may access, in order.
+func accessibleItemFiles(database *db.DB, userID int64, items []*db.PlaylistItem) []*db.AudioFile {
+	var files []*db.AudioFile
+	for _, it := range items {
+		if ok, _ := database.CanAccessAudioFile(userID, it.AudioID); !ok {
+			continue
+		}
+		if af, err := database.GetAudioFileByID(it.AudioID); err == nil {
+			files = append(files, af)
+		}
+	}
+	return files
+}
+
+// ExportRoomPlaylist handles GET /api/room/{code}/playlist/export?format=m3u8|pls|xspf&expires_in=.
+// Only tracks the caller can access are included.
+func (h *PlaylistHandlers) ExportRoomPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	code := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/room/"), "/")[0]
+	pl, err := h.DB.GetPlaylistByRoom(code)
+	if err != nil {
+		jsonError(w, "播放列表不存在", 404)
+		return
+	}
+	items, _ := h.DB.GetPlaylistItems(pl.ID)
+	writePlaylistExport(w, r, user.UserID, "ListenTogether "+code, accessibleItemFiles(h.DB, user.UserID, items))
+}
+
+// SavedPlaylists handles the playlists kept in the database after their rooms close:
+//
+//	GET /api/playlists                 the caller's playlists
+//	GET /api/playlists/{id}/export     as a playlist file (creator or shared)
+func (h *PlaylistHandlers) SavedPlaylists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/playlists"), "/")
+	if rest == "" {
+		list, err := h.DB.GetPlaylistsByCreator(user.UserID)
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		if list == nil {
+			list = []*db.Playlist{}
+		}
+		jsonOK(w, list)
+		return
+	}
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || sub != "export" {
+		jsonError(w, "not found", 404)
+		return
+	}
+	if !h.DB.CanAccessPlaylist(user.UserID, id) {
+		jsonError(w, "播放列表不存在", 404)
+		return
+	}
+	pl, err := h.DB.GetPlaylistByID(id)
+	if err != nil {
+		jsonError(w, "播放列表不存在", 404)
+		return
+	}
+	items, _ := h.DB.GetPlaylistItems(pl.ID)
+	writePlaylistExport(w, r, user.UserID, "ListenTogether "+pl.RoomCode, accessibleItemFiles(h.DB, user.UserID, items))
+}
+
+// ImportRoomPlaylist handles POST /api/room/{code}/playlist/import[?dry_run=true]
+// (room owner). The body is an M3U/M3U8, PLS or XSPF file, raw or as multipart
+// field "file". Matched tracks are appended to the room playlist; the response
+// reports every match and every entry that found none.
+func (h *PlaylistHandlers) ImportRoomPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	code := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/room/"), "/")[0]
+	if !h.isRoomOwner(user.UserID, code) {
+		jsonError(w, "只有房主可以操作播放列表", 403)
+		return
+	}
+
+	var src io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			jsonError(w, "缺少播放列表文件", 400)
+			return
+		}
+		defer f.Close()
+		src = f
+	}
+	data, err := io.ReadAll(src)
+	if err != nil {
+		jsonError(w, "文件过大", 400)
+		return
+	}
+	entries, err := parsePlaylistFile(data)
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
+	files, err := h.DB.GetAccessibleAudioFiles(user.UserID)
+	if err != nil {
+		jsonError(w, "查询失败", 500)
+		return
+	}
+	matched, unmatched := matchPlaylistEntries(entries, files)
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if !dryRun && len(matched) > 0 {
+		pl, err := h.DB.GetOrCreatePlaylist(code, user.UserID)
+		if err != nil {
+			jsonError(w, "创建播放列表失败", 500)
+			return
+		}
+		ids := make([]int64, len(matched))
+		for i, m := range matched {
+			ids[i] = m.AudioID
+		}
+		if err := h.DB.ReplacePlaylistItems(pl.ID, ids, false); err != nil {
+			jsonError(w, "导入失败", 500)
+			return
+		}
+		if h.OnPlaylistUpdate != nil {
+			h.OnPlaylistUpdate(code)
+		}
+	}
+	jsonOK(w, map[string]interface{}{
+		"total":     len(entries),
+		"matched":   matched,
+		"unmatched": unmatched,
+		"dry_run":   dryRun,
+	})
+}
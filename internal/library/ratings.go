@@ -0,0 +1,117 @@
+package library
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// TrackRating handles a user's own opinion of one track:
+//
+//	PUT    /api/library/files/{id}/rating     {"rating": 1-5, 0 clears}
+//	POST   /api/library/files/{id}/favorite
+//	DELETE /api/library/files/{id}/favorite
+//
+// Any track the caller can access may be rated; removing a favorite always works.
+func (h *LibraryHandlers) TrackRating(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/library/files/"), "/"), "/")
+	if len(parts) != 2 {
+		jsonError(w, "invalid path", 400)
+		return
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	unfavorite := parts[1] == "favorite" && r.Method == http.MethodDelete
+	if !unfavorite {
+		if ok, _ := h.DB.CanAccessAudioFile(user.UserID, id); !ok {
+			jsonError(w, "文件不存在", 404)
+			return
+		}
+	}
+
+	switch {
+	case parts[1] == "rating" && r.Method == http.MethodPut:
+		var req struct {
+			Rating int `json:"rating"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		if req.Rating < 0 || req.Rating > 5 {
+			jsonError(w, "评分必须为 1-5 星", 400)
+			return
+		}
+		if err := h.DB.SetRating(user.UserID, id, req.Rating); err != nil {
+			jsonError(w, "评分失败", 500)
+			return
+		}
+	case parts[1] == "favorite" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		if err := h.DB.SetFavorite(user.UserID, id, r.Method == http.MethodPost); err != nil {
+			jsonError(w, "操作失败", 500)
+			return
+		}
+	default:
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+
+	af, err := h.DB.GetAudioFileByID(id)
+	if err != nil {
+		jsonOK(w, map[string]string{"message": "ok"})
+		return
+	}
+	h.DB.FillTrackStats([]*db.AudioFile{af}, user.UserID)
+	jsonOK(w, map[string]interface{}{
+		"avg_rating":     af.AvgRating,
+		"rating_count":   af.RatingCount,
+		"favorite_count": af.FavoriteCount,
+		"my_rating":      af.MyRating,
+		"favorite":       af.Favorite,
+	})
+}
+
+// Favorites handles GET /api/library/favorites: the caller's loved tracks,
+// including ones loved while listening in someone else's room.
+func (h *LibraryHandlers) Favorites(w http.ResponseWriter, r *http.Request) {
+	h.listRated(w, r, h.DB.GetFavoriteAudioFiles)
+}
+
+// Ratings handles GET /api/library/ratings: the tracks the caller rated, best first.
+func (h *LibraryHandlers) Ratings(w http.ResponseWriter, r *http.Request) {
+	h.listRated(w, r, h.DB.GetRatedAudioFiles)
+}
+
+func (h *LibraryHandlers) listRated(w http.ResponseWriter, r *http.Request, query func(int64) ([]*db.AudioFile, error)) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	files, err := query(user.UserID)
+	if err != nil {
+		jsonError(w, "查询失败", 500)
+		return
+	}
+	if files == nil {
+		files = []*db.AudioFile{}
+	}
+	h.DB.FillTrackStats(files, user.UserID)
+	jsonOK(w, files)
+}
@@ -0,0 +1,117 @@
+package library
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// RecoverIncompleteTiers compares every track's manifest with the qualities
+// recorded in the database and re-enqueues missing tiers. Call once at startup;
+// the work itself runs on the audio worker pool.
+func (h *LibraryHandlers) RecoverIncompleteTiers() {
+	files, err := h.DB.GetAllAudioFiles()
+	if err != nil {
+		log.Printf("tier recovery: list tracks: %v", err)
+		return
+	}
+	queued := 0
+	for _, af := range files {
+		var qualities []string
+		if err := json.Unmarshal([]byte(af.Qualities), &qualities); err != nil || len(qualities) == 0 {
+			continue
+		}
+		audioDir := trackDir(h.DataDir, af)
+		if !fileExists(filepath.Join(audioDir, "manifest.json")) {
+			continue // already published to the store
+		}
+		original := findOriginal(audioDir)
+		m, n, err := audio.ResumeTiers(original, audioDir, qualities)
+		if err != nil {
+			log.Printf("tier recovery: track %d (%s): %v", af.ID, af.Title, err)
+		}
+		queued += n
+		// Finish what the interrupted upload would have done afterwards.
+		if m != nil && (n > 0 || !h.Store.Local() || (original != "" && OriginalRetention() == DropOriginal)) {
+			go finalizeTrack(h.Store, h.DataDir, audioDir, original, m, qualities)
+		}
+	}
+	if queued > 0 {
+		log.Printf("tier recovery: re-enqueued %d tier(s)", queued)
+	}
+}
+
+// withProcessing attaches in-flight tier states to each file for the UI.
+func (h *LibraryHandlers) withProcessing(files []*db.AudioFile) {
+	for _, af := range files {
+		af.Processing = audio.TierStatuses(trackDir(h.DataDir, af))
+	}
+}
+
+// GetStatus handles GET /api/library/files/{id}/status and reports the state of
+// every quality tier: "ready", "pending", "processing", "failed" or "missing".
+func (h *LibraryHandlers) GetStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+
+	// Parse ID from /api/library/files/{id}/status
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/library/files/")
+	idStr = strings.TrimSuffix(strings.TrimSuffix(idStr, "/"), "/status")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+
+	af, err := h.DB.GetAudioFileByID(id)
+	if err != nil {
+		jsonError(w, "文件不存在", 404)
+		return
+	}
+	canAccess, _ := h.DB.CanAccessAudioFile(user.UserID, id)
+	if !canAccess && (h.Manager == nil || !h.Manager.IsUserInRoomWithAudio(user.UserID, id)) {
+		jsonError(w, "无权访问", 403)
+		return
+	}
+
+	var qualities []string
+	json.Unmarshal([]byte(af.Qualities), &qualities)
+	audioDir := trackDir(h.DataDir, af)
+	inFlight := audio.TierStatuses(audioDir)
+	manifest, _ := h.loadManifest(af)
+
+	status := make(map[string]string, len(qualities))
+	complete := true
+	for _, q := range qualities {
+		switch {
+		case inFlight[q] != "":
+			status[q] = inFlight[q]
+		case manifest != nil && manifest.Qualities[q] != nil:
+			status[q] = "ready"
+		default:
+			status[q] = "missing"
+		}
+		if status[q] != "ready" {
+			complete = false
+		}
+	}
+	jsonOK(w, map[string]interface{}{
+		"id":        af.ID,
+		"qualities": status,
+		"complete":  complete,
+	})
+}
@@ -0,0 +1,342 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/storage"
+)
+
+// Original retention policies, selected with the ORIGINAL_RETENTION env var.
+const (
+	RetainOriginal = "keep" // default: original.ext stays next to the segments
+	DropOriginal   = "drop" // original.ext is removed once every tier has been verified
+)
+
+// ErrNoOriginal is returned when a track's original was dropped and cannot be re-transcoded.
+var ErrNoOriginal = errors.New("original not retained")
+
+// OriginalRetention returns the configured retention policy.
+func OriginalRetention() string {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("ORIGINAL_RETENTION")), DropOriginal) {
+		return DropOriginal
+	}
+	return RetainOriginal
+}
+
+func trackDir(dataDir string, af *db.AudioFile) string {
+	return filepath.Join(dataDir, "library", strconv.FormatInt(af.OwnerID, 10), af.Filename)
+}
+
+// findOriginal returns the stored source file in audioDir, or "" if there is none.
+func findOriginal(audioDir string) string {
+	matches, _ := filepath.Glob(filepath.Join(audioDir, "original.*"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// finalizeTrack runs after the background tiers of a track are done: it applies
+// the original retention policy and publishes the track to a remote store.
+func finalizeTrack(store storage.Store, dataDir, audioDir, original string, m *audio.MultiQualityManifest, qualities []string) {
+	m.Wait()
+	if OriginalRetention() == DropOriginal && original != "" {
+		if err := audio.VerifyManifest(audioDir, m, qualities); err != nil {
+			log.Printf("keeping original %s: %v", original, err)
+		} else if err := os.Remove(original); err != nil {
+			log.Printf("drop original %s: %v", original, err)
+		}
+	}
+	if err := publishTrack(store, dataDir, audioDir); err != nil {
+		log.Printf("publish %s: %v", audioDir, err)
+	}
+}
+
+// Retranscode regenerates every quality tier of af from its stored original and
+// updates the database record. Tiers are built in a scratch directory and only
+// swapped in after verification, so the old segments keep serving until then.
+func Retranscode(database *db.DB, store storage.Store, dataDir string, af *db.AudioFile) error {
+	audioDir := trackDir(dataDir, af)
+	original := findOriginal(audioDir)
+	if original == "" && !store.Local() {
+		var err error
+		if original, err = fetchOriginal(store, audioDir, af); err != nil {
+			return fmt.Errorf("fetch original: %w", err)
+		}
+	}
+	if original == "" {
+		return ErrNoOriginal
+	}
+
+	work := filepath.Join(audioDir, ".retranscode")
+	os.RemoveAll(work)
+	defer os.RemoveAll(work)
+
+	manifest, probe, err := audio.ProcessAudioMultiQuality(original, work, af.OriginalName)
+	if err != nil {
+		return err
+	}
+	manifest.Wait()
+	qualities := audio.QualityNames(probe)
+	if err := audio.VerifyManifest(work, manifest, qualities); err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	if err := swapTiers(audioDir, work); err != nil {
+		return err
+	}
+
+	qualitiesJSON, _ := json.Marshal(qualities)
+	if err := database.UpdateAudioTranscode(af.ID, manifest.Duration, probe.Format, probe.Bitrate, string(qualitiesJSON)); err != nil {
+		return err
+	}
+	if a := manifest.Analysis; a != nil {
+		database.SetAudioAnalysis(af.ID, a.BPM, a.Key, a.LeadingSilence, a.EffectiveEnd)
+	}
+	dropOriginal := OriginalRetention() == DropOriginal
+	if dropOriginal {
+		os.Remove(original)
+	}
+	if !store.Local() {
+		// publishTrack only uploads, so a dropped original has to be removed
+		// from the store under the key it was published with.
+		if dropOriginal {
+			key := trackKey(af) + "/" + filepath.Base(original)
+			if err := store.Delete(key); err != nil {
+				log.Printf("drop original %s: %v", key, err)
+			}
+		}
+		// Tier sets can shrink, so clear the old remote segments before uploading.
+		keys, err := store.List(trackKey(af))
+		if err != nil {
+			return err
+		}
+		cleared := make(map[string]bool)
+		for _, key := range keys {
+			dir := path.Base(path.Dir(key))
+			if strings.HasPrefix(dir, "segments_") && !cleared[dir] {
+				cleared[dir] = true
+				if err := store.DeletePrefix(trackKey(af) + "/" + dir); err != nil {
+					return err
+				}
+			}
+		}
+		return publishTrack(store, dataDir, audioDir)
+	}
+	return nil
+}
+
+// swapTiers moves the verified tiers and manifest from work into audioDir.
+// Each old tier directory is renamed aside just before its replacement moves
+// in, and the old directories are only deleted once the new manifest is in
+// place, so listeners still on the old manifest keep getting segments. If a
+// move fails the old tiers are put back.
+func swapTiers(audioDir, work string) error {
+	aside := filepath.Join(audioDir, ".retranscode-old")
+	os.RemoveAll(aside)
+	if err := os.Mkdir(aside, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(aside)
+
+	var moved []string // tiers whose old directory is in aside
+	restore := func() {
+		for _, name := range moved {
+			os.RemoveAll(filepath.Join(audioDir, name))
+			os.Rename(filepath.Join(aside, name), filepath.Join(audioDir, name))
+		}
+	}
+
+	fresh := make(map[string]bool)
+	dirs, _ := filepath.Glob(filepath.Join(work, "segments_*"))
+	for _, dir := range dirs {
+		name := filepath.Base(dir)
+		fresh[name] = true
+		dst := filepath.Join(audioDir, name)
+		if fileExists(dst) {
+			if err := os.Rename(dst, filepath.Join(aside, name)); err != nil {
+				restore()
+				return err
+			}
+			moved = append(moved, name)
+		}
+		if err := os.Rename(dir, dst); err != nil {
+			restore()
+			return err
+		}
+	}
+	if err := os.Rename(filepath.Join(work, "manifest.json"), filepath.Join(audioDir, "manifest.json")); err != nil {
+		restore()
+		return err
+	}
+	if src := filepath.Join(work, audio.WaveformFile); fileExists(src) {
+		if err := os.Rename(src, filepath.Join(audioDir, audio.WaveformFile)); err != nil {
+			return err
+		}
+	}
+
+	// Tiers the new manifest no longer lists
+	old, _ := filepath.Glob(filepath.Join(audioDir, "segments_*"))
+	for _, dir := range old {
+		if !fresh[filepath.Base(dir)] {
+			os.RemoveAll(dir)
+		}
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// RetranscodeJob tracks a re-transcode started from the admin API.
+type RetranscodeJob struct {
+	ID         string             `json:"id"`
+	Total      int                `json:"total"`
+	Done       int                `json:"done"`
+	Failed     int                `json:"failed"`
+	Current    string             `json:"current,omitempty"`
+	Errors     []RetranscodeError `json:"errors,omitempty"`
+	Running    bool               `json:"running"`
+	StartedAt  time.Time          `json:"started_at"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty"`
+}
+
+// RetranscodeError records one track that failed to re-transcode.
+type RetranscodeError struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Error string `json:"error"`
+}
+
+type retranscodeRequest struct {
+	IDs []int64 `json:"ids"`
+	All bool    `json:"all"`
+}
+
+// StartRetranscode handles POST /api/admin/library/retranscode (owner only).
+// Body: {"ids": [1, 2]} or {"all": true}. Only one job runs at a time.
+func (h *LibraryHandlers) StartRetranscode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil || user.Role != "owner" {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	var req retranscodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request", 400)
+		return
+	}
+
+	var files []*db.AudioFile
+	if req.All {
+		all, err := h.DB.GetAllAudioFiles()
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		files = all
+	} else {
+		for _, id := range req.IDs {
+			af, err := h.DB.GetAudioFileByID(id)
+			if err != nil {
+				jsonError(w, fmt.Sprintf("文件 %d 不存在", id), 404)
+				return
+			}
+			files = append(files, af)
+		}
+	}
+	if len(files) == 0 {
+		jsonError(w, "没有需要转码的文件", 400)
+		return
+	}
+
+	h.jobsMu.Lock()
+	if h.activeJob != nil && h.activeJob.Running {
+		h.jobsMu.Unlock()
+		jsonError(w, "已有转码任务在运行", 409)
+		return
+	}
+	job := &RetranscodeJob{ID: uuid.New().String(), Total: len(files), Running: true, StartedAt: time.Now()}
+	if h.jobs == nil {
+		h.jobs = make(map[string]*RetranscodeJob)
+	}
+	h.jobs[job.ID] = job
+	h.activeJob = job
+	snapshot := *job
+	h.jobsMu.Unlock()
+
+	go h.runRetranscode(job, files)
+	jsonOK(w, snapshot)
+}
+
+func (h *LibraryHandlers) runRetranscode(job *RetranscodeJob, files []*db.AudioFile) {
+	for _, af := range files {
+		h.jobsMu.Lock()
+		job.Current = af.Title
+		h.jobsMu.Unlock()
+
+		err := Retranscode(h.DB, h.Store, h.DataDir, af)
+
+		h.jobsMu.Lock()
+		job.Done++
+		if err != nil {
+			job.Failed++
+			job.Errors = append(job.Errors, RetranscodeError{ID: af.ID, Title: af.Title, Error: err.Error()})
+			log.Printf("retranscode %d (%s) failed: %v", af.ID, af.Title, err)
+		}
+		h.jobsMu.Unlock()
+	}
+	h.jobsMu.Lock()
+	now := time.Now()
+	job.Current, job.Running, job.FinishedAt = "", false, &now
+	h.jobsMu.Unlock()
+	log.Printf("retranscode job %s finished: %d/%d ok", job.ID, job.Done-job.Failed, job.Total)
+}
+
+// GetRetranscodeJob handles GET /api/admin/library/retranscode/{jobID} (owner only).
+func (h *LibraryHandlers) GetRetranscodeJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil || user.Role != "owner" {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/library/retranscode/"), "/")
+
+	h.jobsMu.Lock()
+	job, ok := h.jobs[id]
+	var snapshot RetranscodeJob
+	if ok {
+		snapshot = *job
+		snapshot.Errors = append([]RetranscodeError(nil), job.Errors...)
+	}
+	h.jobsMu.Unlock()
+	if !ok {
+		jsonError(w, "任务不存在", 404)
+		return
+	}
+	jsonOK(w, snapshot)
+}
@@ -0,0 +1,337 @@
+package library
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/ratelimit"
+)
+
+// Item shares grant another user one track, album or saved playlist instead of
+// the whole library. Listen links give anyone with the URL a single track; they
+// hand out the same signed segment tokens as GetSegments, so audio is served by
+// the normal segment route and only the link lookup is rate limited.
+
+const (
+	listenLinkPlaysPerHour = 60 // per link
+	listenLinkIPPerMinute  = 30 // per client IP, across all links
+	maxShareExpiry         = 365 * 24 * time.Hour
+)
+
+var listenIPLimiter = ratelimit.New()
+var listenLinkLimiter = ratelimit.New()
+
+// expiryFromRequest converts an "expires_in" duration in seconds to a unix
+// deadline; 0 means no expiry.
+func expiryFromRequest(expiresIn int64) (int64, bool) {
+	if expiresIn == 0 {
+		return 0, true
+	}
+	if expiresIn < 0 || time.Duration(expiresIn)*time.Second > maxShareExpiry {
+		return 0, false
+	}
+	return time.Now().Unix() + expiresIn, true
+}
+
+type itemShareRequest struct {
+	SharedWithUID int64  `json:"shared_with_uid"`
+	Kind          string `json:"kind"` // track, album or playlist
+	TrackID       int64  `json:"track_id"`
+	Album         string `json:"album"`
+	PlaylistID    int64  `json:"playlist_id"`
+	ExpiresIn     int64  `json:"expires_in"` // seconds, 0 = never
+}
+
+// ItemShares handles /api/library/shares/items.
+// GET lists shares granted and received; POST creates one.
+func (h *LibraryHandlers) ItemShares(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(r)
+	if user == nil {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		mine, _ := h.DB.GetMyItemShares(user.UserID)
+		withMe, _ := h.DB.GetItemSharesWithMe(user.UserID)
+		if mine == nil {
+			mine = []*db.ItemShare{}
+		}
+		if withMe == nil {
+			withMe = []*db.ItemShare{}
+		}
+		jsonOK(w, map[string]interface{}{
+			"my_shares":      mine,
+			"shared_with_me": withMe,
+		})
+	case http.MethodPost:
+		h.createItemShare(w, r, user)
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+func (h *LibraryHandlers) createItemShare(w http.ResponseWriter, r *http.Request, user *auth.UserInfo) {
+	var req itemShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request", 400)
+		return
+	}
+	target, err := h.DB.GetUserByUID(req.SharedWithUID)
+	if err != nil {
+		jsonError(w, "用户不存在", 404)
+		return
+	}
+	if target.ID == user.UserID {
+		jsonError(w, "不能共享给自己", 400)
+		return
+	}
+	exp, ok := expiryFromRequest(req.ExpiresIn)
+	if !ok {
+		jsonError(w, "无效的有效期", 400)
+		return
+	}
+
+	share := &db.ItemShare{OwnerID: user.UserID, SharedWithID: target.ID, Kind: req.Kind, ExpiresAt: exp}
+	switch req.Kind {
+	case db.ShareTrack:
+		af, err := h.DB.GetAudioFileByID(req.TrackID)
+		if err != nil || af.OwnerID != user.UserID {
+			jsonError(w, "只能共享自己的曲目", 403)
+			return
+		}
+		share.TargetID = af.ID
+	case db.ShareAlbum:
+		req.Album = strings.TrimSpace(req.Album)
+		if req.Album == "" || !h.DB.HasAlbum(user.UserID, req.Album) {
+			jsonError(w, "专辑不存在", 404)
+			return
+		}
+		share.Album = req.Album
+	case db.SharePlaylist:
+		pl, err := h.DB.GetPlaylistByID(req.PlaylistID)
+		if err != nil || pl.CreatedBy != user.UserID {
+			jsonError(w, "只能共享自己的歌单", 403)
+			return
+		}
+		share.TargetID = pl.ID
+	default:
+		jsonError(w, "无效的共享类型", 400)
+		return
+	}
+
+	created, err := h.DB.ShareItem(share)
+	if err != nil {
+		jsonError(w, "共享失败", 500)
+		return
+	}
+	jsonOK(w, created)
+}
+
+// DeleteItemShare handles DELETE /api/library/shares/items/{id}.
+func (h *LibraryHandlers) DeleteItemShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := h.requireAdmin(r)
+	if user == nil {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/library/shares/items/"), "/"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	if err := h.DB.DeleteItemShare(id, user.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonError(w, "共享不存在", 404)
+			return
+		}
+		jsonError(w, "取消共享失败", 500)
+		return
+	}
+	jsonOK(w, map[string]string{"message": "ok"})
+}
+
+func newLinkToken() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ListenLinks handles /api/library/links.
+// GET lists the caller's links; POST {"audio_id": 1, "expires_in": 86400} creates one.
+func (h *LibraryHandlers) ListenLinks(w http.ResponseWriter, r *http.Request) {
+	user := h.requireAdmin(r)
+	if user == nil {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		links, _ := h.DB.GetListenLinksByOwner(user.UserID)
+		if links == nil {
+			links = []*db.ListenLink{}
+		}
+		jsonOK(w, links)
+	case http.MethodPost:
+		var req struct {
+			AudioID   int64 `json:"audio_id"`
+			ExpiresIn int64 `json:"expires_in"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		af, err := h.DB.GetAudioFileByID(req.AudioID)
+		if err != nil || af.OwnerID != user.UserID {
+			jsonError(w, "只能分享自己的曲目", 403)
+			return
+		}
+		exp, ok := expiryFromRequest(req.ExpiresIn)
+		if !ok {
+			jsonError(w, "无效的有效期", 400)
+			return
+		}
+		link, err := h.DB.CreateListenLink(newLinkToken(), user.UserID, af.ID, exp)
+		if err != nil {
+			jsonError(w, "创建链接失败", 500)
+			return
+		}
+		link.Title = af.Title
+		jsonOK(w, link)
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// DeleteListenLink handles DELETE /api/library/links/{id}.
+func (h *LibraryHandlers) DeleteListenLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := h.requireAdmin(r)
+	if user == nil {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	id, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/library/links/"), "/"), 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	if err := h.DB.DeleteListenLink(id, user.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonError(w, "链接不存在", 404)
+			return
+		}
+		jsonError(w, "删除失败", 500)
+		return
+	}
+	jsonOK(w, map[string]string{"message": "ok"})
+}
+
+// ServeListenLink is the unauthenticated side of listen links.
+// GET /api/listen/{token}?quality=medium returns track info and segment list;
+// GET /api/listen/{token}/cover returns the cover art.
+func (h *LibraryHandlers) ServeListenLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	token, sub, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/listen/"), "/"), "/")
+	if token == "" || (sub != "" && sub != "cover") {
+		jsonError(w, "invalid path", 400)
+		return
+	}
+	if !listenIPLimiter.Allow(auth.GetClientIP(r), listenLinkIPPerMinute, time.Minute) {
+		jsonError(w, "请求过于频繁", 429)
+		return
+	}
+	link, err := h.DB.GetListenLink(token)
+	if err != nil {
+		jsonError(w, "链接不存在或已过期", 404)
+		return
+	}
+	af, err := h.DB.GetAudioFileByID(link.AudioID)
+	if err != nil {
+		jsonError(w, "链接不存在或已过期", 404)
+		return
+	}
+
+	if sub == "cover" {
+		if af.CoverArt == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		h.serveObject(w, r, trackKey(af)+"/"+af.CoverArt)
+		return
+	}
+
+	if !listenLinkLimiter.Allow(token, listenLinkPlaysPerHour, time.Hour) {
+		jsonError(w, "该链接播放次数过多，请稍后再试", 429)
+		return
+	}
+	manifest, err := h.loadManifest(af)
+	if err != nil {
+		jsonError(w, "manifest not found", 404)
+		return
+	}
+	quality := r.URL.Query().Get("quality")
+	if manifest.Qualities[quality] == nil {
+		quality = ""
+		for _, q := range append([]string{"medium"}, tierPreference...) {
+			if manifest.Qualities[q] != nil {
+				quality = q
+				break
+			}
+		}
+	}
+	qi := manifest.Qualities[quality]
+	if qi == nil {
+		jsonError(w, "quality not available", 404)
+		return
+	}
+	h.DB.IncrementListenLinkPlays(link.ID)
+
+	exp := time.Now().Add(auth.SegmentTokenTTL() + time.Duration(manifest.Duration*float64(time.Second)))
+	if link.ExpiresAt > 0 && exp.Unix() > link.ExpiresAt {
+		exp = time.Unix(link.ExpiresAt, 0)
+	}
+	qualities := make([]string, 0, len(manifest.Qualities))
+	for _, q := range tierPreference {
+		if manifest.Qualities[q] != nil {
+			qualities = append(qualities, q)
+		}
+	}
+	jsonOK(w, map[string]interface{}{
+		"segment_token": auth.SignSegmentToken(af.OwnerID, af.Filename, exp),
+		"token_expires": exp.Unix(),
+		"quality":       quality,
+		"qualities":     qualities,
+		"format":        qi.Format,
+		"segments":      qi.Segments,
+		"duration":      manifest.Duration,
+		"segment_time":  manifest.SegmentTime,
+		"owner_id":      af.OwnerID,
+		"audio_uuid":    af.Filename,
+		"title":         af.Title,
+		"artist":        af.Artist,
+		"album":         af.Album,
+		"has_cover":     af.CoverArt != "",
+		"expires_at":    link.ExpiresAt,
+	})
+}
@@ -0,0 +1,263 @@
+package library
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+const (
+	maxSmartNameLen  = 64
+	maxSmartQueryLen = 1000
+)
+
+// evalSmartQuery runs a smart playlist query against everything userID can
+// access right now.
+func evalSmartQuery(database *db.DB, userID int64, query string) ([]*db.AudioFile, error) {
+	q, err := parseSmartQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	files, err := database.GetAccessibleAudioFiles(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.FillTrackStats(files, userID); err != nil {
+		return nil, err
+	}
+	return q.apply(files), nil
+}
+
+// SmartPlaylistTracks evaluates sp for userID.
+func (h *LibraryHandlers) SmartPlaylistTracks(userID int64, sp *db.SmartPlaylist) ([]*db.AudioFile, error) {
+	return evalSmartQuery(h.DB, userID, sp.Query)
+}
+
+type smartPlaylistRequest struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// validate trims the request and checks that the query parses.
+func (req *smartPlaylistRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len([]rune(req.Name)) > maxSmartNameLen {
+		return errors.New("名称无效")
+	}
+	return req.validateQuery()
+}
+
+// validateQuery checks the rule set alone, for previews.
+func (req *smartPlaylistRequest) validateQuery() error {
+	req.Query = strings.TrimSpace(req.Query)
+	if len(req.Query) > maxSmartQueryLen {
+		return errors.New("规则过长")
+	}
+	_, err := parseSmartQuery(req.Query)
+	return err
+}
+
+// SmartPlaylists handles /api/library/smart: GET lists the caller's smart
+// playlists, POST {"name": "...", "query": "..."} saves one.
+func (h *LibraryHandlers) SmartPlaylists(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := h.DB.GetSmartPlaylistsByOwner(user.UserID)
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		if list == nil {
+			list = []*db.SmartPlaylist{}
+		}
+		jsonOK(w, list)
+	case http.MethodPost:
+		var req smartPlaylistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		if err := req.validate(); err != nil {
+			jsonError(w, err.Error(), 400)
+			return
+		}
+		sp, err := h.DB.CreateSmartPlaylist(user.UserID, req.Name, req.Query)
+		if err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		jsonOK(w, sp)
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// SmartPlaylist handles a single smart playlist:
+//
+//	GET    /api/library/smart/{id}          rule set and the tracks it selects now
+//	GET    /api/library/smart/{id}/export   as M3U8/PLS/XSPF (?format=)
+//	PUT    /api/library/smart/{id}          {"name": "...", "query": "..."}
+//	DELETE /api/library/smart/{id}
+//	POST   /api/library/smart/preview       {"query": "..."} tracks without saving
+func (h *LibraryHandlers) SmartPlaylist(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	idStr := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/library/smart/"), "/")
+	if idStr == "preview" {
+		if r.Method != http.MethodPost {
+			jsonError(w, "method not allowed", 405)
+			return
+		}
+		var req smartPlaylistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		if err := req.validateQuery(); err != nil {
+			jsonError(w, err.Error(), 400)
+			return
+		}
+		h.writeSmartTracks(w, user.UserID, nil, req.Query)
+		return
+	}
+	idStr, sub, _ := strings.Cut(idStr, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	sp, err := h.DB.GetSmartPlaylist(id)
+	if err != nil || sp.OwnerID != user.UserID {
+		jsonError(w, "智能歌单不存在", 404)
+		return
+	}
+	if sub == "export" && r.Method == http.MethodGet {
+		tracks, err := evalSmartQuery(h.DB, user.UserID, sp.Query)
+		if err != nil {
+			jsonError(w, err.Error(), 400)
+			return
+		}
+		writePlaylistExport(w, r, user.UserID, sp.Name, tracks)
+		return
+	}
+	if sub != "" {
+		jsonError(w, "not found", 404)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.writeSmartTracks(w, user.UserID, sp, sp.Query)
+	case http.MethodPut:
+		var req smartPlaylistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		if err := req.validate(); err != nil {
+			jsonError(w, err.Error(), 400)
+			return
+		}
+		if err := h.DB.UpdateSmartPlaylist(sp.ID, user.UserID, req.Name, req.Query); err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		sp, _ = h.DB.GetSmartPlaylist(sp.ID)
+		jsonOK(w, sp)
+	case http.MethodDelete:
+		if err := h.DB.DeleteSmartPlaylist(sp.ID, user.UserID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				jsonError(w, "智能歌单不存在", 404)
+				return
+			}
+			jsonError(w, "删除失败", 500)
+			return
+		}
+		jsonOK(w, map[string]string{"message": "ok"})
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+func (h *LibraryHandlers) writeSmartTracks(w http.ResponseWriter, userID int64, sp *db.SmartPlaylist, query string) {
+	tracks, err := evalSmartQuery(h.DB, userID, query)
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
+	h.withProcessing(tracks)
+	resp := map[string]interface{}{"tracks": tracks}
+	if sp != nil {
+		resp["playlist"] = sp
+	}
+	jsonOK(w, resp)
+}
+
+// LoadSmartPlaylist handles POST /api/room/{code}/playlist/load
+// {"smart_id": 3, "replace": true}: evaluates one of the room owner's smart
+// playlists and puts the result into the room playlist.
+func (h *PlaylistHandlers) LoadSmartPlaylist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	code := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/room/"), "/")[0]
+	if !h.isRoomOwner(user.UserID, code) {
+		jsonError(w, "只有房主可以操作播放列表", 403)
+		return
+	}
+	var req struct {
+		SmartID int64 `json:"smart_id"`
+		Replace bool  `json:"replace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "invalid request", 400)
+		return
+	}
+	sp, err := h.DB.GetSmartPlaylist(req.SmartID)
+	if err != nil || sp.OwnerID != user.UserID {
+		jsonError(w, "智能歌单不存在", 404)
+		return
+	}
+	tracks, err := evalSmartQuery(h.DB, user.UserID, sp.Query)
+	if err != nil {
+		jsonError(w, err.Error(), 400)
+		return
+	}
+	pl, err := h.DB.GetOrCreatePlaylist(code, user.UserID)
+	if err != nil {
+		jsonError(w, "创建播放列表失败", 500)
+		return
+	}
+	ids := make([]int64, len(tracks))
+	for i, t := range tracks {
+		ids[i] = t.ID
+	}
+	if err := h.DB.ReplacePlaylistItems(pl.ID, ids, req.Replace); err != nil {
+		jsonError(w, "载入失败", 500)
+		return
+	}
+	if h.OnPlaylistUpdate != nil {
+		h.OnPlaylistUpdate(code)
+	}
+	jsonOK(w, map[string]interface{}{"added": len(ids)})
+}
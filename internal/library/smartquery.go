@@ -0,0 +1,480 @@
+package library
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Smart playlist rules are a small query language evaluated in memory against
+// the tracks a user can access, e.g.
+//
+//	genre=jazz AND year>=1990 AND rating>=4, order by last played, limit 50
+//	last_played < this_month OR plays = 0
+//	(artist ~ "miles" OR artist ~ coltrane) AND NOT favorite, order by random
+//
+// Conditions combine with AND, OR, NOT and parentheses. String fields support
+// = != (case-insensitive) and ~ !~ (contains); numeric and time fields support
+// = != < <= > >=. Time fields take a date (2024-06-01), a relative age (30d,
+// 2w, 12h), today, this_week, this_month, this_year or never. Ordering is
+// ascending unless followed by desc, as in SQL; order by random shuffles.
+
+const maxSmartTracks = 500
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindNumber
+	kindTime
+	kindBool
+)
+
+type smartField struct {
+	kind fieldKind
+	str  func(f *db.AudioFile) string
+	num  func(f *db.AudioFile) float64
+}
+
+var smartFields = map[string]smartField{
+	"title":  {kind: kindString, str: func(f *db.AudioFile) string { return f.Title }},
+	"artist": {kind: kindString, str: func(f *db.AudioFile) string { return f.Artist }},
+	"album":  {kind: kindString, str: func(f *db.AudioFile) string { return f.Album }},
+	"genre":  {kind: kindString, str: func(f *db.AudioFile) string { return f.Genre }},
+	"owner":  {kind: kindString, str: func(f *db.AudioFile) string { return f.OwnerName }},
+	"key":    {kind: kindString, str: func(f *db.AudioFile) string { return f.Key }},
+	"year": {kind: kindNumber, num: func(f *db.AudioFile) float64 {
+		y := f.Year
+		if len(y) > 4 {
+			y = y[:4]
+		}
+		n, _ := strconv.Atoi(y)
+		return float64(n)
+	}},
+	"duration":    {kind: kindNumber, num: func(f *db.AudioFile) float64 { return f.Duration }},
+	"bpm":         {kind: kindNumber, num: func(f *db.AudioFile) float64 { return f.BPM }},
+	"rating":      {kind: kindNumber, num: func(f *db.AudioFile) float64 { return f.AvgRating }},
+	"my_rating":   {kind: kindNumber, num: func(f *db.AudioFile) float64 { return float64(f.MyRating) }},
+	"favorites":   {kind: kindNumber, num: func(f *db.AudioFile) float64 { return float64(f.FavoriteCount) }},
+	"plays":       {kind: kindNumber, num: func(f *db.AudioFile) float64 { return float64(f.PlayCount) }},
+	"skips":       {kind: kindNumber, num: func(f *db.AudioFile) float64 { return float64(f.SkipCount) }},
+	"last_played": {kind: kindTime, num: func(f *db.AudioFile) float64 { return float64(f.LastPlayedAt) }},
+	"added":       {kind: kindTime, num: func(f *db.AudioFile) float64 { return float64(f.CreatedAt.Unix()) }},
+	"favorite": {kind: kindBool, num: func(f *db.AudioFile) float64 {
+		if f.Favorite {
+			return 1
+		}
+		return 0
+	}},
+}
+
+// smartQuery is a parsed rule set.
+type smartQuery struct {
+	where   smartNode // nil matches everything
+	orderBy string    // field name, "random" or ""
+	desc    bool
+	limit   int
+}
+
+type smartNode interface {
+	match(f *db.AudioFile) bool
+}
+
+type andNode struct{ l, r smartNode }
+type orNode struct{ l, r smartNode }
+type notNode struct{ n smartNode }
+
+func (n andNode) match(f *db.AudioFile) bool { return n.l.match(f) && n.r.match(f) }
+func (n orNode) match(f *db.AudioFile) bool  { return n.l.match(f) || n.r.match(f) }
+func (n notNode) match(f *db.AudioFile) bool { return !n.n.match(f) }
+
+type condNode struct {
+	field smartField
+	op    string
+	str   string
+	num   float64
+	// camelot also matches musical keys given in Camelot notation ("8A").
+	camelot bool
+}
+
+func (c condNode) match(f *db.AudioFile) bool {
+	if c.field.kind == kindString {
+		v := c.field.str(f)
+		switch c.op {
+		case "=":
+			return strings.EqualFold(v, c.str) || (c.camelot && strings.EqualFold(audio.CamelotCode(v), c.str))
+		case "!=":
+			return !strings.EqualFold(v, c.str)
+		case "~":
+			return strings.Contains(strings.ToLower(v), strings.ToLower(c.str))
+		case "!~":
+			return !strings.Contains(strings.ToLower(v), strings.ToLower(c.str))
+		}
+		return false
+	}
+	v := c.field.num(f)
+	switch c.op {
+	case "=":
+		return v == c.num
+	case "!=":
+		return v != c.num
+	case "<":
+		return v < c.num
+	case "<=":
+		return v <= c.num
+	case ">":
+		return v > c.num
+	case ">=":
+		return v >= c.num
+	}
+	return false
+}
+
+// --- Lexer ---
+
+type smartToken struct {
+	text   string
+	quoted bool
+}
+
+func lexSmartQuery(s string) ([]smartToken, error) {
+	var toks []smartToken
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(rs) && rs[j] != c {
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("语法错误: 引号未闭合")
+			}
+			toks = append(toks, smartToken{text: string(rs[i+1 : j]), quoted: true})
+			i = j + 1
+		case c == '(' || c == ')' || c == ',' || c == '=' || c == '~':
+			toks = append(toks, smartToken{text: string(c)})
+			i++
+		case c == '<' || c == '>' || c == '!':
+			if i+1 < len(rs) && (rs[i+1] == '=' || rs[i+1] == '~' || (c == '<' && rs[i+1] == '>')) {
+				op := string(rs[i : i+2])
+				if op == "<>" {
+					op = "!="
+				}
+				toks = append(toks, smartToken{text: op})
+				i += 2
+			} else if c == '!' {
+				return nil, fmt.Errorf("语法错误: 无效的运算符 !")
+			} else {
+				toks = append(toks, smartToken{text: string(c)})
+				i++
+			}
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune(`()",'=~<>!`, rs[j]) {
+				j++
+			}
+			toks = append(toks, smartToken{text: string(rs[i:j])})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// --- Parser ---
+
+type smartParser struct {
+	toks []smartToken
+	pos  int
+}
+
+func (p *smartParser) peek() string {
+	if p.pos >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos].text
+}
+
+// keyword reports whether the next token is the unquoted keyword kw.
+func (p *smartParser) keyword(kw string) bool {
+	return p.pos < len(p.toks) && !p.toks[p.pos].quoted && strings.EqualFold(p.toks[p.pos].text, kw)
+}
+
+func (p *smartParser) atClauseEnd() bool {
+	return p.pos >= len(p.toks) || p.peek() == "," || p.keyword("order") || p.keyword("limit")
+}
+
+// parseSmartQuery parses a rule set; see the comment at the top of this file.
+func parseSmartQuery(s string) (*smartQuery, error) {
+	toks, err := lexSmartQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &smartParser{toks: toks}
+	q := &smartQuery{}
+	if !p.atClauseEnd() {
+		if q.where, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	for p.pos < len(p.toks) {
+		if p.peek() == "," {
+			p.pos++
+			continue
+		}
+		switch {
+		case p.keyword("order"):
+			p.pos++
+			if !p.keyword("by") {
+				return nil, fmt.Errorf("语法错误: order 后应为 by")
+			}
+			p.pos++
+			// Field names may be written with spaces ("last played").
+			var words []string
+			for p.pos < len(p.toks) && p.peek() != "," && !p.keyword("limit") && !p.keyword("asc") && !p.keyword("desc") {
+				words = append(words, strings.ToLower(p.peek()))
+				p.pos++
+			}
+			q.orderBy = strings.Join(words, "_")
+			if _, ok := smartFields[q.orderBy]; !ok && q.orderBy != "random" {
+				return nil, fmt.Errorf("不支持的排序字段: %s", strings.Join(words, " "))
+			}
+			if p.keyword("asc") || p.keyword("desc") {
+				q.desc = p.keyword("desc")
+				p.pos++
+			}
+		case p.keyword("limit"):
+			p.pos++
+			n, err := strconv.Atoi(p.peek())
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("语法错误: limit 应为正整数")
+			}
+			q.limit = n
+			p.pos++
+		default:
+			return nil, fmt.Errorf("语法错误: 无法识别 %q", p.peek())
+		}
+	}
+	if q.limit == 0 || q.limit > maxSmartTracks {
+		q.limit = maxSmartTracks
+	}
+	return q, nil
+}
+
+func (p *smartParser) parseOr() (smartNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		p.pos++
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *smartParser) parseAnd() (smartNode, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		p.pos++
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *smartParser) parseUnary() (smartNode, error) {
+	if p.keyword("not") {
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	if p.peek() == "(" && !p.toks[p.pos].quoted {
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("语法错误: 缺少 )")
+		}
+		p.pos++
+		return n, nil
+	}
+	return p.parseCond()
+}
+
+func (p *smartParser) parseCond() (smartNode, error) {
+	name := strings.ToLower(p.peek())
+	if name == "" {
+		return nil, fmt.Errorf("语法错误: 条件不完整")
+	}
+	field, ok := smartFields[name]
+	if !ok {
+		return nil, fmt.Errorf("不支持的字段: %s", name)
+	}
+	p.pos++
+	op := p.peek()
+	if field.kind == kindBool && (p.atClauseEnd() || p.keyword("and") || p.keyword("or") || op == ")") {
+		return condNode{field: field, op: "=", num: 1}, nil // bare "favorite"
+	}
+	switch op {
+	case "=", "!=", "~", "!~", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("语法错误: %s 后缺少运算符", name)
+	}
+	p.pos++
+	if p.pos >= len(p.toks) {
+		return nil, fmt.Errorf("语法错误: %s 缺少比较值", name)
+	}
+	val := p.toks[p.pos].text
+	p.pos++
+
+	c := condNode{field: field, op: op, str: val, camelot: name == "key"}
+	isStrOp := op == "~" || op == "!~"
+	switch field.kind {
+	case kindString:
+		if op != "=" && op != "!=" && !isStrOp {
+			return nil, fmt.Errorf("%s 只支持 = != ~ !~", name)
+		}
+		return c, nil
+	case kindBool:
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("%s 只支持 = !=", name)
+		}
+		switch strings.ToLower(val) {
+		case "true", "yes", "1":
+			c.num = 1
+		case "false", "no", "0":
+			c.num = 0
+		default:
+			return nil, fmt.Errorf("%s 的值应为 true 或 false", name)
+		}
+		return c, nil
+	}
+	if isStrOp {
+		return nil, fmt.Errorf("%s 不支持 ~", name)
+	}
+	var err error
+	if field.kind == kindTime {
+		c.num, err = parseSmartTime(val, time.Now())
+	} else {
+		c.num, err = parseSmartNumber(val)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s 的值无效: %s", name, val)
+	}
+	return c, nil
+}
+
+// parseSmartNumber accepts plain numbers and m:ss durations.
+func parseSmartNumber(s string) (float64, error) {
+	if m, sec, ok := strings.Cut(s, ":"); ok {
+		mi, err1 := strconv.Atoi(m)
+		se, err2 := strconv.ParseFloat(sec, 64)
+		if err1 != nil || err2 != nil {
+			return 0, fmt.Errorf("invalid duration")
+		}
+		return float64(mi*60) + se, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseSmartTime converts a time value to unix seconds relative to now.
+func parseSmartTime(s string, now time.Time) (float64, error) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch strings.ToLower(s) {
+	case "never":
+		return 0, nil
+	case "now":
+		return float64(now.Unix()), nil
+	case "today":
+		return float64(day.Unix()), nil
+	case "this_week":
+		offset := (int(day.Weekday()) + 6) % 7 // weeks start on Monday
+		return float64(day.AddDate(0, 0, -offset).Unix()), nil
+	case "this_month":
+		return float64(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Unix()), nil
+	case "this_year":
+		return float64(time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location()).Unix()), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return float64(t.Unix()), nil
+	}
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid time")
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid time")
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("invalid time")
+	}
+	return float64(now.Add(-time.Duration(n * float64(unit))).Unix()), nil
+}
+
+// apply filters, orders and limits files. files must already carry the
+// caller's track stats (FillTrackStats).
+func (q *smartQuery) apply(files []*db.AudioFile) []*db.AudioFile {
+	out := make([]*db.AudioFile, 0, len(files))
+	for _, f := range files {
+		if q.where == nil || q.where.match(f) {
+			out = append(out, f)
+		}
+	}
+	switch q.orderBy {
+	case "":
+	case "random":
+		rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	default:
+		field := smartFields[q.orderBy]
+		less := func(a, b *db.AudioFile) bool {
+			if field.kind == kindString {
+				return strings.ToLower(field.str(a)) < strings.ToLower(field.str(b))
+			}
+			return field.num(a) < field.num(b)
+		}
+		sort.SliceStable(out, func(i, j int) bool {
+			if q.desc {
+				return less(out[j], out[i])
+			}
+			return less(out[i], out[j])
+		})
+	}
+	if len(out) > q.limit {
+		out = out[:q.limit]
+	}
+	return out
+}
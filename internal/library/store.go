@@ -0,0 +1,135 @@
+package library
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/storage"
+)
+
+// Processing always happens on local disk under DataDir. With a remote store the
+// track directory is a staging area: it is uploaded once every tier is done and
+// then removed, so reads check the local copy first.
+
+// trackKey is the storage key prefix of a track: "library/{ownerID}/{uuid}".
+func trackKey(af *db.AudioFile) string {
+	return path.Join("library", strconv.FormatInt(af.OwnerID, 10), af.Filename)
+}
+
+// serveObject serves key from the local staging copy if present, otherwise from the store.
+func (h *LibraryHandlers) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	if local := filepath.Join(h.DataDir, filepath.FromSlash(key)); fileExists(local) {
+		http.ServeFile(w, r, local)
+		return
+	}
+	h.Store.Serve(w, r, key)
+}
+
+// readObject returns the content of key from local staging or the store.
+func readObject(store storage.Store, dataDir, key string) ([]byte, error) {
+	if data, err := os.ReadFile(filepath.Join(dataDir, filepath.FromSlash(key))); err == nil {
+		return data, nil
+	}
+	rc, err := store.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// loadManifest reads a track's manifest.json wherever it currently lives.
+func (h *LibraryHandlers) loadManifest(af *db.AudioFile) (*audio.MultiQualityManifest, error) {
+	return loadTrackManifest(h.Store, h.DataDir, af)
+}
+
+func loadTrackManifest(store storage.Store, dataDir string, af *db.AudioFile) (*audio.MultiQualityManifest, error) {
+	data, err := readObject(store, dataDir, trackKey(af)+"/manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	var m audio.MultiQualityManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// openObject opens key from local staging or the store.
+func openObject(store storage.Store, dataDir, key string) (io.ReadCloser, error) {
+	if f, err := os.Open(filepath.Join(dataDir, filepath.FromSlash(key))); err == nil {
+		return f, nil
+	}
+	return store.Open(key)
+}
+
+// publishTrack uploads every file under audioDir to a remote store and then
+// removes the local copy. It does nothing for the local store.
+func publishTrack(store storage.Store, dataDir, audioDir string) error {
+	if store.Local() {
+		return nil
+	}
+	err := filepath.WalkDir(audioDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".retranscode" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return err
+		}
+		return store.Put(filepath.ToSlash(rel), p)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(audioDir)
+}
+
+// fetchOriginal downloads a track's original from the store into audioDir,
+// returning its local path or "" if the store has none.
+func fetchOriginal(store storage.Store, audioDir string, af *db.AudioFile) (string, error) {
+	keys, err := store.List(trackKey(af))
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		name := path.Base(key)
+		if matched, _ := path.Match("original.*", name); !matched {
+			continue
+		}
+		rc, err := store.Open(key)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		if err := os.MkdirAll(audioDir, 0755); err != nil {
+			return "", err
+		}
+		dst := filepath.Join(audioDir, name)
+		out, err := os.Create(dst)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(out, rc); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return "", err
+		}
+		return dst, out.Close()
+	}
+	return "", nil
+}
@@ -0,0 +1,367 @@
+package library
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Stream URLs let plain players and download buttons fetch a whole track,
+// either the original upload or one tier's segments joined together
+// (?quality=). They accept either a logged-in user with access to the track or
+// a stream token (?st=) for it, which is what exported playlists carry. The
+// user a stream token was issued to must still have access when it is used.
+// Segment tokens are not enough: they are handed to every room listener.
+
+// streamURL returns an absolute URL for af's stream, signed until exp.
+func streamURL(base string, af *db.AudioFile, token string) string {
+	return base + "/api/library/files/" + strconv.FormatInt(af.ID, 10) + "/stream?st=" + token
+}
+
+// streamFileID extracts {id} from /api/library/files/{id}/stream.
+func streamFileID(urlPath string) (int64, bool) {
+	rest := strings.Trim(strings.TrimPrefix(urlPath, "/api/library/files/"), "/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	if sub != "stream" {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	return id, err == nil
+}
+
+// ServeStream handles GET /api/library/files/{id}/stream[?quality=original|lossless|high|medium|low].
+// Signed requests are served without a session; anything else goes through
+// fallback, which must be the authenticated handler.
+func (h *LibraryHandlers) ServeStream(w http.ResponseWriter, r *http.Request, fallback http.HandlerFunc) {
+	id, ok := streamFileID(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if uid, ok := auth.VerifyStreamToken(r.URL.Query().Get("st"), id); ok {
+		if can, _ := h.DB.CanAccessAudioFile(uid, id); !can {
+			jsonError(w, "文件不存在", 404)
+			return
+		}
+		if af, err := h.DB.GetAudioFileByID(id); err == nil {
+			h.sendStream(w, r, af, r.URL.Query().Get("quality"))
+			return
+		}
+	}
+	fallback(w, r)
+}
+
+// GetStream is the authenticated side of ServeStream.
+func (h *LibraryHandlers) GetStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	id, ok := streamFileID(r.URL.Path)
+	if !ok {
+		jsonError(w, "invalid path", 400)
+		return
+	}
+	if can, _ := h.DB.CanAccessAudioFile(user.UserID, id); !can {
+		jsonError(w, "文件不存在", 404)
+		return
+	}
+	af, err := h.DB.GetAudioFileByID(id)
+	if err != nil {
+		jsonError(w, "文件不存在", 404)
+		return
+	}
+	h.sendStream(w, r, af, r.URL.Query().Get("quality"))
+}
+
+// StreamTrack serves af as a single file for other frontends (Subsonic);
+// the caller has already checked access. quality is as for GetStream.
+func (h *LibraryHandlers) StreamTrack(w http.ResponseWriter, r *http.Request, af *db.AudioFile, quality string) {
+	h.sendStream(w, r, af, quality)
+}
+
+// ServeTrackCover serves af's cover art, or 404 if it has none. The caller has
+// already checked access.
+func (h *LibraryHandlers) ServeTrackCover(w http.ResponseWriter, r *http.Request, af *db.AudioFile) {
+	if af.CoverArt == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	w.Header().Set("Content-Type", "image/jpeg")
+	h.serveObject(w, r, trackKey(af)+"/cover.jpg")
+}
+
+// TrackSourcePath returns a local file with all of af for decoding: the
+// original if it is on disk, else the best tier joined into one FLAC.
+func (h *LibraryHandlers) TrackSourcePath(af *db.AudioFile) (string, error) {
+	if p := findOriginal(trackDir(h.DataDir, af)); p != "" {
+		return p, nil
+	}
+	p, _, err := h.streamFile(af, "")
+	return p, err
+}
+
+// tierKbps is the nominal bitrate of each tier, as the player shows them.
+var tierKbps = map[string]int{"high": 256, "medium": 128, "low": 64}
+
+// QualityForBitrate picks the best quality for a client that wants at most
+// maxKbps (0 = no limit): the original if it fits, else the best tier under
+// the limit, else the smallest tier.
+func (h *LibraryHandlers) QualityForBitrate(af *db.AudioFile, maxKbps int) string {
+	if maxKbps <= 0 || (af.OriginalBitrate > 0 && af.OriginalBitrate <= maxKbps) {
+		return ""
+	}
+	m, err := h.loadManifest(af)
+	if err != nil {
+		return ""
+	}
+	best := ""
+	for _, name := range tierPreference {
+		if qi := m.Qualities[name]; qi == nil || len(qi.Segments) == 0 {
+			continue
+		}
+		kbps, ok := tierKbps[name]
+		if ok && kbps <= maxKbps {
+			return name
+		}
+		best = name
+	}
+	return best
+}
+
+// sendStream serves af with Range support. quality "" serves the original,
+// or the best tier if the original was dropped; "original" insists on the
+// original; a tier name serves that tier's segments joined into one FLAC.
+func (h *LibraryHandlers) sendStream(w http.ResponseWriter, r *http.Request, af *db.AudioFile, quality string) {
+	base := strings.TrimSuffix(af.OriginalName, path.Ext(af.OriginalName))
+	switch {
+	case quality == "" || quality == TierOriginal:
+		if key := h.originalKey(af); key != "" {
+			if ct := mime.TypeByExtension(path.Ext(key)); ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			w.Header().Set("X-Stream-Quality", TierOriginal)
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": af.OriginalName}))
+			h.serveObject(w, r, key)
+			return
+		}
+		if quality == TierOriginal {
+			jsonError(w, "原始文件不可用", 404)
+			return
+		}
+	case !containsString(tierPreference, quality):
+		jsonError(w, "无效的音质", 400)
+		return
+	}
+
+	p, tier, err := h.streamFile(af, quality)
+	if errors.Is(err, errTierUnavailable) {
+		jsonError(w, "该音质不可用", 404)
+		return
+	}
+	if err != nil {
+		log.Printf("[stream] build %d/%s: %v", af.ID, quality, err)
+		jsonError(w, "生成音频失败", 500)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		jsonError(w, "生成音频失败", 500)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		jsonError(w, "生成音频失败", 500)
+		return
+	}
+	// The cache file name changes whenever the tier is re-encoded, so it
+	// doubles as a strong validator for If-Range.
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(filepath.Base(p), ".flac")+`"`)
+	w.Header().Set("Content-Type", "audio/flac")
+	w.Header().Set("X-Stream-Quality", tier)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": base + ".flac"}))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// --- Joined tier cache ---
+
+// Joining segments runs ffmpeg, so the result is kept under data/cache/stream
+// until the tier changes or the cache outgrows STREAM_CACHE_MB (default 2048),
+// in which case the least recently served files go first.
+
+const streamCacheDir = "cache/stream"
+
+// streamCacheGrace protects files served or built this recently from pruning,
+// so a path handed out by streamFile is still there when the caller opens it.
+const streamCacheGrace = time.Minute
+
+var errTierUnavailable = errors.New("tier unavailable")
+
+var streamBuilds = struct {
+	sync.Mutex
+	m map[string]*sync.WaitGroup
+}{m: make(map[string]*sync.WaitGroup)}
+
+func streamCacheLimit() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("STREAM_CACHE_MB"), 10, 64); err == nil && n > 0 {
+		return n << 20
+	}
+	return 2048 << 20
+}
+
+// streamFile returns the path of af's tier joined into one FLAC, building it
+// if needed. want "" picks the best tier available.
+func (h *LibraryHandlers) streamFile(af *db.AudioFile, want string) (string, string, error) {
+	data, err := readObject(h.Store, h.DataDir, trackKey(af)+"/manifest.json")
+	if err != nil {
+		return "", "", errTierUnavailable
+	}
+	var m audio.MultiQualityManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", "", err
+	}
+	tier := ""
+	for _, name := range tierPreference {
+		if want != "" && name != want {
+			continue
+		}
+		if qi := m.Qualities[name]; qi != nil && len(qi.Segments) > 0 {
+			tier = name
+			break
+		}
+	}
+	if tier == "" {
+		return "", "", errTierUnavailable
+	}
+
+	dir := filepath.Join(h.DataDir, filepath.FromSlash(streamCacheDir))
+	sum := sha1.Sum(data)
+	p := filepath.Join(dir, fmt.Sprintf("%d_%s_%x.flac", af.ID, tier, sum[:6]))
+	for {
+		// Touching the file both marks it recently used and checks it exists;
+		// if the pruner got to it first it is simply built again.
+		now := time.Now()
+		if os.Chtimes(p, now, now) == nil {
+			return p, tier, nil
+		}
+		streamBuilds.Lock()
+		if wg := streamBuilds.m[p]; wg != nil {
+			streamBuilds.Unlock()
+			wg.Wait()
+			if fileExists(p) {
+				continue
+			}
+			return "", "", errors.New("build failed")
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		streamBuilds.m[p] = wg
+		streamBuilds.Unlock()
+
+		err := h.buildStreamFile(dir, p, af, tier)
+		streamBuilds.Lock()
+		delete(streamBuilds.m, p)
+		streamBuilds.Unlock()
+		wg.Done()
+		if err != nil {
+			return "", "", err
+		}
+		return p, tier, nil
+	}
+}
+
+func (h *LibraryHandlers) buildStreamFile(dir, p string, af *db.AudioFile, tier string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dir, ".build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	out, _, err := h.materializeTier(tmp, af, tier)
+	if err != nil {
+		return err
+	}
+	// Drop joins of older encodes of this tier before adding the new one.
+	old, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%d_%s_*.flac", af.ID, tier)))
+	for _, f := range old {
+		os.Remove(f)
+	}
+	if err := os.Rename(out, p); err != nil {
+		return err
+	}
+	pruneStreamCache(dir, streamCacheLimit(), p)
+	return nil
+}
+
+// pruneStreamCache removes the least recently used files until the cache fits
+// in limit bytes, never removing keep or files used within streamCacheGrace.
+func pruneStreamCache(dir string, limit int64, keep string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	type cached struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []cached
+	var total int64
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".flac") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cached{filepath.Join(dir, e.Name()), fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	young := time.Now().Add(-streamCacheGrace)
+	for _, f := range files {
+		if total <= limit || f.mtime.After(young) {
+			break
+		}
+		if f.path == keep {
+			continue
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+		}
+	}
+}
+
+// dropStreamCache removes every joined tier of a deleted track.
+func (h *LibraryHandlers) dropStreamCache(audioID int64) {
+	files, _ := filepath.Glob(filepath.Join(h.DataDir, filepath.FromSlash(streamCacheDir), fmt.Sprintf("%d_*.flac", audioID)))
+	for _, f := range files {
+		os.Remove(f)
+	}
+}
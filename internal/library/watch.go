@@ -0,0 +1,287 @@
+package library
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// The folder watcher polls an admin-configured directory on the server and
+// ingests new audio files into a chosen user's library, exactly as if they had
+// been uploaded. Every file it has looked at is recorded in watch_files, so a
+// file is imported once; failed files are retried only after they change.
+
+const (
+	watchSettingKey     = "folder_watch"
+	defaultWatchSeconds = 300
+	minWatchSeconds     = 30
+	// Files modified more recently than this may still be copying in.
+	watchSettleTime = 30 * time.Second
+)
+
+// WatchConfig is the folder watch configuration, stored in server_settings.
+type WatchConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Dir      string `json:"dir"`
+	OwnerID  int64  `json:"owner_id"`
+	Interval int    `json:"interval"` // seconds between scans
+}
+
+// WatchStatus describes the watcher's most recent scan.
+type WatchStatus struct {
+	Scanning  bool       `json:"scanning"`
+	LastScan  *time.Time `json:"last_scan,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Imported  int        `json:"imported"`
+	Failed    int        `json:"failed"`
+}
+
+func (h *LibraryHandlers) loadWatchConfig() WatchConfig {
+	cfg := WatchConfig{Interval: defaultWatchSeconds}
+	if raw, err := h.DB.GetServerSetting(watchSettingKey); err == nil && raw != "" {
+		json.Unmarshal([]byte(raw), &cfg)
+	}
+	if cfg.Interval < minWatchSeconds {
+		cfg.Interval = minWatchSeconds
+	}
+	return cfg
+}
+
+// StartFolderWatch runs the folder watcher in the background. Configuration is
+// re-read before every scan, so changes apply without a restart.
+func (h *LibraryHandlers) StartFolderWatch() {
+	h.watchMu.Lock()
+	if h.watchKick != nil {
+		h.watchMu.Unlock()
+		return
+	}
+	h.watchKick = make(chan struct{}, 1)
+	h.watchMu.Unlock()
+
+	go func() {
+		for {
+			cfg := h.loadWatchConfig()
+			if cfg.Enabled && cfg.Dir != "" {
+				h.scanWatchDir(cfg)
+			}
+			select {
+			case <-time.After(time.Duration(cfg.Interval) * time.Second):
+			case <-h.watchKick:
+			}
+		}
+	}()
+}
+
+// kickFolderWatch asks the watcher to scan now instead of waiting for the interval.
+func (h *LibraryHandlers) kickFolderWatch() {
+	h.watchMu.Lock()
+	kick := h.watchKick
+	h.watchMu.Unlock()
+	if kick == nil {
+		return
+	}
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+}
+
+func (h *LibraryHandlers) scanWatchDir(cfg WatchConfig) {
+	h.watchMu.Lock()
+	h.watchStatus.Scanning = true
+	h.watchMu.Unlock()
+
+	imported, failed, err := h.ingestWatchDir(cfg)
+
+	h.watchMu.Lock()
+	now := time.Now()
+	h.watchStatus = WatchStatus{LastScan: &now, Imported: imported, Failed: failed}
+	if err != nil {
+		h.watchStatus.LastError = err.Error()
+		log.Printf("folder watch %s: %v", cfg.Dir, err)
+	}
+	h.watchMu.Unlock()
+	if imported+failed > 0 {
+		log.Printf("folder watch %s: %d imported, %d failed", cfg.Dir, imported, failed)
+	}
+}
+
+func (h *LibraryHandlers) ingestWatchDir(cfg WatchConfig) (imported, failed int, err error) {
+	if _, err := h.DB.GetUserByID(cfg.OwnerID); err != nil {
+		return 0, 0, err
+	}
+	seen, err := h.DB.GetWatchFiles()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = filepath.WalkDir(cfg.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Unreadable subdirectory: skip it rather than abort the scan.
+			if d != nil && d.IsDir() && p != cfg.Dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != cfg.Dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !allowedAudioExts[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < watchSettleTime {
+			return nil
+		}
+		prev := seen[p]
+		// Imported files are never re-imported, even if edited or deleted from the library.
+		if prev != nil && (prev.AudioID > 0 || (prev.Size == info.Size() && prev.ModTime == info.ModTime().Unix())) {
+			return nil
+		}
+
+		rec := &db.WatchFile{Path: p, Size: info.Size(), ModTime: info.ModTime().Unix()}
+		if af, err := h.ingestWatchFile(cfg.OwnerID, p); err != nil {
+			rec.Error = err.Error()
+			failed++
+			log.Printf("folder watch: %s: %v", p, err)
+		} else {
+			rec.AudioID = af.ID
+			imported++
+		}
+		h.DB.SaveWatchFile(rec)
+		return nil
+	})
+	return imported, failed, err
+}
+
+// ingestWatchFile imports one file, picking up a sidecar .lrc with the same base name.
+func (h *LibraryHandlers) ingestWatchFile(ownerID int64, p string) (*db.AudioFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var defaults trackMeta
+	if data, err := os.ReadFile(strings.TrimSuffix(p, filepath.Ext(p)) + ".lrc"); err == nil && len(data) <= maxLyricsSize {
+		defaults.Lyrics = string(data)
+	}
+	return h.ingestTrack(ownerID, f, filepath.Base(p), defaults, trackMeta{})
+}
+
+// validateWatchConfig checks cfg and returns a user-facing message if it is unusable.
+func (h *LibraryHandlers) validateWatchConfig(cfg *WatchConfig) string {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultWatchSeconds
+	}
+	if cfg.Interval < minWatchSeconds {
+		return "扫描间隔不能小于30秒"
+	}
+	if cfg.Dir == "" {
+		if cfg.Enabled {
+			return "请指定导入目录"
+		}
+		return ""
+	}
+	if !filepath.IsAbs(cfg.Dir) {
+		return "导入目录必须是绝对路径"
+	}
+	cfg.Dir = filepath.Clean(cfg.Dir)
+	if st, err := os.Stat(cfg.Dir); err != nil || !st.IsDir() {
+		return "导入目录不存在"
+	}
+	// Watching the data directory would re-import our own originals.
+	if data, err := filepath.Abs(h.DataDir); err == nil {
+		if rel, err := filepath.Rel(data, cfg.Dir); err == nil && !strings.HasPrefix(rel, "..") {
+			return "导入目录不能位于数据目录内"
+		}
+		if rel, err := filepath.Rel(cfg.Dir, data); err == nil && !strings.HasPrefix(rel, "..") {
+			return "导入目录不能包含数据目录"
+		}
+	}
+	if _, err := h.DB.GetUserByID(cfg.OwnerID); err != nil {
+		return "归属用户不存在"
+	}
+	return ""
+}
+
+type watchResponse struct {
+	Config    WatchConfig     `json:"config"`
+	OwnerName string          `json:"owner_name,omitempty"`
+	Status    WatchStatus     `json:"status"`
+	Failures  []*db.WatchFile `json:"failures"`
+}
+
+// FolderWatch handles GET/PUT /api/admin/library/watch (owner only).
+// PUT body: {"enabled": true, "dir": "/srv/music", "owner_id": 1, "interval": 300}
+func (h *LibraryHandlers) FolderWatch(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil || user.Role != "owner" {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var cfg WatchConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		if msg := h.validateWatchConfig(&cfg); msg != "" {
+			jsonError(w, msg, 400)
+			return
+		}
+		raw, _ := json.Marshal(cfg)
+		if err := h.DB.SetServerSetting(watchSettingKey, string(raw)); err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		h.kickFolderWatch()
+	default:
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+
+	resp := watchResponse{Config: h.loadWatchConfig(), Failures: []*db.WatchFile{}}
+	if u, err := h.DB.GetUserByID(resp.Config.OwnerID); err == nil {
+		resp.OwnerName = u.Username
+	}
+	h.watchMu.Lock()
+	resp.Status = h.watchStatus
+	h.watchMu.Unlock()
+	if failures, err := h.DB.GetFailedWatchFiles(50); err == nil && failures != nil {
+		resp.Failures = failures
+	}
+	jsonOK(w, resp)
+}
+
+// ScanFolderWatch handles POST /api/admin/library/watch/scan (owner only): scan now.
+func (h *LibraryHandlers) ScanFolderWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil || user.Role != "owner" {
+		jsonError(w, "forbidden", 403)
+		return
+	}
+	if cfg := h.loadWatchConfig(); !cfg.Enabled || cfg.Dir == "" {
+		jsonError(w, "目录监视未启用", 400)
+		return
+	}
+	h.kickFolderWatch()
+	jsonOK(w, map[string]bool{"ok": true})
+}
@@ -0,0 +1,331 @@
+package lyrics
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	lrcTimeRe   = regexp.MustCompile(`^\[(\d{1,3}):(\d{1,2})(?:[.:](\d{1,3}))?\]`)
+	lrcMetaRe   = regexp.MustCompile(`^\[([a-zA-Z#]+):(.*)\]$`)
+	lrcWordRe   = regexp.MustCompile(`<(\d{1,3}):(\d{1,2})(?:[.:](\d{1,3}))?>`)
+	srtTimingRe = regexp.MustCompile(`(\d{1,2}):(\d{2}):(\d{2})[,.](\d{1,3})\s*-->\s*(\d{1,2}):(\d{2}):(\d{2})[,.](\d{1,3})`)
+)
+
+// ParseLRC parses LRC text. Lines sharing a timestamp with an earlier line are
+// treated as its translation. Text without any timestamps yields unsynced lyrics.
+func ParseLRC(data string) *Lyrics {
+	l := &Lyrics{Format: "lrc", Synced: true}
+	var plain []string
+	byTime := make(map[int]int) // centiseconds -> line index
+	offset := 0.0
+
+	for _, raw := range strings.Split(strings.ReplaceAll(strings.TrimPrefix(data, "\uFEFF"), "\r", ""), "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
+
+		var times []float64
+		for {
+			m := lrcTimeRe.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+			times = append(times, clockSeconds("0", m[1], m[2], m[3]))
+			line = line[len(m[0]):]
+		}
+
+		if len(times) == 0 {
+			if m := lrcMetaRe.FindStringSubmatch(line); m != nil {
+				key, val := strings.ToLower(m[1]), strings.TrimSpace(m[2])
+				if key == "offset" {
+					// Positive offset means lyrics should appear earlier.
+					if ms, err := strconv.Atoi(strings.TrimPrefix(val, "+")); err == nil {
+						offset = float64(ms) / 1000
+					}
+				}
+				if l.Meta == nil {
+					l.Meta = make(map[string]string)
+				}
+				l.Meta[key] = val
+				continue
+			}
+			plain = append(plain, line)
+			continue
+		}
+
+		text, words := parseLRCWords(line)
+		for _, t := range times {
+			key := int(t * 100)
+			if idx, ok := byTime[key]; ok {
+				if l.Lines[idx].Translation == "" {
+					l.Lines[idx].Translation = text
+				}
+				continue
+			}
+			byTime[key] = len(l.Lines)
+			// Word timings are written against the first timestamp; each repeat
+			// of the line gets its own copy moved to its own time.
+			l.Lines = append(l.Lines, Line{Time: t, Text: text, Words: shiftWords(words, t-times[0])})
+		}
+	}
+
+	if len(l.Lines) == 0 {
+		l.Format, l.Synced = "text", false
+		for _, p := range plain {
+			l.Lines = append(l.Lines, Line{Text: p})
+		}
+		return l
+	}
+
+	if offset != 0 {
+		for i := range l.Lines {
+			l.Lines[i].Time = clampZero(l.Lines[i].Time - offset)
+			for j := range l.Lines[i].Words {
+				w := &l.Lines[i].Words[j]
+				w.Time = clampZero(w.Time - offset)
+				if w.End != 0 {
+					w.End = clampZero(w.End - offset)
+				}
+			}
+		}
+	}
+	l.finish()
+	return l
+}
+
+// parseLRCWords splits an enhanced LRC line into plain text and word timings.
+func parseLRCWords(line string) (string, []Word) {
+	locs := lrcWordRe.FindAllStringSubmatchIndex(line, -1)
+	if locs == nil {
+		return strings.TrimSpace(line), nil
+	}
+	var words []Word
+	var text strings.Builder
+	text.WriteString(line[:locs[0][0]])
+	for i, loc := range locs {
+		t := clockSeconds("0", line[loc[2]:loc[3]], line[loc[4]:loc[5]], submatch(line, loc, 6))
+		end := len(line)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		w := line[loc[1]:end]
+		text.WriteString(w)
+		if strings.TrimSpace(w) == "" {
+			// A trailing <mm:ss.xx> marks the end of the previous word.
+			if n := len(words); n > 0 && words[n-1].End == 0 {
+				words[n-1].End = t
+			}
+			continue
+		}
+		words = append(words, Word{Time: t, Text: w})
+	}
+	return strings.TrimSpace(text.String()), words
+}
+
+// shiftWords returns a copy of words moved by d seconds.
+func shiftWords(words []Word, d float64) []Word {
+	if words == nil {
+		return nil
+	}
+	out := make([]Word, len(words))
+	for i, w := range words {
+		w.Time += d
+		if w.End != 0 {
+			w.End += d
+		}
+		out[i] = w
+	}
+	return out
+}
+
+// ParseSRT parses SubRip subtitles. Multi-line cues are joined with newlines.
+func ParseSRT(data string) (*Lyrics, error) {
+	l := &Lyrics{Format: "srt", Synced: true}
+	blocks := strings.Split(strings.ReplaceAll(strings.TrimPrefix(data, "\uFEFF"), "\r", ""), "\n\n")
+	for _, block := range blocks {
+		var cue *Line
+		var text []string
+		for _, row := range strings.Split(strings.TrimSpace(block), "\n") {
+			if cue == nil {
+				if m := srtTimingRe.FindStringSubmatch(row); m != nil {
+					cue = &Line{
+						Time: clockSeconds(m[1], m[2], m[3], m[4]),
+						End:  clockSeconds(m[5], m[6], m[7], m[8]),
+					}
+				}
+				continue
+			}
+			if s := strings.TrimSpace(row); s != "" {
+				text = append(text, s)
+			}
+		}
+		if cue == nil || len(text) == 0 {
+			continue
+		}
+		cue.Text = strings.Join(text, "\n")
+		l.Lines = append(l.Lines, *cue)
+	}
+	if len(l.Lines) == 0 {
+		return nil, fmt.Errorf("no SRT cues found")
+	}
+	l.finish()
+	return l, nil
+}
+
+// ParseTTML parses TTML/DFXP. Each <p> is a line; timed <span>s become words and
+// spans with a translation role (ttm:role="x-translation") become the translation.
+func ParseTTML(data string) (*Lyrics, error) {
+	l := &Lyrics{Format: "ttml", Synced: true}
+	dec := xml.NewDecoder(strings.NewReader(data))
+	dec.Strict = false
+
+	var cur *Line
+	var spanStack []*Word // nil entries for untimed spans
+	translation := 0      // depth inside translation spans
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p":
+				begin, end := ttmlAttr(t, "begin"), ttmlAttr(t, "end")
+				cur = &Line{Time: parseTTMLTime(begin), End: parseTTMLTime(end)}
+			case "span":
+				if cur == nil {
+					continue
+				}
+				if strings.Contains(ttmlAttr(t, "role"), "translation") || translation > 0 {
+					translation++
+					spanStack = append(spanStack, nil)
+					continue
+				}
+				if begin := ttmlAttr(t, "begin"); begin != "" {
+					spanStack = append(spanStack, &Word{Time: parseTTMLTime(begin), End: parseTTMLTime(ttmlAttr(t, "end"))})
+				} else {
+					spanStack = append(spanStack, nil)
+				}
+			case "br":
+				if cur != nil {
+					cur.Text += " "
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "p":
+				if cur != nil {
+					cur.Text = strings.Join(strings.Fields(cur.Text), " ")
+					cur.Translation = strings.Join(strings.Fields(cur.Translation), " ")
+					if cur.Text != "" {
+						l.Lines = append(l.Lines, *cur)
+					}
+				}
+				cur, spanStack, translation = nil, nil, 0
+			case "span":
+				if n := len(spanStack); n > 0 {
+					if w := spanStack[n-1]; w != nil && cur != nil && strings.TrimSpace(w.Text) != "" {
+						w.Text = strings.TrimSpace(w.Text)
+						cur.Words = append(cur.Words, *w)
+					}
+					spanStack = spanStack[:n-1]
+				}
+				if translation > 0 {
+					translation--
+				}
+			}
+		case xml.CharData:
+			if cur == nil {
+				continue
+			}
+			s := string(t)
+			if translation > 0 {
+				cur.Translation += s
+				continue
+			}
+			cur.Text += s
+			for i := len(spanStack) - 1; i >= 0; i-- {
+				if spanStack[i] != nil {
+					spanStack[i].Text += s
+					break
+				}
+			}
+		}
+	}
+	if len(l.Lines) == 0 {
+		return nil, fmt.Errorf("no TTML lines found")
+	}
+	l.finish()
+	return l, nil
+}
+
+func ttmlAttr(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// parseTTMLTime accepts clock times (hh:mm:ss.fff, mm:ss.fff) and offsets (12.5s, 1500ms).
+func parseTTMLTime(s string) float64 {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return 0
+	case strings.HasSuffix(s, "ms"):
+		v, _ := strconv.ParseFloat(strings.TrimSuffix(s, "ms"), 64)
+		return v / 1000
+	case strings.HasSuffix(s, "s"):
+		v, _ := strconv.ParseFloat(strings.TrimSuffix(s, "s"), 64)
+		return v
+	}
+	var total float64
+	for _, part := range strings.Split(s, ":") {
+		v, _ := strconv.ParseFloat(part, 64)
+		total = total*60 + v
+	}
+	return total
+}
+
+// clockSeconds converts h:m:s.frac components (frac as written: 1-3 digits) to seconds.
+func clockSeconds(h, m, s, frac string) float64 {
+	hv, _ := strconv.Atoi(h)
+	mv, _ := strconv.Atoi(m)
+	sv, _ := strconv.Atoi(s)
+	t := float64(hv*3600 + mv*60 + sv)
+	if frac != "" {
+		f, _ := strconv.Atoi(frac)
+		t += float64(f) / pow10(len(frac))
+	}
+	return t
+}
+
+func submatch(s string, loc []int, i int) string {
+	if loc[i] < 0 {
+		return ""
+	}
+	return s[loc[i]:loc[i+1]]
+}
+
+func pow10(n int) float64 {
+	v := 1.0
+	for i := 0; i < n; i++ {
+		v *= 10
+	}
+	return v
+}
+
+func clampZero(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
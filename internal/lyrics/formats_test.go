@@ -0,0 +1,58 @@
+package lyrics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLRCRepeatedEnhancedLine(t *testing.T) {
+	l := ParseLRC(`[00:05.00]<00:05.00>Verse <00:06.00>line
+[00:10.00][01:10.00]<00:10.00>Sing <00:10.50>it <00:11.00>again<00:12.00>
+[00:15.00]<00:15.00>Bridge`)
+
+	if len(l.Lines) != 4 {
+		t.Fatalf("got %d lines, want 4", len(l.Lines))
+	}
+	want := map[float64][][2]float64{
+		10: {{10, 10.5}, {10.5, 11}, {11, 12}},
+		70: {{70, 70.5}, {70.5, 71}, {71, 72}},
+	}
+	for _, line := range l.Lines {
+		exp, ok := want[line.Time]
+		if !ok {
+			continue
+		}
+		if line.Text != "Sing it again" || len(line.Words) != len(exp) {
+			t.Fatalf("line at %v = %q with %d words", line.Time, line.Text, len(line.Words))
+		}
+		for i, w := range line.Words {
+			if !near(w.Time, exp[i][0]) || !near(w.End, exp[i][1]) {
+				t.Errorf("line at %v word %q = %v-%v, want %v-%v", line.Time, w.Text, w.Time, w.End, exp[i][0], exp[i][1])
+			}
+		}
+		delete(want, line.Time)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing chorus lines at %v", want)
+	}
+}
+
+func TestParseLRCOffsetShiftsRepeatedWords(t *testing.T) {
+	l := ParseLRC(`[offset:+500]
+[00:10.00][00:40.00]<00:10.00>Hey <00:11.00>you<00:12.00>`)
+
+	if len(l.Lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(l.Lines))
+	}
+	for i, start := range []float64{9.5, 39.5} {
+		line := l.Lines[i]
+		if !near(line.Time, start) {
+			t.Fatalf("line %d time = %v, want %v", i, line.Time, start)
+		}
+		if !near(line.Words[0].Time, start) || !near(line.Words[1].Time, start+1) || !near(line.Words[1].End, start+2) {
+			t.Errorf("line %d words = %+v", i, line.Words)
+		}
+	}
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
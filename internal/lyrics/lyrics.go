@@ -0,0 +1,162 @@
+// Package lyrics parses LRC (including enhanced word-level tags), SRT and TTML
+// lyrics into a common timeline.
+package lyrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Word is a word-level timing inside a line (enhanced LRC <mm:ss.xx> or TTML spans).
+type Word struct {
+	Time float64 `json:"time"`
+	End  float64 `json:"end,omitempty"`
+	Text string  `json:"text"`
+}
+
+// Line is one lyric line. Time and End are in seconds; End is 0 when unknown.
+type Line struct {
+	Time        float64 `json:"time"`
+	End         float64 `json:"end,omitempty"`
+	Text        string  `json:"text"`
+	Translation string  `json:"translation,omitempty"`
+	Words       []Word  `json:"words,omitempty"`
+}
+
+// Lyrics is the structured timeline stored per track.
+type Lyrics struct {
+	Format string            `json:"format"` // "lrc", "srt", "ttml" or "text"
+	Synced bool              `json:"synced"`
+	Meta   map[string]string `json:"meta,omitempty"`
+	Lines  []Line            `json:"lines"`
+}
+
+// Parse detects the format from the filename extension (if any) or the content.
+func Parse(data, filename string) (*Lyrics, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".lrc":
+		return ParseLRC(data), nil
+	case ".srt":
+		return ParseSRT(data)
+	case ".ttml", ".xml", ".dfxp":
+		return ParseTTML(data)
+	}
+
+	trimmed := strings.TrimSpace(strings.TrimPrefix(data, "\uFEFF"))
+	switch {
+	case strings.HasPrefix(trimmed, "<"):
+		return ParseTTML(trimmed)
+	case srtTimingRe.MatchString(trimmed):
+		return ParseSRT(trimmed)
+	default:
+		return ParseLRC(trimmed), nil
+	}
+}
+
+// Load decodes stored timeline JSON, falling back to parsing the raw lyrics text.
+// Returns nil when neither yields any lines.
+func Load(timelineJSON, raw string) *Lyrics {
+	if timelineJSON != "" {
+		var l Lyrics
+		if err := json.Unmarshal([]byte(timelineJSON), &l); err == nil && len(l.Lines) > 0 {
+			return &l
+		}
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	l, err := Parse(raw, "")
+	if err != nil || len(l.Lines) == 0 {
+		return nil
+	}
+	return l
+}
+
+// MergeTranslation attaches each line of t to the line of l with the nearest start
+// time (within 1s). Unsynced lyrics are matched line by line.
+func (l *Lyrics) MergeTranslation(t *Lyrics) {
+	if t == nil {
+		return
+	}
+	if !l.Synced || !t.Synced {
+		for i := range l.Lines {
+			if i < len(t.Lines) {
+				l.Lines[i].Translation = t.Lines[i].Text
+			}
+		}
+		return
+	}
+	for _, tl := range t.Lines {
+		best, bestDiff := -1, 1.0
+		for i := range l.Lines {
+			if d := math.Abs(l.Lines[i].Time - tl.Time); d <= bestDiff {
+				best, bestDiff = i, d
+			}
+		}
+		if best >= 0 && l.Lines[best].Translation == "" {
+			l.Lines[best].Translation = tl.Text
+		}
+	}
+}
+
+// LineAt returns the index of the line active at pos seconds, or -1 before the
+// first line or for unsynced lyrics.
+func (l *Lyrics) LineAt(pos float64) int {
+	if l == nil || !l.Synced {
+		return -1
+	}
+	i := sort.Search(len(l.Lines), func(i int) bool { return l.Lines[i].Time > pos })
+	return i - 1
+}
+
+// ToLRC renders the timeline as plain LRC so clients that only understand LRC keep working.
+func (l *Lyrics) ToLRC() string {
+	var b strings.Builder
+	for _, line := range l.Lines {
+		if l.Synced {
+			b.WriteString(formatLRCTime(line.Time))
+		}
+		b.WriteString(line.Text)
+		b.WriteByte('\n')
+		if line.Translation != "" {
+			if l.Synced {
+				b.WriteString(formatLRCTime(line.Time))
+			}
+			b.WriteString(line.Translation)
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+func formatLRCTime(t float64) string {
+	cs := int(math.Round(t * 100))
+	return fmt.Sprintf("[%02d:%02d.%02d]", cs/6000, cs/100%60, cs%100)
+}
+
+// finish sorts lines and fills in missing end times from the next line.
+func (l *Lyrics) finish() {
+	if !l.Synced {
+		return
+	}
+	sort.SliceStable(l.Lines, func(i, j int) bool { return l.Lines[i].Time < l.Lines[j].Time })
+	for i := range l.Lines {
+		if l.Lines[i].End == 0 && i+1 < len(l.Lines) {
+			l.Lines[i].End = l.Lines[i+1].Time
+		}
+		words := l.Lines[i].Words
+		for j := range words {
+			if words[j].End == 0 {
+				if j+1 < len(words) {
+					words[j].End = words[j+1].Time
+				} else {
+					words[j].End = l.Lines[i].End
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package ratelimit provides the sliding-window limiter used for joins,
+// logins and public links.
+package ratelimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxEntries bounds the number of tracked keys; past it the least recently
+// seen tenth is dropped.
+const maxEntries = 10000
+
+const sweepInterval = 10 * time.Minute
+
+// Limiter counts hits per key over a sliding window.
+type Limiter struct {
+	mu        sync.Mutex
+	entries   map[string][]time.Time
+	maxWindow time.Duration // longest window passed to Allow, for the sweeper
+}
+
+// New returns a Limiter whose expired keys are swept in the background.
+func New() *Limiter {
+	l := &Limiter{entries: make(map[string][]time.Time)}
+	go func() {
+		for range time.NewTicker(sweepInterval).C {
+			l.sweep()
+		}
+	}()
+	return l
+}
+
+// Allow records a hit for key and reports whether it is within maxHits in the
+// last window. Refused hits are not recorded.
+func (l *Limiter) Allow(key string, maxHits int, window time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if window > l.maxWindow {
+		l.maxWindow = window
+	}
+	now := time.Now()
+	cutoff := now.Add(-window)
+	var valid []time.Time
+	for _, t := range l.entries[key] {
+		if t.After(cutoff) {
+			valid = append(valid, t)
+		}
+	}
+	if len(valid) >= maxHits {
+		l.entries[key] = valid
+		return false
+	}
+	if len(l.entries) >= maxEntries {
+		l.dropOldest()
+	}
+	l.entries[key] = append(valid, now)
+	return true
+}
+
+// sweep removes keys with no hit inside the longest window in use.
+func (l *Limiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-l.maxWindow)
+	for k, times := range l.entries {
+		if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+func (l *Limiter) dropOldest() {
+	type entry struct {
+		key  string
+		last time.Time
+	}
+	entries := make([]entry, 0, len(l.entries))
+	for k, times := range l.entries {
+		var last time.Time
+		if len(times) > 0 {
+			last = times[len(times)-1]
+		}
+		entries = append(entries, entry{k, last})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].last.Before(entries[j].last) })
+	n := max(len(entries)/10, 1)
+	for _, e := range entries[:n] {
+		delete(l.entries, e.key)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/xingzihai/listen-together/internal/lyrics"
+	"github.com/xingzihai/listen-together/pkg/protocol"
 )
 
 // Configurable limits
@@ -19,6 +21,8 @@ var (
 	ErrMaxRoomsReached    = errors.New("已达到全局房间上限")
 	ErrUserMaxRooms       = errors.New("您已达到创建房间数量上限")
 	ErrRoomFull           = errors.New("房间已满，无法加入")
+	ErrTooManySubscribers = errors.New("收听人数已满")
+	ErrRoomClosed         = errors.New("房间已关闭")
 )
 
 type PlayState int
@@ -50,34 +54,12 @@ func (c *Client) Send(v interface{}) error {
 func (c *Client) Lock()   { c.mu.Lock() }
 func (c *Client) Unlock() { c.mu.Unlock() }
 
-type ClientInfo struct {
-	ClientID string `json:"clientID"`
-	Username string `json:"username"`
-	UID      int64  `json:"uid"`
-	IsHost   bool   `json:"isHost"`
-}
-
-type AudioInfo struct {
-	Filename     string   `json:"filename"`
-	Duration     float64  `json:"duration"`
-	SegmentCount int      `json:"segmentCount"`
-	SegmentTime  float64  `json:"segmentTime"`
-	Segments     []string `json:"segments"`
-}
-
-// TrackAudioInfo is the complete audio metadata broadcast via trackChange.
-// Clients use this directly without needing to fetch the file list API.
-type TrackAudioInfo struct {
-	AudioID      int64    `json:"audio_id"`
-	OwnerID      int64    `json:"owner_id"`
-	AudioUUID    string   `json:"audio_uuid"`
-	Filename     string   `json:"filename"`
-	Title        string   `json:"title"`
-	Artist       string   `json:"artist"`
-	OriginalName string   `json:"original_name"`
-	Duration     float64  `json:"duration"`
-	Qualities    []string `json:"qualities"`
-}
+// Wire types shared with the WebSocket protocol.
+type (
+	ClientInfo     = protocol.ClientInfo
+	AudioInfo      = protocol.AudioInfo
+	TrackAudioInfo = protocol.TrackAudioInfo
+)
 
 type Room struct {
 	Code       string
@@ -92,12 +74,48 @@ type Room struct {
 	OwnerID      int64
 	OwnerName    string
 	CurrentTrack int
+	SkipSilence  bool // treat TrackAudio.EffectiveEnd as the end of the track
+	TrackEndSent bool // trackEnd already sent to the host for the current track
+	ListenedFor  float64 // seconds the current track has been playing, for scrobbling
+	ListenSent   bool    // listen already recorded for the current track
+	Lyrics       *lyrics.Lyrics // parsed lyrics of the current track, for lyricLine in syncTick
 	Mu         sync.RWMutex
+
+	subs   map[*Subscriber]bool // SSE listeners, guarded by Mu
+	closed bool                 // removed from the manager; no new subscribers
 }
 
 type Manager struct {
-	rooms map[string]*Room
-	mu    sync.RWMutex
+	rooms   map[string]*Room
+	mu      sync.RWMutex
+	onClose func(code, reason string)
+}
+
+// Reasons passed to the OnClose callback.
+const (
+	CloseEmpty        = "empty"         // the last client left
+	CloseInactive     = "inactive"      // idle for 30 minutes
+	CloseOwnerChanged = "owner_changed" // the owner lost the right to host
+)
+
+// OnClose registers fn to be called, outside the manager lock, whenever a room
+// is removed.
+func (m *Manager) OnClose(fn func(code, reason string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onClose = fn
+}
+
+func (m *Manager) closed(codes []string, reason string) {
+	m.mu.RLock()
+	fn := m.onClose
+	m.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+	for _, code := range codes {
+		fn(code, reason)
+	}
 }
 
 func NewManager() *Manager {
@@ -158,8 +176,13 @@ func (m *Manager) GetRooms() []*Room {
 
 func (m *Manager) DeleteRoom(code string) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	rm, ok := m.rooms[code]
 	delete(m.rooms, code)
+	m.mu.Unlock()
+	if ok {
+		rm.closeSubscribers(protocol.RoomClosedEvent{Type: protocol.TypeRoomClosed, Error: "房间已关闭", Reason: CloseEmpty})
+		m.closed([]string{code}, CloseEmpty)
+	}
 }
 
 // CloseRoomsByOwnerID finds all rooms owned by the given user ID,
@@ -168,6 +191,7 @@ func (m *Manager) DeleteRoom(code string) {
 func (m *Manager) CloseRoomsByOwnerID(ownerID int64) []string {
 	type closedRoom struct {
 		code    string
+		room    *Room
 		clients []*Client
 	}
 	var toClose []closedRoom
@@ -185,7 +209,7 @@ func (m *Manager) CloseRoomsByOwnerID(ownerID int64) []string {
 		}
 		rm.Mu.RUnlock()
 		if isOwner {
-			toClose = append(toClose, closedRoom{code, clients})
+			toClose = append(toClose, closedRoom{code, rm, clients})
 			delete(m.rooms, code)
 		}
 	}
@@ -193,14 +217,14 @@ func (m *Manager) CloseRoomsByOwnerID(ownerID int64) []string {
 
 	var closed []string
 	for _, cr := range toClose {
+		ev := protocol.RoomClosedEvent{Type: protocol.TypeRoomClosed, Error: "房间已被关闭（房主权限变更）", Reason: CloseOwnerChanged}
 		for _, c := range cr.clients {
-			c.Send(map[string]interface{}{
-				"type":  "roomClosed",
-				"error": "房间已被关闭（房主权限变更）",
-			})
+			c.Send(ev)
 		}
+		cr.room.closeSubscribers(ev)
 		closed = append(closed, cr.code)
 	}
+	m.closed(closed, CloseOwnerChanged)
 	return closed
 }
 
@@ -230,11 +254,9 @@ func (m *Manager) IsUserInRoomWithAudio(userID int64, audioID int64) bool {
 		rm.Mu.RLock()
 		ta := rm.TrackAudio
 		if ta != nil && ta.AudioID == audioID {
-			for _, c := range rm.Clients {
-				if c.UID == userID {
-					rm.Mu.RUnlock()
-					return true
-				}
+			if rm.hasUserLocked(userID) {
+				rm.Mu.RUnlock()
+				return true
 			}
 		}
 		rm.Mu.RUnlock()
@@ -250,6 +272,7 @@ func (m *Manager) cleanupLoop() {
 		// Phase 1: collect inactive rooms under lock
 		type closedRoom struct {
 			code    string
+			room    *Room
 			clients []*Client
 		}
 		var toClose []closedRoom
@@ -268,21 +291,23 @@ func (m *Manager) cleanupLoop() {
 			}
 			room.Mu.RUnlock()
 			if inactive {
-				toClose = append(toClose, closedRoom{code, clients})
+				toClose = append(toClose, closedRoom{code, room, clients})
 				delete(m.rooms, code)
 			}
 		}
 		m.mu.Unlock()
 
 		// Phase 2: notify clients outside all locks
+		var codes []string
 		for _, cr := range toClose {
+			ev := protocol.RoomClosedEvent{Type: protocol.TypeRoomClosed, Error: "房间因长时间不活跃已关闭", Reason: CloseInactive}
 			for _, c := range cr.clients {
-				c.Send(map[string]interface{}{
-					"type":  "roomClosed",
-					"error": "房间因长时间不活跃已关闭",
-				})
+				c.Send(ev)
 			}
+			cr.room.closeSubscribers(ev)
+			codes = append(codes, cr.code)
 		}
+		m.closed(codes, CloseInactive)
 	}
 }
 
@@ -339,10 +364,34 @@ func (r *Room) GetClients() []*Client {
 	return clients
 }
 
+// HasUser reports whether userID has a connection in the room, WebSocket or
+// SSE.
+func (r *Room) HasUser(userID int64) bool {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	return r.hasUserLocked(userID)
+}
+
+func (r *Room) hasUserLocked(userID int64) bool {
+	for _, c := range r.Clients {
+		if c.UID == userID {
+			return true
+		}
+	}
+	for s := range r.subs {
+		if s.UID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientCount returns the number of connections in the room, WebSocket and
+// SSE.
 func (r *Room) ClientCount() int {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
-	return len(r.Clients)
+	return len(r.Clients) + len(r.subs)
 }
 
 func (r *Room) SetAudio(audio *AudioInfo) {
@@ -361,6 +410,7 @@ func (r *Room) Play(position float64) {
 	r.Position = position
 	r.StartTime = time.Now()
 	r.LastActive = time.Now()
+	r.TrackEndSent = false
 }
 
 func (r *Room) Pause() float64 {
@@ -384,6 +434,33 @@ func (r *Room) Seek(position float64) {
 		r.StartTime = time.Now()
 	}
 	r.LastActive = time.Now()
+	r.TrackEndSent = false
+}
+
+// EffectiveDuration returns the duration used for clamping and auto-advance:
+// the detected end of audible sound when SkipSilence is on, else the full duration.
+// Caller must hold r.Mu.
+func (r *Room) EffectiveDuration() float64 {
+	if r.TrackAudio != nil {
+		if r.SkipSilence && r.TrackAudio.EffectiveEnd > 0 {
+			return r.TrackAudio.EffectiveEnd
+		}
+		return r.TrackAudio.Duration
+	}
+	if r.Audio != nil {
+		return r.Audio.Duration
+	}
+	return 0
+}
+
+// CurrentPosition returns the playback position of the current track, in seconds.
+func (r *Room) CurrentPosition() float64 {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	if r.State == StatePlaying {
+		return r.Position + time.Since(r.StartTime).Seconds()
+	}
+	return r.Position
 }
 
 func (r *Room) GetPlaybackState() (PlayState, float64, time.Time) {
@@ -415,6 +492,13 @@ func (r *Room) GetClientList() []ClientInfo {
 			IsHost:   c.IsHost,
 		})
 	}
+	for s := range r.subs {
+		if seen[s.UID] {
+			continue
+		}
+		seen[s.UID] = true
+		list = append(list, ClientInfo{ClientID: s.ID, Username: s.Username, UID: s.UID, ListenOnly: true})
+	}
 	return list
 }
 
@@ -0,0 +1,116 @@
+package room
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// MaxSubscribersPerRoom limits the SSE listeners of one room.
+const MaxSubscribersPerRoom = 200
+
+// subscriberBuffer is how many messages a subscriber may fall behind before
+// it is dropped.
+const subscriberBuffer = 64
+
+// Subscriber is a read-only listener on the SSE transport. It receives the
+// room's broadcasts and is listed and counted like a client, but can't
+// become host and doesn't keep an empty room open.
+type Subscriber struct {
+	ID       string
+	UID      int64
+	Username string
+	// C carries encoded messages. It is closed when the room closes or the
+	// subscriber falls too far behind.
+	C chan []byte
+}
+
+// Subscribe adds a listener for userID; id is its client ID in the user list.
+func (r *Room) Subscribe(id string, userID int64, username string) (*Subscriber, error) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if r.closed {
+		return nil, ErrRoomClosed
+	}
+	if len(r.subs) >= MaxSubscribersPerRoom {
+		return nil, ErrTooManySubscribers
+	}
+	if r.subs == nil {
+		r.subs = make(map[*Subscriber]bool)
+	}
+	s := &Subscriber{ID: id, UID: userID, Username: username, C: make(chan []byte, subscriberBuffer)}
+	r.subs[s] = true
+	r.LastActive = time.Now()
+	return s, nil
+}
+
+// Unsubscribe removes s. It is a no-op if s was already dropped.
+func (r *Room) Unsubscribe(s *Subscriber) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	if r.subs[s] {
+		delete(r.subs, s)
+		close(s.C)
+	}
+}
+
+// KickSubscriber ends the stream of the subscriber with client ID id after
+// sending it a kicked event. It reports whether there was one.
+func (r *Room) KickSubscriber(id string) bool {
+	data, _ := json.Marshal(protocol.KickedEvent{Type: protocol.TypeKicked})
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	for s := range r.subs {
+		if s.ID == id {
+			select {
+			case s.C <- data:
+			default:
+			}
+			delete(r.subs, s)
+			close(s.C)
+			return true
+		}
+	}
+	return false
+}
+
+// HasSubscribers reports whether the room has any SSE listeners.
+func (r *Room) HasSubscribers() bool {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+	return len(r.subs) > 0
+}
+
+// Publish queues an encoded message for every subscriber without blocking.
+// A subscriber whose buffer is full is dropped; its stream ends and the
+// client reconnects to get the current state.
+func (r *Room) Publish(data []byte) {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	for s := range r.subs {
+		select {
+		case s.C <- data:
+		default:
+			delete(r.subs, s)
+			close(s.C)
+		}
+	}
+}
+
+// closeSubscribers sends ev to every subscriber that has room for it and
+// ends their streams.
+func (r *Room) closeSubscribers(ev protocol.RoomClosedEvent) {
+	data, _ := json.Marshal(ev)
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	r.closed = true
+	for s := range r.subs {
+		select {
+		case s.C <- data:
+		default:
+		}
+		close(s.C)
+	}
+	r.subs = nil
+}
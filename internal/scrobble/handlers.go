@@ -0,0 +1,108 @@
+package scrobble
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Handlers serves /api/user/scrobbling.
+type Handlers struct {
+	DB *db.DB
+}
+
+func (h *Handlers) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/user/scrobbling", func(w http.ResponseWriter, r *http.Request) {
+		auth.AuthMiddleware(http.HandlerFunc(h.Scrobbling)).ServeHTTP(w, r)
+	})
+}
+
+// Scrobbling handles GET (status), PUT {"token":"...","enabled":true} (link
+// or toggle) and DELETE (unlink). The token itself is never returned.
+func (h *Handlers) Scrobbling(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Token   *string `json:"token"`
+			Enabled *bool   `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid json", 400)
+			return
+		}
+		st := LoadSettings(h.DB, user.UserID)
+		if req.Token != nil {
+			token := strings.TrimSpace(*req.Token)
+			if token == "" {
+				jsonError(w, "令牌不能为空", 400)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+			name, ok, err := validateToken(ctx, token)
+			cancel()
+			if err != nil {
+				jsonError(w, "无法连接 ListenBrainz，请稍后再试", 502)
+				return
+			}
+			if !ok {
+				jsonError(w, "ListenBrainz 令牌无效", 400)
+				return
+			}
+			st.Token, st.UserName, st.Enabled = token, name, true
+		}
+		if req.Enabled != nil {
+			if *req.Enabled && st.Token == "" {
+				jsonError(w, "请先填写 ListenBrainz 令牌", 400)
+				return
+			}
+			st.Enabled = *req.Enabled
+		}
+		if err := saveSettings(h.DB, user.UserID, &st); err != nil {
+			jsonError(w, "save failed", 500)
+			return
+		}
+	case http.MethodDelete:
+		if err := saveSettings(h.DB, user.UserID, nil); err != nil {
+			jsonError(w, "save failed", 500)
+			return
+		}
+	default:
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	h.writeStatus(w, user.UserID)
+}
+
+func (h *Handlers) writeStatus(w http.ResponseWriter, userID int64) {
+	st := LoadSettings(h.DB, userID)
+	queued, lastErr, _ := h.DB.CountQueuedScrobbles(userID)
+	jsonOK(w, map[string]interface{}{
+		"linked":     st.Token != "",
+		"enabled":    st.Active(),
+		"user_name":  st.UserName,
+		"queued":     queued,
+		"last_error": lastErr,
+	})
+}
+
+func jsonError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func jsonOK(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,135 @@
+package scrobble
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultAPIURL is the public ListenBrainz API. LISTENBRAINZ_URL points the
+// server at any compatible service instead (a self-hosted instance, or a
+// stand-in server in tests).
+const DefaultAPIURL = "https://api.listenbrainz.org"
+
+// APIURL returns the configured ListenBrainz-compatible API root.
+func APIURL() string {
+	if u := strings.TrimSuffix(os.Getenv("LISTENBRAINZ_URL"), "/"); u != "" {
+		return u
+	}
+	return DefaultAPIURL
+}
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// Listen is one listen in ListenBrainz' submission format.
+type Listen struct {
+	ListenedAt    int64         `json:"listened_at"`
+	TrackMetadata TrackMetadata `json:"track_metadata"`
+}
+
+type TrackMetadata struct {
+	ArtistName     string         `json:"artist_name"`
+	TrackName      string         `json:"track_name"`
+	ReleaseName    string         `json:"release_name,omitempty"`
+	AdditionalInfo AdditionalInfo `json:"additional_info"`
+}
+
+type AdditionalInfo struct {
+	DurationMs       int64  `json:"duration_ms,omitempty"`
+	SubmissionClient string `json:"submission_client"`
+	MediaPlayer      string `json:"media_player"`
+}
+
+// apiError is a non-2xx reply from the service.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Status, e.Message)
+}
+
+// permanent reports whether retrying the same request can't succeed. That
+// includes a rejected token (401): replaying listens against it would fail
+// until the user relinks, so they are dropped rather than retried for days.
+func (e *apiError) permanent() bool {
+	return e.Status >= 400 && e.Status < 500 &&
+		e.Status != http.StatusTooManyRequests && e.Status != http.StatusRequestTimeout
+}
+
+func call(ctx context.Context, method, path, token string, body interface{}, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, APIURL()+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &apiError{Status: resp.StatusCode, Message: e.Error}
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// submitListens posts listens for the token's user: "single" for one,
+// "import" for a backlog.
+func submitListens(ctx context.Context, token string, listens []Listen) error {
+	listenType := "import"
+	if len(listens) == 1 {
+		listenType = "single"
+	}
+	return call(ctx, http.MethodPost, "/1/submit-listens", token, map[string]interface{}{
+		"listen_type": listenType,
+		"payload":     listens,
+	}, nil)
+}
+
+// validateToken returns the service user name of token, or ok=false if the
+// service rejected it.
+func validateToken(ctx context.Context, token string) (userName string, ok bool, err error) {
+	var v struct {
+		Valid    bool   `json:"valid"`
+		UserName string `json:"user_name"`
+	}
+	if err := call(ctx, http.MethodGet, "/1/validate-token", token, nil, &v); err != nil {
+		var ae *apiError
+		if errors.As(err, &ae) && ae.Status/100 == 4 {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return v.UserName, v.Valid, nil
+}
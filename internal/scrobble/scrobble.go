@@ -0,0 +1,204 @@
+// Package scrobble submits what members hear in rooms to their ListenBrainz
+// (or compatible) accounts. Listens go through a queue in SQLite so they
+// survive restarts and outages of the service.
+package scrobble
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// settingsKey is where Settings live in a user's settings_json.
+const settingsKey = "listenbrainz"
+
+// Settings is a user's opt-in to scrobbling.
+type Settings struct {
+	Enabled  bool   `json:"enabled"`
+	Token    string `json:"token"`
+	UserName string `json:"user_name,omitempty"`
+}
+
+// Active reports whether listens should be submitted for the user.
+func (s Settings) Active() bool { return s.Enabled && s.Token != "" }
+
+// LoadSettings reads userID's scrobbling settings; the zero value means not linked.
+func LoadSettings(d *db.DB, userID int64) Settings {
+	raw, _ := d.GetUserSettings(userID)
+	var all map[string]json.RawMessage
+	var s Settings
+	if json.Unmarshal([]byte(raw), &all) == nil {
+		json.Unmarshal(all[settingsKey], &s)
+	}
+	return s
+}
+
+// saveSettings stores s for userID without touching the other settings;
+// nil removes them.
+func saveSettings(d *db.DB, userID int64, s *Settings) error {
+	raw, _ := d.GetUserSettings(userID)
+	all := map[string]json.RawMessage{}
+	json.Unmarshal([]byte(raw), &all)
+	if s == nil {
+		delete(all, settingsKey)
+	} else {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		all[settingsKey] = b
+	}
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return d.SaveUserSettings(userID, string(b))
+}
+
+// Queue retry policy: exponential backoff from one minute up to maxBackoff,
+// then the listen is dropped after maxAttempts.
+const (
+	pollInterval = 30 * time.Second
+	batchSize    = 100
+	maxBackoff   = 12 * time.Hour
+	maxAttempts  = 16
+)
+
+// Scrobbler queues listens and submits them in the background.
+type Scrobbler struct {
+	DB   *db.DB
+	wake chan struct{}
+}
+
+func New(d *db.DB) *Scrobbler {
+	return &Scrobbler{DB: d, wake: make(chan struct{}, 1)}
+}
+
+// Start runs the submission loop until the process exits.
+func (s *Scrobbler) Start() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			for s.flush() {
+			}
+			select {
+			case <-ticker.C:
+			case <-s.wake:
+			}
+		}
+	}()
+}
+
+// Record queues a listen of audioID, started at listenedAt, for every user in
+// userIDs who has scrobbling turned on.
+func (s *Scrobbler) Record(userIDs []int64, audioID int64, listenedAt time.Time) {
+	af, err := s.DB.GetAudioFileByID(audioID)
+	if err != nil {
+		return
+	}
+	// ListenBrainz needs both names; untagged uploads would only add noise.
+	if af.Artist == "" || af.Title == "" {
+		return
+	}
+	l := Listen{
+		ListenedAt: listenedAt.Unix(),
+		TrackMetadata: TrackMetadata{
+			ArtistName:  af.Artist,
+			TrackName:   af.Title,
+			ReleaseName: af.Album,
+			AdditionalInfo: AdditionalInfo{
+				DurationMs:       int64(af.Duration * 1000),
+				SubmissionClient: "listen-together",
+				MediaPlayer:      "ListenTogether",
+			},
+		},
+	}
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return
+	}
+	queued := false
+	for _, uid := range userIDs {
+		if !LoadSettings(s.DB, uid).Active() {
+			continue
+		}
+		if err := s.DB.EnqueueScrobble(uid, string(payload)); err != nil {
+			log.Printf("[scrobble] enqueue for user %d: %v", uid, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush submits one batch of due listens and reports whether a full batch
+// was taken, i.e. more may be waiting.
+func (s *Scrobbler) flush() bool {
+	due, err := s.DB.GetDueScrobbles(time.Now(), batchSize)
+	if err != nil {
+		log.Printf("[scrobble] read queue: %v", err)
+		return false
+	}
+	byUser := map[int64][]*db.QueuedScrobble{}
+	var order []int64
+	for _, q := range due {
+		if byUser[q.UserID] == nil {
+			order = append(order, q.UserID)
+		}
+		byUser[q.UserID] = append(byUser[q.UserID], q)
+	}
+	for _, uid := range order {
+		s.submit(uid, byUser[uid])
+	}
+	return len(due) == batchSize
+}
+
+func (s *Scrobbler) submit(userID int64, items []*db.QueuedScrobble) {
+	ids := make([]int64, 0, len(items))
+	listens := make([]Listen, 0, len(items))
+	attempts := 0
+	for _, q := range items {
+		var l Listen
+		if json.Unmarshal([]byte(q.Payload), &l) != nil {
+			s.DB.DeleteScrobbles([]int64{q.ID})
+			continue
+		}
+		ids = append(ids, q.ID)
+		listens = append(listens, l)
+		attempts = max(attempts, q.Attempts)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	// Unlinked or turned off since the listen was queued.
+	st := LoadSettings(s.DB, userID)
+	if !st.Active() {
+		s.DB.DeleteScrobbles(ids)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := submitListens(ctx, st.Token, listens)
+	var ae *apiError
+	switch {
+	case err == nil:
+		s.DB.DeleteScrobbles(ids)
+	case errors.As(err, &ae) && ae.permanent(), attempts+1 >= maxAttempts:
+		log.Printf("[scrobble] dropping %d listens of user %d: %v", len(ids), userID, err)
+		s.DB.DeleteScrobbles(ids)
+	default:
+		backoff := min(time.Minute<<attempts, maxBackoff)
+		s.DB.RetryScrobbles(ids, time.Now().Add(backoff), err.Error())
+	}
+}
@@ -0,0 +1,200 @@
+package scrobble
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// fakeListenBrainz stands in for the ListenBrainz API: it records the
+// submissions it gets and answers each with status.
+type fakeListenBrainz struct {
+	mu      sync.Mutex
+	status  int
+	auth    []string
+	submits []map[string]json.RawMessage
+}
+
+func (f *fakeListenBrainz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/1/submit-listens" {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var v map[string]json.RawMessage
+	json.Unmarshal(body, &v)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	f.submits = append(f.submits, v)
+	w.WriteHeader(f.status)
+	if f.status/100 != 2 {
+		json.NewEncoder(w).Encode(map[string]interface{}{"code": f.status, "error": "stand-in failure"})
+		return
+	}
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (f *fakeListenBrainz) setStatus(code int) {
+	f.mu.Lock()
+	f.status = code
+	f.mu.Unlock()
+}
+
+func (f *fakeListenBrainz) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.submits)
+}
+
+type testEnv struct {
+	db  *db.DB
+	s   *Scrobbler
+	lb  *fakeListenBrainz
+	uid int64
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	lb := &fakeListenBrainz{status: http.StatusOK}
+	srv := httptest.NewServer(lb)
+	t.Cleanup(srv.Close)
+	t.Setenv("LISTENBRAINZ_URL", srv.URL)
+
+	d, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := d.CreateUser("alice", "password1", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveSettings(d, u.ID, &Settings{Enabled: true, Token: "tok-123", UserName: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{db: d, s: New(d), lb: lb, uid: u.ID}
+}
+
+func (e *testEnv) enqueue(t *testing.T, track string) {
+	t.Helper()
+	l := Listen{ListenedAt: time.Now().Unix(), TrackMetadata: TrackMetadata{ArtistName: "Artist", TrackName: track}}
+	b, _ := json.Marshal(l)
+	if err := e.db.EnqueueScrobble(e.uid, string(b)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (e *testEnv) queued(t *testing.T) int {
+	t.Helper()
+	n, _, err := e.db.CountQueuedScrobbles(e.uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSubmitSuccess(t *testing.T) {
+	e := newTestEnv(t)
+	e.enqueue(t, "One")
+	e.enqueue(t, "Two")
+	e.s.flush()
+
+	if e.lb.count() != 1 {
+		t.Fatalf("submissions = %d, want 1", e.lb.count())
+	}
+	if got := e.lb.auth[0]; got != "Token tok-123" {
+		t.Errorf("Authorization = %q", got)
+	}
+	var listenType string
+	json.Unmarshal(e.lb.submits[0]["listen_type"], &listenType)
+	if listenType != "import" {
+		t.Errorf("listen_type = %q, want import", listenType)
+	}
+	var payload []Listen
+	json.Unmarshal(e.lb.submits[0]["payload"], &payload)
+	if len(payload) != 2 || payload[0].TrackMetadata.TrackName != "One" || payload[1].TrackMetadata.TrackName != "Two" {
+		t.Errorf("payload = %+v", payload)
+	}
+	if n := e.queued(t); n != 0 {
+		t.Errorf("queued after success = %d, want 0", n)
+	}
+}
+
+func TestServerErrorRetriesWithBackoff(t *testing.T) {
+	e := newTestEnv(t)
+	e.lb.setStatus(http.StatusServiceUnavailable)
+	e.enqueue(t, "One")
+	e.s.flush()
+
+	if n := e.queued(t); n != 1 {
+		t.Fatalf("queued after 503 = %d, want 1", n)
+	}
+	now := time.Now()
+	if due, _ := e.db.GetDueScrobbles(now, batchSize); len(due) != 0 {
+		t.Fatalf("listen due again immediately after 503")
+	}
+	// First retry waits a minute.
+	due, _ := e.db.GetDueScrobbles(now.Add(time.Minute+5*time.Second), batchSize)
+	if len(due) != 1 {
+		t.Fatalf("listen not due after the first backoff")
+	}
+	if due[0].Attempts != 1 || !strings.Contains(due[0].LastError, "503") {
+		t.Errorf("attempts = %d, last error = %q", due[0].Attempts, due[0].LastError)
+	}
+
+	// A second failure doubles the wait.
+	e.s.submit(e.uid, due)
+	now = time.Now()
+	if due, _ := e.db.GetDueScrobbles(now.Add(time.Minute+5*time.Second), batchSize); len(due) != 0 {
+		t.Fatalf("second backoff not longer than the first")
+	}
+	due, _ = e.db.GetDueScrobbles(now.Add(2*time.Minute+5*time.Second), batchSize)
+	if len(due) != 1 || due[0].Attempts != 2 {
+		t.Fatalf("after second failure: due = %d", len(due))
+	}
+
+	// Once the service is back the listen goes through.
+	e.lb.setStatus(http.StatusOK)
+	e.s.submit(e.uid, due)
+	if n := e.queued(t); n != 0 {
+		t.Errorf("queued after recovery = %d, want 0", n)
+	}
+	if e.lb.count() != 3 {
+		t.Errorf("submissions = %d, want 3", e.lb.count())
+	}
+}
+
+func TestClientErrorDrops(t *testing.T) {
+	for _, code := range []int{http.StatusBadRequest, http.StatusUnauthorized} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			e := newTestEnv(t)
+			e.lb.setStatus(code)
+			e.enqueue(t, "One")
+			e.s.flush()
+			if e.lb.count() != 1 {
+				t.Fatalf("submissions = %d, want 1", e.lb.count())
+			}
+			if n := e.queued(t); n != 0 {
+				t.Errorf("queued after %d = %d, want 0", code, n)
+			}
+		})
+	}
+}
+
+func TestTooManyRequestsRetries(t *testing.T) {
+	e := newTestEnv(t)
+	e.lb.setStatus(http.StatusTooManyRequests)
+	e.enqueue(t, "One")
+	e.s.flush()
+	if n := e.queued(t); n != 1 {
+		t.Errorf("queued after 429 = %d, want 1", n)
+	}
+}
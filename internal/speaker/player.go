@@ -0,0 +1,544 @@
+// Package speaker plays a room through a local audio output. It follows the
+// room over the WebSocket protocol, downloads and decodes the FLAC segments
+// of the current track and writes PCM to a Sink, staying in sync with the
+// room by the same clock-sync and drift rules as the web player.
+package speaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/xingzihai/listen-together/pkg/client"
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// ErrKicked is returned by Run when the host kicks this listener.
+var ErrKicked = errors.New("kicked from the room")
+
+// ErrRoomClosed is returned by Run when the room is closed.
+var ErrRoomClosed = errors.New("room closed")
+
+// ErrOutput wraps the error returned by Run when writing to the sink fails.
+// The sink can't be used again; reconnecting won't help.
+var ErrOutput = errors.New("output failed")
+
+// Options configures a Player.
+type Options struct {
+	Quality string                                   // preferred quality tier, default medium
+	Logf    func(format string, args ...interface{}) // status messages; nil discards them
+}
+
+const (
+	chunkFrames   = SampleRate / 50 // 20ms per write
+	statusEvery   = 5 * time.Second
+	rebufferRetry = time.Second
+)
+
+// Player plays the room a client has joined.
+type Player struct {
+	c    *client.Client
+	sink Sink
+	opts Options
+	ctx  context.Context
+	wake chan struct{}
+
+	mu           sync.Mutex
+	want         *protocol.TrackAudioInfo // track announced by the room
+	wantIndex    int
+	track        *track // want, once its segment list is loaded
+	trackGen     int
+	trackStarted time.Time
+	playing      bool
+	anchorPos    float64 // room position (s) at anchorMs
+	anchorMs     int64   // server time (ms)
+	restart      bool    // recompute the output position from the anchor
+	ended        bool
+
+	// Output position: the source frame written next, and when it will be
+	// heard after silence frames of silence.
+	cursor  float64
+	heardAt time.Time
+	silence int
+
+	// Drift correction, as in the web player
+	rate           float64
+	rateUntil      time.Time
+	pendingSoft    float64 // seconds, applied at the next segment boundary
+	driftOffset    float64 // accumulated soft corrections
+	lastCorrection time.Time
+	lastResync     time.Time
+	resyncBackoff  time.Duration
+}
+
+// NewPlayer returns a player for the room c has joined, writing to sink.
+func NewPlayer(c *client.Client, sink Sink, opts Options) *Player {
+	if opts.Quality == "" {
+		opts.Quality = "medium"
+	}
+	return &Player{c: c, sink: sink, opts: opts, wake: make(chan struct{}, 1), rate: 1}
+}
+
+func (p *Player) logf(format string, args ...interface{}) {
+	if p.opts.Logf != nil {
+		p.opts.Logf(format, args...)
+	}
+}
+
+func (p *Player) poke() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run plays until ctx is done, the connection ends, the listener is kicked
+// or the sink fails. It does not close the client or the sink.
+func (p *Player) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	p.ctx = ctx
+	var outErr error
+	outDone := make(chan struct{})
+	go func() {
+		outErr = p.output(ctx)
+		close(outDone)
+	}()
+	go p.driftLoop(ctx)
+	if p.c.HasCapability("statusReport") {
+		go p.statusLoop(ctx)
+	}
+	err := p.loop(ctx, outDone)
+	cancel()
+	<-outDone
+	if err == nil {
+		err = outErr
+	}
+	return err
+}
+
+func (p *Player) loop(ctx context.Context, outDone <-chan struct{}) error {
+	p.c.Clock().WaitSynced(ctx.Done())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-outDone:
+			return nil
+		case ev, ok := <-p.c.Events():
+			if !ok {
+				return p.c.Err()
+			}
+			if err := p.handle(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Player) handle(ev interface{}) error {
+	switch ev := ev.(type) {
+	case *protocol.TrackChangeEvent:
+		p.setTrack(ev.TrackAudio, ev.TrackIndex)
+	case *protocol.PlayEvent:
+		// Play carries the track for listeners that missed trackChange
+		if ev.TrackAudio != nil && !p.isTrack(ev.TrackAudio, ev.TrackIndex) {
+			p.setTrack(ev.TrackAudio, ev.TrackIndex)
+		}
+		p.play(ev.Position, ev.ServerTime, ev.ScheduledAt)
+	case *protocol.PauseEvent:
+		p.mu.Lock()
+		p.playing, p.anchorPos = false, ev.Position
+		p.mu.Unlock()
+	case *protocol.SeekEvent:
+		p.mu.Lock()
+		playing := p.playing
+		if !playing {
+			p.anchorPos = ev.Position
+		}
+		p.mu.Unlock()
+		if playing {
+			p.play(ev.Position, ev.ServerTime, ev.ScheduledAt)
+		}
+	case *protocol.SyncTickEvent:
+		// Server-authoritative anchor; check drift against it right away
+		p.mu.Lock()
+		playing := p.playing
+		if playing {
+			p.anchorPos, p.anchorMs = ev.Position, ev.ServerTime
+		}
+		p.mu.Unlock()
+		if playing {
+			p.correctDrift(true)
+		}
+	case *protocol.ForceTrackEvent:
+		if ev.TrackAudio != nil && !p.isTrack(ev.TrackAudio, ev.TrackIndex) {
+			p.setTrack(ev.TrackAudio, ev.TrackIndex)
+		}
+		p.play(ev.Position, ev.ServerTime, 0)
+	case *protocol.ForceResyncEvent:
+		p.play(ev.Position, ev.ServerTime, 0)
+	case *protocol.KickedEvent:
+		return ErrKicked
+	case *protocol.RoomClosedEvent:
+		return fmt.Errorf("%w: %s", ErrRoomClosed, ev.Error)
+	}
+	return nil
+}
+
+func (p *Player) isTrack(ta *protocol.TrackAudioInfo, index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ta != nil && p.want != nil && p.want.AudioID == ta.AudioID && p.wantIndex == index
+}
+
+// setTrack stops playback and loads the segment list of ta in the background.
+func (p *Player) setTrack(ta *protocol.TrackAudioInfo, index int) {
+	p.mu.Lock()
+	p.trackGen++
+	gen := p.trackGen
+	p.want, p.wantIndex, p.track = ta, index, nil
+	p.playing, p.ended = false, false
+	p.mu.Unlock()
+	if ta == nil {
+		return
+	}
+	go func() {
+		t, err := loadTrack(p.ctx, p.c, ta, index, p.opts.Quality)
+		if err != nil {
+			p.logf("load %q: %v", ta.Title, err)
+			return
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if gen != p.trackGen {
+			return
+		}
+		p.track, p.trackStarted, p.restart = t, time.Now(), true
+		p.logf("now playing: %s - %s (%s)", ta.Artist, ta.Title, t.quality)
+		p.poke()
+	}()
+}
+
+// play starts playback from position at the room anchor: scheduledAt if the
+// host scheduled the start, else serverTime.
+func (p *Player) play(position float64, serverTime, scheduledAt int64) {
+	p.mu.Lock()
+	p.playing, p.ended, p.restart = true, false, true
+	p.anchorPos, p.anchorMs = position, serverTime
+	if scheduledAt > 0 {
+		p.anchorMs = scheduledAt
+	}
+	if p.anchorMs == 0 {
+		p.anchorMs = p.c.Clock().Now()
+	}
+	p.rate, p.pendingSoft, p.driftOffset = 1, 0, 0
+	p.mu.Unlock()
+	p.poke()
+}
+
+// output writes PCM to the sink, sink latency ahead of when it should be heard.
+func (p *Player) output(ctx context.Context) error {
+	buf := make([]byte, chunkFrames*frameBytes)
+	latency := p.sink.Latency()
+	for {
+		p.mu.Lock()
+		n, wait := p.fill(buf, latency)
+		p.mu.Unlock()
+		if n > 0 {
+			if _, err := p.sink.Write(buf[:n*frameBytes]); err != nil {
+				return fmt.Errorf("%w: %w", ErrOutput, err)
+			}
+			continue
+		}
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timeout = time.After(wait)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.wake:
+		case <-timeout:
+		}
+	}
+}
+
+// fill renders the next chunk into buf and returns its frame count, or 0 and
+// how long to wait (0 meaning until woken). p.mu held.
+func (p *Player) fill(buf []byte, latency time.Duration) (int, time.Duration) {
+	t := p.track
+	if !p.playing || t == nil || p.ended {
+		return 0, 0
+	}
+	now := time.Now()
+	if due := p.heardAt.Add(-latency); due.After(now) {
+		return 0, due.Sub(now)
+	} else if now.Sub(due) > 100*time.Millisecond {
+		// Nothing queued (start, rebuffer or a stalled sink)
+		p.heardAt = now.Add(latency)
+	}
+	if p.rate != 1 && !now.Before(p.rateUntil) {
+		p.rate = 1
+		p.cursor = math.Round(p.cursor)
+	}
+
+	if p.restart {
+		// Like playAtPosition: start where the room will be when this audio
+		// is heard, after silence if the start is scheduled later.
+		st := p.c.Clock().ServerTime(p.heardAt)
+		pos := client.PositionAt(p.anchorPos, p.anchorMs, st)
+		idx := int(pos / t.segTime)
+		if idx >= len(t.segments) {
+			p.ended = true
+			return 0, 0
+		}
+		if t.pcm[idx] == nil {
+			p.request(t, idx, idx+1)
+			return 0, rebufferRetry
+		}
+		p.silence = 0
+		if st < p.anchorMs {
+			p.silence = int(float64(p.anchorMs-st) / 1000 * SampleRate)
+		}
+		p.cursor = math.Round(pos * float64(t.rate)) // whole frames: no interpolation at rate 1
+		p.rate, p.pendingSoft = 1, 0
+		p.restart = false
+		p.request(t, idx+1, idx+3)
+	}
+
+	n := 0
+	for ; n < chunkFrames; n++ {
+		var l, r float32
+		if p.silence > 0 {
+			p.silence--
+		} else {
+			i := int(p.cursor)
+			idx := i / t.segFrames
+			if idx >= len(t.segments) {
+				p.ended = true
+				break
+			}
+			seg := t.pcm[idx]
+			if seg == nil {
+				// Not downloaded in time: rebuffer, then rejoin the room position
+				p.request(t, idx, idx+1)
+				p.restart = true
+				break
+			}
+			off := i - idx*t.segFrames
+			if off < seg.frames {
+				l, r = seg.data[2*off], seg.data[2*off+1]
+				l1, r1 := l, r
+				if off+1 < seg.frames {
+					l1, r1 = seg.data[2*off+2], seg.data[2*off+3]
+				} else if next := t.pcm[idx+1]; next != nil && next.frames > 0 {
+					l1, r1 = next.data[0], next.data[1]
+				}
+				frac := float32(p.cursor - float64(i))
+				l += (l1 - l) * frac
+				r += (r1 - r) * frac
+			} else if idx == len(t.segments)-1 {
+				p.ended = true
+				break
+			}
+			p.cursor += float64(t.rate) / SampleRate * p.rate
+			if next := int(p.cursor) / t.segFrames; next != idx {
+				p.segmentBoundary(t, next)
+			}
+		}
+		putSample(buf[n*frameBytes:], l)
+		putSample(buf[n*frameBytes+2:], r)
+	}
+	p.heardAt = p.heardAt.Add(time.Duration(n) * time.Second / SampleRate)
+	if n == 0 {
+		return 0, rebufferRetry
+	}
+	return n, 0
+}
+
+// segmentBoundary preloads ahead, drops old segments and applies a pending
+// soft correction, which like the web player only takes effect at the start
+// of the next segment. p.mu held.
+func (p *Player) segmentBoundary(t *track, idx int) {
+	p.request(t, idx, idx+3)
+	for i := range t.pcm {
+		if i < idx-1 {
+			delete(t.pcm, i)
+		}
+	}
+	if p.pendingSoft > 0 {
+		// Ahead: start the next segment later
+		p.silence += int(p.pendingSoft * SampleRate)
+	} else if p.pendingSoft < 0 {
+		// Behind: skip into the next segment
+		p.cursor += math.Round(-p.pendingSoft * float64(t.rate))
+	}
+	p.driftOffset += p.pendingSoft
+	p.pendingSoft = 0
+}
+
+func putSample(b []byte, v float32) {
+	s := int32(v * 32768)
+	if s > 32767 {
+		s = 32767
+	} else if s < -32768 {
+		s = -32768
+	}
+	b[0], b[1] = byte(s), byte(s>>8)
+}
+
+// request starts downloading segments from..to that are not loaded. p.mu held.
+func (p *Player) request(t *track, from, to int) {
+	for i := from; i <= to && i < len(t.segments); i++ {
+		if i < 0 || t.pcm[i] != nil || t.loading[i] {
+			continue
+		}
+		t.loading[i] = true
+		go p.fetch(t, i)
+	}
+}
+
+func (p *Player) fetch(t *track, idx int) {
+	s, err := fetchSegment(p.ctx, p.c, t, idx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(t.loading, idx)
+	if err != nil {
+		if p.ctx.Err() == nil {
+			p.logf("%v", err)
+		}
+		return
+	}
+	if t.rate == 0 {
+		t.rate = s.Info.SampleRate
+		t.segFrames = framesPerSegment(t.segTime, t.rate)
+	}
+	t.pcm[idx] = toSegment(s, t.segFrames, idx == len(t.segments)-1)
+	p.poke()
+}
+
+// heardPosition is the track position being heard at now. p.mu held.
+func (p *Player) heardPosition(now time.Time) float64 {
+	queued := p.heardAt.Sub(now).Seconds() + float64(p.silence)/SampleRate
+	return p.cursor/float64(p.track.rate) - queued*p.rate
+}
+
+// driftLoop checks drift every 200ms for the first 5s of a track, then every second.
+func (p *Player) driftLoop(ctx context.Context) {
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	var last time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			p.mu.Lock()
+			fast := now.Sub(p.trackStarted) < 5*time.Second
+			p.mu.Unlock()
+			if !fast && now.Sub(last) < time.Second {
+				continue
+			}
+			last = now
+			p.correctDrift(false)
+		}
+	}
+}
+
+// correctDrift applies the web player's three tiers: soft (5-50ms) shifts
+// the next segment, playback rate (50-200ms) catches up by 2-3% for up to
+// 5s, hard (>200ms) restarts from the room position with backoff.
+func (p *Player) correctDrift(skipDebounce bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.track
+	if !p.playing || t == nil || t.rate == 0 || p.restart || p.ended || p.silence > 0 {
+		return
+	}
+	now := time.Now()
+	if p.rate != 1 {
+		if now.Before(p.rateUntil) {
+			return
+		}
+		p.rate = 1
+		p.cursor = math.Round(p.cursor)
+	}
+	if !skipDebounce && now.Sub(p.lastCorrection) < 100*time.Millisecond {
+		return
+	}
+	p.lastCorrection = now
+
+	expected := client.PositionAt(p.anchorPos, p.anchorMs, p.c.Clock().ServerTime(now))
+	drift := p.heardPosition(now) - expected
+	abs := math.Abs(drift)
+	switch {
+	case abs > 0.005 && abs <= 0.05:
+		// Cap accumulated soft corrections at ±500ms, then resync hard
+		if math.Abs(p.driftOffset+drift) > 0.5 {
+			p.logf("soft correction capped at %.0fms, resyncing", p.driftOffset*1000)
+			p.driftOffset = 0
+			p.restart = true
+			return
+		}
+		if math.Abs(p.pendingSoft) > 0.003 && (p.pendingSoft > 0) == (drift > 0) {
+			return
+		}
+		p.pendingSoft += drift
+		p.resyncBackoff = 500 * time.Millisecond
+	case abs > 0.05 && abs <= 0.2:
+		offset := 0.02
+		if abs > 0.1 {
+			offset = 0.03
+		}
+		p.rate = 1 + offset
+		if drift > 0 {
+			p.rate = 1 - offset
+		}
+		p.rateUntil = now.Add(time.Duration(math.Min(5, abs/offset) * float64(time.Second)))
+		p.resyncBackoff = 500 * time.Millisecond
+		p.logf("drift %.0fms, playback rate %.2f", drift*1000, p.rate)
+	case abs > 0.2:
+		if p.resyncBackoff == 0 {
+			p.resyncBackoff = 500 * time.Millisecond
+		}
+		if now.Sub(p.lastResync) < p.resyncBackoff {
+			return
+		}
+		p.logf("drift %.0fms, resyncing", drift*1000)
+		p.lastResync = now
+		p.resyncBackoff = p.resyncBackoff * 3 / 2
+		if p.resyncBackoff > 5*time.Second {
+			p.resyncBackoff = 5 * time.Second
+		}
+		p.restart = true
+		p.poke()
+	}
+}
+
+// statusLoop reports the heard position so the server can force the right
+// track or position if this listener has fallen out of step.
+func (p *Player) statusLoop(ctx context.Context) {
+	tick := time.NewTicker(statusEvery)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			p.mu.Lock()
+			ok := p.playing && p.track != nil && p.track.rate != 0 && !p.restart && !p.ended
+			var pos float64
+			var index int
+			if ok {
+				pos, index = p.heardPosition(now), p.track.index
+			}
+			p.mu.Unlock()
+			if ok {
+				p.c.ReportStatus(index, math.Max(0, pos))
+			}
+		}
+	}
+}
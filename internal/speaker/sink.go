@@ -0,0 +1,167 @@
+package speaker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output format written to every sink: interleaved signed 16-bit
+// little-endian stereo.
+const (
+	SampleRate = 44100
+	Channels   = 2
+	frameBytes = Channels * 2
+)
+
+// Sink receives PCM in the output format.
+type Sink interface {
+	io.WriteCloser
+	// Latency is how long audio takes from Write to the speaker. The player
+	// writes that far ahead so the audio is heard on time.
+	Latency() time.Duration
+}
+
+// defaultDeviceLatency is the buffer requested from aplay and pacat.
+const defaultDeviceLatency = 200 * time.Millisecond
+
+// OpenSink opens an output by spec:
+//
+//	alsa[:DEVICE]   play through aplay, e.g. alsa:hw:1,0
+//	pulse[:SINK]    play through pacat
+//	-               raw PCM to stdout
+//	PATH            raw PCM to a file or named pipe; *.wav gets a WAV header
+//
+// latency overrides the device buffer for alsa and pulse, and tells the
+// player how far behind a file or pipe reader plays; 0 keeps the default.
+func OpenSink(spec string, latency time.Duration) (Sink, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "alsa", "pulse":
+		if latency <= 0 {
+			latency = defaultDeviceLatency
+		}
+		var args []string
+		if kind == "alsa" {
+			args = []string{"aplay", "-q", "-t", "raw", "-f", "S16_LE",
+				"-c", strconv.Itoa(Channels), "-r", strconv.Itoa(SampleRate),
+				"--buffer-time=" + strconv.FormatInt(latency.Microseconds(), 10)}
+			if arg != "" {
+				args = append(args, "-D", arg)
+			}
+		} else {
+			args = []string{"pacat", "--playback", "--raw", "--format=s16le",
+				"--channels=" + strconv.Itoa(Channels), "--rate=" + strconv.Itoa(SampleRate),
+				"--latency-msec=" + strconv.FormatInt(latency.Milliseconds(), 10)}
+			if arg != "" {
+				args = append(args, "--device="+arg)
+			}
+		}
+		return startCommandSink(args, latency)
+	case "-":
+		return &fileSink{f: os.Stdout, latency: latency}, nil
+	case "":
+		return nil, fmt.Errorf("empty output")
+	}
+	f, err := os.OpenFile(spec, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{f: f, latency: latency, close: true}
+	if strings.HasSuffix(strings.ToLower(spec), ".wav") {
+		s.wav = true
+		if _, err := f.Write(wavHeader(0xffffffff - 36)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// commandSink pipes PCM into a player process.
+type commandSink struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	latency time.Duration
+}
+
+func startCommandSink(args []string, latency time.Duration) (*commandSink, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+	return &commandSink{cmd: cmd, stdin: stdin, latency: latency}, nil
+}
+
+func (s *commandSink) Write(p []byte) (int, error) {
+	n, err := s.stdin.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%s: %w", s.cmd.Path, err)
+	}
+	return n, nil
+}
+
+func (s *commandSink) Latency() time.Duration { return s.latency }
+
+func (s *commandSink) Close() error {
+	s.stdin.Close()
+	return s.cmd.Wait()
+}
+
+// fileSink writes raw PCM, or a streaming WAV file, to a file or pipe.
+type fileSink struct {
+	f       *os.File
+	latency time.Duration
+	close   bool
+	wav     bool
+	written int64
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	n, err := s.f.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+func (s *fileSink) Latency() time.Duration { return s.latency }
+
+// Close fixes up the WAV sizes when the file is seekable.
+func (s *fileSink) Close() error {
+	if !s.close {
+		return nil
+	}
+	if s.wav && s.written <= 0xffffffff-36 {
+		if _, err := s.f.Seek(0, io.SeekStart); err == nil {
+			s.f.Write(wavHeader(uint32(s.written)))
+		}
+	}
+	return s.f.Close()
+}
+
+func wavHeader(dataSize uint32) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 36+dataSize)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], Channels)
+	binary.LittleEndian.PutUint32(h[24:], SampleRate)
+	binary.LittleEndian.PutUint32(h[28:], SampleRate*frameBytes)
+	binary.LittleEndian.PutUint16(h[32:], frameBytes)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], dataSize)
+	return h
+}
@@ -0,0 +1,174 @@
+package speaker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/flac"
+	"github.com/xingzihai/listen-together/pkg/client"
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// track is one room track being played: its segment list and the decoded
+// segments around the play position.
+type track struct {
+	info     *protocol.TrackAudioInfo
+	index    int
+	quality  string
+	segments []string
+	segTime  float64
+	token    string
+
+	// Set by the first decoded segment
+	rate      int // source sample rate
+	segFrames int // frames per non-final segment
+
+	pcm     map[int]*segment
+	loading map[int]bool
+}
+
+// segment is a decoded segment as interleaved stereo floats in [-1, 1].
+type segment struct {
+	frames int
+	data   []float32
+}
+
+// pickQuality mirrors the web player: the preferred tier if the track has
+// it, else medium, else the last one listed.
+func pickQuality(qualities []string, preferred string) string {
+	has := func(q string) bool {
+		for _, x := range qualities {
+			if x == q {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has(preferred):
+		return preferred
+	case has("medium") || len(qualities) == 0:
+		return "medium"
+	}
+	return qualities[len(qualities)-1]
+}
+
+// loadTrack fetches the segment list of ta at the chosen quality.
+func loadTrack(ctx context.Context, c *client.Client, ta *protocol.TrackAudioInfo, index int, preferred string) (*track, error) {
+	q := pickQuality(ta.Qualities, preferred)
+	resp, err := c.Do(ctx, http.MethodGet, fmt.Sprintf("/api/library/files/%d/segments/%s/", ta.AudioID, q))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("segment list: %s", resp.Status)
+	}
+	var data struct {
+		SegmentToken string   `json:"segment_token"`
+		Segments     []string `json:"segments"`
+		SegmentTime  float64  `json:"segment_time"`
+		OwnerID      int64    `json:"owner_id"`
+		AudioUUID    string   `json:"audio_uuid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("segment list: %w", err)
+	}
+	if len(data.Segments) == 0 {
+		return nil, fmt.Errorf("segment list: no segments")
+	}
+	t := &track{
+		info: ta, index: index, quality: q,
+		segments: data.Segments, segTime: data.SegmentTime,
+		token: data.SegmentToken,
+		pcm:   make(map[int]*segment), loading: make(map[int]bool),
+	}
+	if t.segTime <= 0 {
+		t.segTime = 5
+	}
+	if t.token == "" {
+		t.token = ta.SegmentToken
+	}
+	return t, nil
+}
+
+// segmentPath is the ServeSegmentFile URL of segment idx, signed with the
+// track's ?st= token so it also works for tokens without library access.
+func (t *track) segmentPath(idx int) string {
+	p := fmt.Sprintf("/api/library/segments/%d/%s/%s/%s", t.info.OwnerID, t.info.AudioUUID, t.quality, t.segments[idx])
+	if t.token != "" {
+		p += "?st=" + url.QueryEscape(t.token)
+	}
+	return p
+}
+
+// fetchSegment downloads and decodes segment idx, retrying like the web player.
+func fetchSegment(ctx context.Context, c *client.Client, t *track, idx int) (*flac.Stream, error) {
+	var data []byte
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(300 * time.Millisecond):
+			}
+		}
+		var resp *http.Response
+		resp, err = c.Do(ctx, http.MethodGet, t.segmentPath(idx))
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("segment %s: %s", t.segments[idx], resp.Status)
+			continue
+		}
+		data, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := flac.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("segment %s: %w", t.segments[idx], err)
+	}
+	return s, nil
+}
+
+// toSegment converts decoded samples to stereo floats. Like the web player it
+// trims FLAC block-alignment padding so every segment but the last is exactly
+// segFrames long.
+func toSegment(s *flac.Stream, segFrames int, last bool) *segment {
+	n := s.Frames()
+	if !last && n > segFrames {
+		n = segFrames
+	}
+	scale := 1 / float32(int64(1)<<(s.Info.BitsPerSample-1))
+	left := s.Samples[0]
+	right := left
+	if len(s.Samples) > 1 {
+		right = s.Samples[1]
+	}
+	data := make([]float32, n*2)
+	for i := 0; i < n; i++ {
+		data[2*i] = float32(left[i]) * scale
+		data[2*i+1] = float32(right[i]) * scale
+	}
+	return &segment{frames: n, data: data}
+}
+
+// framesPerSegment is the trimmed segment length at rate.
+func framesPerSegment(segTime float64, rate int) int {
+	return int(math.Round(segTime * float64(rate)))
+}
@@ -0,0 +1,374 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "minio"
+	testSecretKey = "minio-secret"
+	testRegion    = "us-east-1"
+	testBucket    = "music"
+)
+
+// fakeS3 is a MinIO-style stand-in: one path-style bucket held in memory that
+// checks SigV4 header and presigned-query signatures on every request.
+type fakeS3 struct {
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string][]byte
+	types    map[string]string
+	pageSize int // ListObjectsV2 page size, small to exercise continuation
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, objects: make(map[string][]byte), types: make(map[string]string), pageSize: 2}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL, err)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/"+testBucket)
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(rest, "/")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if int64(len(body)) != r.ContentLength {
+			http.Error(w, "<Error><Code>IncompleteBody</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		f.types[key] = r.Header.Get("Content-Type")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[key])
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(body))+`"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("list-type") != "2" {
+		http.Error(w, "<Error><Code>InvalidArgument</Code></Error>", http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, q.Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	start := 0
+	if tok := q.Get("continuation-token"); tok != "" {
+		start, _ = strconv.Atoi(tok)
+	}
+	type content struct {
+		Key string `xml:"Key"`
+	}
+	var res struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}
+	end := min(start+f.pageSize, len(keys))
+	for _, k := range keys[start:end] {
+		res.Contents = append(res.Contents, content{k})
+	}
+	if end < len(keys) {
+		res.IsTruncated = true
+		res.NextContinuationToken = strconv.Itoa(end)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(res)
+}
+
+// verify recomputes the request's SigV4 signature, from either the
+// Authorization header or presigned query parameters.
+func (f *fakeS3) verify(r *http.Request) error {
+	q := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate string
+	presigned := q.Get("X-Amz-Signature") != ""
+	if presigned {
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		issued, err := time.Parse("20060102T150405Z", amzDate)
+		if err != nil {
+			return err
+		}
+		expires, _ := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if time.Since(issued) > time.Duration(expires)*time.Second {
+			return errors.New("presigned URL expired")
+		}
+		q.Del("X-Amz-Signature")
+	} else {
+		auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+		if !ok {
+			return errors.New("missing SigV4 authorization")
+		}
+		for _, part := range strings.Split(auth, ", ") {
+			k, v, _ := strings.Cut(part, "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				signature = v
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+	}
+	parts := strings.SplitN(credential, "/", 2)
+	if len(parts) != 2 || parts[0] != testAccessKey {
+		return errors.New("unknown access key")
+	}
+	scope := parts[1]
+
+	var query []string
+	for k, vs := range q {
+		for _, v := range vs {
+			query = append(query, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(query)
+	var headers strings.Builder
+	for _, h := range strings.Split(signedHeaders, ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	payload := "UNSIGNED-PAYLOAD"
+	if !presigned {
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(query, "&"), headers.String(), signedHeaders, payload}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, s := range strings.Split(scope, "/") {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(s))
+		key = m.Sum(nil)
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(toSign))
+	if want := hex.EncodeToString(m.Sum(nil)); signature != want {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func newTestS3Store(endpoint string) *S3Store {
+	return &S3Store{Endpoint: endpoint, Region: testRegion, Bucket: testBucket,
+		AccessKey: testAccessKey, SecretKey: testSecretKey, Prefix: "lt"}
+}
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestS3PutOpenListDelete(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	s := newTestS3Store(srv.URL)
+
+	files := map[string]string{
+		"library/3/abc/segments_medium/seg_000.flac": "first",
+		"library/3/abc/segments_medium/seg_001.flac": "second",
+		"library/3/abc/segments_low/seg 000.flac":    "with a space",
+		"library/3/abc/manifest.json":                `{"duration":10}`,
+		"library/4/def/manifest.json":                `{}`,
+	}
+	for key, content := range files {
+		if err := s.Put(key, writeTemp(t, "obj", content)); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	if got := fake.types["lt/library/3/abc/manifest.json"]; got != "application/json" {
+		t.Errorf("manifest Content-Type = %q, want application/json", got)
+	}
+
+	for key, content := range files {
+		rc, err := s.Open(key)
+		if err != nil {
+			t.Fatalf("Open %s: %v", key, err)
+		}
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(got) != content {
+			t.Errorf("Open %s = %q, want %q", key, got, content)
+		}
+	}
+	if _, err := s.Open("library/3/abc/missing.flac"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open missing: err = %v, want fs.ErrNotExist", err)
+	}
+
+	keys, err := s.List("library/3/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"library/3/abc/manifest.json",
+		"library/3/abc/segments_low/seg 000.flac",
+		"library/3/abc/segments_medium/seg_000.flac",
+		"library/3/abc/segments_medium/seg_001.flac",
+	}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %q, want %q", keys, want)
+	}
+
+	if err := s.DeletePrefix("library/3/abc/segments_medium"); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = s.List("library/3")
+	want = []string{"library/3/abc/manifest.json", "library/3/abc/segments_low/seg 000.flac"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("List after delete = %q, want %q", keys, want)
+	}
+	if _, ok := fake.objects["lt/library/4/def/manifest.json"]; !ok {
+		t.Error("DeletePrefix removed an object outside the prefix")
+	}
+
+	if err := s.Delete("library/3/abc/manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = s.List("library/3")
+	if strings.Join(keys, ",") != "library/3/abc/segments_low/seg 000.flac" {
+		t.Errorf("List after Delete = %q", keys)
+	}
+}
+
+func TestS3ServeProxiesRange(t *testing.T) {
+	_, srv := newFakeS3(t)
+	s := newTestS3Store(srv.URL)
+	key := "library/3/abc/segments_medium/seg_000.flac"
+	if err := s.Put(key, writeTemp(t, "seg.flac", "0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/library/segments/3/abc/medium/seg_000.flac", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := httptest.NewRecorder()
+	s.Serve(rec, req, key)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Errorf("Serve Range = %d %q, want 206 \"2345\"", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.Serve(rec, httptest.NewRequest(http.MethodGet, "/", nil), "library/3/abc/missing.flac")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Serve missing = %d, want 404", rec.Code)
+	}
+}
+
+func TestS3ServeRedirectsToPresignedURL(t *testing.T) {
+	_, srv := newFakeS3(t)
+	s := newTestS3Store(srv.URL)
+	s.Redirect = true
+	key := "library/3/abc/segments_low/seg 000.flac"
+	if err := s.Put(key, writeTemp(t, "seg.flac", "segment data")); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.Serve(rec, httptest.NewRequest(http.MethodGet, "/api/library/segments/3/abc/low/seg%20000.flac", nil), key)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Serve = %d, want 302", rec.Code)
+	}
+	loc := rec.Header().Get("Location")
+	if !strings.HasPrefix(loc, srv.URL+"/"+testBucket+"/lt/library/3/abc/segments_low/") {
+		t.Fatalf("Location = %q", loc)
+	}
+
+	// The browser follows the redirect without credentials
+	resp, err := http.Get(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "segment data" {
+		t.Errorf("GET presigned URL = %d %q", resp.StatusCode, body)
+	}
+
+	u, _ := url.Parse(loc)
+	if got := u.Query().Get("X-Amz-Expires"); got != "900" {
+		t.Errorf("X-Amz-Expires = %s, want 900", got)
+	}
+	q := u.Query()
+	q.Set("X-Amz-Expires", "3600")
+	u.RawQuery = q.Encode()
+	if err := (&fakeS3{}).verify(&http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: http.Header{}}); err == nil {
+		t.Error("tampered presigned URL still verifies")
+	}
+}
+
+func TestS3SignedURLTTLCapped(t *testing.T) {
+	s := newTestS3Store("http://127.0.0.1:9000")
+	raw, err := s.SignedURL("library/1/x/manifest.json", 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(raw)
+	if got := u.Query().Get("X-Amz-Expires"); got != strconv.Itoa(7*24*3600) {
+		t.Errorf("X-Amz-Expires = %s, want 7 days", got)
+	}
+}
@@ -0,0 +1,191 @@
+// Package storage abstracts where processed library files live. Keys are
+// slash-separated paths relative to the data directory, e.g.
+// "library/3/6f1c.../segments_medium/seg_000.flac".
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNoSignedURL is returned by stores that cannot hand out direct download URLs.
+var ErrNoSignedURL = errors.New("storage: signed URLs not supported")
+
+// Store is a flat object store addressed by key.
+type Store interface {
+	// Put copies the local file at localPath to key.
+	Put(key, localPath string) error
+	// Open returns the object's content. Missing objects yield an error wrapping fs.ErrNotExist.
+	Open(key string) (io.ReadCloser, error)
+	// List returns every key under prefix.
+	List(prefix string) ([]string, error)
+	// Delete removes the object at key. A missing object is not an error.
+	Delete(key string) error
+	// DeletePrefix removes every object under prefix.
+	DeletePrefix(prefix string) error
+	// SignedURL returns a time-limited URL that fetches key without further auth.
+	SignedURL(key string, ttl time.Duration) (string, error)
+	// Serve writes the object to w, honouring Range and conditional requests.
+	Serve(w http.ResponseWriter, r *http.Request, key string)
+	// Local reports whether keys are plain files under the data directory, in
+	// which case processed output is already in place and nothing needs uploading.
+	Local() bool
+}
+
+// FromEnv builds the store selected by STORAGE_BACKEND ("local", the default, or "s3").
+// The S3 backend reads S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY,
+// S3_SECRET_KEY, and optionally S3_PREFIX and S3_REDIRECT.
+func FromEnv(dataDir string) (Store, error) {
+	switch strings.ToLower(os.Getenv("STORAGE_BACKEND")) {
+	case "", "local":
+		return &LocalStore{Root: dataDir}, nil
+	case "s3":
+		s := &S3Store{
+			Endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Prefix:    strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+			Redirect:  os.Getenv("S3_REDIRECT") == "true",
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		if s.Endpoint == "" || s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+			return nil, fmt.Errorf("storage: S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("storage: unknown backend %q", os.Getenv("STORAGE_BACKEND"))
+	}
+}
+
+// cleanKey normalises a key and rejects anything escaping the root.
+func cleanKey(key string) (string, error) {
+	k := path.Clean("/" + strings.ReplaceAll(key, "\\", "/"))[1:]
+	if k == "" || strings.HasPrefix(k, "..") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return k, nil
+}
+
+// LocalStore keeps objects as files under Root.
+type LocalStore struct {
+	Root string
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	k, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(k)), nil
+}
+
+func (s *LocalStore) Put(key, localPath string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if filepath.Clean(localPath) == dst {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (s *LocalStore) Open(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *LocalStore) List(prefix string) ([]string, error) {
+	root, err := s.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+func (s *LocalStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) DeletePrefix(prefix string) error {
+	p, err := s.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (s *LocalStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	return "", ErrNoSignedURL
+}
+
+func (s *LocalStore) Serve(w http.ResponseWriter, r *http.Request, key string) {
+	p, err := s.path(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := os.Stat(p); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, p)
+}
+
+func (s *LocalStore) Local() bool { return true }
@@ -0,0 +1,453 @@
+package subsonic
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+const (
+	defaultListSize = 10
+	maxListSize     = 500
+)
+
+// intParam reads an integer form value, falling back to def and capping at max
+// (0 = no cap).
+func intParam(r *http.Request, name string, def, max int) int {
+	n, err := strconv.Atoi(r.Form.Get(name))
+	if err != nil || n < 0 {
+		n = def
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n
+}
+
+// page returns list[offset:offset+size] clamped to the list.
+func page[T any](list []T, offset, size int) []T {
+	if offset >= len(list) {
+		return list[:0]
+	}
+	list = list[offset:]
+	if size < len(list) {
+		list = list[:size]
+	}
+	return list
+}
+
+func (h *Handler) view(w http.ResponseWriter, r *http.Request, u *db.User) *libraryView {
+	v, err := h.loadView(u.ID)
+	if err != nil {
+		writeError(w, r, errGeneric, "failed to load library")
+		return nil
+	}
+	return v
+}
+
+func (h *Handler) ping(w http.ResponseWriter, r *http.Request, u *db.User) {
+	write(w, r, newResponse())
+}
+
+func (h *Handler) getLicense(w http.ResponseWriter, r *http.Request, u *db.User) {
+	resp := newResponse()
+	resp.License = &license{Valid: true}
+	write(w, r, resp)
+}
+
+func (h *Handler) getOpenSubsonicExtensions(w http.ResponseWriter, r *http.Request, u *db.User) {
+	resp := newResponse()
+	resp.OpenSubsonicExtensions = &[]extension{}
+	write(w, r, resp)
+}
+
+func (h *Handler) getUser(w http.ResponseWriter, r *http.Request, u *db.User) {
+	admin := u.Role == "admin" || u.Role == "owner"
+	target := u
+	if name := r.Form.Get("username"); name != "" && name != u.Username {
+		if !admin {
+			writeError(w, r, errNotAllowed, "not authorized")
+			return
+		}
+		other, err := h.DB.GetUserByUsername(name)
+		if err != nil {
+			writeError(w, r, errNotFound, "user not found")
+			return
+		}
+		target = other
+	}
+	resp := newResponse()
+	resp.User = &user{
+		Username:          target.Username,
+		ScrobblingEnabled: true,
+		AdminRole:         target.Role == "admin" || target.Role == "owner",
+		SettingsRole:      true,
+		DownloadRole:      true,
+		CoverArtRole:      true,
+		StreamRole:        true,
+		Folders:           []int{1},
+	}
+	write(w, r, resp)
+}
+
+func (h *Handler) getMusicFolders(w http.ResponseWriter, r *http.Request, u *db.User) {
+	resp := newResponse()
+	resp.MusicFolders = &musicFolders{Folders: []musicFolder{{ID: 1, Name: libraryFolder}}}
+	write(w, r, resp)
+}
+
+func (h *Handler) getGenres(w http.ResponseWriter, r *http.Request, u *db.User) {
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	byName := map[string]*genre{}
+	albums := map[string]map[string]bool{}
+	for _, af := range v.files {
+		name := strings.TrimSpace(af.Genre)
+		if name == "" {
+			continue
+		}
+		g := byName[name]
+		if g == nil {
+			g = &genre{Name: name}
+			byName[name] = g
+			albums[name] = map[string]bool{}
+		}
+		g.SongCount++
+		if al := v.albumOf[af.ID]; al != nil && !albums[name][al.id] {
+			albums[name][al.id] = true
+			g.AlbumCount++
+		}
+	}
+	list := []genre{}
+	for _, g := range byName {
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	resp := newResponse()
+	resp.Genres = &genres{Genres: list}
+	write(w, r, resp)
+}
+
+func (h *Handler) getArtists(w http.ResponseWriter, r *http.Request, u *db.User) {
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	byLetter := map[string][]artistID3{}
+	var letters []string
+	for _, ar := range v.sortedArtists() {
+		letter := indexLetter(ar.name)
+		if _, ok := byLetter[letter]; !ok {
+			letters = append(letters, letter)
+		}
+		byLetter[letter] = append(byLetter[letter], v.toArtist(ar))
+	}
+	// "#" (digits, CJK, symbols) goes last, as clients expect.
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i] == "#" || letters[j] == "#" {
+			return letters[j] == "#" && letters[i] != "#"
+		}
+		return letters[i] < letters[j]
+	})
+	index := make([]indexID3, 0, len(letters))
+	for _, letter := range letters {
+		index = append(index, indexID3{Name: letter, Artists: byLetter[letter]})
+	}
+	resp := newResponse()
+	resp.Artists = &artistsID3{Index: index}
+	write(w, r, resp)
+}
+
+func (h *Handler) getArtist(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id := r.Form.Get("id")
+	if id == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	ar := v.artists[id]
+	if ar == nil {
+		writeError(w, r, errNotFound, "artist not found")
+		return
+	}
+	resp := newResponse()
+	resp.Artist = &artistWithAlbums{artistID3: v.toArtist(ar), Albums: v.toAlbums(ar.albums)}
+	write(w, r, resp)
+}
+
+func (h *Handler) getAlbum(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id := r.Form.Get("id")
+	if id == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	al := v.albums[id]
+	if al == nil {
+		writeError(w, r, errNotFound, "album not found")
+		return
+	}
+	resp := newResponse()
+	resp.Album = &albumWithSongs{albumID3: v.toAlbum(al), Songs: v.toChildren(al.tracks)}
+	write(w, r, resp)
+}
+
+func (h *Handler) getSong(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id := r.Form.Get("id")
+	if id == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	af := v.song(id)
+	if af == nil {
+		writeError(w, r, errNotFound, "song not found")
+		return
+	}
+	c := v.toChild(af)
+	resp := newResponse()
+	resp.Song = &c
+	write(w, r, resp)
+}
+
+// getAlbumList2 supports the list types clients use for their home screens.
+func (h *Handler) getAlbumList2(w http.ResponseWriter, r *http.Request, u *db.User) {
+	typ := r.Form.Get("type")
+	if typ == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: type")
+		return
+	}
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	list := v.sortedAlbums()
+	stats := make(map[string]albumID3, len(list))
+	for _, al := range list {
+		stats[al.id] = v.toAlbum(al)
+	}
+	by := func(less func(a, b albumID3) bool) {
+		sort.SliceStable(list, func(i, j int) bool { return less(stats[list[i].id], stats[list[j].id]) })
+	}
+	switch typ {
+	case "random":
+		rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	case "newest":
+		by(func(a, b albumID3) bool { return a.Created > b.Created })
+	case "frequent":
+		list = filterAlbums(list, func(al *albumEntry) bool { return stats[al.id].PlayCount > 0 })
+		by(func(a, b albumID3) bool { return a.PlayCount > b.PlayCount })
+	case "recent":
+		list = filterAlbums(list, func(al *albumEntry) bool { return stats[al.id].Played != "" })
+		by(func(a, b albumID3) bool { return a.Played > b.Played })
+	case "starred":
+		list = filterAlbums(list, func(al *albumEntry) bool { return albumStarred(al) })
+	case "highest":
+		ratings := map[string]float64{}
+		for _, al := range list {
+			ratings[al.id] = albumRating(al)
+		}
+		list = filterAlbums(list, func(al *albumEntry) bool { return ratings[al.id] > 0 })
+		sort.SliceStable(list, func(i, j int) bool { return ratings[list[i].id] > ratings[list[j].id] })
+	case "alphabeticalByName":
+	case "alphabeticalByArtist":
+		by(func(a, b albumID3) bool { return strings.ToLower(a.Artist) < strings.ToLower(b.Artist) })
+	case "byYear":
+		from, to := intParam(r, "fromYear", 0, 0), intParam(r, "toYear", 9999, 0)
+		lo, hi := from, to
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		list = filterAlbums(list, func(al *albumEntry) bool {
+			y := stats[al.id].Year
+			return y >= lo && y <= hi
+		})
+		if from > to {
+			by(func(a, b albumID3) bool { return a.Year > b.Year })
+		} else {
+			by(func(a, b albumID3) bool { return a.Year < b.Year })
+		}
+	case "byGenre":
+		g := r.Form.Get("genre")
+		list = filterAlbums(list, func(al *albumEntry) bool {
+			for _, af := range al.tracks {
+				if strings.EqualFold(af.Genre, g) {
+					return true
+				}
+			}
+			return false
+		})
+	default:
+		writeError(w, r, errGeneric, "unsupported list type: "+typ)
+		return
+	}
+	list = page(list, intParam(r, "offset", 0, 0), intParam(r, "size", defaultListSize, maxListSize))
+	out := make([]albumID3, 0, len(list))
+	for _, al := range list {
+		out = append(out, stats[al.id])
+	}
+	resp := newResponse()
+	resp.AlbumList2 = &albumList2{Albums: out}
+	write(w, r, resp)
+}
+
+func filterAlbums(list []*albumEntry, keep func(*albumEntry) bool) []*albumEntry {
+	var out []*albumEntry
+	for _, al := range list {
+		if keep(al) {
+			out = append(out, al)
+		}
+	}
+	return out
+}
+
+// albumStarred reports whether every track on al is a favorite; there is no
+// separate album favorite.
+func albumStarred(al *albumEntry) bool {
+	for _, af := range al.tracks {
+		if !af.Favorite {
+			return false
+		}
+	}
+	return len(al.tracks) > 0
+}
+
+// albumRating averages the caller's ratings of al's tracks, falling back to
+// everyone's average for tracks they haven't rated.
+func albumRating(al *albumEntry) float64 {
+	var sum float64
+	var n int
+	for _, af := range al.tracks {
+		switch {
+		case af.MyRating > 0:
+			sum += float64(af.MyRating)
+		case af.AvgRating > 0:
+			sum += af.AvgRating
+		default:
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+func (h *Handler) getRandomSongs(w http.ResponseWriter, r *http.Request, u *db.User) {
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	g := r.Form.Get("genre")
+	from, to := intParam(r, "fromYear", 0, 0), intParam(r, "toYear", 9999, 0)
+	var picked []*db.AudioFile
+	for _, af := range v.files {
+		if g != "" && !strings.EqualFold(af.Genre, g) {
+			continue
+		}
+		if y := parseYear(af.Year); (from > 0 || to < 9999) && (y < from || y > to) {
+			continue
+		}
+		picked = append(picked, af)
+	}
+	rand.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+	picked = page(picked, 0, intParam(r, "size", defaultListSize, maxListSize))
+	resp := newResponse()
+	resp.RandomSongs = &songs{Songs: v.toChildren(picked)}
+	write(w, r, resp)
+}
+
+// search3 matches every word of query against names; an empty query (or "")
+// returns everything, which is how clients sync a whole library.
+func (h *Handler) search3(w http.ResponseWriter, r *http.Request, u *db.User) {
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	words := strings.Fields(strings.ToLower(strings.Trim(r.Form.Get("query"), `"`)))
+	matches := func(fields ...string) bool {
+		text := strings.ToLower(strings.Join(fields, " "))
+		for _, w := range words {
+			if !strings.Contains(text, w) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var artists []*artistEntry
+	for _, ar := range v.sortedArtists() {
+		if matches(ar.name) {
+			artists = append(artists, ar)
+		}
+	}
+	var albums []*albumEntry
+	for _, al := range v.sortedAlbums() {
+		if matches(al.name, al.artist) {
+			albums = append(albums, al)
+		}
+	}
+	var tracks []*db.AudioFile
+	for _, af := range v.files {
+		if matches(af.Title, af.Artist, af.Album, af.OriginalName) {
+			tracks = append(tracks, af)
+		}
+	}
+
+	resp := newResponse()
+	resp.SearchResult3 = &searchResult3{
+		Artists: v.toArtists(page(artists, intParam(r, "artistOffset", 0, 0), intParam(r, "artistCount", 20, maxListSize))),
+		Albums:  v.toAlbums(page(albums, intParam(r, "albumOffset", 0, 0), intParam(r, "albumCount", 20, maxListSize))),
+		Songs:   v.toChildren(page(tracks, intParam(r, "songOffset", 0, 0), intParam(r, "songCount", 20, maxListSize))),
+	}
+	write(w, r, resp)
+}
+
+// getStarred2 lists favorite tracks, plus albums and artists whose tracks are
+// all favorites.
+func (h *Handler) getStarred2(w http.ResponseWriter, r *http.Request, u *db.User) {
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	var tracks []*db.AudioFile
+	for _, af := range v.files {
+		if af.Favorite {
+			tracks = append(tracks, af)
+		}
+	}
+	albums := filterAlbums(v.sortedAlbums(), albumStarred)
+	var artists []*artistEntry
+	for _, ar := range v.sortedArtists() {
+		all := len(ar.albums) > 0
+		for _, al := range ar.albums {
+			all = all && albumStarred(al)
+		}
+		if all {
+			artists = append(artists, ar)
+		}
+	}
+	resp := newResponse()
+	resp.Starred2 = &starred2{
+		Artists: v.toArtists(artists),
+		Albums:  v.toAlbums(albums),
+		Songs:   v.toChildren(tracks),
+	}
+	write(w, r, resp)
+}
@@ -0,0 +1,272 @@
+package subsonic
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// accessibleTrack looks up a song id the user may play.
+func (h *Handler) accessibleTrack(userID int64, id string) *db.AudioFile {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	if ok, _ := h.DB.CanAccessAudioFile(userID, n); !ok {
+		return nil
+	}
+	af, err := h.DB.GetAudioFileByID(n)
+	if err != nil {
+		return nil
+	}
+	return af
+}
+
+// stream serves stream and download. format=raw (and download) get the
+// original, or the best tier joined into one FLAC when ORIGINAL_RETENTION has
+// dropped it; otherwise maxBitRate (kbps) picks a tier when the original is
+// larger.
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id := r.Form.Get("id")
+	if id == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	af := h.accessibleTrack(u.ID, id)
+	if af == nil {
+		writeError(w, r, errNotFound, "song not found")
+		return
+	}
+	quality := ""
+	if r.Form.Get("format") != "raw" && !strings.HasSuffix(strings.TrimSuffix(r.URL.Path, ".view"), "/download") {
+		quality = h.Library.QualityForBitrate(af, intParam(r, "maxBitRate", 0, 0))
+	}
+	h.Library.StreamTrack(w, r, af, quality)
+}
+
+// getCoverArt accepts song, album and artist ids.
+func (h *Handler) getCoverArt(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id := r.Form.Get("id")
+	if id == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	var af *db.AudioFile
+	if strings.HasPrefix(id, "al-") || strings.HasPrefix(id, "ar-") {
+		v := h.view(w, r, u)
+		if v == nil {
+			return
+		}
+		af = v.coverTrack(id)
+	} else {
+		af = h.accessibleTrack(u.ID, id)
+	}
+	if af == nil || af.CoverArt == "" {
+		writeError(w, r, errNotFound, "cover art not found")
+		return
+	}
+	h.Library.ServeTrackCover(w, r, af)
+}
+
+// scrobble counts submitted plays; "now playing" notifications are accepted
+// and ignored.
+func (h *Handler) scrobble(w http.ResponseWriter, r *http.Request, u *db.User) {
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	if r.Form.Get("submission") != "false" {
+		for _, id := range ids {
+			if af := h.accessibleTrack(u.ID, id); af != nil {
+				h.DB.RecordTrackPlay(af.ID, false)
+			}
+		}
+	}
+	write(w, r, newResponse())
+}
+
+// star and unstar map to favorites. Albums and artists can't be favorites on
+// their own, so albumId/artistId are accepted but have no effect.
+func (h *Handler) star(w http.ResponseWriter, r *http.Request, u *db.User) {
+	h.setStarred(w, r, u, true)
+}
+
+func (h *Handler) unstar(w http.ResponseWriter, r *http.Request, u *db.User) {
+	h.setStarred(w, r, u, false)
+}
+
+func (h *Handler) setStarred(w http.ResponseWriter, r *http.Request, u *db.User, starred bool) {
+	for _, id := range r.Form["id"] {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			writeError(w, r, errNotFound, "song not found")
+			return
+		}
+		// Unstarring is allowed after access is gone, like unfavoriting.
+		if starred && h.accessibleTrack(u.ID, id) == nil {
+			writeError(w, r, errNotFound, "song not found")
+			return
+		}
+		if err := h.DB.SetFavorite(u.ID, n, starred); err != nil {
+			writeError(w, r, errGeneric, "failed to save")
+			return
+		}
+	}
+	write(w, r, newResponse())
+}
+
+func (h *Handler) setRating(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id, ratingStr := r.Form.Get("id"), r.Form.Get("rating")
+	if id == "" || ratingStr == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id or rating")
+		return
+	}
+	rating, err := strconv.Atoi(ratingStr)
+	if err != nil || rating < 0 || rating > 5 {
+		writeError(w, r, errGeneric, "rating must be between 0 and 5")
+		return
+	}
+	af := h.accessibleTrack(u.ID, id)
+	if af == nil {
+		writeError(w, r, errNotFound, "song not found")
+		return
+	}
+	if err := h.DB.SetRating(u.ID, af.ID, rating); err != nil {
+		writeError(w, r, errGeneric, "failed to save")
+		return
+	}
+	write(w, r, newResponse())
+}
+
+// --- Playlists ---
+
+// Saved room playlists use their numeric id; smart playlists are "sp-{id}"
+// and are evaluated on every request.
+
+const smartPrefix = "sp-"
+
+func (h *Handler) getPlaylists(w http.ResponseWriter, r *http.Request, u *db.User) {
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	list := []playlist{}
+	saved, _ := h.DB.GetPlaylistsByCreator(u.ID)
+	for _, pl := range saved {
+		items, _ := h.DB.GetPlaylistItems(pl.ID)
+		list = append(list, v.toPlaylist(savedPlaylistInfo(pl, u), v.itemTracks(items)))
+	}
+	smart, _ := h.DB.GetSmartPlaylistsByOwner(u.ID)
+	for _, sp := range smart {
+		tracks, err := h.Library.SmartPlaylistTracks(u.ID, sp)
+		if err != nil {
+			continue
+		}
+		list = append(list, v.toPlaylist(smartPlaylistInfo(sp, u), tracks))
+	}
+	resp := newResponse()
+	resp.Playlists = &playlists{Playlists: list}
+	write(w, r, resp)
+}
+
+func (h *Handler) getPlaylist(w http.ResponseWriter, r *http.Request, u *db.User) {
+	id := r.Form.Get("id")
+	if id == "" {
+		writeError(w, r, errMissingParam, "required parameter is missing: id")
+		return
+	}
+	v := h.view(w, r, u)
+	if v == nil {
+		return
+	}
+	var info playlist
+	var tracks []*db.AudioFile
+	if spID, ok := strings.CutPrefix(id, smartPrefix); ok {
+		n, _ := strconv.ParseInt(spID, 10, 64)
+		sp, err := h.DB.GetSmartPlaylist(n)
+		if err != nil || sp.OwnerID != u.ID {
+			writeError(w, r, errNotFound, "playlist not found")
+			return
+		}
+		if tracks, err = h.Library.SmartPlaylistTracks(u.ID, sp); err != nil {
+			writeError(w, r, errGeneric, err.Error())
+			return
+		}
+		info = smartPlaylistInfo(sp, u)
+	} else {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || !h.DB.CanAccessPlaylist(u.ID, n) {
+			writeError(w, r, errNotFound, "playlist not found")
+			return
+		}
+		pl, err := h.DB.GetPlaylistByID(n)
+		if err != nil {
+			writeError(w, r, errNotFound, "playlist not found")
+			return
+		}
+		items, _ := h.DB.GetPlaylistItems(pl.ID)
+		tracks = v.itemTracks(items)
+		info = savedPlaylistInfo(pl, nil)
+		if owner, err := h.DB.GetUserByID(pl.CreatedBy); err == nil {
+			info.Owner = owner.Username
+		}
+	}
+	pl := v.toPlaylist(info, tracks)
+	resp := newResponse()
+	resp.Playlist = &playlistWithSongs{playlist: pl, Entries: v.toChildren(tracks)}
+	write(w, r, resp)
+}
+
+func savedPlaylistInfo(pl *db.Playlist, owner *db.User) playlist {
+	info := playlist{
+		ID:      strconv.FormatInt(pl.ID, 10),
+		Name:    "ListenTogether " + pl.RoomCode,
+		Comment: "房间 " + pl.RoomCode + " 的播放列表",
+		Created: formatTime(pl.CreatedAt),
+		Changed: formatTime(pl.CreatedAt),
+	}
+	if owner != nil {
+		info.Owner = owner.Username
+	}
+	return info
+}
+
+func smartPlaylistInfo(sp *db.SmartPlaylist, owner *db.User) playlist {
+	return playlist{
+		ID:      smartPrefix + strconv.FormatInt(sp.ID, 10),
+		Name:    sp.Name,
+		Comment: sp.Query,
+		Owner:   owner.Username,
+		Created: formatTime(sp.CreatedAt),
+		Changed: formatTime(time.Now()),
+	}
+}
+
+// itemTracks resolves playlist items to the tracks the view can play.
+func (v *libraryView) itemTracks(items []*db.PlaylistItem) []*db.AudioFile {
+	var tracks []*db.AudioFile
+	for _, it := range items {
+		if af := v.byID[it.AudioID]; af != nil {
+			tracks = append(tracks, af)
+		}
+	}
+	return tracks
+}
+
+func (v *libraryView) toPlaylist(info playlist, tracks []*db.AudioFile) playlist {
+	var dur float64
+	for _, af := range tracks {
+		dur += af.Duration
+		if info.CoverArt == "" && af.CoverArt != "" {
+			info.CoverArt = strconv.FormatInt(af.ID, 10)
+		}
+	}
+	info.SongCount = len(tracks)
+	info.Duration = int(math.Round(dur))
+	return info
+}
@@ -0,0 +1,277 @@
+// Package subsonic serves a Subsonic/OpenSubsonic compatible REST API on top
+// of the library, so mobile and desktop Subsonic clients can browse and play
+// everything a user has access to without the web UI.
+package subsonic
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/library"
+)
+
+// Handler serves /rest/*.
+type Handler struct {
+	DB      *db.DB
+	Library *library.LibraryHandlers
+}
+
+// endpoint handles one Subsonic method for an authenticated user.
+type endpoint func(h *Handler, w http.ResponseWriter, r *http.Request, u *db.User)
+
+var endpoints map[string]endpoint
+
+func init() {
+	endpoints = map[string]endpoint{
+		"ping":                      (*Handler).ping,
+		"getLicense":                (*Handler).getLicense,
+		"getOpenSubsonicExtensions": (*Handler).getOpenSubsonicExtensions,
+		"getUser":                   (*Handler).getUser,
+		"getMusicFolders":           (*Handler).getMusicFolders,
+		"getGenres":                 (*Handler).getGenres,
+		"getArtists":                (*Handler).getArtists,
+		"getArtist":                 (*Handler).getArtist,
+		"getAlbum":                  (*Handler).getAlbum,
+		"getSong":                   (*Handler).getSong,
+		"getAlbumList2":             (*Handler).getAlbumList2,
+		"getRandomSongs":            (*Handler).getRandomSongs,
+		"search3":                   (*Handler).search3,
+		"getPlaylists":              (*Handler).getPlaylists,
+		"getPlaylist":               (*Handler).getPlaylist,
+		"getStarred2":               (*Handler).getStarred2,
+		"stream":                    (*Handler).stream,
+		"download":                  (*Handler).stream,
+		"getCoverArt":               (*Handler).getCoverArt,
+		"scrobble":                  (*Handler).scrobble,
+		"star":                      (*Handler).star,
+		"unstar":                    (*Handler).unstar,
+		"setRating":                 (*Handler).setRating,
+	}
+}
+
+func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/rest/", h.serve)
+	mux.HandleFunc("/api/subsonic/credentials", func(w http.ResponseWriter, r *http.Request) {
+		auth.AuthMiddleware(http.HandlerFunc(h.Credentials)).ServeHTTP(w, r)
+	})
+}
+
+// serve dispatches /rest/{method}[.view].
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, errGeneric, "invalid request")
+		return
+	}
+	method := strings.TrimSuffix(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rest/"), "/"), ".view")
+	fn, ok := endpoints[method]
+	if !ok {
+		writeError(w, r, errNotFound, "unknown method: "+method)
+		return
+	}
+	u, code, msg := h.authenticate(r)
+	if u == nil {
+		writeError(w, r, code, msg)
+		return
+	}
+	fn(h, w, r, u)
+}
+
+// --- Authentication ---
+
+// Subsonic clients authenticate every request with u plus either a token
+// t=md5(password+s) or the password itself (p, optionally "enc:"+hex). The
+// password is a per-user app password from /api/subsonic/credentials, never
+// the login password.
+
+const (
+	maxAuthFailures   = 10
+	authFailureWindow = 10 * time.Minute
+)
+
+var authFailures = &failureLimiter{records: make(map[string][]time.Time)}
+
+func (h *Handler) authenticate(r *http.Request) (*db.User, int, string) {
+	ip := auth.GetClientIP(r)
+	if authFailures.blocked(ip, maxAuthFailures, authFailureWindow) {
+		return nil, errWrongCreds, "too many failed attempts, try again later"
+	}
+	username := r.Form.Get("u")
+	if username == "" {
+		return nil, errMissingParam, "required parameter is missing: u"
+	}
+	token, salt, pass := r.Form.Get("t"), r.Form.Get("s"), r.Form.Get("p")
+	if token == "" && pass == "" {
+		return nil, errMissingParam, "required parameter is missing: t or p"
+	}
+	u, err := h.DB.GetUserByUsername(username)
+	if err == nil {
+		if stored, _, err := h.DB.GetSubsonicPassword(u.ID); err == nil && checkCredentials(stored, token, salt, pass) {
+			return u, 0, ""
+		}
+	}
+	authFailures.fail(ip)
+	log.Printf("[subsonic] failed login for %q from %s", username, ip)
+	return nil, errWrongCreds, "wrong username or password"
+}
+
+func checkCredentials(stored, token, salt, pass string) bool {
+	if token != "" {
+		sum := md5.Sum([]byte(stored + salt))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(token)), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	if enc, ok := strings.CutPrefix(pass, "enc:"); ok {
+		b, err := hex.DecodeString(enc)
+		if err != nil {
+			return false
+		}
+		pass = string(b)
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(stored)) == 1
+}
+
+// failureLimiter counts failed logins per key; unlike the request limiters
+// elsewhere, successful requests are never counted.
+type failureLimiter struct {
+	mu      sync.Mutex
+	records map[string][]time.Time
+}
+
+const maxFailureEntries = 10000
+
+func (fl *failureLimiter) blocked(key string, maxCount int, window time.Duration) bool {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	cutoff := time.Now().Add(-window)
+	var valid []time.Time
+	for _, t := range fl.records[key] {
+		if t.After(cutoff) {
+			valid = append(valid, t)
+		}
+	}
+	if len(valid) == 0 {
+		delete(fl.records, key)
+		return false
+	}
+	fl.records[key] = valid
+	return len(valid) >= maxCount
+}
+
+func (fl *failureLimiter) fail(key string) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if len(fl.records) >= maxFailureEntries {
+		// Drop entries whose newest failure is outside the window; they carry no state.
+		cutoff := time.Now().Add(-authFailureWindow)
+		for k, times := range fl.records {
+			if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+				delete(fl.records, k)
+			}
+		}
+	}
+	fl.records[key] = append(fl.records[key], time.Now())
+}
+
+// Credentials handles /api/subsonic/credentials for the logged-in user:
+// GET shows the current app password, POST generates a new one and DELETE
+// turns Subsonic access off.
+func (h *Handler) Credentials(w http.ResponseWriter, r *http.Request) {
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		pw, created, err := h.DB.GetSubsonicPassword(user.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonOK(w, map[string]interface{}{"enabled": false, "username": user.Username})
+			return
+		}
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		jsonOK(w, map[string]interface{}{"enabled": true, "username": user.Username, "password": pw, "created_at": created})
+	case http.MethodPost:
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			jsonError(w, "生成失败", 500)
+			return
+		}
+		pw := hex.EncodeToString(b)
+		if err := h.DB.SetSubsonicPassword(user.UserID, pw); err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		jsonOK(w, map[string]interface{}{"enabled": true, "username": user.Username, "password": pw, "created_at": time.Now()})
+	case http.MethodDelete:
+		if err := h.DB.DeleteSubsonicPassword(user.UserID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			jsonError(w, "删除失败", 500)
+			return
+		}
+		jsonOK(w, map[string]interface{}{"enabled": false, "username": user.Username})
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// --- Responses ---
+
+func newResponse() *response {
+	return &response{
+		Xmlns:         xmlNamespace,
+		Status:        "ok",
+		Version:       apiVersion,
+		Type:          serverName,
+		ServerVersion: serverVersion,
+		OpenSubsonic:  true,
+	}
+}
+
+// write encodes resp as XML, or as JSON when the client asked for f=json.
+func write(w http.ResponseWriter, r *http.Request, resp *response) {
+	if f := r.Form.Get("f"); f == "json" || f == "jsonp" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]*response{"subsonic-response": resp})
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(resp)
+}
+
+// writeError reports a failed call. Subsonic errors are always HTTP 200.
+func writeError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	resp := newResponse()
+	resp.Status = "failed"
+	resp.Error = &apiError{Code: code, Message: msg}
+	write(w, r, resp)
+}
+
+func jsonError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func jsonOK(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
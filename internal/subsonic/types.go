@@ -0,0 +1,214 @@
+package subsonic
+
+import "encoding/xml"
+
+// Response bodies. Every type is encoded both as XML (attributes) and as
+// JSON (the same names as object keys), which is how Subsonic clients expect
+// them.
+
+const (
+	apiVersion    = "1.16.1"
+	serverName    = "listen-together"
+	serverVersion = "1.0"
+	xmlNamespace  = "http://subsonic.org/restapi"
+)
+
+// Subsonic error codes.
+const (
+	errGeneric      = 0
+	errMissingParam = 10
+	errWrongCreds   = 40
+	errNotAllowed   = 50
+	errNotFound     = 70
+)
+
+type response struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error                  *apiError          `xml:"error,omitempty" json:"error,omitempty"`
+	License                *license           `xml:"license,omitempty" json:"license,omitempty"`
+	OpenSubsonicExtensions *[]extension       `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	User                   *user              `xml:"user,omitempty" json:"user,omitempty"`
+	MusicFolders           *musicFolders      `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Genres                 *genres            `xml:"genres,omitempty" json:"genres,omitempty"`
+	Artists                *artistsID3        `xml:"artists,omitempty" json:"artists,omitempty"`
+	Artist                 *artistWithAlbums  `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album                  *albumWithSongs    `xml:"album,omitempty" json:"album,omitempty"`
+	Song                   *child             `xml:"song,omitempty" json:"song,omitempty"`
+	AlbumList2             *albumList2        `xml:"albumList2,omitempty" json:"albumList2,omitempty"`
+	RandomSongs            *songs             `xml:"randomSongs,omitempty" json:"randomSongs,omitempty"`
+	SearchResult3          *searchResult3     `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Playlists              *playlists         `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist               *playlistWithSongs `xml:"playlist,omitempty" json:"playlist,omitempty"`
+	Starred2               *starred2          `xml:"starred2,omitempty" json:"starred2,omitempty"`
+}
+
+type apiError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+type license struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type extension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+type user struct {
+	Username          string `xml:"username,attr" json:"username"`
+	ScrobblingEnabled bool   `xml:"scrobblingEnabled,attr" json:"scrobblingEnabled"`
+	AdminRole         bool   `xml:"adminRole,attr" json:"adminRole"`
+	SettingsRole      bool   `xml:"settingsRole,attr" json:"settingsRole"`
+	DownloadRole      bool   `xml:"downloadRole,attr" json:"downloadRole"`
+	UploadRole        bool   `xml:"uploadRole,attr" json:"uploadRole"`
+	PlaylistRole      bool   `xml:"playlistRole,attr" json:"playlistRole"`
+	CoverArtRole      bool   `xml:"coverArtRole,attr" json:"coverArtRole"`
+	CommentRole       bool   `xml:"commentRole,attr" json:"commentRole"`
+	PodcastRole       bool   `xml:"podcastRole,attr" json:"podcastRole"`
+	StreamRole        bool   `xml:"streamRole,attr" json:"streamRole"`
+	JukeboxRole       bool   `xml:"jukeboxRole,attr" json:"jukeboxRole"`
+	ShareRole         bool   `xml:"shareRole,attr" json:"shareRole"`
+	Folders           []int  `xml:"folder" json:"folder"`
+}
+
+type musicFolders struct {
+	Folders []musicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type musicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+type genres struct {
+	Genres []genre `xml:"genre" json:"genre"`
+}
+
+type genre struct {
+	Name       string `xml:",chardata" json:"value"`
+	SongCount  int    `xml:"songCount,attr" json:"songCount"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
+}
+
+type artistsID3 struct {
+	IgnoredArticles string     `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+	Index           []indexID3 `xml:"index" json:"index"`
+}
+
+type indexID3 struct {
+	Name    string      `xml:"name,attr" json:"name"`
+	Artists []artistID3 `xml:"artist" json:"artist"`
+}
+
+type artistID3 struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Name       string `xml:"name,attr" json:"name"`
+	CoverArt   string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	AlbumCount int    `xml:"albumCount,attr" json:"albumCount"`
+	Starred    string `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+}
+
+type artistWithAlbums struct {
+	artistID3
+	Albums []albumID3 `xml:"album" json:"album"`
+}
+
+type albumID3 struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Artist    string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	ArtistID  string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	CoverArt  string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int    `xml:"songCount,attr" json:"songCount"`
+	Duration  int    `xml:"duration,attr" json:"duration"`
+	PlayCount int    `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	Created   string `xml:"created,attr" json:"created"`
+	Year      int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre     string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Played    string `xml:"played,attr,omitempty" json:"played,omitempty"`
+}
+
+type albumWithSongs struct {
+	albumID3
+	Songs []child `xml:"song" json:"song"`
+}
+
+// child is a song; Subsonic calls every directory entry a "child".
+type child struct {
+	ID            string  `xml:"id,attr" json:"id"`
+	Parent        string  `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir         bool    `xml:"isDir,attr" json:"isDir"`
+	Title         string  `xml:"title,attr" json:"title"`
+	Album         string  `xml:"album,attr,omitempty" json:"album,omitempty"`
+	Artist        string  `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Year          int     `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Genre         string  `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	CoverArt      string  `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Size          int64   `xml:"size,attr,omitempty" json:"size,omitempty"`
+	ContentType   string  `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix        string  `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Duration      int     `xml:"duration,attr" json:"duration"`
+	BitRate       int     `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"`
+	Path          string  `xml:"path,attr,omitempty" json:"path,omitempty"`
+	PlayCount     int     `xml:"playCount,attr,omitempty" json:"playCount,omitempty"`
+	Played        string  `xml:"played,attr,omitempty" json:"played,omitempty"`
+	Created       string  `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Starred       string  `xml:"starred,attr,omitempty" json:"starred,omitempty"`
+	AlbumID       string  `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	ArtistID      string  `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+	Type          string  `xml:"type,attr" json:"type"`
+	UserRating    int     `xml:"userRating,attr,omitempty" json:"userRating,omitempty"`
+	AverageRating float64 `xml:"averageRating,attr,omitempty" json:"averageRating,omitempty"`
+	BPM           int     `xml:"bpm,attr,omitempty" json:"bpm,omitempty"`
+}
+
+type albumList2 struct {
+	Albums []albumID3 `xml:"album" json:"album"`
+}
+
+type songs struct {
+	Songs []child `xml:"song" json:"song"`
+}
+
+type searchResult3 struct {
+	Artists []artistID3 `xml:"artist" json:"artist"`
+	Albums  []albumID3  `xml:"album" json:"album"`
+	Songs   []child     `xml:"song" json:"song"`
+}
+
+type playlists struct {
+	Playlists []playlist `xml:"playlist" json:"playlist"`
+}
+
+type playlist struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Comment   string `xml:"comment,attr,omitempty" json:"comment,omitempty"`
+	Owner     string `xml:"owner,attr,omitempty" json:"owner,omitempty"`
+	Public    bool   `xml:"public,attr" json:"public"`
+	SongCount int    `xml:"songCount,attr" json:"songCount"`
+	Duration  int    `xml:"duration,attr" json:"duration"`
+	Created   string `xml:"created,attr" json:"created"`
+	Changed   string `xml:"changed,attr" json:"changed"`
+	CoverArt  string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+}
+
+type playlistWithSongs struct {
+	playlist
+	Entries []child `xml:"entry" json:"entry"`
+}
+
+type starred2 struct {
+	Artists []artistID3 `xml:"artist" json:"artist"`
+	Albums  []albumID3  `xml:"album" json:"album"`
+	Songs   []child     `xml:"song" json:"song"`
+}
@@ -0,0 +1,341 @@
+package subsonic
+
+import (
+	"encoding/base64"
+	"math"
+	"mime"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Subsonic browses by artist and album, which we don't store: a view groups
+// the tracks a user can access when a request needs it. Album and artist IDs
+// are derived from the names so they stay stable between requests.
+
+const (
+	unknownArtist  = "未知艺术家"
+	unknownAlbum   = "未知专辑"
+	variousArtists = "Various Artists"
+	libraryFolder  = "音乐库"
+)
+
+type albumEntry struct {
+	id       string
+	name     string
+	artist   string
+	artistID string
+	tracks   []*db.AudioFile
+}
+
+type artistEntry struct {
+	id     string
+	name   string
+	albums []*albumEntry
+}
+
+type libraryView struct {
+	files   []*db.AudioFile
+	byID    map[int64]*db.AudioFile
+	albumOf map[int64]*albumEntry
+	albums  map[string]*albumEntry
+	artists map[string]*artistEntry
+}
+
+// loadView groups everything userID can access, with ratings and favorites
+// filled in for userID.
+func (h *Handler) loadView(userID int64) (*libraryView, error) {
+	files, err := h.DB.GetAccessibleAudioFiles(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.DB.FillTrackStats(files, userID); err != nil {
+		return nil, err
+	}
+	return buildView(files), nil
+}
+
+func buildView(files []*db.AudioFile) *libraryView {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ID < files[j].ID })
+	v := &libraryView{
+		files:   files,
+		byID:    make(map[int64]*db.AudioFile, len(files)),
+		albumOf: make(map[int64]*albumEntry, len(files)),
+		albums:  make(map[string]*albumEntry),
+		artists: make(map[string]*artistEntry),
+	}
+	for _, af := range files {
+		v.byID[af.ID] = af
+		name := strings.TrimSpace(af.Album)
+		key := strings.ToLower(name)
+		if name == "" {
+			// Loose tracks get one unknown album per artist.
+			name, key = unknownAlbum, "\x00"+strings.ToLower(artistName(af))
+		}
+		id := "al-" + base64.RawURLEncoding.EncodeToString([]byte(key))
+		al := v.albums[id]
+		if al == nil {
+			al = &albumEntry{id: id, name: name}
+			v.albums[id] = al
+		}
+		al.tracks = append(al.tracks, af)
+		v.albumOf[af.ID] = al
+	}
+	for _, al := range v.albums {
+		al.artist = artistName(al.tracks[0])
+		for _, af := range al.tracks[1:] {
+			if !strings.EqualFold(artistName(af), al.artist) {
+				al.artist = variousArtists
+				break
+			}
+		}
+		al.artistID = artistID(al.artist)
+		// An artist lists every album with one of their tracks on it.
+		seen := map[string]bool{}
+		for _, name := range append([]string{al.artist}, trackArtists(al)...) {
+			id := artistID(name)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			ar := v.artists[id]
+			if ar == nil {
+				ar = &artistEntry{id: id, name: name}
+				v.artists[id] = ar
+			}
+			ar.albums = append(ar.albums, al)
+		}
+	}
+	for _, ar := range v.artists {
+		sortAlbums(ar.albums)
+	}
+	return v
+}
+
+func trackArtists(al *albumEntry) []string {
+	var names []string
+	for _, af := range al.tracks {
+		names = append(names, artistName(af))
+	}
+	return names
+}
+
+func artistName(af *db.AudioFile) string {
+	if a := strings.TrimSpace(af.Artist); a != "" {
+		return a
+	}
+	return unknownArtist
+}
+
+func artistID(name string) string {
+	return "ar-" + base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(name)))
+}
+
+func sortAlbums(albums []*albumEntry) {
+	sort.Slice(albums, func(i, j int) bool {
+		return strings.ToLower(albums[i].name) < strings.ToLower(albums[j].name)
+	})
+}
+
+// sortedAlbums returns every album ordered by name.
+func (v *libraryView) sortedAlbums() []*albumEntry {
+	list := make([]*albumEntry, 0, len(v.albums))
+	for _, al := range v.albums {
+		list = append(list, al)
+	}
+	sortAlbums(list)
+	return list
+}
+
+// sortedArtists returns every artist ordered by name.
+func (v *libraryView) sortedArtists() []*artistEntry {
+	list := make([]*artistEntry, 0, len(v.artists))
+	for _, ar := range v.artists {
+		list = append(list, ar)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].name) < strings.ToLower(list[j].name)
+	})
+	return list
+}
+
+// song returns the track with the given id, or nil if the view lacks it.
+func (v *libraryView) song(id string) *db.AudioFile {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return v.byID[n]
+}
+
+// coverTrack finds a track whose cover stands for id, which may be a song,
+// album or artist id.
+func (v *libraryView) coverTrack(id string) *db.AudioFile {
+	var tracks []*db.AudioFile
+	if al := v.albums[id]; al != nil {
+		tracks = al.tracks
+	} else if ar := v.artists[id]; ar != nil {
+		for _, al := range ar.albums {
+			tracks = append(tracks, al.tracks...)
+		}
+	} else if af := v.song(id); af != nil {
+		tracks = []*db.AudioFile{af}
+	}
+	for _, af := range tracks {
+		if af.CoverArt != "" {
+			return af
+		}
+	}
+	return nil
+}
+
+// --- Conversions ---
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatUnix(sec int64) string {
+	if sec == 0 {
+		return ""
+	}
+	return formatTime(time.Unix(sec, 0))
+}
+
+func (v *libraryView) toChild(af *db.AudioFile) child {
+	al := v.albumOf[af.ID]
+	title := af.Title
+	if title == "" {
+		title = strings.TrimSuffix(af.OriginalName, path.Ext(af.OriginalName))
+	}
+	suffix := strings.ToLower(strings.TrimPrefix(path.Ext(af.OriginalName), "."))
+	c := child{
+		ID:            strconv.FormatInt(af.ID, 10),
+		Title:         title,
+		Artist:        artistName(af),
+		ArtistID:      artistID(artistName(af)),
+		Year:          parseYear(af.Year),
+		Genre:         af.Genre,
+		Size:          af.Size,
+		Suffix:        suffix,
+		ContentType:   mime.TypeByExtension("." + suffix),
+		Duration:      int(math.Round(af.Duration)),
+		BitRate:       af.OriginalBitrate,
+		PlayCount:     af.PlayCount,
+		Played:        formatUnix(af.LastPlayedAt),
+		Created:       formatTime(af.CreatedAt),
+		Type:          "music",
+		UserRating:    af.MyRating,
+		AverageRating: math.Round(af.AvgRating*100) / 100,
+		BPM:           int(math.Round(af.BPM)),
+	}
+	if al != nil {
+		c.Parent, c.Album, c.AlbumID = al.id, al.name, al.id
+		c.Path = path.Join(al.artist, al.name, af.OriginalName)
+	}
+	if af.CoverArt != "" {
+		c.CoverArt = c.ID
+	}
+	if af.Favorite {
+		// Favorites don't expose when they were set; the upload time will do.
+		c.Starred = formatTime(af.CreatedAt)
+	}
+	return c
+}
+
+func (v *libraryView) toChildren(files []*db.AudioFile) []child {
+	out := make([]child, 0, len(files))
+	for _, af := range files {
+		out = append(out, v.toChild(af))
+	}
+	return out
+}
+
+func (v *libraryView) toAlbum(al *albumEntry) albumID3 {
+	a := albumID3{
+		ID:        al.id,
+		Name:      al.name,
+		Artist:    al.artist,
+		ArtistID:  al.artistID,
+		SongCount: len(al.tracks),
+	}
+	var dur float64
+	var created time.Time
+	var played int64
+	for _, af := range al.tracks {
+		dur += af.Duration
+		a.PlayCount += af.PlayCount
+		if created.IsZero() || af.CreatedAt.Before(created) {
+			created = af.CreatedAt
+		}
+		if af.LastPlayedAt > played {
+			played = af.LastPlayedAt
+		}
+		if a.Year == 0 {
+			a.Year = parseYear(af.Year)
+		}
+		if a.Genre == "" {
+			a.Genre = af.Genre
+		}
+	}
+	a.Duration = int(math.Round(dur))
+	a.Created = formatTime(created)
+	a.Played = formatUnix(played)
+	if cover := v.coverTrack(al.id); cover != nil {
+		a.CoverArt = strconv.FormatInt(cover.ID, 10)
+	}
+	return a
+}
+
+func (v *libraryView) toAlbums(list []*albumEntry) []albumID3 {
+	out := make([]albumID3, 0, len(list))
+	for _, al := range list {
+		out = append(out, v.toAlbum(al))
+	}
+	return out
+}
+
+func (v *libraryView) toArtist(ar *artistEntry) artistID3 {
+	a := artistID3{ID: ar.id, Name: ar.name, AlbumCount: len(ar.albums)}
+	if cover := v.coverTrack(ar.id); cover != nil {
+		a.CoverArt = strconv.FormatInt(cover.ID, 10)
+	}
+	return a
+}
+
+func (v *libraryView) toArtists(list []*artistEntry) []artistID3 {
+	out := make([]artistID3, 0, len(list))
+	for _, ar := range list {
+		out = append(out, v.toArtist(ar))
+	}
+	return out
+}
+
+// indexLetter is the getArtists index an artist is listed under.
+func indexLetter(name string) string {
+	for _, r := range name {
+		r = unicode.ToUpper(r)
+		if r >= 'A' && r <= 'Z' {
+			return string(r)
+		}
+		return "#"
+	}
+	return "#"
+}
+
+func parseYear(s string) int {
+	s = strings.TrimSpace(s)
+	if len(s) > 4 {
+		s = s[:4]
+	}
+	y, _ := strconv.Atoi(s)
+	return y
+}
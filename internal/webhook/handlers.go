@@ -0,0 +1,231 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// RegisterRoutes serves the owner-only webhook admin API:
+//
+//	GET/POST            /api/admin/webhooks
+//	GET/PUT/DELETE      /api/admin/webhooks/{id}
+//	GET                 /api/admin/webhooks/{id}/deliveries
+//	POST                /api/admin/webhooks/{id}/test
+func (d *Dispatcher) RegisterRoutes(mux *http.ServeMux) {
+	wrap := func(fn http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			auth.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if u := auth.GetUser(r); u == nil || u.Role != "owner" {
+					jsonError(w, "forbidden", 403)
+					return
+				}
+				fn(w, r)
+			})).ServeHTTP(w, r)
+		}
+	}
+	mux.HandleFunc("/api/admin/webhooks", wrap(d.Webhooks))
+	mux.HandleFunc("/api/admin/webhooks/", wrap(d.Webhook))
+}
+
+// webhookView is a webhook as the API shows it.
+type webhookView struct {
+	*db.Webhook
+	Events []string `json:"events"`
+}
+
+func view(wh *db.Webhook) webhookView {
+	events := splitEvents(wh.Events)
+	if events == nil {
+		events = []string{}
+	}
+	return webhookView{Webhook: wh, Events: events}
+}
+
+type webhookRequest struct {
+	URL          *string   `json:"url"`
+	Events       *[]string `json:"events"`
+	Enabled      *bool     `json:"enabled"`
+	RotateSecret bool      `json:"rotate_secret"`
+}
+
+// apply validates req and copies it onto wh.
+func (req *webhookRequest) apply(wh *db.Webhook) string {
+	if req.URL != nil {
+		u, err := url.Parse(strings.TrimSpace(*req.URL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "URL 必须是 http(s) 地址"
+		}
+		wh.URL = u.String()
+	}
+	if req.Events != nil {
+		var events []string
+		for _, e := range *req.Events {
+			if !containsEvent(allEvents, e) {
+				return "未知事件: " + e
+			}
+			if !containsEvent(events, e) {
+				events = append(events, e)
+			}
+		}
+		wh.Events = strings.Join(events, ",")
+	}
+	if req.Enabled != nil {
+		wh.Enabled = *req.Enabled
+	}
+	if req.RotateSecret || wh.Secret == "" {
+		wh.Secret = newSecret()
+	}
+	return ""
+}
+
+func newSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// Webhooks handles GET (list, with the event names) and POST (create)
+// /api/admin/webhooks. POST body: {"url":"https://...","events":["track.changed"],"enabled":true};
+// no events means all of them.
+func (d *Dispatcher) Webhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := d.DB.ListWebhooks()
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		views := []webhookView{}
+		for _, wh := range list {
+			views = append(views, view(wh))
+		}
+		jsonOK(w, map[string]interface{}{"webhooks": views, "events": allEvents})
+	case http.MethodPost:
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		wh := &db.Webhook{Enabled: true}
+		if msg := req.apply(wh); msg != "" {
+			jsonError(w, msg, 400)
+			return
+		}
+		created, err := d.DB.CreateWebhook(wh.URL, wh.Secret, wh.Events, wh.Enabled, auth.GetUser(r).UserID)
+		if err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		d.reload()
+		jsonOK(w, view(created))
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// Webhook handles /api/admin/webhooks/{id}[/deliveries|/test].
+func (d *Dispatcher) Webhook(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/webhooks/"), "/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		jsonError(w, "invalid id", 400)
+		return
+	}
+	wh, err := d.DB.GetWebhook(id)
+	if err != nil {
+		jsonError(w, "webhook 不存在", 404)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		jsonOK(w, view(wh))
+	case sub == "" && r.Method == http.MethodPut:
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			jsonError(w, "invalid request", 400)
+			return
+		}
+		if msg := req.apply(wh); msg != "" {
+			jsonError(w, msg, 400)
+			return
+		}
+		if err := d.DB.UpdateWebhook(wh); err != nil {
+			jsonError(w, "保存失败", 500)
+			return
+		}
+		d.reload()
+		jsonOK(w, view(wh))
+	case sub == "" && r.Method == http.MethodDelete:
+		if err := d.DB.DeleteWebhook(id); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			jsonError(w, "删除失败", 500)
+			return
+		}
+		d.reload()
+		jsonOK(w, map[string]string{"message": "ok"})
+	case sub == "deliveries" && r.Method == http.MethodGet:
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > logSize {
+			limit = 50
+		}
+		list, err := d.DB.GetWebhookDeliveries(id, limit)
+		if err != nil {
+			jsonError(w, "查询失败", 500)
+			return
+		}
+		if list == nil {
+			list = []*db.WebhookDelivery{}
+		}
+		jsonOK(w, list)
+	case sub == "test" && r.Method == http.MethodPost:
+		d.Test(w, r, wh)
+	default:
+		jsonError(w, "method not allowed", 405)
+	}
+}
+
+// Test sends a ping to wh right away, even if it is disabled, and returns
+// the logged delivery. It is not retried.
+func (d *Dispatcher) Test(w http.ResponseWriter, r *http.Request, wh *db.Webhook) {
+	body, _ := json.Marshal(envelope{Event: EventPing, Timestamp: time.Now().Unix(), Data: map[string]interface{}{
+		"webhook_id": wh.ID,
+		"message":    "ListenTogether webhook test",
+	}})
+	// Logged as already sending so the dispatcher doesn't deliver it a second time.
+	dl, err := d.DB.AddSendingWebhookDelivery(wh.ID, EventPing, string(body))
+	if err != nil {
+		jsonError(w, "保存失败", 500)
+		return
+	}
+	code, sendErr := send(wh, dl)
+	dl.Attempts, dl.ResponseCode = 1, code
+	if sendErr == nil {
+		dl.Status, dl.DeliveredAt = "delivered", time.Now().Unix()
+	} else {
+		dl.Status, dl.Error = "failed", sendErr.Error()
+	}
+	d.DB.UpdateWebhookDelivery(dl)
+	jsonOK(w, dl)
+}
+
+func jsonError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+func jsonOK(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
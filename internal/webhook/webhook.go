@@ -0,0 +1,300 @@
+// Package webhook delivers server events to owner-configured HTTP endpoints
+// as HMAC-signed JSON, with a persistent delivery log and retries.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/db"
+)
+
+// Events a webhook can subscribe to. Ping is only sent by the test endpoint.
+const (
+	EventRoomCreated     = "room.created"
+	EventRoomClosed      = "room.closed"
+	EventTrackChanged    = "track.changed"
+	EventUserJoined      = "user.joined"
+	EventUserLeft        = "user.left"
+	EventUploadCompleted = "upload.completed"
+	EventUserRegistered  = "user.registered"
+	EventPing            = "ping"
+)
+
+var allEvents = []string{EventRoomCreated, EventRoomClosed, EventTrackChanged, EventUserJoined,
+	EventUserLeft, EventUploadCompleted, EventUserRegistered}
+
+// Request headers. The signature is "t={unix},v1={hex}" where v1 is
+// HMAC-SHA256 of "{unix}.{body}" keyed with the webhook secret; receivers
+// should check it and reject old timestamps.
+const (
+	HeaderEvent     = "X-ListenTogether-Event"
+	HeaderDelivery  = "X-ListenTogether-Delivery"
+	HeaderSignature = "X-ListenTogether-Signature"
+)
+
+// Retry policy: a failed delivery is retried after 30s, 2m, 8m, 32m, ~2h,
+// then marked failed. The log keeps the newest logSize deliveries per webhook.
+const (
+	maxAttempts  = 6
+	baseBackoff  = 30 * time.Second
+	pollInterval = 15 * time.Second
+	batchSize    = 200
+	logSize      = 200
+)
+
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// Redirects would resend the signed body somewhere the owner didn't configure.
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Dispatcher records events for the subscribed webhooks and delivers them in
+// the background.
+type Dispatcher struct {
+	DB *db.DB
+
+	wake chan struct{}
+
+	mu      sync.Mutex
+	hooks   []*db.Webhook  // enabled webhooks; nil until loaded
+	running map[int64]bool // webhooks with a delivery run in progress
+}
+
+func New(d *db.DB) *Dispatcher {
+	return &Dispatcher{DB: d, wake: make(chan struct{}, 1), running: map[int64]bool{}}
+}
+
+// Start runs the delivery loop until the process exits.
+func (d *Dispatcher) Start() {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			d.deliverDue()
+			select {
+			case <-ticker.C:
+			case <-d.wake:
+			}
+		}
+	}()
+}
+
+// reload drops the cached webhook list after a change.
+func (d *Dispatcher) reload() {
+	d.mu.Lock()
+	d.hooks = nil
+	d.mu.Unlock()
+}
+
+func (d *Dispatcher) enabledHooks() []*db.Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hooks == nil {
+		all, err := d.DB.ListWebhooks()
+		if err != nil {
+			log.Printf("[webhook] load: %v", err)
+			return nil
+		}
+		d.hooks = []*db.Webhook{}
+		for _, wh := range all {
+			if wh.Enabled {
+				d.hooks = append(d.hooks, wh)
+			}
+		}
+	}
+	return d.hooks
+}
+
+// subscribed reports whether wh wants event.
+func subscribed(wh *db.Webhook, event string) bool {
+	return wh.Events == "" || containsEvent(splitEvents(wh.Events), event)
+}
+
+func splitEvents(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func containsEvent(list []string, event string) bool {
+	for _, e := range list {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// envelope is the JSON body of every delivery.
+type envelope struct {
+	Event     string      `json:"event"`
+	Timestamp int64       `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Emit queues event with data for every enabled webhook subscribed to it. It
+// is safe to call on a nil Dispatcher.
+func (d *Dispatcher) Emit(event string, data interface{}) {
+	if d == nil {
+		return
+	}
+	var targets []*db.Webhook
+	for _, wh := range d.enabledHooks() {
+		if subscribed(wh, event) {
+			targets = append(targets, wh)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	body, err := json.Marshal(envelope{Event: event, Timestamp: time.Now().Unix(), Data: data})
+	if err != nil {
+		log.Printf("[webhook] encode %s: %v", event, err)
+		return
+	}
+	for _, wh := range targets {
+		if _, err := d.DB.AddWebhookDelivery(wh.ID, event, string(body)); err != nil {
+			log.Printf("[webhook] queue %s for %d: %v", event, wh.ID, err)
+		}
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue starts a delivery run for every webhook. Each run is its own
+// goroutine, and a webhook whose previous run hasn't finished is skipped, so a
+// slow or dead endpoint only holds up itself.
+func (d *Dispatcher) deliverDue() {
+	hooks, err := d.DB.ListWebhooks()
+	if err != nil {
+		log.Printf("[webhook] load: %v", err)
+		return
+	}
+	for _, wh := range hooks {
+		d.mu.Lock()
+		busy := d.running[wh.ID]
+		d.running[wh.ID] = true
+		d.mu.Unlock()
+		if busy {
+			continue
+		}
+		go func() {
+			defer func() {
+				d.mu.Lock()
+				delete(d.running, wh.ID)
+				d.mu.Unlock()
+			}()
+			d.deliverHook(wh)
+		}()
+	}
+}
+
+// deliverHook sends the due deliveries of wh, oldest first. The run stops at
+// the first failure: the endpoint is most likely down, so the rest of the
+// batch is put off by the same backoff instead of each timing out in turn.
+// Retries can still land after newer events, so receivers shouldn't rely on
+// delivery order.
+func (d *Dispatcher) deliverHook(wh *db.Webhook) {
+	due, err := d.DB.GetDueWebhookDeliveries(wh.ID, time.Now(), batchSize)
+	if err != nil {
+		log.Printf("[webhook] read queue of %d: %v", wh.ID, err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+	defer d.DB.PruneWebhookDeliveries(wh.ID, logSize)
+	for i, dl := range due {
+		if d.attempt(wh, dl) {
+			continue
+		}
+		next := dl.NextAttemptAt
+		if dl.Status != "pending" {
+			next = time.Now().Add(baseBackoff).Unix()
+		}
+		for _, rest := range due[i+1:] {
+			rest.NextAttemptAt = next
+			if err := d.DB.UpdateWebhookDelivery(rest); err != nil {
+				log.Printf("[webhook] save delivery %d: %v", rest.ID, err)
+			}
+		}
+		return
+	}
+}
+
+// attempt sends dl once and records the outcome, scheduling a retry on
+// failure. It reports false if the endpoint failed.
+func (d *Dispatcher) attempt(wh *db.Webhook, dl *db.WebhookDelivery) bool {
+	if !wh.Enabled {
+		dl.Status, dl.Error = "failed", "webhook disabled"
+		d.DB.UpdateWebhookDelivery(dl)
+		return true
+	}
+	code, err := send(wh, dl)
+	dl.Attempts++
+	dl.ResponseCode = code
+	switch {
+	case err == nil:
+		dl.Status, dl.Error, dl.DeliveredAt = "delivered", "", time.Now().Unix()
+	case dl.Attempts >= maxAttempts:
+		dl.Status, dl.Error = "failed", err.Error()
+	default:
+		dl.Error = err.Error()
+		dl.NextAttemptAt = time.Now().Add(baseBackoff << (2 * (dl.Attempts - 1))).Unix()
+	}
+	if err := d.DB.UpdateWebhookDelivery(dl); err != nil {
+		log.Printf("[webhook] save delivery %d: %v", dl.ID, err)
+	}
+	return err == nil
+}
+
+// Sign returns the signature header value for body sent at ts.
+func Sign(secret string, ts int64, body []byte) string {
+	t := strconv.FormatInt(ts, 10)
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(t + "."))
+	m.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// send POSTs dl to wh and returns the response status; any non-2xx is an error.
+func send(wh *db.Webhook, dl *db.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpClient.Timeout)
+	defer cancel()
+	body := []byte(dl.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ListenTogether-Webhook/1")
+	req.Header.Set(HeaderEvent, dl.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(dl.ID, 10))
+	req.Header.Set(HeaderSignature, Sign(wh.Secret, time.Now().Unix(), body))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
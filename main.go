@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"math"
 	"net/http"
@@ -19,55 +20,39 @@ import (
 	"github.com/xingzihai/listen-together/internal/auth"
 	"github.com/xingzihai/listen-together/internal/db"
 	"github.com/xingzihai/listen-together/internal/library"
+	"github.com/xingzihai/listen-together/internal/lyrics"
+	"github.com/xingzihai/listen-together/internal/ratelimit"
 	"github.com/xingzihai/listen-together/internal/room"
+	"github.com/xingzihai/listen-together/internal/scrobble"
+	"github.com/xingzihai/listen-together/internal/storage"
+	"github.com/xingzihai/listen-together/internal/subsonic"
 	syncpkg "github.com/xingzihai/listen-together/internal/sync"
+	"github.com/xingzihai/listen-together/internal/webhook"
+	"github.com/xingzihai/listen-together/pkg/protocol"
 )
 
 var (
 	upgrader = websocket.Upgrader{
 		CheckOrigin: checkOrigin,
 	}
-	manager  = room.NewManager()
-	dataDir  = "./data/rooms"
-	globalDB *db.DB
+	manager   = room.NewManager()
+	dataDir   = "./data/rooms"
+	globalDB  *db.DB
+	scrobbler *scrobble.Scrobbler
+	hooks     *webhook.Dispatcher
 )
 
-type WSMessage struct {
-	Type           string  `json:"type"`
-	RoomCode       string  `json:"roomCode,omitempty"`
-	ClientTime     int64   `json:"clientTime,omitempty"`
-	Position       float64 `json:"position,omitempty"`
-	TargetClientID string  `json:"targetClientID,omitempty"`
-	TrackIndex     int     `json:"trackIndex"`
-}
-
-type PlaylistBroadcast struct {
-	Playlist interface{} `json:"playlist"`
-	Items    interface{} `json:"items"`
-}
-
-type WSResponse struct {
-	Type         string                `json:"type"`
-	Success      bool                  `json:"success,omitempty"`
-	RoomCode     string                `json:"roomCode,omitempty"`
-	IsHost       bool                  `json:"isHost,omitempty"`
-	ClientCount  int                   `json:"clientCount,omitempty"`
-	Audio        *room.AudioInfo       `json:"audio,omitempty"`
-	TrackAudio   *room.TrackAudioInfo  `json:"trackAudio,omitempty"`
-	State        string                `json:"state,omitempty"`
-	Position     float64               `json:"position,omitempty"`
-	ServerTime   int64                 `json:"serverTime,omitempty"`
-	ClientTime   int64                 `json:"clientTime,omitempty"`
-	ScheduledAt  int64                 `json:"scheduledAt,omitempty"`
-	Error        string                `json:"error,omitempty"`
-	Username     string                `json:"username,omitempty"`
-	Role         string                `json:"role,omitempty"`
-	Users        []room.ClientInfo     `json:"users,omitempty"`
-	PlaylistData *PlaylistBroadcast    `json:"playlistData,omitempty"`
-	TrackIndex   int                   `json:"trackIndex"`
-}
+// JSON responses use the library API's format.
+var (
+	jsonError = library.JSONError
+	jsonOK    = library.JSONOK
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1:])
+	}
+
 	os.MkdirAll(dataDir, 0755)
 	os.MkdirAll("./data", 0755)
 
@@ -83,12 +68,30 @@ func main() {
 
 	mux := http.NewServeMux()
 
-	authHandlers := &auth.AuthHandlers{DB: database, Manager: manager}
+	// Outgoing webhooks (owner-configured)
+	hooks = webhook.New(database)
+	hooks.Start()
+	hooks.RegisterRoutes(mux)
+	manager.OnClose(emitRoomClosed)
+
+	authHandlers := &auth.AuthHandlers{DB: database, Manager: manager, OnRegister: emitUserRegistered}
 	authHandlers.RegisterRoutes(mux)
 
+	store, err := storage.FromEnv("./data")
+	if err != nil {
+		log.Fatalf("Failed to configure storage: %v", err)
+	}
+	if !store.Local() && os.Getenv("SEGMENT_ACCEL_PREFIX") != "" {
+		log.Printf("SEGMENT_ACCEL_PREFIX ignored: segments are not on local disk with STORAGE_BACKEND=%s", os.Getenv("STORAGE_BACKEND"))
+	}
+
 	// Library handlers
-	libHandlers := &library.LibraryHandlers{DB: database, DataDir: "./data", Manager: manager}
+	libHandlers := &library.LibraryHandlers{DB: database, DataDir: "./data", Manager: manager, Store: store, OnTrackAdded: emitUploadCompleted}
 	libHandlers.RegisterRoutes(mux)
+	// Re-enqueue tiers lost to a restart mid-transcode
+	go libHandlers.RecoverIncompleteTiers()
+	// Ingest new files from the admin-configured import directory
+	libHandlers.StartFolderWatch()
 
 	// Playlist handlers
 	plHandlers := &library.PlaylistHandlers{
@@ -106,18 +109,33 @@ func main() {
 				return
 			}
 			items, _ := database.GetPlaylistItems(pl.ID)
-			broadcast(rm, WSResponse{
-				Type: "playlistUpdate",
-				PlaylistData: &PlaylistBroadcast{
-					Playlist: pl,
-					Items:    items,
-				},
-			}, "")
+			broadcast(rm, playlistUpdateEvent(pl, items), "")
 		},
 	}
 	plHandlers.RegisterRoutes(mux)
 
+	// ListenBrainz scrobbling of room listens
+	scrobbler = scrobble.New(database)
+	scrobbler.Start()
+	scrobbleHandlers := &scrobble.Handlers{DB: database}
+	scrobbleHandlers.RegisterRoutes(mux)
+
+	// Subsonic-compatible API for mobile and desktop players
+	subsonicHandler := &subsonic.Handler{DB: database, Library: libHandlers}
+	subsonicHandler.RegisterRoutes(mux)
+
+	// Icecast-style radio stream of each room
+	radio := newRadioHub(manager, libHandlers)
+	radio.RegisterRoutes(mux)
+
+	// Server-sent events and HTTP clock sync for clients that can't use /ws
+	registerEventRoutes(mux)
+
 	mux.HandleFunc("/ws", handleWebSocket)
+	// Machine-readable description of the /ws messages, for alternative clients
+	mux.HandleFunc("/api/protocol", func(w http.ResponseWriter, r *http.Request) {
+		jsonOK(w, protocol.Schema())
+	})
 
 	// Admin page (owner only)
 	mux.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
@@ -131,9 +149,9 @@ func main() {
 
 	mux.Handle("/", http.FileServer(http.Dir("./web/static")))
 
-	// Fix #2: Global request body limit (1MB for non-upload routes; upload has its own 50MB limit)
+	// Fix #2: Global request body limit (1MB for non-upload routes; upload and import set their own limits)
 	limitedMux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/api/library/upload" {
+		if r.URL.Path != "/api/library/upload" && r.URL.Path != "/api/library/import" {
 			r.Body = http.MaxBytesReader(w, r.Body, 1<<20) // 1MB
 		}
 		mux.ServeHTTP(w, r)
@@ -150,39 +168,54 @@ func main() {
 				pos := rm.Position
 				startT := rm.StartTime
 				clientCount := len(rm.Clients)
-				// Get duration for position clamping
-				duration := 0.0
-				if rm.TrackAudio != nil {
-					duration = rm.TrackAudio.Duration
-				} else if rm.Audio != nil {
-					duration = rm.Audio.Duration
-				}
+				// Get duration for position clamping (detected end of audio when skipping silence)
+				duration := rm.EffectiveDuration()
+				skipSilence := rm.SkipSilence && rm.TrackAudio != nil && rm.TrackAudio.EffectiveEnd > 0
+				trackEndSent := rm.TrackEndSent
+				trackIdx := rm.CurrentTrack
+				trackLyrics := rm.Lyrics
+				var host *room.Client
 				var clients []*room.Client
 				hostID := ""
+				if rm.Host != nil {
+					host = rm.Host
+					hostID = rm.Host.ID
+				}
 				// Only broadcast to multi-client rooms
 				if state == room.StatePlaying && clientCount > 1 {
-					if rm.Host != nil {
-						hostID = rm.Host.ID
-					}
 					clients = make([]*room.Client, 0, clientCount)
 					for _, c := range rm.Clients {
 						clients = append(clients, c)
 					}
 				}
 				rm.Mu.RUnlock()
-				if clients == nil {
+				if state != room.StatePlaying {
 					continue
 				}
+				countListen(rm, time.Second)
 				elapsed := time.Since(startT).Seconds()
 				currentPos := pos + elapsed
 				// Clamp position to duration
 				if duration > 0 && currentPos > duration {
 					currentPos = duration
 				}
-				msg := map[string]interface{}{
-					"type":       "syncTick",
-					"position":   currentPos,
-					"serverTime": syncpkg.GetServerTime(),
+
+				// Trailing silence reached: ask the host to advance, once per track
+				if skipSilence && !trackEndSent && host != nil && currentPos >= duration {
+					rm.Mu.Lock()
+					rm.TrackEndSent = true
+					rm.Mu.Unlock()
+					host.Send(protocol.TrackEndEvent{Type: protocol.TypeTrackEnd, TrackIndex: trackIdx, Position: currentPos})
+				}
+
+				if clients == nil && !rm.HasSubscribers() {
+					continue
+				}
+				msg := protocol.SyncTickEvent{Type: protocol.TypeSyncTick, Position: currentPos, ServerTime: syncpkg.GetServerTime()}
+				// Current lyric line for clients that can't parse lyrics themselves
+				if trackLyrics != nil && trackLyrics.Synced {
+					line := trackLyrics.LineAt(currentPos)
+					msg.LyricLine = &line
 				}
 				for _, c := range clients {
 					if c.ID == hostID {
@@ -190,6 +223,7 @@ func main() {
 					}
 					c.Send(msg)
 				}
+				publishEvent(rm, msg)
 			}
 		}
 	}()
@@ -257,91 +291,8 @@ func generateClientID() string {
 	return hex.EncodeToString(b)
 }
 
-// --- Join rate limiter (anti-enumeration) ---
-type rateLimiter struct {
-	mu      sync.Mutex
-	entries map[string][]time.Time
-}
-
-const maxRateLimitEntries = 10000
-
-func newRateLimiter() *rateLimiter {
-	rl := &rateLimiter{entries: make(map[string][]time.Time)}
-	go func() {
-		for range time.NewTicker(10 * time.Minute).C {
-			rl.mu.Lock()
-			now := time.Now()
-			for k, times := range rl.entries {
-				valid := times[:0]
-				for _, t := range times {
-					if now.Sub(t) < 5*time.Minute {
-						valid = append(valid, t)
-					}
-				}
-				if len(valid) == 0 {
-					delete(rl.entries, k)
-				} else {
-					rl.entries[k] = valid
-				}
-			}
-			rl.mu.Unlock()
-		}
-	}()
-	return rl
-}
-
-func (rl *rateLimiter) allow(key string, maxAttempts int, window time.Duration) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	now := time.Now()
-	cutoff := now.Add(-window)
-	// Prune old entries
-	valid := rl.entries[key][:0]
-	for _, t := range rl.entries[key] {
-		if t.After(cutoff) {
-			valid = append(valid, t)
-		}
-	}
-	if len(valid) >= maxAttempts {
-		rl.entries[key] = valid
-		return false
-	}
-	// Enforce max entries limit
-	if len(rl.entries) >= maxRateLimitEntries {
-		rl.cleanOldestEntries()
-	}
-	rl.entries[key] = append(valid, now)
-	return true
-}
-
-func (rl *rateLimiter) cleanOldestEntries() {
-	toRemove := len(rl.entries) / 10
-	if toRemove < 1 {
-		toRemove = 1
-	}
-	type entry struct {
-		key  string
-		last time.Time
-	}
-	entries := make([]entry, 0, len(rl.entries))
-	for k, times := range rl.entries {
-		if len(times) > 0 {
-			entries = append(entries, entry{k, times[len(times)-1]})
-		}
-	}
-	for i := 0; i < len(entries)-1; i++ {
-		for j := i + 1; j < len(entries); j++ {
-			if entries[j].last.Before(entries[i].last) {
-				entries[i], entries[j] = entries[j], entries[i]
-			}
-		}
-	}
-	for i := 0; i < toRemove && i < len(entries); i++ {
-		delete(rl.entries, entries[i].key)
-	}
-}
-
-var joinLimiter = newRateLimiter()
+// Join rate limiter (anti-enumeration)
+var joinLimiter = ratelimit.New()
 
 // --- Per-user WebSocket connection limiter ---
 type wsConnTracker struct {
@@ -493,40 +444,61 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for {
-		var msg WSMessage
-		if err := conn.ReadJSON(&msg); err != nil {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
 			break
 		}
 		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		msgType := protocol.PeekType(data)
 
 		// Rate limit check — total first, then per-type
 		if !checkRate(&totalTimes, totalRateLimit) {
-			safeWrite(WSResponse{Type: "error", Error: "消息频率过高，连接已断开"})
+			safeWrite(wsError(protocol.CodeRateLimited, "消息频率过高，连接已断开", msgType))
 			break
 		}
-		if msg.Type == "ping" {
+		if msgType == protocol.TypePing {
 			if !checkRate(&pingTimes, pingRateLimit) {
-				safeWrite(WSResponse{Type: "error", Error: "消息频率过高，连接已断开"})
+				safeWrite(wsError(protocol.CodeRateLimited, "消息频率过高，连接已断开", msgType))
 				break
 			}
 		} else {
 			if !checkRate(&msgTimes, msgRateLimit) {
-				safeWrite(WSResponse{Type: "error", Error: "消息频率过高，连接已断开"})
+				safeWrite(wsError(protocol.CodeRateLimited, "消息频率过高，连接已断开", msgType))
 				break
 			}
 		}
 
-		switch msg.Type {
-		case "create":
+		decoded, err := protocol.DecodeCommand(data)
+		if err != nil {
+			if _, ok := err.(*protocol.UnknownTypeError); ok {
+				safeWrite(wsError(protocol.CodeUnknownType, "未知的消息类型: "+msgType, msgType))
+			} else {
+				safeWrite(wsError(protocol.CodeInvalidMessage, "消息格式错误", msgType))
+			}
+			continue
+		}
+
+		switch msg := decoded.(type) {
+		case *protocol.Hello:
+			if msg.Version < protocol.MinVersion {
+				safeWrite(wsError(protocol.CodeUnsupportedVersion, fmt.Sprintf("协议版本过旧，最低支持 %d", protocol.MinVersion), msgType))
+				break
+			}
+			safeWrite(protocol.HelloEvent{
+				Type: protocol.TypeHello, Version: protocol.Version, MinVersion: protocol.MinVersion,
+				Server: "listen-together", Capabilities: protocol.Capabilities, ClientID: clientID,
+			})
+
+		case *protocol.Create:
 			// Permission check: only admin and owner can create rooms
 			if userRole != "admin" && userRole != "owner" {
-				safeWrite(WSResponse{Type: "error", Error: "没有创建房间的权限"})
+				safeWrite(wsError(protocol.CodeForbidden, "没有创建房间的权限", msgType))
 				continue
 			}
 			code := generateCode()
 			newRoom, createErr := manager.CreateRoom(code, userID)
 			if createErr != nil {
-				safeWrite(WSResponse{Type: "error", Error: createErr.Error()})
+				safeWrite(wsError(protocol.CodeLimitReached, createErr.Error(), msgType))
 				continue
 			}
 			// Leave old room before joining new one to prevent client leak
@@ -536,29 +508,33 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 					audio.CleanupRoom(filepath.Join(dataDir, currentRoom.Code))
 					manager.DeleteRoom(currentRoom.Code)
 				} else {
-					broadcast(currentRoom, WSResponse{Type: "userLeft", ClientCount: currentRoom.ClientCount(), Users: currentRoom.GetClientList()}, "")
+					broadcast(currentRoom, userLeftEvent(currentRoom), "")
 				}
+				emitUserEvent(webhook.EventUserLeft, currentRoom, userID, username)
 			}
 			currentRoom = newRoom
 			currentRoom.OwnerID = userID
 			currentRoom.OwnerName = username
+			currentRoom.SkipSilence = loadSkipSilence(userID)
 			client := &room.Client{ID: clientID, Username: username, Conn: conn, UID: userID, JoinedAt: time.Now()}
 			if err := currentRoom.AddClient(client); err != nil {
-				safeWrite(WSResponse{Type: "error", Error: err.Error()})
+				safeWrite(wsError(protocol.CodeLimitReached, err.Error(), msgType))
 				continue
 			}
 			myClient = client
-			safeWrite(WSResponse{Type: "created", Success: true, RoomCode: code, IsHost: true, Username: username, Role: userRole, Users: currentRoom.GetClientList()})
+			safeWrite(protocol.CreatedEvent{Type: protocol.TypeCreated, Success: true, RoomCode: code, IsHost: true, Username: username, Role: userRole, Users: currentRoom.GetClientList(), SkipSilence: currentRoom.SkipSilence})
+			emitRoomCreated(currentRoom)
+			emitUserEvent(webhook.EventUserJoined, currentRoom, userID, username)
 
-		case "join":
+		case *protocol.Join:
 			// Fix #3: Rate limit join attempts (5 per minute per IP)
-			if !joinLimiter.allow(auth.GetClientIP(r), 5, time.Minute) {
-				safeWrite(WSResponse{Type: "error", Error: "操作太频繁，请稍后再试"})
+			if !joinLimiter.Allow(auth.GetClientIP(r), 5, time.Minute) {
+				safeWrite(wsError(protocol.CodeRateLimited, "操作太频繁，请稍后再试", msgType))
 				continue
 			}
 			joinRoom := manager.GetRoom(msg.RoomCode)
 			if joinRoom == nil {
-				safeWrite(WSResponse{Type: "error", Error: "Room not found"})
+				safeWrite(wsError(protocol.CodeNotFound, "Room not found", msgType))
 				continue
 			}
 			// Leave old room before joining new one to prevent client leak
@@ -568,23 +544,25 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 					audio.CleanupRoom(filepath.Join(dataDir, currentRoom.Code))
 					manager.DeleteRoom(currentRoom.Code)
 				} else {
-					broadcast(currentRoom, WSResponse{Type: "userLeft", ClientCount: currentRoom.ClientCount(), Users: currentRoom.GetClientList()}, "")
+					broadcast(currentRoom, userLeftEvent(currentRoom), "")
 				}
+				emitUserEvent(webhook.EventUserLeft, currentRoom, userID, username)
 			}
 			currentRoom = joinRoom
 			client := &room.Client{ID: clientID, Username: username, Conn: conn, UID: userID, JoinedAt: time.Now()}
 			if err := currentRoom.AddClient(client); err != nil {
-				safeWrite(WSResponse{Type: "error", Error: err.Error()})
+				safeWrite(wsError(protocol.CodeLimitReached, err.Error(), msgType))
 				currentRoom = nil
 				continue
 			}
 			myClient = client
 			isHost := currentRoom.IsHost(clientID)
 			currentRoom.Mu.RLock()
-			resp := WSResponse{
-				Type: "joined", Success: true, RoomCode: msg.RoomCode,
+			resp := protocol.JoinedEvent{
+				Type: protocol.TypeJoined, Success: true, RoomCode: msg.RoomCode,
 				IsHost: isHost, ClientCount: len(currentRoom.Clients), Audio: currentRoom.Audio,
 				Username: username, Role: userRole, Users: currentRoom.GetClientList(),
+				SkipSilence: currentRoom.SkipSilence,
 			}
 			state, pos, startT := currentRoom.State, currentRoom.Position, currentRoom.StartTime
 			currentRoom.Mu.RUnlock()
@@ -592,9 +570,10 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			// Send playlist data to joining client
 			if pl, err := globalDB.GetPlaylistByRoom(msg.RoomCode); err == nil && pl != nil {
 				items, _ := globalDB.GetPlaylistItems(pl.ID)
-				safeWrite(WSResponse{Type: "playlistUpdate", PlaylistData: &PlaylistBroadcast{Playlist: pl, Items: items}})
+				safeWrite(playlistUpdateEvent(pl, items))
 			}
-			broadcast(currentRoom, WSResponse{Type: "userJoined", ClientCount: currentRoom.ClientCount(), Username: username, Users: currentRoom.GetClientList()}, clientID)
+			broadcast(currentRoom, protocol.UserJoinedEvent{Type: protocol.TypeUserJoined, ClientCount: currentRoom.ClientCount(), Username: username, Users: currentRoom.GetClientList()}, clientID)
+			emitUserEvent(webhook.EventUserJoined, currentRoom, userID, username)
 
 			// Send current track info with full audio metadata
 			currentRoom.Mu.RLock()
@@ -603,10 +582,10 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			currentRoom.Mu.RUnlock()
 
 			if trackAudio != nil {
-				safeWrite(WSResponse{
-					Type:       "trackChange",
+				safeWrite(protocol.TrackChangeEvent{
+					Type:       protocol.TypeTrackChange,
 					TrackIndex: trackIdx,
-					TrackAudio: trackAudio,
+					TrackAudio: signTrackAudio(trackAudio),
 					ServerTime: syncpkg.GetServerTime(),
 				})
 				// If currently playing, send play to sync position
@@ -616,14 +595,14 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 					// No ScheduledAt for join restore — client needs to load segments first,
 					// so scheduledAt would always expire. Let client use elapsed fallback.
 					nowMs := syncpkg.GetServerTime()
-					safeWrite(WSResponse{Type: "play", Position: currentPos, ServerTime: nowMs})
+					safeWrite(protocol.PlayEvent{Type: protocol.TypePlay, Position: currentPos, ServerTime: nowMs, TrackIndex: trackIdx})
 				}
 			}
 
-		case "ping":
-			safeWrite(WSResponse{Type: "pong", ClientTime: msg.ClientTime, ServerTime: syncpkg.GetServerTime()})
+		case *protocol.Ping:
+			safeWrite(protocol.PongEvent{Type: protocol.TypePong, ClientTime: msg.ClientTime, ServerTime: syncpkg.GetServerTime()})
 
-		case "play":
+		case *protocol.Play:
 			if currentRoom == nil || !currentRoom.IsHost(clientID) {
 				continue
 			}
@@ -641,7 +620,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			}
 			currentRoom.Mu.RUnlock()
 			if errMsg := validatePosition(msg.Position, dur); errMsg != "" {
-				safeWrite(WSResponse{Type: "error", Error: errMsg})
+				safeWrite(wsError(protocol.CodeInvalidArgument, errMsg, msgType))
 				continue
 			}
 			currentRoom.Play(msg.Position)
@@ -654,13 +633,13 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			ti := currentRoom.CurrentTrack
 			currentRoom.Mu.RUnlock()
 
-			broadcast(currentRoom, WSResponse{
-				Type: "play", Position: msg.Position,
+			broadcast(currentRoom, protocol.PlayEvent{
+				Type: protocol.TypePlay, Position: msg.Position,
 				ServerTime: nowMs, ScheduledAt: scheduledTime,
-				TrackAudio: ta, TrackIndex: ti,
+				TrackAudio: signTrackAudio(ta), TrackIndex: ti,
 			}, "")
 
-		case "pause":
+		case *protocol.Pause:
 			if currentRoom == nil || !currentRoom.IsHost(clientID) {
 				continue
 			}
@@ -668,9 +647,9 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			pos := currentRoom.Pause()
-			broadcast(currentRoom, WSResponse{Type: "pause", Position: pos, ServerTime: syncpkg.GetServerTime()}, "")
+			broadcast(currentRoom, protocol.PauseEvent{Type: protocol.TypePause, Position: pos, ServerTime: syncpkg.GetServerTime()}, "")
 
-		case "seek":
+		case *protocol.Seek:
 			if currentRoom == nil || !currentRoom.IsHost(clientID) {
 				continue
 			}
@@ -687,15 +666,15 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			}
 			currentRoom.Mu.RUnlock()
 			if errMsg := validatePosition(msg.Position, dur); errMsg != "" {
-				safeWrite(WSResponse{Type: "error", Error: errMsg})
+				safeWrite(wsError(protocol.CodeInvalidArgument, errMsg, msgType))
 				continue
 			}
 			currentRoom.Seek(msg.Position)
 			nowMs := syncpkg.GetServerTime()
 			scheduledTime := nowMs + 800
-			broadcast(currentRoom, WSResponse{Type: "seek", Position: msg.Position, ServerTime: nowMs, ScheduledAt: scheduledTime}, "")
+			broadcast(currentRoom, protocol.SeekEvent{Type: protocol.TypeSeek, Position: msg.Position, ServerTime: nowMs, ScheduledAt: scheduledTime}, "")
 
-		case "statusReport":
+		case *protocol.StatusReport:
 			// Client reports its actual playback state for server-side validation
 			if currentRoom == nil {
 				continue
@@ -718,16 +697,13 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				currentRoom.Mu.RLock()
 				ta := currentRoom.TrackAudio
 				currentRoom.Mu.RUnlock()
-				correction := map[string]interface{}{
-					"type":       "forceTrack",
-					"trackIndex": serverTrackIdx,
-					"position":   serverPos,
-					"serverTime": syncpkg.GetServerTime(),
-				}
-				if ta != nil {
-					correction["trackAudio"] = ta
-				}
-				myClient.Send(correction)
+				myClient.Send(protocol.ForceTrackEvent{
+					Type:       protocol.TypeForceTrack,
+					TrackIndex: serverTrackIdx,
+					Position:   serverPos,
+					ServerTime: syncpkg.GetServerTime(),
+					TrackAudio: signTrackAudio(ta),
+				})
 				continue
 			}
 
@@ -746,36 +722,74 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				// If drift > 400ms, force resync
 				if drift > 0.4 {
 					log.Printf("[sync] client %s drift %.0fms — forcing resync", clientID, drift*1000)
-					myClient.Send(map[string]interface{}{
-						"type":       "forceResync",
-						"position":   expectedPos,
-						"serverTime": syncpkg.GetServerTime(),
+					myClient.Send(protocol.ForceResyncEvent{
+						Type:       protocol.TypeForceResync,
+						Position:   expectedPos,
+						ServerTime: syncpkg.GetServerTime(),
 					})
 				}
 			}
 
-		case "kick":
+		case *protocol.Kick:
 			if currentRoom == nil {
 				continue
 			}
 			if currentRoom.OwnerID != userID {
-				safeWrite(WSResponse{Type: "error", Error: "只有房主可以踢人"})
+				safeWrite(wsError(protocol.CodeForbidden, "只有房主可以踢人", msgType))
 				continue
 			}
 			if msg.TargetClientID == clientID {
-				safeWrite(WSResponse{Type: "error", Error: "不能踢出自己"})
+				safeWrite(wsError(protocol.CodeInvalidArgument, "不能踢出自己", msgType))
 				continue
 			}
 			target := currentRoom.RemoveClientByID(msg.TargetClientID)
 			if target == nil {
-				safeWrite(WSResponse{Type: "error", Error: "用户不存在"})
+				// An SSE listener: its stream announces the departure as it ends
+				if !currentRoom.KickSubscriber(msg.TargetClientID) {
+					safeWrite(wsError(protocol.CodeNotFound, "用户不存在", msgType))
+				}
 				continue
 			}
-			target.Send(WSResponse{Type: "kicked"})
+			target.Send(protocol.KickedEvent{Type: protocol.TypeKicked})
 			target.Conn.Close()
-			broadcast(currentRoom, WSResponse{Type: "userLeft", ClientCount: currentRoom.ClientCount(), Users: currentRoom.GetClientList()}, "")
+			broadcast(currentRoom, userLeftEvent(currentRoom), "")
+
+		case *protocol.SkipSilence:
+			if currentRoom == nil {
+				continue
+			}
+			if currentRoom.OwnerID != userID {
+				continue
+			}
+			currentRoom.Mu.Lock()
+			currentRoom.SkipSilence = msg.Enabled
+			currentRoom.Mu.Unlock()
+			// Remember the choice so the owner's next room starts the same way
+			if err := saveSkipSilence(userID, msg.Enabled); err != nil {
+				log.Printf("save skip-silence setting for user %d: %v", userID, err)
+			}
+			broadcast(currentRoom, protocol.SkipSilenceEvent{Type: protocol.TypeSkipSilence, Enabled: msg.Enabled}, "")
 
-		case "nextTrack":
+		case *protocol.Love:
+			// Favorite whatever the room is playing right now. Listeners may not
+			// have library access to the track; loving it only records the favorite.
+			if currentRoom == nil {
+				continue
+			}
+			currentRoom.Mu.RLock()
+			ta := currentRoom.TrackAudio
+			currentRoom.Mu.RUnlock()
+			if ta == nil {
+				safeWrite(wsError(protocol.CodeNoTrack, "当前没有播放曲目", msgType))
+				continue
+			}
+			if err := globalDB.SetFavorite(userID, ta.AudioID, true); err != nil {
+				safeWrite(wsError(protocol.CodeInternal, "收藏失败", msgType))
+				continue
+			}
+			safeWrite(protocol.LovedEvent{Type: protocol.TypeLoved, Success: true, AudioID: ta.AudioID})
+
+		case *protocol.NextTrack:
 			if currentRoom == nil {
 				continue
 			}
@@ -791,9 +805,19 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			items, err := globalDB.GetPlaylistItems(pl.ID)
-			if err != nil || msg.TrackIndex < 0 || msg.TrackIndex >= len(items) {
+			if err != nil {
+				continue
+			}
+			if msg.Auto {
+				currentRoom.Mu.RLock()
+				cur := currentRoom.CurrentTrack
+				currentRoom.Mu.RUnlock()
+				msg.TrackIndex = pickNextTrack(currentRoom, pl.PlayMode, items, cur)
+			}
+			if msg.TrackIndex < 0 || msg.TrackIndex >= len(items) {
 				continue
 			}
+			recordOutgoingTrack(currentRoom)
 			item := items[msg.TrackIndex]
 			af, err := globalDB.GetAudioFileByID(item.AudioID)
 			if err != nil {
@@ -811,11 +835,19 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				OriginalName: af.OriginalName,
 				Duration:     af.Duration,
 				Qualities:    qualities,
+				EffectiveEnd: af.EffectiveEnd,
 			}
 
+			timeline, _ := globalDB.GetLyricsTimeline(af.ID)
+			trackLyrics := lyrics.Load(timeline, af.Lyrics)
+
 			currentRoom.Mu.Lock()
 			currentRoom.CurrentTrack = msg.TrackIndex
 			currentRoom.TrackAudio = trackAudio
+			currentRoom.TrackEndSent = false
+			currentRoom.ListenedFor = 0
+			currentRoom.ListenSent = false
+			currentRoom.Lyrics = trackLyrics
 			currentRoom.Audio = &room.AudioInfo{
 				Filename: af.OriginalName,
 				Duration: af.Duration,
@@ -826,17 +858,18 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			currentRoom.Mu.Unlock()
 
 			// Broadcast trackChange with full audio metadata
-			broadcast(currentRoom, WSResponse{
-				Type:       "trackChange",
+			broadcast(currentRoom, protocol.TrackChangeEvent{
+				Type:       protocol.TypeTrackChange,
 				TrackIndex: msg.TrackIndex,
-				TrackAudio: trackAudio,
+				TrackAudio: signTrackAudio(trackAudio),
 				ServerTime: syncpkg.GetServerTime(),
 			}, "")
+			emitTrackChanged(currentRoom, msg.TrackIndex, af, username)
 		}
 	}
-
 	if currentRoom != nil {
 		empty := currentRoom.RemoveClient(clientID)
+		emitUserEvent(webhook.EventUserLeft, currentRoom, userID, username)
 		if empty {
 			audio.CleanupRoom(filepath.Join(dataDir, currentRoom.Code))
 			manager.DeleteRoom(currentRoom.Code)
@@ -844,9 +877,9 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			users := currentRoom.GetClientList()
 			for _, c := range currentRoom.GetClients() {
 				if currentRoom.IsHost(c.ID) {
-					c.Send(WSResponse{Type: "hostTransfer", IsHost: true, ClientCount: currentRoom.ClientCount(), Users: users})
+					c.Send(protocol.HostTransferEvent{Type: protocol.TypeHostTransfer, IsHost: true, ClientCount: currentRoom.ClientCount(), Users: users})
 				} else {
-					c.Send(WSResponse{Type: "userLeft", ClientCount: currentRoom.ClientCount(), Users: users})
+					c.Send(protocol.UserLeftEvent{Type: protocol.TypeUserLeft, ClientCount: currentRoom.ClientCount(), Users: users})
 				}
 			}
 		}
@@ -855,10 +888,78 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 // sendJSON is deprecated — use safeWrite (per-conn) or Client.Send() instead
 
-func broadcast(rm *room.Room, msg WSResponse, excludeID string) {
+// signTrackAudio returns a copy of ta carrying a fresh segment token, so
+// listeners can fetch segments without a database check per request.
+func signTrackAudio(ta *room.TrackAudioInfo) *room.TrackAudioInfo {
+	if ta == nil {
+		return nil
+	}
+	signed := *ta
+	exp := time.Now().Add(auth.SegmentTokenTTL() + time.Duration(ta.Duration*float64(time.Second)))
+	signed.SegmentToken = auth.SignSegmentToken(ta.OwnerID, ta.AudioUUID, exp)
+	signed.TokenExpires = exp.Unix()
+	return &signed
+}
+
+// skipSilenceSetting is the user_settings key holding an owner's skip-silence
+// choice; rooms they create start with it.
+const skipSilenceSetting = "skipSilence"
+
+func loadSkipSilence(userID int64) bool {
+	raw, _ := globalDB.GetUserSettings(userID)
+	var all map[string]json.RawMessage
+	var enabled bool
+	if json.Unmarshal([]byte(raw), &all) == nil {
+		json.Unmarshal(all[skipSilenceSetting], &enabled)
+	}
+	return enabled
+}
+
+// saveSkipSilence stores the choice without touching the user's other settings.
+func saveSkipSilence(userID int64, enabled bool) error {
+	raw, _ := globalDB.GetUserSettings(userID)
+	all := map[string]json.RawMessage{}
+	json.Unmarshal([]byte(raw), &all)
+	all[skipSilenceSetting], _ = json.Marshal(enabled)
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return globalDB.SaveUserSettings(userID, string(b))
+}
+
+// wsError builds an error event; req is the type of the command that failed.
+func wsError(code, msg, req string) protocol.ErrorEvent {
+	return protocol.ErrorEvent{Type: protocol.TypeError, Error: msg, Code: code, Request: req}
+}
+
+func userLeftEvent(rm *room.Room) protocol.UserLeftEvent {
+	return protocol.UserLeftEvent{Type: protocol.TypeUserLeft, ClientCount: rm.ClientCount(), Users: rm.GetClientList()}
+}
+
+// playlistUpdateEvent converts a room playlist from the database to its wire form.
+func playlistUpdateEvent(pl *db.Playlist, items []*db.PlaylistItem) protocol.PlaylistUpdateEvent {
+	data := &protocol.PlaylistData{
+		Playlist: &protocol.Playlist{ID: pl.ID, RoomCode: pl.RoomCode, CreatedBy: pl.CreatedBy, PlayMode: pl.PlayMode, CurrentIndex: pl.CurrentIndex, CreatedAt: pl.CreatedAt},
+		Items:    make([]protocol.PlaylistItem, 0, len(items)),
+	}
+	for _, it := range items {
+		data.Items = append(data.Items, protocol.PlaylistItem{
+			ID: it.ID, PlaylistID: it.PlaylistID, AudioID: it.AudioID, Position: it.Position,
+			Title: it.Title, Artist: it.Artist, Duration: it.Duration, Filename: it.Filename,
+			OriginalName: it.OriginalName, OwnerID: it.OwnerID, Qualities: it.Qualities,
+		})
+	}
+	return protocol.PlaylistUpdateEvent{Type: protocol.TypePlaylistUpdate, PlaylistData: data}
+}
+
+// broadcast sends msg to the room's WebSocket clients except excludeID, and to
+// its SSE listeners.
+func broadcast(rm *room.Room, msg interface{}, excludeID string) {
 	for _, c := range rm.GetClients() {
 		if c.ID != excludeID {
 			c.Send(msg)
 		}
 	}
+	publishEvent(rm, msg)
 }
@@ -0,0 +1,435 @@
+// Package client is a Go SDK for ListenTogether rooms. It logs in (or uses a
+// personal access token), connects to /ws, keeps a synchronised server clock
+// and exposes the room protocol as typed commands and events.
+//
+//	c, err := client.Dial(ctx, client.Options{BaseURL: "https://music.example.com", Token: "lt_pat_..."})
+//	if err != nil { ... }
+//	defer c.Close()
+//	if _, err := c.Join(ctx, "AB12CD34"); err != nil { ... }
+//	for ev := range c.Events() {
+//		switch ev := ev.(type) {
+//		case *protocol.TrackChangeEvent:
+//			fmt.Println("now playing", ev.TrackAudio.Title)
+//		}
+//	}
+//
+// Message types are defined in package protocol.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// Options configures Dial. Either Token or Username and Password is required.
+type Options struct {
+	BaseURL    string // server root, e.g. https://music.example.com
+	Token      string // personal access token (needs room:control) or session token
+	Username   string
+	Password   string
+	ClientName string       // sent in the hello handshake, e.g. "my-bot/1.0"
+	HTTPClient *http.Client // defaults to http.DefaultClient
+}
+
+// Error is an error event returned by the server in reply to a command.
+type Error struct {
+	Code    string // one of the protocol.Code* constants
+	Message string
+	Request string // type of the command that failed
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// UnknownEvent is delivered for event types this package does not know, so
+// newer servers do not break older clients.
+type UnknownEvent struct {
+	Type string
+	Data json.RawMessage
+}
+
+// ErrClosed is returned by commands after the connection is gone.
+var ErrClosed = errors.New("client: connection closed")
+
+const (
+	eventBuffer  = 256
+	helloTimeout = 5 * time.Second
+)
+
+// Client is one WebSocket connection to a server.
+type Client struct {
+	base  *url.URL
+	http  *http.Client
+	token string
+	conn  *websocket.Conn
+
+	writeMu sync.Mutex
+	events  chan interface{}
+	done    chan struct{}
+	err     error
+	closing atomic.Bool
+
+	mu      sync.Mutex
+	waiters []*waiter
+	hello   *protocol.HelloEvent
+
+	clock    *Clock
+	playback *Playback
+}
+
+type waiter struct {
+	types   []string // event types that complete the wait
+	request string   // command type whose error event completes the wait
+	ch      chan interface{}
+}
+
+// Login exchanges a username and password for a session token.
+func Login(ctx context.Context, hc *http.Client, baseURL, username, password string) (string, error) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(baseURL, "/")+"/api/auth/login", strings.NewReader(string(body)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		return "", fmt.Errorf("client: login failed (%d): %s", res.StatusCode, e.Error)
+	}
+	for _, c := range res.Cookies() {
+		if c.Name == "token" {
+			return c.Value, nil
+		}
+	}
+	return "", errors.New("client: login response carried no token")
+}
+
+// Dial authenticates, connects to /ws, performs the hello handshake and starts
+// clock synchronisation. The returned client must be closed.
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	base, err := url.Parse(strings.TrimRight(opts.BaseURL, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("client: invalid base URL %q", opts.BaseURL)
+	}
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	token := opts.Token
+	if token == "" {
+		if opts.Username == "" {
+			return nil, errors.New("client: Token or Username is required")
+		}
+		if token, err = Login(ctx, hc, base.String(), opts.Username, opts.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	wsURL := *base
+	wsURL.Scheme = map[string]string{"http": "ws", "https": "wss"}[base.Scheme]
+	wsURL.Path += "/ws"
+	conn, res, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("client: connect: %s", res.Status)
+		}
+		return nil, fmt.Errorf("client: connect: %w", err)
+	}
+
+	c := &Client{
+		base:     base,
+		http:     hc,
+		token:    token,
+		conn:     conn,
+		events:   make(chan interface{}, eventBuffer),
+		done:     make(chan struct{}),
+		playback: &Playback{},
+	}
+	c.clock = newClock(c)
+	c.playback.clock = c.clock
+	go c.readLoop()
+
+	// Servers before the versioned protocol ignore hello; don't wait forever.
+	hctx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+	hello := protocol.Hello{Type: protocol.TypeHello, Version: protocol.Version, Client: opts.ClientName}
+	ev, err := c.request(hctx, hello, protocol.TypeHello)
+	if err != nil {
+		var perr *Error
+		if ctx.Err() != nil || (err != context.DeadlineExceeded && (!errors.As(err, &perr) || perr.Code != protocol.CodeUnknownType)) {
+			c.Close()
+			return nil, err
+		}
+	} else {
+		c.mu.Lock()
+		c.hello = ev.(*protocol.HelloEvent)
+		c.mu.Unlock()
+	}
+	go c.clock.run(c.done)
+	return c, nil
+}
+
+// Server returns the server's hello reply, or nil for servers that predate it.
+func (c *Client) Server() *protocol.HelloEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello
+}
+
+// HasCapability reports whether the server announced an optional feature.
+func (c *Client) HasCapability(name string) bool {
+	if h := c.Server(); h != nil {
+		for _, cap := range h.Capabilities {
+			if cap == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Events returns the stream of server events as pointers to protocol event
+// structs (or *UnknownEvent). Pongs are consumed by the clock and not
+// delivered. If the buffer fills up because nobody reads, events are dropped.
+// The channel is closed when the connection ends.
+func (c *Client) Events() <-chan interface{} {
+	return c.events
+}
+
+// Done is closed when the connection ends; Err then tells why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that ended the connection, or nil while it is open.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the connection.
+func (c *Client) Close() error {
+	c.closing.Store(true)
+	c.writeMu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+// Clock returns the synchronised server clock.
+func (c *Client) Clock() *Clock {
+	return c.clock
+}
+
+// Playback returns the room playback state tracked from events.
+func (c *Client) Playback() *Playback {
+	return c.playback
+}
+
+// Send writes a command; cmd is a protocol command struct with Type set.
+func (c *Client) Send(cmd interface{}) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteJSON(cmd)
+}
+
+// Create makes a new room with this user as host (admins and owners only).
+func (c *Client) Create(ctx context.Context) (*protocol.CreatedEvent, error) {
+	ev, err := c.request(ctx, protocol.Create{Type: protocol.TypeCreate}, protocol.TypeCreated)
+	if err != nil {
+		return nil, err
+	}
+	return ev.(*protocol.CreatedEvent), nil
+}
+
+// Join enters a room. The playlist, current track and play state follow as events.
+func (c *Client) Join(ctx context.Context, roomCode string) (*protocol.JoinedEvent, error) {
+	ev, err := c.request(ctx, protocol.Join{Type: protocol.TypeJoin, RoomCode: roomCode}, protocol.TypeJoined)
+	if err != nil {
+		return nil, err
+	}
+	return ev.(*protocol.JoinedEvent), nil
+}
+
+// Play starts playback at position seconds. Room owner only.
+func (c *Client) Play(position float64) error {
+	return c.Send(protocol.Play{Type: protocol.TypePlay, Position: position})
+}
+
+// Pause stops playback. Room owner only.
+func (c *Client) Pause() error {
+	return c.Send(protocol.Pause{Type: protocol.TypePause})
+}
+
+// Seek moves playback to position seconds. Room owner only.
+func (c *Client) Seek(position float64) error {
+	return c.Send(protocol.Seek{Type: protocol.TypeSeek, Position: position})
+}
+
+// NextTrack switches to playlist item index. Room owner only; playback
+// starts with the next Play.
+func (c *Client) NextTrack(index int) error {
+	return c.Send(protocol.NextTrack{Type: protocol.TypeNextTrack, TrackIndex: index})
+}
+
+// AutoNext lets the server pick the next track from the play mode, as
+// clients do when a track ends. Room owner only.
+func (c *Client) AutoNext() error {
+	return c.Send(protocol.NextTrack{Type: protocol.TypeNextTrack, Auto: true})
+}
+
+// Kick removes a connection (a ClientInfo.ClientID) from the room. Room owner only.
+func (c *Client) Kick(clientID string) error {
+	return c.Send(protocol.Kick{Type: protocol.TypeKick, TargetClientID: clientID})
+}
+
+// Love adds the playing track to this user's favorites.
+func (c *Client) Love() error {
+	return c.Send(protocol.Love{Type: protocol.TypeLove})
+}
+
+// SkipSilence turns trailing-silence skipping on or off. Room owner only.
+func (c *Client) SkipSilence(enabled bool) error {
+	return c.Send(protocol.SkipSilence{Type: protocol.TypeSkipSilence, Enabled: enabled})
+}
+
+// ReportStatus tells the server what this client is playing; it answers with
+// forceTrack or forceResync when the client is off.
+func (c *Client) ReportStatus(trackIndex int, position float64) error {
+	return c.Send(protocol.StatusReport{Type: protocol.TypeStatusReport, TrackIndex: trackIndex, Position: position})
+}
+
+// request sends cmd and waits for an event of type reply, or an error event
+// for cmd's type.
+func (c *Client) request(ctx context.Context, cmd interface{}, reply string) (interface{}, error) {
+	w := &waiter{types: []string{reply}, request: protocol.PeekType(mustJSON(cmd)), ch: make(chan interface{}, 1)}
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	defer c.removeWaiter(w)
+	if err := c.Send(cmd); err != nil {
+		return nil, err
+	}
+	select {
+	case ev := <-w.ch:
+		if e, ok := ev.(*protocol.ErrorEvent); ok {
+			return nil, &Error{Code: e.Code, Message: e.Error, Request: e.Request}
+		}
+		return ev, nil
+	case <-c.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) removeWaiter(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, x := range c.waiters {
+		if x == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop() {
+	defer close(c.events)
+	defer close(c.done)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if c.closing.Load() || websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				err = ErrClosed
+			}
+			c.err = err
+			return
+		}
+		ev, err := protocol.DecodeEvent(data)
+		if err != nil {
+			var unknown *protocol.UnknownTypeError
+			if !errors.As(err, &unknown) {
+				continue // malformed; nothing useful to deliver
+			}
+			ev = &UnknownEvent{Type: unknown.Type, Data: append(json.RawMessage(nil), data...)}
+		}
+		if pong, ok := ev.(*protocol.PongEvent); ok {
+			c.clock.handlePong(pong)
+			continue
+		}
+		c.playback.update(ev)
+		c.wake(protocol.PeekType(data), ev)
+		select {
+		case c.events <- ev:
+		default:
+		}
+	}
+}
+
+// wake completes the waiters the event answers.
+func (c *Client) wake(typ string, ev interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	errEv, isErr := ev.(*protocol.ErrorEvent)
+	for _, w := range c.waiters {
+		match := isErr && errEv.Request == w.request
+		for _, t := range w.types {
+			match = match || (!isErr && t == typ)
+		}
+		if match {
+			select {
+			case w.ch <- ev:
+			default:
+			}
+		}
+	}
+}
+
+// Do sends an HTTP request to the server with this client's credentials.
+// path is relative to the base URL, e.g. /api/library/files.
+func (c *Client) Do(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base.String()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return c.http.Do(req)
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
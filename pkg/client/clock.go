@@ -0,0 +1,196 @@
+package client
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// Clock estimates the offset between the local clock and the server's using
+// ping/pong, the same way the web client does: keep recent samples, average
+// the offsets of the three with the lowest round trip, and blend small
+// changes instead of jumping.
+type Clock struct {
+	c *Client
+
+	mu      sync.Mutex
+	offset  float64 // ms to add to local time to get server time
+	rtt     float64 // best recent round trip, ms
+	synced  bool
+	samples []clockSample
+	pending time.Time // local send time of the ping in flight
+	changed chan struct{}
+}
+
+type clockSample struct {
+	offset, rtt float64
+	at          time.Time
+}
+
+const (
+	clockMaxSamples = 64
+	clockMaxRTT     = 1000.0 // ms; slower pongs are useless
+	clockPingLost   = 2 * time.Second
+)
+
+func newClock(c *Client) *Clock {
+	return &Clock{c: c, rtt: math.Inf(1), changed: make(chan struct{})}
+}
+
+// ServerTime returns the server time, in Unix milliseconds, at local time t.
+func (k *Clock) ServerTime(t time.Time) int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return t.UnixMilli() + int64(math.Round(k.offset))
+}
+
+// Now returns the current server time in Unix milliseconds.
+func (k *Clock) Now() int64 {
+	return k.ServerTime(time.Now())
+}
+
+// Offset returns the estimated server-minus-local offset and round trip.
+func (k *Clock) Offset() (offset, rtt time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return time.Duration(k.offset * float64(time.Millisecond)), time.Duration(k.rtt * float64(time.Millisecond))
+}
+
+// Synced reports whether enough samples have been collected to trust the offset.
+func (k *Clock) Synced() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.synced
+}
+
+// WaitSynced blocks until the clock is synced, the connection ends or done is closed.
+func (k *Clock) WaitSynced(done <-chan struct{}) bool {
+	for {
+		k.mu.Lock()
+		synced, ch := k.synced, k.changed
+		k.mu.Unlock()
+		if synced {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-k.c.done:
+			return false
+		case <-done:
+			return false
+		}
+	}
+}
+
+// run pings in a burst, then every 300ms until the offset is stable, then every 2s.
+func (k *Clock) run(done <-chan struct{}) {
+	for i := 0; i < 16; i++ {
+		k.ping()
+		select {
+		case <-done:
+			return
+		case <-time.After(40 * time.Millisecond):
+		}
+	}
+	for {
+		interval := 300 * time.Millisecond
+		k.mu.Lock()
+		if !k.synced {
+			interval = 150 * time.Millisecond
+		} else if k.stable() {
+			interval = 2 * time.Second
+		}
+		k.mu.Unlock()
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+			k.ping()
+		}
+	}
+}
+
+func (k *Clock) ping() {
+	k.mu.Lock()
+	now := time.Now()
+	if !k.pending.IsZero() && now.Sub(k.pending) < clockPingLost {
+		k.mu.Unlock()
+		return
+	}
+	k.pending = now
+	k.mu.Unlock()
+	k.c.Send(protocol.Ping{Type: protocol.TypePing, ClientTime: now.UnixMilli()})
+}
+
+func (k *Clock) handlePong(p *protocol.PongEvent) {
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pending.IsZero() || p.ClientTime != k.pending.UnixMilli() {
+		return
+	}
+	sent := k.pending
+	k.pending = time.Time{}
+	rtt := float64(now.Sub(sent)) / float64(time.Millisecond)
+	if rtt > clockMaxRTT || (!math.IsInf(k.rtt, 1) && rtt > k.rtt*2.5) {
+		return
+	}
+	offset := float64(p.ServerTime) - (float64(sent.UnixNano())/1e6 + rtt/2)
+	k.samples = append(k.samples, clockSample{offset: offset, rtt: rtt, at: now})
+	if len(k.samples) > clockMaxSamples {
+		k.samples = k.samples[1:]
+	}
+
+	// Expire old samples: 10s while settling, 30s once stable
+	expiry := 10 * time.Second
+	if k.synced && k.stable() {
+		expiry = 30 * time.Second
+	}
+	kept := k.samples[:0]
+	for _, s := range k.samples {
+		if now.Sub(s.at) < expiry {
+			kept = append(kept, s)
+		}
+	}
+	k.samples = kept
+	if len(k.samples) < 3 {
+		k.synced = false
+		return
+	}
+
+	byRTT := append([]clockSample(nil), k.samples...)
+	sort.Slice(byRTT, func(i, j int) bool { return byRTT[i].rtt < byRTT[j].rtt })
+	sum := 0.0
+	for _, s := range byRTT[:3] {
+		sum += s.offset
+	}
+	next := sum / 3
+	if k.synced && math.Abs(next-k.offset) < 10 {
+		k.offset = 0.7*k.offset + 0.3*next
+	} else {
+		k.offset = next
+	}
+	k.rtt = byRTT[0].rtt
+	if !k.synced {
+		k.synced = true
+		close(k.changed)
+		k.changed = make(chan struct{})
+	}
+}
+
+// stable reports whether the last five offsets moved less than 3ms each. k.mu held.
+func (k *Clock) stable() bool {
+	n := len(k.samples)
+	if n < 5 {
+		return false
+	}
+	for i := n - 4; i < n; i++ {
+		if math.Abs(k.samples[i].offset-k.samples[i-1].offset) > 3 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/xingzihai/listen-together/pkg/protocol"
+)
+
+// PositionAt returns the room position, in seconds, at server time now (ms)
+// given an anchor: the room was at position at server time anchorMs and has
+// been playing since. Before anchorMs (a scheduled start) it stays at position.
+func PositionAt(position float64, anchorMs, now int64) float64 {
+	if now <= anchorMs {
+		return position
+	}
+	return position + float64(now-anchorMs)/1000
+}
+
+// Playback tracks the room's play state from trackChange, play, pause, seek,
+// syncTick and the forced corrections, so callers can ask for the current
+// position at any time.
+type Playback struct {
+	clock *Clock
+
+	mu         sync.Mutex
+	playing    bool
+	position   float64 // seconds at anchor
+	anchor     int64   // server ms when the room was at position
+	trackIndex int
+	track      *protocol.TrackAudioInfo
+}
+
+// State is a snapshot of the room's playback.
+type State struct {
+	Playing    bool
+	Position   float64 // seconds, now
+	TrackIndex int
+	Track      *protocol.TrackAudioInfo // nil before the first trackChange
+}
+
+// State returns the playback state at the current server time.
+func (p *Playback) State() State {
+	now := p.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := State{Playing: p.playing, Position: p.position, TrackIndex: p.trackIndex, Track: p.track}
+	if p.playing {
+		s.Position = PositionAt(p.position, p.anchor, now)
+		if p.track != nil && p.track.Duration > 0 && s.Position > p.track.Duration {
+			s.Position = p.track.Duration
+		}
+	}
+	return s
+}
+
+// Position returns the current room position in seconds.
+func (p *Playback) Position() float64 {
+	return p.State().Position
+}
+
+func (p *Playback) update(ev interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch ev := ev.(type) {
+	case *protocol.JoinedEvent:
+		p.playing, p.position, p.track, p.trackIndex = false, 0, nil, 0
+	case *protocol.TrackChangeEvent:
+		p.playing, p.position, p.anchor = false, 0, ev.ServerTime
+		p.track, p.trackIndex = ev.TrackAudio, ev.TrackIndex
+	case *protocol.ForceTrackEvent:
+		p.position, p.anchor = ev.Position, ev.ServerTime
+		if ev.TrackAudio != nil {
+			p.track, p.trackIndex = ev.TrackAudio, ev.TrackIndex
+		}
+	case *protocol.PlayEvent:
+		p.playing, p.position, p.anchor = true, ev.Position, ev.ServerTime
+		if ev.ScheduledAt > 0 {
+			p.anchor = ev.ScheduledAt
+		}
+		if ev.TrackAudio != nil {
+			p.track, p.trackIndex = ev.TrackAudio, ev.TrackIndex
+		}
+	case *protocol.PauseEvent:
+		p.playing, p.position, p.anchor = false, ev.Position, ev.ServerTime
+	case *protocol.SeekEvent:
+		p.position, p.anchor = ev.Position, ev.ScheduledAt
+	case *protocol.SyncTickEvent:
+		p.playing, p.position, p.anchor = true, ev.Position, ev.ServerTime
+	case *protocol.ForceResyncEvent:
+		p.position, p.anchor = ev.Position, ev.ServerTime
+	case *protocol.RoomClosedEvent, *protocol.KickedEvent:
+		p.playing, p.track = false, nil
+	}
+}
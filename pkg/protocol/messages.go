@@ -0,0 +1,340 @@
+package protocol
+
+// Message type names, shared by commands and events where both exist.
+const (
+	TypeHello          = "hello"
+	TypeCreate         = "create"
+	TypeCreated        = "created"
+	TypeJoin           = "join"
+	TypeJoined         = "joined"
+	TypePing           = "ping"
+	TypePong           = "pong"
+	TypePlay           = "play"
+	TypePause          = "pause"
+	TypeSeek           = "seek"
+	TypeStatusReport   = "statusReport"
+	TypeKick           = "kick"
+	TypeKicked         = "kicked"
+	TypeSkipSilence    = "skipSilence"
+	TypeLove           = "love"
+	TypeLoved          = "loved"
+	TypeNextTrack      = "nextTrack"
+	TypeUserJoined     = "userJoined"
+	TypeUserLeft       = "userLeft"
+	TypeHostTransfer   = "hostTransfer"
+	TypeSyncTick       = "syncTick"
+	TypeTrackChange    = "trackChange"
+	TypeTrackEnd       = "trackEnd"
+	TypeForceTrack     = "forceTrack"
+	TypeForceResync    = "forceResync"
+	TypePlaylistUpdate = "playlistUpdate"
+	TypeRoomClosed     = "roomClosed"
+	TypeRoleChanged    = "roleChanged"
+	TypeError          = "error"
+)
+
+// --- Commands (client → server) ---
+
+// Hello opens the handshake. It is optional; a client that sends it learns
+// the server's version and capabilities before doing anything else.
+type Hello struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`                // highest protocol version the client speaks
+	Client       string   `json:"client,omitempty"`       // free-form client name, e.g. "my-bot/1.2"
+	Capabilities []string `json:"capabilities,omitempty"` // optional features the client handles
+}
+
+// Create makes a new room with the sender as host. Admins and owners only.
+type Create struct {
+	Type string `json:"type"`
+}
+
+// Join enters an existing room, leaving the current one.
+type Join struct {
+	Type     string `json:"type"`
+	RoomCode string `json:"roomCode"`
+}
+
+// Ping asks for a pong, used for clock synchronisation.
+type Ping struct {
+	Type       string `json:"type"`
+	ClientTime int64  `json:"clientTime"` // client clock, ms
+}
+
+// Play starts playback at Position seconds. Room owner only.
+type Play struct {
+	Type     string  `json:"type"`
+	Position float64 `json:"position"`
+}
+
+// Pause stops playback. Room owner only.
+type Pause struct {
+	Type string `json:"type"`
+}
+
+// Seek moves playback to Position seconds. Room owner only.
+type Seek struct {
+	Type     string  `json:"type"`
+	Position float64 `json:"position"`
+}
+
+// StatusReport tells the server what the client is actually playing; the
+// server replies with forceTrack or forceResync when it is off.
+type StatusReport struct {
+	Type       string  `json:"type"`
+	Position   float64 `json:"position"`
+	TrackIndex int     `json:"trackIndex"`
+}
+
+// Kick removes another connection from the room. Room owner only.
+type Kick struct {
+	Type           string `json:"type"`
+	TargetClientID string `json:"targetClientID"`
+}
+
+// SkipSilence turns trailing-silence skipping on or off. Room owner only.
+type SkipSilence struct {
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// Love adds the playing track to the sender's favorites.
+type Love struct {
+	Type string `json:"type"`
+}
+
+// NextTrack switches to playlist item TrackIndex. With Auto set (the previous
+// track ended) the server picks the index from the play mode. Room owner only.
+type NextTrack struct {
+	Type       string `json:"type"`
+	TrackIndex int    `json:"trackIndex"`
+	Auto       bool   `json:"auto,omitempty"`
+}
+
+// --- Events (server → client) ---
+
+// HelloEvent answers a Hello.
+type HelloEvent struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`    // protocol version the server speaks
+	MinVersion   int      `json:"minVersion"` // oldest client version accepted
+	Server       string   `json:"server"`
+	Capabilities []string `json:"capabilities"`
+	ClientID     string   `json:"clientID"` // this connection's ID in user lists
+}
+
+// CreatedEvent answers Create.
+type CreatedEvent struct {
+	Type        string       `json:"type"`
+	Success     bool         `json:"success"`
+	RoomCode    string       `json:"roomCode"`
+	IsHost      bool         `json:"isHost"`
+	Username    string       `json:"username"`
+	Role        string       `json:"role"`
+	Users       []ClientInfo `json:"users"`
+	SkipSilence bool         `json:"skipSilence,omitempty"` // starts as the owner's last choice
+}
+
+// JoinedEvent answers Join. It is followed by playlistUpdate and, if a track
+// is loaded, trackChange and play.
+type JoinedEvent struct {
+	Type        string       `json:"type"`
+	Success     bool         `json:"success"`
+	RoomCode    string       `json:"roomCode"`
+	IsHost      bool         `json:"isHost"`
+	ClientCount int          `json:"clientCount"`
+	Audio       *AudioInfo   `json:"audio,omitempty"`
+	Username    string       `json:"username"`
+	Role        string       `json:"role"`
+	Users       []ClientInfo `json:"users"`
+	SkipSilence bool         `json:"skipSilence,omitempty"` // see SkipSilenceEvent
+}
+
+// UserJoinedEvent tells the others in a room that someone joined.
+type UserJoinedEvent struct {
+	Type        string       `json:"type"`
+	ClientCount int          `json:"clientCount"`
+	Username    string       `json:"username"`
+	Users       []ClientInfo `json:"users"`
+}
+
+// UserLeftEvent tells a room that someone left or was kicked.
+type UserLeftEvent struct {
+	Type        string       `json:"type"`
+	ClientCount int          `json:"clientCount"`
+	Users       []ClientInfo `json:"users"`
+}
+
+// HostTransferEvent tells a client it has become the room's host.
+type HostTransferEvent struct {
+	Type        string       `json:"type"`
+	IsHost      bool         `json:"isHost"`
+	ClientCount int          `json:"clientCount"`
+	Users       []ClientInfo `json:"users"`
+}
+
+// KickedEvent tells a client the owner removed it; the connection is closed after.
+type KickedEvent struct {
+	Type string `json:"type"`
+}
+
+// PongEvent answers Ping.
+type PongEvent struct {
+	Type       string `json:"type"`
+	ClientTime int64  `json:"clientTime"` // echoed from the ping
+	ServerTime int64  `json:"serverTime"` // server clock, ms
+}
+
+// PlayEvent starts playback at Position. ScheduledAt, when set, is the server
+// time (ms) at which every client should start, so they start together.
+type PlayEvent struct {
+	Type        string          `json:"type"`
+	Position    float64         `json:"position"`
+	ServerTime  int64           `json:"serverTime"`
+	ScheduledAt int64           `json:"scheduledAt,omitempty"`
+	TrackAudio  *TrackAudioInfo `json:"trackAudio,omitempty"` // lets late joiners load the track
+	TrackIndex  int             `json:"trackIndex"`
+}
+
+// PauseEvent stops playback at Position.
+type PauseEvent struct {
+	Type       string  `json:"type"`
+	Position   float64 `json:"position"`
+	ServerTime int64   `json:"serverTime"`
+}
+
+// SeekEvent moves playback to Position at ScheduledAt.
+type SeekEvent struct {
+	Type        string  `json:"type"`
+	Position    float64 `json:"position"`
+	ServerTime  int64   `json:"serverTime"`
+	ScheduledAt int64   `json:"scheduledAt"`
+}
+
+// SyncTickEvent is the authoritative playback position, sent to listeners
+// every second while the room plays.
+type SyncTickEvent struct {
+	Type       string  `json:"type"`
+	Position   float64 `json:"position"`
+	ServerTime int64   `json:"serverTime"`
+	LyricLine  *int    `json:"lyricLine,omitempty"` // index of the current synced lyric line, -1 before the first
+}
+
+// TrackChangeEvent loads a new track; playback starts with the next play.
+type TrackChangeEvent struct {
+	Type       string          `json:"type"`
+	TrackIndex int             `json:"trackIndex"`
+	TrackAudio *TrackAudioInfo `json:"trackAudio"`
+	ServerTime int64           `json:"serverTime"`
+}
+
+// TrackEndEvent asks the host to advance because the track reached trailing silence.
+type TrackEndEvent struct {
+	Type       string  `json:"type"`
+	TrackIndex int     `json:"trackIndex"`
+	Position   float64 `json:"position"`
+}
+
+// ForceTrackEvent answers a StatusReport on the wrong track; handle it like trackChange.
+type ForceTrackEvent struct {
+	Type       string          `json:"type"`
+	TrackIndex int             `json:"trackIndex"`
+	Position   float64         `json:"position"`
+	ServerTime int64           `json:"serverTime"`
+	TrackAudio *TrackAudioInfo `json:"trackAudio,omitempty"`
+}
+
+// ForceResyncEvent answers a StatusReport that drifted too far from Position.
+type ForceResyncEvent struct {
+	Type       string  `json:"type"`
+	Position   float64 `json:"position"`
+	ServerTime int64   `json:"serverTime"`
+}
+
+// SkipSilenceEvent announces the room's skip-silence setting.
+type SkipSilenceEvent struct {
+	Type    string `json:"type"`
+	Enabled bool   `json:"enabled"`
+}
+
+// LovedEvent answers Love.
+type LovedEvent struct {
+	Type    string `json:"type"`
+	Success bool   `json:"success"`
+	AudioID int64  `json:"audioId"`
+}
+
+// PlaylistUpdateEvent carries the room's whole playlist after any change.
+type PlaylistUpdateEvent struct {
+	Type         string        `json:"type"`
+	PlaylistData *PlaylistData `json:"playlistData"`
+}
+
+// RoomClosedEvent tells the clients of a room that it was closed.
+type RoomClosedEvent struct {
+	Type   string `json:"type"`
+	Error  string `json:"error"`  // message for the user
+	Reason string `json:"reason"` // inactive or owner_changed
+}
+
+// RoleChangedEvent tells a user the site owner changed their role.
+type RoleChangedEvent struct {
+	Type string `json:"type"`
+	Role string `json:"role"`
+}
+
+// ErrorEvent reports a command that failed. Code is stable and meant for
+// programs; Error is a message for people and may change.
+type ErrorEvent struct {
+	Type    string `json:"type"`
+	Error   string `json:"error"`
+	Code    string `json:"code"`
+	Request string `json:"request,omitempty"` // type of the command that failed, if known
+}
+
+// messageSpec registers a message struct under its type name.
+type messageSpec struct {
+	Type string
+	Zero interface{}
+	Doc  string
+}
+
+var commands = []messageSpec{
+	{TypeHello, Hello{}, "Handshake: announce the client's protocol version and capabilities."},
+	{TypeCreate, Create{}, "Create a room with the sender as host."},
+	{TypeJoin, Join{}, "Join a room by code."},
+	{TypePing, Ping{}, "Clock sync request."},
+	{TypePlay, Play{}, "Start playback at a position (seconds)."},
+	{TypePause, Pause{}, "Pause playback."},
+	{TypeSeek, Seek{}, "Seek to a position (seconds)."},
+	{TypeStatusReport, StatusReport{}, "Report the client's actual playback state."},
+	{TypeKick, Kick{}, "Remove a connection from the room."},
+	{TypeSkipSilence, SkipSilence{}, "Turn trailing-silence skipping on or off."},
+	{TypeLove, Love{}, "Favorite the playing track."},
+	{TypeNextTrack, NextTrack{}, "Switch to a playlist item."},
+}
+
+var events = []messageSpec{
+	{TypeHello, HelloEvent{}, "Handshake reply with the server's protocol version and capabilities."},
+	{TypeCreated, CreatedEvent{}, "Room created."},
+	{TypeJoined, JoinedEvent{}, "Room joined."},
+	{TypeUserJoined, UserJoinedEvent{}, "Someone joined the room."},
+	{TypeUserLeft, UserLeftEvent{}, "Someone left the room."},
+	{TypeHostTransfer, HostTransferEvent{}, "The receiver is now the host."},
+	{TypeKicked, KickedEvent{}, "The receiver was removed from the room."},
+	{TypePong, PongEvent{}, "Clock sync reply."},
+	{TypePlay, PlayEvent{}, "Playback started."},
+	{TypePause, PauseEvent{}, "Playback paused."},
+	{TypeSeek, SeekEvent{}, "Playback moved."},
+	{TypeSyncTick, SyncTickEvent{}, "Authoritative position while playing."},
+	{TypeTrackChange, TrackChangeEvent{}, "A new track was loaded."},
+	{TypeTrackEnd, TrackEndEvent{}, "Trailing silence reached; the host should advance."},
+	{TypeForceTrack, ForceTrackEvent{}, "The client is on the wrong track."},
+	{TypeForceResync, ForceResyncEvent{}, "The client drifted too far."},
+	{TypeSkipSilence, SkipSilenceEvent{}, "Skip-silence setting changed."},
+	{TypeLoved, LovedEvent{}, "Track favorited."},
+	{TypePlaylistUpdate, PlaylistUpdateEvent{}, "The room's playlist changed."},
+	{TypeRoomClosed, RoomClosedEvent{}, "The room was closed."},
+	{TypeRoleChanged, RoleChangedEvent{}, "The receiver's site role changed."},
+	{TypeError, ErrorEvent{}, "A command failed."},
+}
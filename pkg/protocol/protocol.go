@@ -0,0 +1,166 @@
+// Package protocol defines the ListenTogether WebSocket protocol: the JSON
+// messages exchanged over /ws, the hello handshake that negotiates the
+// protocol version, and a JSON Schema describing both directions.
+//
+// Every message is a JSON object whose "type" field names it. Clients send
+// commands (Hello, Join, Play, ...); the server sends events (HelloEvent,
+// JoinedEvent, PlayEvent, ...). Receivers must ignore fields they do not know,
+// so adding an optional field is not a breaking change. Removing or renaming a
+// field, or changing its meaning, bumps Version.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	// Version is the protocol version this server speaks.
+	Version = 1
+	// MinVersion is the oldest client version still accepted in a hello.
+	MinVersion = 1
+)
+
+// Capabilities lists the optional features the server supports, sent in the
+// hello reply. Clients should check for a capability before relying on it.
+var Capabilities = []string{
+	"autoNext",     // nextTrack with auto=true lets the server pick the index
+	"love",         // love command favorites the playing track
+	"lyricLine",    // syncTick carries the current synced lyric line
+	"skipSilence",  // trackEnd is sent at the start of trailing silence
+	"statusReport", // statusReport answered with forceTrack/forceResync
+}
+
+// Error codes carried by ErrorEvent.Code.
+const (
+	CodeInvalidMessage     = "invalid_message"     // not JSON, or a field has the wrong type
+	CodeUnknownType        = "unknown_type"        // the type is not a known command
+	CodeUnsupportedVersion = "unsupported_version" // hello with a version below MinVersion
+	CodeRateLimited        = "rate_limited"        // too many messages; the connection is closed
+	CodeForbidden          = "forbidden"           // the user may not do this
+	CodeNotFound           = "not_found"           // room or user does not exist
+	CodeInvalidArgument    = "invalid_argument"    // e.g. a position outside the track
+	CodeLimitReached       = "limit_reached"       // room full, or too many rooms
+	CodeNoTrack            = "no_track"            // nothing is playing
+	CodeInternal           = "internal"
+)
+
+// AudioInfo describes the room's audio for clients of the original single-file API.
+type AudioInfo struct {
+	Filename     string   `json:"filename"`
+	Duration     float64  `json:"duration"`
+	SegmentCount int      `json:"segmentCount"`
+	SegmentTime  float64  `json:"segmentTime"`
+	Segments     []string `json:"segments"`
+}
+
+// TrackAudioInfo is the complete audio metadata broadcast via trackChange.
+// Clients use this directly without needing to fetch the file list API.
+type TrackAudioInfo struct {
+	AudioID      int64    `json:"audio_id"`
+	OwnerID      int64    `json:"owner_id"`
+	AudioUUID    string   `json:"audio_uuid"`
+	Filename     string   `json:"filename"`
+	Title        string   `json:"title"`
+	Artist       string   `json:"artist"`
+	OriginalName string   `json:"original_name"`
+	Duration     float64  `json:"duration"`
+	Qualities    []string `json:"qualities"`
+	EffectiveEnd float64  `json:"effective_end,omitempty"` // detected start of trailing silence, 0 if unknown
+	SegmentToken string   `json:"segment_token,omitempty"` // signed ?st= token for segment URLs, set per send
+	TokenExpires int64    `json:"token_expires,omitempty"`
+}
+
+// ClientInfo is one connection in a room's user list.
+type ClientInfo struct {
+	ClientID string `json:"clientID"`
+	Username string `json:"username"`
+	UID      int64  `json:"uid"`
+	IsHost   bool   `json:"isHost"`
+	// ListenOnly marks a listener on the SSE event stream. It can be kicked
+	// like any client but can't control playback.
+	ListenOnly bool `json:"listenOnly,omitempty"`
+}
+
+// Playlist is a room's playlist header.
+type Playlist struct {
+	ID           int64     `json:"id"`
+	RoomCode     string    `json:"room_code"`
+	CreatedBy    int64     `json:"created_by"`
+	PlayMode     string    `json:"play_mode"` // sequential, repeat_one, repeat_all, shuffle
+	CurrentIndex int       `json:"current_index"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PlaylistItem is one track in a room's playlist.
+type PlaylistItem struct {
+	ID           int64   `json:"id"`
+	PlaylistID   int64   `json:"playlist_id"`
+	AudioID      int64   `json:"audio_id"`
+	Position     int     `json:"position"`
+	Title        string  `json:"title"`
+	Artist       string  `json:"artist"`
+	Duration     float64 `json:"duration"`
+	Filename     string  `json:"filename"`
+	OriginalName string  `json:"original_name"`
+	OwnerID      int64   `json:"owner_id"`
+	Qualities    string  `json:"qualities"` // JSON array of quality names
+}
+
+// PlaylistData is the full playlist as sent in playlistUpdate.
+type PlaylistData struct {
+	Playlist *Playlist      `json:"playlist"`
+	Items    []PlaylistItem `json:"items"`
+}
+
+// envelope is the part every message shares.
+type envelope struct {
+	Type string `json:"type"`
+}
+
+// UnknownTypeError is returned by Decode for a type it has no struct for.
+type UnknownTypeError struct {
+	Type string
+}
+
+func (e *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown message type %q", e.Type)
+}
+
+// PeekType returns the type field of a raw message, or "" if it has none.
+func PeekType(data []byte) string {
+	var env envelope
+	json.Unmarshal(data, &env)
+	return env.Type
+}
+
+// DecodeCommand decodes a message sent by a client into a pointer to its
+// command struct, e.g. *Join.
+func DecodeCommand(data []byte) (interface{}, error) {
+	return decode(commands, data)
+}
+
+// DecodeEvent decodes a message sent by the server into a pointer to its
+// event struct, e.g. *PlayEvent.
+func DecodeEvent(data []byte) (interface{}, error) {
+	return decode(events, data)
+}
+
+func decode(specs []messageSpec, data []byte) (interface{}, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	for _, s := range specs {
+		if s.Type == env.Type {
+			v := reflect.New(reflect.TypeOf(s.Zero)).Interface()
+			if err := json.Unmarshal(data, v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		}
+	}
+	return nil, &UnknownTypeError{Type: env.Type}
+}
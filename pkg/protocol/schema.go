@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Schema returns a JSON Schema (draft 2020-12) describing every message.
+// Each message and shared type is under $defs; x-commands and x-events map
+// type names to their definitions, and the root matches any message.
+func Schema() map[string]interface{} {
+	g := &schemaGen{defs: make(map[string]interface{})}
+	cmds := make(map[string]interface{})
+	evts := make(map[string]interface{})
+	var all []interface{}
+	for _, list := range []struct {
+		specs  []messageSpec
+		prefix string
+		index  map[string]interface{}
+	}{{commands, "command.", cmds}, {events, "event.", evts}} {
+		for _, s := range list.specs {
+			name := list.prefix + s.Type
+			def := g.object(reflect.TypeOf(s.Zero), s.Type)
+			def["title"] = reflect.TypeOf(s.Zero).Name()
+			def["description"] = s.Doc
+			g.defs[name] = def
+			ref := map[string]interface{}{"$ref": "#/$defs/" + name}
+			list.index[s.Type] = ref
+			all = append(all, ref)
+		}
+	}
+	return map[string]interface{}{
+		"$schema":        "https://json-schema.org/draft/2020-12/schema",
+		"$id":            fmt.Sprintf("listen-together/protocol/v%d", Version),
+		"title":          "ListenTogether WebSocket protocol",
+		"x-version":      Version,
+		"x-min-version":  MinVersion,
+		"x-capabilities": Capabilities,
+		"x-commands":     cmds,
+		"x-events":       evts,
+		"oneOf":          all,
+		"$defs":          g.defs,
+	}
+}
+
+type schemaGen struct {
+	defs map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// object describes struct type t. typeName, if set, pins the type field.
+func (g *schemaGen) object(t reflect.Type, typeName string) map[string]interface{} {
+	props := make(map[string]interface{})
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if name == "type" && typeName != "" {
+			props[name] = map[string]interface{}{"const": typeName}
+		} else {
+			props[name] = g.schema(f.Type)
+		}
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": props, "required": required}
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = nil // reserve against recursion
+			g.defs[t.Name()] = g.object(t, "")
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
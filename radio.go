@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xingzihai/listen-together/internal/audio"
+	"github.com/xingzihai/listen-together/internal/auth"
+	"github.com/xingzihai/listen-together/internal/library"
+	"github.com/xingzihai/listen-together/internal/room"
+)
+
+// Room radio: /radio/{code}.mp3 (or .ogg) is an endless Icecast-style stream
+// of whatever the room is playing, for players that can't run the web client.
+// Each room and format has one station: a pacer decodes the current track to
+// PCM in step with the room clock (silence while paused or between tracks) and
+// feeds a single encoder whose output is fanned out to every listener.
+
+const (
+	radioTick         = 100 * time.Millisecond
+	radioLead         = 1.0 // seconds of PCM written ahead of real time
+	radioMaxDrift     = 2.0 // seconds before the decoder is restarted at the room position
+	radioIdleGrace    = 10 * time.Second
+	radioMaxListeners = 32
+	radioChunkSize    = 4096
+	icyMetaInt        = 16000
+
+	defaultRadioTokenTTL = 30 * 24 * time.Hour
+	maxRadioTokenTTL     = 365 * 24 * time.Hour
+)
+
+type radioHub struct {
+	manager  *room.Manager
+	lib      *library.LibraryHandlers
+	mu       sync.Mutex
+	stations map[string]*radioStation
+}
+
+func newRadioHub(manager *room.Manager, lib *library.LibraryHandlers) *radioHub {
+	return &radioHub{manager: manager, lib: lib, stations: make(map[string]*radioStation)}
+}
+
+func (h *radioHub) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/radio/", h.ServeRadio)
+	mux.HandleFunc("/api/radio/", func(w http.ResponseWriter, r *http.Request) {
+		auth.AuthMiddleware(http.HandlerFunc(h.GetRadioURLs)).ServeHTTP(w, r)
+	})
+}
+
+// ServeRadio handles GET /radio/{code}[.mp3|.ogg][?format=][&token=]. Without
+// a token the caller must be logged in and in the room.
+func (h *radioHub) ServeRadio(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/radio/"), "/")
+	format := r.URL.Query().Get("format")
+	for _, f := range []string{audio.LiveMP3, audio.LiveOgg} {
+		if c, ok := strings.CutSuffix(code, "."+f); ok {
+			code, format = c, f
+		}
+	}
+	if format == "" {
+		format = audio.LiveMP3
+	}
+	if format != audio.LiveMP3 && format != audio.LiveOgg {
+		jsonError(w, "不支持的格式", 400)
+		return
+	}
+	rm := h.manager.GetRoom(code)
+	if token := r.URL.Query().Get("token"); token != "" {
+		if !auth.VerifyRadioToken(token, code) {
+			jsonError(w, "链接无效或已过期", 403)
+			return
+		}
+	} else if user := auth.ExtractUserFromRequest(r); user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	} else if rm != nil && !rm.HasUser(user.UserID) {
+		jsonError(w, "您不在该房间中", 403)
+		return
+	}
+	if rm == nil {
+		jsonError(w, "房间不存在", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", audio.LiveContentType(format))
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", "ListenTogether "+code)
+	w.Header().Set("icy-pub", "0")
+	withMeta := r.Header.Get("Icy-MetaData") == "1"
+	if withMeta {
+		w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInt))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	st, l, err := h.listen(rm, format)
+	if err != nil {
+		if errors.Is(err, errRadioFull) {
+			jsonError(w, "收听人数已满", 503)
+		} else {
+			log.Printf("[radio] %s/%s: %v", code, format, err)
+			jsonError(w, "电台不可用", 503)
+		}
+		return
+	}
+	defer st.unsubscribe(l)
+
+	flusher, _ := w.(http.Flusher)
+	var out io.Writer = w
+	if withMeta {
+		out = &icyWriter{w: w, left: icyMetaInt, title: st.Title}
+	}
+	w.WriteHeader(http.StatusOK)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case b, ok := <-l:
+			if !ok {
+				return
+			}
+			if _, err := out.Write(b); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// GetRadioURLs handles GET /api/radio/{code}[?expires_in=seconds]: signed
+// stream URLs for players that can't log in.
+func (h *radioHub) GetRadioURLs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "method not allowed", 405)
+		return
+	}
+	user := auth.GetUser(r)
+	if user == nil {
+		jsonError(w, "unauthorized", 401)
+		return
+	}
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/radio/"), "/")
+	rm := h.manager.GetRoom(code)
+	if rm == nil {
+		jsonError(w, "房间不存在", 404)
+		return
+	}
+	if !rm.HasUser(user.UserID) {
+		jsonError(w, "您不在该房间中", 403)
+		return
+	}
+	ttl := defaultRadioTokenTTL
+	if v := r.URL.Query().Get("expires_in"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 || time.Duration(n)*time.Second > maxRadioTokenTTL {
+			jsonError(w, "无效的有效期", 400)
+			return
+		}
+		ttl = time.Duration(n) * time.Second
+	}
+	exp := time.Now().Add(ttl)
+	base := library.PublicBaseURL(r) + "/radio/" + code
+	token := auth.SignRadioToken(code, exp)
+	jsonOK(w, map[string]interface{}{
+		"mp3_url":    base + ".mp3?token=" + token,
+		"ogg_url":    base + ".ogg?token=" + token,
+		"expires_at": exp.Unix(),
+	})
+}
+
+var errRadioFull = errors.New("radio station full")
+
+// listen subscribes to the room's station for format, starting it if needed.
+func (h *radioHub) listen(rm *room.Room, format string) (*radioStation, chan []byte, error) {
+	key := rm.Code + "/" + format
+	for {
+		h.mu.Lock()
+		st := h.stations[key]
+		if st == nil || st.rm != rm {
+			var err error
+			if st, err = h.startStation(rm, format); err != nil {
+				h.mu.Unlock()
+				return nil, nil, err
+			}
+			h.stations[key] = st
+		}
+		h.mu.Unlock()
+		l, err := st.subscribe()
+		if err != errRadioClosed {
+			return st, l, err
+		}
+		// Lost the race with an idle shutdown; start a fresh station.
+		h.mu.Lock()
+		if h.stations[key] == st {
+			delete(h.stations, key)
+		}
+		h.mu.Unlock()
+	}
+}
+
+var errRadioClosed = errors.New("radio station closed")
+
+type radioStation struct {
+	hub    *radioHub
+	key    string
+	rm     *room.Room
+	format string
+	enc    *audio.LiveEncoder
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[chan []byte]bool
+	idleSince time.Time
+	header    []byte // Ogg header pages, sent to each new listener first
+	title     string
+}
+
+// startStation starts the encoder, pacer and fan-out of a new station. Caller
+// holds h.mu.
+func (h *radioHub) startStation(rm *room.Room, format string) (*radioStation, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	enc, err := audio.StartEncoder(ctx, format)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	st := &radioStation{
+		hub:       h,
+		key:       rm.Code + "/" + format,
+		rm:        rm,
+		format:    format,
+		enc:       enc,
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[chan []byte]bool),
+		idleSince: time.Now(),
+	}
+	go st.pace()
+	go st.fanOut()
+	return st, nil
+}
+
+func (st *radioStation) subscribe() (chan []byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil, errRadioClosed
+	}
+	if len(st.listeners) >= radioMaxListeners {
+		return nil, errRadioFull
+	}
+	l := make(chan []byte, 64)
+	if len(st.header) > 0 {
+		l <- st.header
+	}
+	st.listeners[l] = true
+	return l, nil
+}
+
+func (st *radioStation) unsubscribe(l chan []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.listeners[l] {
+		delete(st.listeners, l)
+		close(l)
+	}
+	if len(st.listeners) == 0 {
+		st.idleSince = time.Now()
+	}
+}
+
+// broadcast sends b to every listener, dropping those that can't keep up.
+func (st *radioStation) broadcast(b []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for l := range st.listeners {
+		select {
+		case l <- b:
+		default:
+			delete(st.listeners, l)
+			close(l)
+		}
+	}
+	if len(st.listeners) == 0 && st.idleSince.IsZero() {
+		st.idleSince = time.Now()
+	} else if len(st.listeners) > 0 {
+		st.idleSince = time.Time{}
+	}
+}
+
+// idle reports whether the station has had no listeners for the grace period.
+func (st *radioStation) idle() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.listeners) == 0 && !st.idleSince.IsZero() && time.Since(st.idleSince) > radioIdleGrace
+}
+
+// Title returns "Artist - Title" of the track on air.
+func (st *radioStation) Title() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.title
+}
+
+func (st *radioStation) setTrack(ta *room.TrackAudioInfo) {
+	title := ""
+	if ta != nil {
+		title = ta.Title
+		if title == "" {
+			title = ta.OriginalName
+		}
+		if ta.Artist != "" {
+			title = ta.Artist + " - " + title
+		}
+	}
+	st.mu.Lock()
+	st.title = title
+	st.mu.Unlock()
+}
+
+func (st *radioStation) close() {
+	st.cancel()
+	st.mu.Lock()
+	st.closed = true
+	for l := range st.listeners {
+		delete(st.listeners, l)
+		close(l)
+	}
+	st.mu.Unlock()
+	st.hub.mu.Lock()
+	if st.hub.stations[st.key] == st {
+		delete(st.hub.stations, st.key)
+	}
+	st.hub.mu.Unlock()
+}
+
+// pace writes PCM to the encoder at real-time speed, following the room.
+func (st *radioStation) pace() {
+	defer st.close()
+	defer st.enc.In.Close()
+
+	const bps = audio.PCMBytesPerSecond
+	start := time.Now()
+	var written int64
+	var track, failed *room.TrackAudioInfo
+	var src *pcmSource
+	defer func() {
+		if src != nil {
+			src.stop()
+		}
+	}()
+
+	ticker := time.NewTicker(radioTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if st.hub.manager.GetRoom(st.rm.Code) != st.rm || st.idle() {
+			return
+		}
+
+		st.rm.Mu.RLock()
+		ta := st.rm.TrackAudio
+		state := st.rm.State
+		st.rm.Mu.RUnlock()
+		pos := st.rm.CurrentPosition()
+
+		elapsed := time.Since(start).Seconds()
+		target := int64((elapsed+radioLead)*bps) &^ 3
+		n := target - written
+		if n <= 0 {
+			continue
+		}
+		// After a stall, skip ahead rather than bursting.
+		if n > 2*bps {
+			written = target - 2*bps
+			n = 2 * bps
+		}
+		// Room position at the moment the next byte we write will be heard.
+		want := pos
+		if state == room.StatePlaying {
+			want += float64(written)/bps - elapsed
+		}
+
+		if ta != track {
+			if src != nil {
+				src.stop()
+				src = nil
+			}
+			track = ta
+			st.setTrack(ta)
+		}
+		if src != nil && src.failed.Load() {
+			src.stop()
+			src, failed = nil, ta
+		}
+		if state == room.StatePlaying && ta != nil && ta != failed && want < ta.Duration {
+			if src == nil || ((src.started() || src.ended) && math.Abs(src.pos()-want) > radioMaxDrift) {
+				if src != nil {
+					src.stop()
+				}
+				src = st.startSource(ta.AudioID, math.Max(want, 0))
+			}
+		}
+
+		buf := make([]byte, n)
+		if state == room.StatePlaying && src != nil {
+			src.read(buf)
+		}
+		if _, err := st.enc.In.Write(buf); err != nil {
+			return
+		}
+		written += n
+	}
+}
+
+// fanOut reads the encoder and broadcasts its output. Ogg is split on page
+// boundaries so listeners always start on a whole page after the headers.
+func (st *radioStation) fanOut() {
+	defer st.enc.Wait()
+	defer st.cancel()
+	defer st.enc.Out.Close()
+	if st.format != audio.LiveOgg {
+		for {
+			b := make([]byte, radioChunkSize)
+			n, err := st.enc.Out.Read(b)
+			if n > 0 {
+				st.broadcast(b[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	br := bufio.NewReader(st.enc.Out)
+	inHeader := true
+	for {
+		page, granule, err := readOggPage(br)
+		if err != nil {
+			return
+		}
+		if inHeader && granule == 0 {
+			st.mu.Lock()
+			st.header = append(st.header, page...)
+			st.mu.Unlock()
+		} else {
+			inHeader = false
+		}
+		st.broadcast(page)
+	}
+}
+
+// readOggPage reads one Ogg page and returns it with its granule position.
+func readOggPage(br *bufio.Reader) ([]byte, uint64, error) {
+	hdr := make([]byte, 27)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, 0, err
+	}
+	if string(hdr[:4]) != "OggS" {
+		return nil, 0, errors.New("lost ogg sync")
+	}
+	segs := make([]byte, hdr[26])
+	if _, err := io.ReadFull(br, segs); err != nil {
+		return nil, 0, err
+	}
+	size := 0
+	for _, s := range segs {
+		size += int(s)
+	}
+	page := make([]byte, 0, len(hdr)+len(segs)+size)
+	page = append(append(page, hdr...), segs...)
+	body := make([]byte, size)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, 0, err
+	}
+	return append(page, body...), binary.LittleEndian.Uint64(hdr[6:14]), nil
+}
+
+// pcmSource decodes one track from an offset in the background.
+type pcmSource struct {
+	cancel   context.CancelFunc
+	data     chan []byte
+	pending  []byte
+	offset   float64
+	consumed int64
+	ended    bool
+	failed   atomic.Bool
+}
+
+func (st *radioStation) startSource(audioID int64, pos float64) *pcmSource {
+	ctx, cancel := context.WithCancel(st.ctx)
+	s := &pcmSource{cancel: cancel, data: make(chan []byte, 16), offset: pos}
+	go func() {
+		defer close(s.data)
+		af, err := globalDB.GetAudioFileByID(audioID)
+		if err != nil {
+			s.failed.Store(true)
+			return
+		}
+		p, err := st.hub.lib.TrackSourcePath(af)
+		if err != nil {
+			log.Printf("[radio] %s: source for %d: %v", st.key, audioID, err)
+			s.failed.Store(true)
+			return
+		}
+		rc, err := audio.DecodePCM(ctx, p, pos)
+		if err != nil {
+			log.Printf("[radio] %s: decode %d: %v", st.key, audioID, err)
+			s.failed.Store(true)
+			return
+		}
+		defer rc.Close()
+		for {
+			b := make([]byte, 32<<10)
+			n, err := rc.Read(b)
+			if n > 0 {
+				select {
+				case s.data <- b[:n]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *pcmSource) stop() { s.cancel() }
+
+// read copies whole frames of decoded PCM into p without blocking and
+// returns how many bytes it filled; the rest of p stays silent.
+func (s *pcmSource) read(p []byte) int {
+	n := 0
+	for n < len(p) {
+		if len(s.pending) < 4 {
+			select {
+			case b, ok := <-s.data:
+				if !ok {
+					s.ended = true
+					s.consumed += int64(n)
+					return n
+				}
+				s.pending = append(s.pending, b...)
+				continue
+			default:
+				s.consumed += int64(n)
+				return n
+			}
+		}
+		c := copy(p[n:], s.pending[:len(s.pending)&^3])
+		s.pending = s.pending[c:]
+		n += c
+	}
+	s.consumed += int64(n)
+	return n
+}
+
+func (s *pcmSource) started() bool { return s.consumed > 0 }
+
+// pos is the track position of the next byte read returns.
+func (s *pcmSource) pos() float64 {
+	return s.offset + float64(s.consumed)/audio.PCMBytesPerSecond
+}
+
+// icyWriter interleaves Shoutcast metadata every icyMetaInt bytes of audio.
+type icyWriter struct {
+	w         io.Writer
+	left      int
+	title     func() string
+	sent      string
+	announced bool
+}
+
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := min(len(p), iw.left)
+		if _, err := iw.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+		p = p[n:]
+		iw.left -= n
+		if iw.left > 0 {
+			continue
+		}
+		meta := []byte{0}
+		if t := iw.title(); t != iw.sent || !iw.announced {
+			meta = icyMetadata(t)
+			iw.sent, iw.announced = t, true
+		}
+		if _, err := iw.w.Write(meta); err != nil {
+			return 0, err
+		}
+		iw.left = icyMetaInt
+	}
+	return total, nil
+}
+
+// icyMetadata builds a metadata block: a length byte (in 16-byte units)
+// followed by StreamTitle, zero padded.
+func icyMetadata(title string) []byte {
+	if r := []rune(title); len(r) > 200 {
+		title = string(r[:200])
+	}
+	s := "StreamTitle='" + strings.ReplaceAll(title, "'", "’") + "';"
+	n := (len(s) + 15) / 16
+	b := make([]byte, 1+n*16)
+	b[0] = byte(n)
+	copy(b[1:], s)
+	return b
+}
@@ -3,10 +3,11 @@ let ws, roomCode, isHost = false, audioInfo = null, pausedPosition = 0;
 let reconnectAttempts = 0, reconnectDelay = 3000;
 const MAX_RECONNECT_ATTEMPTS = 10, MAX_RECONNECT_DELAY = 60000;
 let roomUsers = [], myClientID = null;
-let playlist = null, playlistItems = [], currentTrackIndex = -1, playMode = 'sequential';
+let playlist = null, playlistItems = [], currentTrackIndex = -1, playMode = 'sequential', skipSilence = false;
 let trackLoading = false, pendingPlay = null;
 let trackChangeGen = 0;
 let deviceKicked = false;
+let currentAudioId = null;
 
 // --- Cover Art ---
 function updateCoverArt(ownerID, audioUUID) {
@@ -77,7 +78,8 @@ function renderAudiencePanel() {
     list.innerHTML = roomUsers.map(u => {
         const hostBadge = u.isHost ? '<span class="host-badge">👑</span>' : '';
         const kickBtn = (isHost && !u.isHost) ? `<button class="btn-kick" data-cid="${escapeHtml(u.clientID)}">踢出</button>` : '';
-        return `<div class="audience-row"><span class="audience-info">${hostBadge}${escapeHtml(u.username)} <span class="audience-uid">(UID:${String(u.uid).padStart(5,'0')})</span></span>${kickBtn}</div>`;
+        const listenOnly = u.listenOnly ? ' <span class="audience-uid">[仅收听]</span>' : '';
+        return `<div class="audience-row"><span class="audience-info">${hostBadge}${escapeHtml(u.username)} <span class="audience-uid">(UID:${String(u.uid).padStart(5,'0')})</span>${listenOnly}</span>${kickBtn}</div>`;
     }).join('');
     list.querySelectorAll('.btn-kick').forEach(btn => {
         btn.onclick = () => {
@@ -108,6 +110,24 @@ function showScreen(id) {
     // Show/hide bottom player bar when in room
     const bar = $('bottomBar');
     if (bar) { if (id === 'room') bar.classList.remove('hidden'); else bar.classList.add('hidden'); }
+    if (id === 'home') loadInvites();
+    if (id === 'room') {
+        $('inviteBtn').classList.toggle('hidden', !isHost);
+        $('importPlaylistBtn').classList.toggle('hidden', !isHost);
+        updateSkipSilenceBtn();
+    }
+}
+
+// Open rooms the user was invited to, directly or through a group
+async function loadInvites() {
+    const list = $('invitesList');
+    try {
+        const res = await fetch('/api/rooms/invites', { credentials: 'include' });
+        const invites = res.ok ? await res.json() : [];
+        list.innerHTML = invites.map(inv => `<button class="w-full px-4 py-3 bg-white border border-gray-200 rounded-lg text-sm text-left hover:border-emerald-500 transition-all" data-code="${escapeHtml(inv.room_code)}">
+            ✉️ ${escapeHtml(inv.inviter_name || inv.owner_name)} 邀请你加入 <b class="tracking-widest text-emerald-600">${escapeHtml(inv.room_code)}</b>${inv.group_name ? ` <span class="text-gray-400">· ${escapeHtml(inv.group_name)}</span>` : ''} <span class="text-gray-400">· ${parseInt(inv.client_count)}人</span></button>`).join('');
+        list.querySelectorAll('button').forEach(b => b.onclick = () => { $('roomCodeInput').value = b.dataset.code; $('joinBtn').click(); });
+    } catch (e) { list.innerHTML = ''; }
 }
 
 function formatTime(s) {
@@ -119,7 +139,11 @@ function formatTime(s) {
 function connect(onOpen) {
     const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
     ws = new WebSocket(`${protocol}//${location.host}/ws`);
-    ws.onopen = () => { console.log('WS connected'); reconnectAttempts = 0; reconnectDelay = 3000; if (onOpen) onOpen(); };
+    ws.onopen = () => {
+        console.log('WS connected'); reconnectAttempts = 0; reconnectDelay = 3000;
+        ws.send(JSON.stringify({ type: 'hello', version: 1, client: 'web' }));
+        if (onOpen) onOpen();
+    };
     ws.onmessage = e => handleMessage(JSON.parse(e.data));
     ws.onclose = (ev) => {
         if (deviceKicked) return;
@@ -181,7 +205,7 @@ async function handleMessage(msg) {
             updatePlayButton(false);
             // fall through to shared logic
         case 'joined':
-            roomCode = msg.roomCode; isHost = msg.isHost;
+            roomCode = msg.roomCode; isHost = msg.isHost; skipSilence = !!msg.skipSilence;
             if (msg.users) { roomUsers = msg.users; renderAudiencePanel(); }
             location.hash = roomCode;
             $('displayCode').textContent = roomCode;
@@ -233,6 +257,7 @@ async function handleMessage(msg) {
             isHost = true;
             $('userCount').textContent = msg.clientCount;
             $('syncStatus').textContent = 'You are now the host';
+            updateSkipSilenceBtn();
             if (msg.users) { roomUsers = msg.users; renderAudiencePanel(); }
             break;
         case 'roleChanged':
@@ -276,6 +301,9 @@ async function handleMessage(msg) {
             alert(msg.error || '你的账号已在其他设备连接');
             break;
         case 'error': alert(msg.error); break;
+        case 'loved':
+            if (currentAudioId === msg.audioId) $('loveBtn').textContent = '❤️';
+            break;
         case 'playlistUpdate':
             if (msg.playlistData) {
                 const oldItems = playlistItems;
@@ -295,6 +323,13 @@ async function handleMessage(msg) {
             // Server sends full audio metadata — use it directly
             await handleTrackChange(msg);
             break;
+        case 'skipSilence':
+            skipSilence = msg.enabled; updateSkipSilenceBtn();
+            break;
+        case 'trackEnd':
+            // Server detected trailing silence (skipSilence on) — advance early
+            if (msg.trackIndex === currentTrackIndex) onTrackEnd();
+            break;
     }
 }
 
@@ -474,6 +509,17 @@ $('copyInviteLink').onclick = () => {
     setTimeout(() => $('copyInviteLink').textContent = '📎 复制邀请链接', 1500);
 };
 
+$('inviteBtn').onclick = async () => {
+    const target = prompt('输入用户UID，或 g:群组ID 邀请整个群组');
+    if (!target) return;
+    const m = target.trim().match(/^g:(\d+)$/i);
+    const body = m ? { group_id: parseInt(m[1]) } : { user_uid: parseInt(target) };
+    const res = await authFetch(`/api/room/${roomCode}/invites`, { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(body) });
+    if (!res.ok) { const d = await res.json().catch(() => ({})); alert(d.error || '邀请失败'); return; }
+    $('inviteBtn').textContent = '✅ 已邀请';
+    setTimeout(() => $('inviteBtn').textContent = '✉️ 邀请用户或群组', 1500);
+};
+
 // --- Playlist Functions ---
 
 async function loadPlaylist() {
@@ -528,6 +574,24 @@ function updatePlayModeBtn() {
     else btn.textContent = '🔁';
 }
 
+// Only the host sees the toggle; the server broadcasts the new state to everyone
+function updateSkipSilenceBtn() {
+    const btn = $('skipSilenceBtn');
+    btn.classList.toggle('hidden', !isHost);
+    btn.classList.toggle('text-emerald-500', skipSilence);
+    btn.classList.toggle('text-gray-500', !skipSilence);
+    btn.title = skipSilence ? '跳过结尾静音：已开启' : '跳过结尾静音：已关闭';
+}
+
+$('skipSilenceBtn').onclick = () => {
+    if (!isHost || !ws || ws.readyState !== WebSocket.OPEN) return;
+    ws.send(JSON.stringify({ type: 'skipSilence', enabled: !skipSilence }));
+};
+
+$('loveBtn').onclick = () => {
+    if (ws && ws.readyState === WebSocket.OPEN && currentAudioId) ws.send(JSON.stringify({ type: 'love' }));
+};
+
 $('playModeBtn').onclick = async () => {
     if (!isHost || !roomCode) return;
     const modes = ['sequential', 'shuffle', 'repeat_one'];
@@ -544,6 +608,8 @@ $('playModeBtn').onclick = async () => {
 async function handleTrackChange(msg, isJoinRestore) {
     const ta = msg.trackAudio;
     if (!ta) return;
+    if (currentAudioId !== ta.audio_id) $('loveBtn').textContent = '🤍';
+    currentAudioId = ta.audio_id;
 
     // Increment generation counter to invalidate any in-flight async from previous calls
     const gen = ++trackChangeGen;
@@ -583,7 +649,8 @@ async function handleTrackChange(msg, isJoinRestore) {
             qualities: qualities,
             ownerID: data.owner_id || ta.owner_id,
             audioID: ta.audio_id,
-            audioUUID: data.audio_uuid || ta.audio_uuid
+            audioUUID: data.audio_uuid || ta.audio_uuid,
+            segmentToken: data.segment_token || ta.segment_token
         };
         window.audioPlayer._trackSegBase = null;
         await setupAudio();
@@ -659,10 +726,57 @@ function onTrackEnd() {
         if (nextIdx >= playlistItems.length) nextIdx = 0;
     }
     if (nextIdx >= 0 && ws) {
-        ws.send(JSON.stringify({ type: 'nextTrack', trackIndex: nextIdx }));
+        // auto: the server picks the index itself (rating-weighted in shuffle mode)
+        ws.send(JSON.stringify({ type: 'nextTrack', trackIndex: nextIdx, auto: true }));
     }
 }
 
+// Playlist files: export carries signed stream URLs; import matches entries against the library
+$('exportPlaylistBtn').onclick = () => {
+    if (roomCode) location.href = `/api/room/${roomCode}/playlist/export?format=m3u8`;
+};
+
+$('importPlaylistInput').onchange = async (e) => {
+    const file = e.target.files[0];
+    e.target.value = '';
+    if (!file || !roomCode) return;
+    const fd = new FormData();
+    fd.append('file', file);
+    const res = await authFetch(`/api/room/${roomCode}/playlist/import`, { method: 'POST', body: fd });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) { alert(data.error || '导入失败'); return; }
+    let msg = `共 ${data.total} 首，已匹配 ${data.matched.length} 首`;
+    if (data.unmatched.length) {
+        msg += `，未匹配 ${data.unmatched.length} 首：\n` + data.unmatched.slice(0, 15).map(u => [u.entry.artist, u.entry.title].filter(Boolean).join(' - ')).join('\n');
+        if (data.unmatched.length > 15) msg += '\n…';
+    }
+    alert(msg);
+};
+
+// Smart playlists: evaluated on the server when loaded into the room playlist
+async function loadSmartPlaylists() {
+    const row = $('smartLoadRow');
+    try {
+        const res = await authFetch('/api/library/smart');
+        const list = res.ok ? await res.json() : [];
+        row.classList.toggle('hidden', !list.length);
+        $('smartSelect').innerHTML = list.map(sp => `<option value="${sp.id}">${escapeHtml(sp.name)}</option>`).join('');
+    } catch { row.classList.add('hidden'); }
+}
+
+$('smartLoadBtn').onclick = async () => {
+    const id = parseInt($('smartSelect').value);
+    if (!id || !roomCode) return;
+    const res = await authFetch(`/api/room/${roomCode}/playlist/load`, {
+        method: 'POST', headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ smart_id: id, replace: true })
+    });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) { alert(data.error || '载入失败'); return; }
+    $('smartLoadBtn').textContent = `✓ ${data.added} 首`;
+    setTimeout(() => $('smartLoadBtn').textContent = '载入智能歌单', 1500);
+};
+
 // Library modal
 $('addFromLibBtn').onclick = async () => {
     if (!isHost) return;
@@ -672,6 +786,7 @@ $('addFromLibBtn').onclick = async () => {
     const empty = $('libraryEmpty');
     list.innerHTML = '<div style="text-align:center;padding:20px;color:var(--text-muted)">加载中...</div>';
     empty.style.display = 'none';
+    loadSmartPlaylists();
     try {
         const res = await authFetch('/api/library/files?accessible=true');
         const files = await res.json();
@@ -32,6 +32,7 @@ const Auth = {
         this.user = user;
         document.getElementById('loginScreen').classList.remove('active');
         document.getElementById('home').classList.add('active');
+        if (typeof loadInvites === 'function') loadInvites();
 
         // Role badge
         let badge = '';
@@ -210,6 +211,9 @@ document.addEventListener('DOMContentLoaded', () => {
                 document.getElementById('settingsCreatedAt').textContent = d.toLocaleString('zh-CN');
             }
         } catch (e) {}
+        loadSubsonic();
+        loadScrobbling();
+        loadAPITokens();
     };
     document.getElementById('settingsClose').onclick = () => {
         document.getElementById('settingsOverlay').classList.add('hidden');
@@ -218,6 +222,166 @@ document.addEventListener('DOMContentLoaded', () => {
         if (e.target === e.currentTarget) e.currentTarget.classList.add('hidden');
     };
 
+    // Subsonic app password
+    function renderSubsonic(data) {
+        const info = document.getElementById('subsonicInfo');
+        const revoke = document.getElementById('subsonicRevokeBtn');
+        const gen = document.getElementById('subsonicGenerateBtn');
+        if (!data.enabled) {
+            info.textContent = '未启用';
+            revoke.classList.add('hidden');
+            gen.textContent = '生成应用密码';
+            return;
+        }
+        info.innerHTML = '';
+        [['服务器', location.origin], ['用户名', data.username], ['应用密码', data.password]].forEach(([k, v]) => {
+            const row = document.createElement('div');
+            row.textContent = k + '：';
+            const val = document.createElement('span');
+            val.className = 'text-gray-800 font-mono select-all';
+            val.textContent = v;
+            row.appendChild(val);
+            info.appendChild(row);
+        });
+        revoke.classList.remove('hidden');
+        gen.textContent = '重新生成';
+    }
+    async function loadSubsonic() {
+        try {
+            const res = await fetch('/api/subsonic/credentials');
+            if (res.ok) renderSubsonic(await res.json());
+        } catch (e) {}
+    }
+    document.getElementById('subsonicGenerateBtn').onclick = async () => {
+        if (!document.getElementById('subsonicRevokeBtn').classList.contains('hidden') &&
+            !confirm('重新生成后，已登录的客户端需要填写新密码。继续？')) return;
+        const res = await fetch('/api/subsonic/credentials', { method: 'POST' });
+        if (res.ok) renderSubsonic(await res.json());
+    };
+    document.getElementById('subsonicRevokeBtn').onclick = async () => {
+        if (!confirm('停用后所有 Subsonic 客户端将无法登录。继续？')) return;
+        const res = await fetch('/api/subsonic/credentials', { method: 'DELETE' });
+        if (res.ok) renderSubsonic(await res.json());
+    };
+
+    // ListenBrainz scrobbling
+    function renderScrobbling(data) {
+        const info = document.getElementById('scrobbleInfo');
+        const toggle = document.getElementById('scrobbleToggleBtn');
+        const unlink = document.getElementById('scrobbleUnlinkBtn');
+        document.getElementById('scrobbleTokenInput').value = '';
+        document.getElementById('scrobbleError').textContent = '';
+        if (!data.linked) {
+            info.textContent = '未关联';
+            toggle.classList.add('hidden');
+            unlink.classList.add('hidden');
+            document.getElementById('scrobbleSaveBtn').textContent = '关联';
+            return;
+        }
+        let text = '已关联：' + (data.user_name || '') + (data.enabled ? '' : '（已暂停）');
+        if (data.queued) text += '，' + data.queued + ' 条待提交' + (data.last_error ? '（' + data.last_error + '）' : '');
+        info.textContent = text;
+        toggle.textContent = data.enabled ? '暂停记录' : '恢复记录';
+        toggle.dataset.enabled = data.enabled ? '1' : '';
+        toggle.classList.remove('hidden');
+        unlink.classList.remove('hidden');
+        document.getElementById('scrobbleSaveBtn').textContent = '更换令牌';
+    }
+    async function loadScrobbling() {
+        try {
+            const res = await fetch('/api/user/scrobbling');
+            if (res.ok) renderScrobbling(await res.json());
+        } catch (e) {}
+    }
+    async function putScrobbling(body) {
+        const errEl = document.getElementById('scrobbleError');
+        try {
+            const res = await fetch('/api/user/scrobbling', {
+                method: 'PUT', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(body)
+            });
+            const data = await res.json();
+            if (res.ok) renderScrobbling(data); else errEl.textContent = data.error || '保存失败';
+        } catch (e) { errEl.textContent = '网络错误'; }
+    }
+    document.getElementById('scrobbleSaveBtn').onclick = () => {
+        const token = document.getElementById('scrobbleTokenInput').value.trim();
+        if (!token) { document.getElementById('scrobbleError').textContent = '请填写令牌'; return; }
+        putScrobbling({ token });
+    };
+    document.getElementById('scrobbleToggleBtn').onclick = (e) => {
+        putScrobbling({ enabled: !e.currentTarget.dataset.enabled });
+    };
+    document.getElementById('scrobbleUnlinkBtn').onclick = async () => {
+        if (!confirm('取消关联后不再记录收听。继续？')) return;
+        const res = await fetch('/api/user/scrobbling', { method: 'DELETE' });
+        if (res.ok) renderScrobbling(await res.json());
+    };
+
+    // Personal access tokens
+    const scopeLabels = { 'room:control': '控制房间', 'playlist:write': '编辑歌单', 'library:read': '读取曲库' };
+    function renderAPITokens(data) {
+        const box = document.getElementById('apiTokenScopes');
+        if (!box.children.length) {
+            data.scopes.forEach(sc => {
+                const label = document.createElement('label');
+                const cb = document.createElement('input');
+                cb.type = 'checkbox'; cb.value = sc;
+                label.append(cb, ' ' + (scopeLabels[sc] || sc) + ' (' + sc + ')');
+                box.appendChild(label);
+            });
+        }
+        const list = document.getElementById('apiTokenList');
+        list.innerHTML = '';
+        const active = data.tokens.filter(t => !t.revoked_at && !(t.expires_at && t.expires_at * 1000 < Date.now()));
+        if (!active.length) { list.textContent = '暂无令牌'; return; }
+        active.forEach(t => {
+            const row = document.createElement('div');
+            row.className = 'flex items-center gap-2';
+            const text = document.createElement('span');
+            text.className = 'flex-1';
+            const used = t.last_used_at ? '最近使用 ' + new Date(t.last_used_at * 1000).toLocaleString('zh-CN') : '从未使用';
+            const exp = t.expires_at ? '，' + new Date(t.expires_at * 1000).toLocaleDateString('zh-CN') + ' 过期' : '';
+            text.textContent = t.name + '（' + t.prefix + '…，' + t.scopes.join(' ') + '）' + used + exp;
+            const btn = document.createElement('button');
+            btn.className = 'text-xs text-red-500';
+            btn.textContent = '撤销';
+            btn.onclick = async () => {
+                if (!confirm('撤销后使用该令牌的程序将无法访问。继续？')) return;
+                const res = await fetch('/api/user/tokens/' + t.id, { method: 'DELETE' });
+                if (res.ok) loadAPITokens();
+            };
+            row.append(text, btn);
+            list.appendChild(row);
+        });
+    }
+    async function loadAPITokens() {
+        document.getElementById('apiTokenNew').classList.add('hidden');
+        try {
+            const res = await fetch('/api/user/tokens');
+            if (res.ok) renderAPITokens(await res.json());
+        } catch (e) {}
+    }
+    document.getElementById('apiTokenCreateBtn').onclick = async () => {
+        const errEl = document.getElementById('apiTokenError');
+        errEl.textContent = '';
+        const name = document.getElementById('apiTokenName').value.trim();
+        const scopes = [...document.querySelectorAll('#apiTokenScopes input:checked')].map(c => c.value);
+        if (!name) { errEl.textContent = '请填写名称'; return; }
+        if (!scopes.length) { errEl.textContent = '至少选择一个权限范围'; return; }
+        try {
+            const res = await fetch('/api/user/tokens', {
+                method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify({ name, scopes })
+            });
+            const data = await res.json();
+            if (!res.ok) { errEl.textContent = data.error || '创建失败'; return; }
+            await loadAPITokens();
+            const el = document.getElementById('apiTokenNew');
+            el.textContent = data.token;
+            el.classList.remove('hidden');
+            document.getElementById('apiTokenName').value = '';
+        } catch (e) { errEl.textContent = '网络错误'; }
+    };
+
     // Change username
     document.getElementById('changeUsernameBtn').onclick = async () => {
         const errEl = document.getElementById('usernameError');
@@ -52,6 +52,7 @@ class AudioPlayer {
         this._ownerID = audioInfo.ownerID || null;
         this._audioID = audioInfo.audioID || null;
         this._audioUUID = audioInfo.audioUUID || null;
+        this._segToken = audioInfo.segmentToken || null;
         this._upgrading = false;
         if (this._qualities.length > 0) {
             const preferred = this._quality;
@@ -79,6 +80,7 @@ class AudioPlayer {
             this.duration = data.duration || this.duration;
             if (data.owner_id) this._ownerID = data.owner_id;
             if (data.audio_uuid) this._audioUUID = data.audio_uuid;
+            if (data.segment_token) this._segToken = data.segment_token;
         } catch (e) { console.error('loadQualitySegments:', e); }
     }
 
@@ -105,6 +107,7 @@ class AudioPlayer {
             const newSegments = data.segments || [];
             const newSegTime = data.segment_time || this.segmentTime;
             const newAudioUUID = data.audio_uuid || this._audioUUID;
+            if (data.segment_token) this._segToken = data.segment_token;
             if (!newSegments.length) throw new Error('no segments for target quality');
             const newBuffers = new Map();
             for (let i = 0; i < newSegments.length; i++) {
@@ -114,7 +117,7 @@ class AudioPlayer {
                 if (!arrayBuf) {
                     for (let attempt = 0; attempt < 3; attempt++) {
                         try {
-                            const r = await fetch(url, {credentials:'include'});
+                            const r = await fetch(this._signedURL(url), {credentials:'include'});
                             if (!r.ok) throw new Error(`HTTP ${r.status}`);
                             arrayBuf = await r.arrayBuffer();
                             break;
@@ -164,6 +167,13 @@ class AudioPlayer {
         return base + this.segments[idx];
     }
 
+    // Library segment URLs get the signed token appended at fetch time only, so
+    // the cache key stays stable across token refreshes.
+    _signedURL(url) {
+        if (!this._segToken || !url.startsWith('/api/library/segments/')) return url;
+        return url + '?st=' + encodeURIComponent(this._segToken);
+    }
+
     async preloadSegments(startIdx, count) {
         const end = Math.min(startIdx + count, this.segments.length);
         const promises = [];
@@ -178,7 +188,7 @@ class AudioPlayer {
         if (!data) {
             for (let attempt = 0; attempt < 3; attempt++) {
                 try {
-                    const res = await fetch(url, {credentials:'include'});
+                    const res = await fetch(this._signedURL(url), {credentials:'include'});
                     if (!res.ok) throw new Error(`HTTP ${res.status}`);
                     data = await res.arrayBuffer(); break;
                 } catch (e) { if (attempt === 2) throw e; await new Promise(r => setTimeout(r, 300)); }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/xingzihai/listen-together/internal/db"
+	"github.com/xingzihai/listen-together/internal/room"
+	"github.com/xingzihai/listen-together/internal/webhook"
+)
+
+// Payloads of the webhook events raised from package main. Room closure,
+// uploads and registrations are wired to the manager and handler callbacks
+// in main().
+
+func emitRoomCreated(rm *room.Room) {
+	rm.Mu.RLock()
+	data := map[string]interface{}{"room": rm.Code, "owner_id": rm.OwnerID, "owner": rm.OwnerName}
+	rm.Mu.RUnlock()
+	hooks.Emit(webhook.EventRoomCreated, data)
+}
+
+func emitRoomClosed(code, reason string) {
+	hooks.Emit(webhook.EventRoomClosed, map[string]interface{}{"room": code, "reason": reason})
+}
+
+// emitUserEvent raises user.joined or user.left for rm.
+func emitUserEvent(event string, rm *room.Room, userID int64, username string) {
+	hooks.Emit(event, map[string]interface{}{
+		"room":         rm.Code,
+		"user_id":      userID,
+		"username":     username,
+		"client_count": rm.ClientCount(),
+	})
+}
+
+func emitTrackChanged(rm *room.Room, index int, af *db.AudioFile, by string) {
+	hooks.Emit(webhook.EventTrackChanged, map[string]interface{}{
+		"room":        rm.Code,
+		"track_index": index,
+		"changed_by":  by,
+		"track":       trackPayload(af),
+	})
+}
+
+func emitUploadCompleted(af *db.AudioFile) {
+	data := trackPayload(af)
+	data["owner_id"] = af.OwnerID
+	data["original_name"] = af.OriginalName
+	hooks.Emit(webhook.EventUploadCompleted, data)
+}
+
+func emitUserRegistered(u *db.User) {
+	hooks.Emit(webhook.EventUserRegistered, map[string]interface{}{"user_id": u.ID, "username": u.Username})
+}
+
+func trackPayload(af *db.AudioFile) map[string]interface{} {
+	return map[string]interface{}{
+		"audio_id": af.ID,
+		"title":    af.Title,
+		"artist":   af.Artist,
+		"album":    af.Album,
+		"duration": af.Duration,
+	}
+}